@@ -18,7 +18,7 @@ Return values (exit codes):
 		The program ended due to an error
 
 Note that this program will update the schema of the database to the latest version available (embedded in the
-executable during the build).
+executable during the build). Use the `--db-print-migrations` flag to print the pending migrations without applying them.
 */
 package main
 
@@ -30,13 +30,16 @@ import (
 	"WasaTEXT/service/api"
 	"WasaTEXT/service/database"
 	"WasaTEXT/service/globaltime"
+	"WasaTEXT/service/storage"
 	"github.com/ardanlabs/conf"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -81,21 +84,36 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dsn := cfg.DB.DSN
+	if dsn == "" && cfg.DB.Driver == string(database.SQLite) {
+		dsn = cfg.DB.Filename
+	}
+	dbconn, err := sql.Open(cfg.DB.Driver, dsn)
 	if err != nil {
-		logger.WithError(err).Error("error opening SQLite DB")
-		return fmt.Errorf("opening SQLite: %w", err)
+		logger.WithError(err).Error("error opening the database")
+		return fmt.Errorf("opening %s database: %w", cfg.DB.Driver, err)
 	}
 	defer func() {
 		logger.Debug("database stopping")
 		_ = dbconn.Close()
 	}()
-	db, err := database.New(dbconn)
+	if cfg.DB.PrintMigrations {
+		return printPendingMigrations(dbconn, database.Dialect(cfg.DB.Driver))
+	}
+	db, err := database.New(dbconn, database.Dialect(cfg.DB.Driver))
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	// Start blob storage for uploaded files
+	logger.Infof("initializing %s storage", cfg.Storage.Backend)
+	store, err := newBlobStore(cfg)
+	if err != nil {
+		logger.WithError(err).Error("error creating the blob storage")
+		return fmt.Errorf("creating blob storage: %w", err)
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -110,8 +128,10 @@ func run() error {
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:            logger,
+		Database:          db,
+		MessageEditWindow: cfg.Messages.EditWindow,
+		Storage:           store,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -181,3 +201,37 @@ func run() error {
 
 	return nil
 }
+
+// newBlobStore creates the storage backend selected in the configuration
+func newBlobStore(cfg WebAPIConfiguration) (storage.BlobStore, error) {
+	switch cfg.Storage.Backend {
+	case "local":
+		return storage.NewLocal(cfg.Storage.Root)
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  cfg.Storage.Endpoint,
+			Region:    cfg.Storage.Region,
+			Bucket:    cfg.Storage.Bucket,
+			AccessKey: cfg.Storage.AccessKey,
+			SecretKey: cfg.Storage.SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// printPendingMigrations prints the schema migrations that have not been applied to the database yet
+func printPendingMigrations(db *sql.DB, dialect database.Dialect) error {
+	pending, err := database.PendingMigrations(db, dialect)
+	if err != nil {
+		return fmt.Errorf("reading pending migrations: %w", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("the database schema is up to date") //nolint:forbidigo
+		return nil
+	}
+	for _, m := range pending {
+		fmt.Printf("-- migration %04d_%s\n%s\n", m.Version, m.Name, strings.TrimSpace(m.SQL)) //nolint:forbidigo
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package api
 
 import (
 	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"database/sql"
+	"errors"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -18,7 +21,7 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
 			rt.baseLogger.WithError(err).Error("can't generate a request UUID")
-			w.WriteHeader(http.StatusInternalServerError)
+			sendError(w, reqcontext.RequestContext{}, http.StatusInternalServerError, CodeInternalError, "Internal server error")
 			return
 		}
 		var ctx = reqcontext.RequestContext{
@@ -35,3 +38,45 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 		fn(w, r, ps, ctx)
 	}
 }
+
+// authWrap is like wrap, but it also authenticates the caller using the session token in the Authorization header.
+// The user ID and name are stored in the reqcontext.RequestContext; unauthenticated requests are rejected with HTTP
+// Status 401 before the handler is called.
+func (rt *_router) authWrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrap(rt.requireAuth(fn, false))
+}
+
+// streamAuthWrap is like authWrap, but it also accepts the session token in the `access_token` query parameter, as
+// browsers can't set headers when opening a WebSocket or an EventSource.
+func (rt *_router) streamAuthWrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrap(rt.requireAuth(fn, true))
+}
+
+// requireAuth returns a handler that resolves the caller before calling fn, or rejects the request with HTTP Status 401.
+func (rt *_router) requireAuth(fn httpRouterHandler, allowQueryToken bool) httpRouterHandler {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		userID, err := rt.authenticate(r, allowQueryToken)
+		if errors.Is(err, errMissingToken) || errors.Is(err, database.ErrSessionNotFound) {
+			sendError(w, ctx, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid session token")
+			return
+		} else if err != nil {
+			sendInternalError(w, ctx, err, "can't resolve the session token")
+			return
+		}
+
+		userName, err := rt.db.GetUserByID(r.Context(), userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			sendError(w, ctx, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid session token")
+			return
+		} else if err != nil {
+			sendInternalError(w, ctx, err, "can't load the authenticated user")
+			return
+		}
+
+		ctx.UserID = userID
+		ctx.UserName = userName
+		ctx.Logger = ctx.Logger.WithField("user-id", userID)
+
+		fn(w, r, ps, ctx)
+	}
+}
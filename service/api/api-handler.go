@@ -17,30 +17,58 @@ func (rt *_router) Handler() http.Handler {
 
 
 	// API routes
-	rt.router.POST("/session", rt.doLogin)
+	rt.router.POST("/session", rt.wrap(rt.doLogin))
+	rt.router.DELETE("/session", rt.authWrap(rt.doLogout))
 
-	rt.router.POST("/conversations/start-conversation", rt.postConversations)
-	rt.router.GET("/conversations", rt.getUserConversations)
-	rt.router.GET("/conversations/get-details/:conversation_id", rt.getConversationByID)
-	rt.router.DELETE("/conversations/delete/:conversation_id", rt.deleteConversation)
+	rt.router.POST("/conversations/start-conversation", rt.authWrap(rt.postConversations))
+	rt.router.GET("/conversations", rt.authWrap(rt.getUserConversations))
+	rt.router.GET("/conversations/get-details/:conversation_id", rt.authWrap(rt.getConversationByID))
+	rt.router.DELETE("/conversations/delete/:conversation_id", rt.authWrap(rt.deleteConversation))
 	
-	rt.router.GET("/conversations/messages/:conversation_id", rt.getMessagesFromConversation)
-	rt.router.POST("/conversations/send-message/:conversation_id", rt.postMessage)
-	rt.router.DELETE("/conversations/delete-message/:conversation_id/message/:message_id", rt.deleteMessage)
-	rt.router.POST("/conversations/forward-message/:conversation_id/messages/:message_id", rt.forwardMessage)
-	rt.router.POST("/conversations/react/:conversation_id/messages/:message_id", rt.commentMessage)
-	rt.router.DELETE("/conversations/delete-react/:conversation_id/messages/:message_id", rt.unCommentMessage)
+	rt.router.GET("/conversations/messages/:conversation_id", rt.authWrap(rt.getMessagesFromConversation))
+	rt.router.POST("/conversations/send-message/:conversation_id", rt.authWrap(rt.postMessage))
+	rt.router.DELETE("/conversations/delete-message/:conversation_id/message/:message_id", rt.authWrap(rt.deleteMessage))
+	rt.router.POST("/conversations/forward-message/:conversation_id/messages/:message_id", rt.authWrap(rt.forwardMessage))
+	rt.router.POST("/conversations/react/:conversation_id/messages/:message_id", rt.authWrap(rt.commentMessage))
+	rt.router.DELETE("/conversations/delete-react/:conversation_id/messages/:message_id", rt.authWrap(rt.unCommentMessage))
+	rt.router.POST("/conversations/read/:conversation_id", rt.authWrap(rt.markConversationRead))
+	rt.router.GET("/conversations/receipts/:conversation_id/messages/:message_id", rt.authWrap(rt.getMessageReceipts))
+	rt.router.PATCH("/conversations/edit-message/:conversation_id/messages/:message_id", rt.authWrap(rt.editMessage))
+	rt.router.GET("/conversations/message-edits/:conversation_id/messages/:message_id", rt.authWrap(rt.getMessageEdits))
+	rt.router.GET("/conversations/thread/:conversation_id/messages/:message_id", rt.authWrap(rt.getThread))
+	rt.router.GET("/conversations/attachment/:conversation_id/attachments/:attachment_id", rt.authWrap(rt.getAttachment))
 	
-	rt.router.POST("/conversations/create-group", rt.createGroup)
-	rt.router.PATCH("/conversations/group/change-name/:conversation_id", rt.renameGroup)
-	rt.router.POST("/conversations/group/add/:conversation_id", rt.addToGroup)
-	rt.router.DELETE("/conversations/group/leave/:conversation_id", rt.leaveGroup)
-	rt.router.PATCH("/conversations/group/change-photo/:conversation_id", rt.updateGroupPhoto)
-	rt.router.GET("/conversations/group/get-photo/:conversation_id", rt.getGroupPhoto)
-
-	rt.router.PATCH("/users/modify-username", rt.modifyUserName)
-	rt.router.GET("/users/get-photo/:user_id", rt.getUserPhoto)
-	rt.router.PATCH("/users/update-photo", rt.updateUserPhoto)
+	rt.router.POST("/conversations/create-group", rt.authWrap(rt.createGroup))
+	rt.router.PATCH("/conversations/group/change-name/:conversation_id", rt.authWrap(rt.renameGroup))
+	rt.router.PATCH("/conversations/group/change-description/:conversation_id", rt.authWrap(rt.changeGroupDescription))
+	rt.router.GET("/conversations/group/profile/:conversation_id", rt.authWrap(rt.getGroupProfile))
+	rt.router.GET("/conversations/group/members/:conversation_id", rt.authWrap(rt.getGroupMembers))
+	rt.router.POST("/conversations/group/add/:conversation_id", rt.authWrap(rt.addToGroup))
+	rt.router.DELETE("/conversations/group/leave/:conversation_id", rt.authWrap(rt.leaveGroup))
+	rt.router.POST("/conversations/group/promote/:conversation_id", rt.authWrap(rt.promoteMember))
+	rt.router.POST("/conversations/group/demote/:conversation_id", rt.authWrap(rt.demoteMember))
+	rt.router.DELETE("/conversations/group/remove/:conversation_id/members/:user_id", rt.authWrap(rt.removeMember))
+	rt.router.POST("/conversations/group/transfer-ownership/:conversation_id", rt.authWrap(rt.transferOwnership))
+	rt.router.PATCH("/conversations/group/change-photo/:conversation_id", rt.authWrap(rt.updateGroupPhoto))
+	rt.router.GET("/conversations/group/get-photo/:conversation_id", rt.authWrap(rt.getGroupPhoto))
+	rt.router.POST("/conversations/group/create-invite/:conversation_id", rt.authWrap(rt.createInvite))
+	rt.router.GET("/conversations/group/invites/:conversation_id", rt.authWrap(rt.getInvites))
+	rt.router.DELETE("/conversations/group/revoke-invite/:conversation_id/invites/:token", rt.authWrap(rt.revokeInvite))
+	rt.router.GET("/conversations/group/join-requests/:conversation_id", rt.authWrap(rt.getJoinRequests))
+	rt.router.POST("/conversations/group/approve-request/:conversation_id/requests/:user_id", rt.authWrap(rt.approveJoinRequest))
+	rt.router.DELETE("/conversations/group/reject-request/:conversation_id/requests/:user_id", rt.authWrap(rt.rejectJoinRequest))
+	rt.router.POST("/invites/:token/join", rt.authWrap(rt.joinWithInvite))
+
+	rt.router.PATCH("/users/modify-username", rt.authWrap(rt.modifyUserName))
+	rt.router.GET("/users/get-photo/:user_id", rt.wrap(rt.getUserPhoto))
+	rt.router.PATCH("/users/update-photo", rt.authWrap(rt.updateUserPhoto))
+
+	rt.router.GET("/search/messages", rt.authWrap(rt.searchMessages))
+
+	rt.router.GET("/events", rt.streamAuthWrap(rt.getEvents))
+	rt.router.GET("/events/sse", rt.streamAuthWrap(rt.getEventsSSE))
+
+	rt.router.GET("/sync", rt.authWrap(rt.syncChanges))
 	
 	return rt.router
 }
@@ -39,9 +39,13 @@ package api
 import (
 	"errors"
 	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
+	"WasaTEXT/service/storage"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,6 +55,12 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// MessageEditWindow is how long after sending a message its sender can edit it. Zero means no limit
+	MessageEditWindow time.Duration
+
+	// Storage is where uploaded files (photos and attachments) are saved
+	Storage storage.BlobStore
 }
 
 // Router is the package API interface representing an API handler builder
@@ -71,6 +81,12 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Storage == nil {
+		return nil, errors.New("storage is required")
+	}
+	if cfg.MessageEditWindow < 0 {
+		return nil, errors.New("message edit window can't be negative")
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,11 +94,21 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
-	}, nil
+	rt := &_router{
+		router:            router,
+		baseLogger:        cfg.Logger,
+		db:                cfg.Database,
+		storage:           cfg.Storage,
+		hub:               events.NewHub(),
+		messageEditWindow: cfg.MessageEditWindow,
+		stopMaintenance:   make(chan struct{}),
+		maintenanceDone:   make(chan struct{}),
+	}
+
+	// Start the background maintenance tasks; they are stopped by Close
+	go rt.runMaintenance()
+
+	return rt, nil
 }
 
 type _router struct {
@@ -93,4 +119,20 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// storage is where uploaded files are saved. Keys are saved in the database in place of file paths
+	storage storage.BlobStore
+
+	// messageEditWindow is how long after sending a message its sender can edit it (zero means no limit)
+	messageEditWindow time.Duration
+
+	// hub dispatches real-time events to the clients connected to the event stream
+	hub *events.Hub
+
+	// publishMu serializes the publication of events, so that each user receives them in sequence order
+	publishMu sync.Mutex
+
+	// stopMaintenance is closed to stop the background maintenance goroutine, which closes maintenanceDone on exit
+	stopMaintenance chan struct{}
+	maintenanceDone chan struct{}
 }
@@ -0,0 +1,982 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// testServer è un'istanza dell'API raggiungibile con httptest. Ogni richiesta e ogni risposta vengono validate
+// rispetto alla specifica OpenAPI: una differenza fa fallire il test
+type testServer struct {
+	t       *testing.T
+	srv     *httptest.Server
+	handler http.Handler
+	spec    *openAPISpec
+	blobs   *testBlobStore
+}
+
+// testBlobStore è lo storage dei file del server di test. Se failGet è impostato, ogni lettura fallisce con quell'errore
+type testBlobStore struct {
+	storage.BlobStore
+
+	mu      sync.Mutex
+	failGet error
+}
+
+func (b *testBlobStore) setFailGet(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failGet = err
+}
+
+func (b *testBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, storage.BlobInfo, error) {
+	b.mu.Lock()
+	err := b.failGet
+	b.mu.Unlock()
+	if err != nil {
+		return nil, storage.BlobInfo{}, err
+	}
+	return b.BlobStore.Get(ctx, key)
+}
+
+// newTestServer avvia l'API su un database in memoria vuoto; il server viene chiuso alla fine del test
+func newTestServer(t *testing.T) *testServer {
+	return startTestServer(t, database.NewMemory())
+}
+
+// startTestServer avvia l'API sul database specificato; il server viene chiuso alla fine del test
+func startTestServer(t *testing.T, db database.AppDatabase) *testServer {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := &testBlobStore{BlobStore: local}
+	rt, err := New(Config{
+		Logger:   logger,
+		Database: db,
+		Storage:  blobs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rt.Handler()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		srv.Close()
+		_ = rt.Close()
+	})
+	return &testServer{t: t, srv: srv, handler: handler, spec: loadSpec(t), blobs: blobs}
+}
+
+// request esegue la richiesta con il token specificato (se non vuoto) e il body con il suo Content-Type (se non
+// vuoto), dopo averla validata. Restituisce la risposta, già validata, e il suo body
+func (s *testServer) request(method, path, token, contentType string, body []byte) (*http.Response, []byte) {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for _, e := range s.spec.validateRequest(req, body) {
+		s.t.Errorf("%s %s: %s", method, path, e)
+	}
+
+	res, err := s.srv.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, e := range s.spec.validateResponse(req, res, resBody) {
+		s.t.Errorf("%s %s -> %d: %s", method, path, res.StatusCode, e)
+	}
+	return res, resBody
+}
+
+// do esegue la richiesta con il token specificato (se non vuoto) e con body codificato in JSON (se non nil). Se out
+// non è nil, vi decodifica la risposta. Restituisce lo status code della risposta
+func (s *testServer) do(method, path, token string, body, out interface{}) int {
+	s.t.Helper()
+	var buf []byte
+	contentType := ""
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			s.t.Fatal(err)
+		}
+		contentType = "application/json"
+	}
+
+	res, resBody := s.request(method, path, token, contentType, buf)
+	if out != nil && res.StatusCode < 300 {
+		if err := json.Unmarshal(resBody, out); err != nil {
+			s.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+// problem esegue una richiesta che deve fallire con lo status specificato e restituisce il corpo dell'errore
+func (s *testServer) problem(method, path, token string, body interface{}, status int) Problem {
+	s.t.Helper()
+	var buf []byte
+	contentType := ""
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			s.t.Fatal(err)
+		}
+		contentType = "application/json"
+	}
+
+	res, resBody := s.request(method, path, token, contentType, buf)
+	if res.StatusCode != status {
+		s.t.Fatalf("%s %s: status %d, want %d", method, path, res.StatusCode, status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != problemContentType {
+		s.t.Fatalf("%s %s: Content-Type %q, want %q", method, path, ct, problemContentType)
+	}
+	var p Problem
+	if err := json.Unmarshal(resBody, &p); err != nil {
+		s.t.Fatalf("%s %s: decoding problem: %v", method, path, err)
+	}
+	if p.Status != status || p.RequestID == "" {
+		s.t.Errorf("%s %s: problem = %+v", method, path, p)
+	}
+	return p
+}
+
+// login effettua il login dell'utente (creandolo se non esiste) e restituisce il token di sessione
+func (s *testServer) login(name string) string {
+	s.t.Helper()
+	var res LoginResponse
+	if code := s.do(http.MethodPost, "/session", "", LoginRequest{Name: name}, &res); code != http.StatusOK {
+		s.t.Fatalf("login %q: status %d", name, code)
+	}
+	return res.Token
+}
+
+// userID restituisce l'id dell'utente, effettuandone il login
+func (s *testServer) userID(name string) string {
+	s.t.Helper()
+	var res LoginResponse
+	if code := s.do(http.MethodPost, "/session", "", LoginRequest{Name: name}, &res); code != http.StatusOK {
+		s.t.Fatalf("login %q: status %d", name, code)
+	}
+	return res.Identifier
+}
+
+// startConversation avvia una conversazione privata con l'utente specificato e ne restituisce l'id
+func (s *testServer) startConversation(token, username string) string {
+	s.t.Helper()
+	var res ConvIDResponse
+	code := s.do(http.MethodPost, "/conversations/start-conversation", token, UsernameRequest{Username: username}, &res)
+	if code >= 300 {
+		s.t.Fatalf("starting conversation with %q: status %d", username, code)
+	}
+	return res.ConversationID
+}
+
+// send invia un messaggio di testo e restituisce il messaggio salvato
+func (s *testServer) send(token, convID, text string) database.Message {
+	s.t.Helper()
+	var msg database.Message
+	code := s.do(http.MethodPost, "/conversations/send-message/"+convID, token, MessageRequest{Text: text}, &msg)
+	if code != http.StatusCreated {
+		s.t.Fatalf("sending message: status %d", code)
+	}
+	return msg
+}
+
+// messages restituisce i messaggi più recenti della conversazione
+func (s *testServer) messages(token, convID string) []database.Message {
+	s.t.Helper()
+	var page MessagesResponse
+	if code := s.do(http.MethodGet, "/conversations/messages/"+convID, token, nil, &page); code != http.StatusOK {
+		s.t.Fatalf("getting messages: status %d", code)
+	}
+	return page.Messages
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	s := newTestServer(t)
+	if code := s.do(http.MethodGet, "/conversations", "", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d", code)
+	}
+	if code := s.do(http.MethodGet, "/conversations", "not-a-token", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("with an unknown token: status %d", code)
+	}
+
+	token := s.login("alice")
+	if code := s.do(http.MethodGet, "/conversations", token, nil, nil); code != http.StatusOK {
+		t.Errorf("with a valid token: status %d", code)
+	}
+	if code := s.do(http.MethodDelete, "/session", token, nil, nil); code >= 300 {
+		t.Fatalf("logout: status %d", code)
+	}
+	if code := s.do(http.MethodGet, "/conversations", token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("after logout: status %d", code)
+	}
+}
+
+func TestPrivateConversation(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+
+	conv := s.startConversation(alice, "bob")
+	if again := s.startConversation(bob, "alice"); again != conv {
+		t.Errorf("second conversation between alice and bob: %q, want %q", again, conv)
+	}
+	s.send(alice, conv, "hi bob")
+	s.send(bob, conv, "hi alice")
+
+	msgs := s.messages(alice, conv)
+	if len(msgs) != 2 || msgs[0].Content != "hi bob" || msgs[1].Content != "hi alice" {
+		t.Errorf("messages = %+v", msgs)
+	}
+
+	var convs []database.Conversation
+	if code := s.do(http.MethodGet, "/conversations", bob, nil, &convs); code != http.StatusOK {
+		t.Fatalf("listing conversations: status %d", code)
+	}
+	if len(convs) != 1 || convs[0].Name != "alice" || convs[0].LastMessage != "hi alice" {
+		t.Errorf("bob's conversations = %+v", convs)
+	}
+
+	// Chi non fa parte della conversazione non può leggerla né scriverci
+	if code := s.do(http.MethodGet, "/conversations/messages/"+conv, carol, nil, nil); code != http.StatusForbidden {
+		t.Errorf("reading as a non-member: status %d", code)
+	}
+	if code := s.do(http.MethodPost, "/conversations/send-message/"+conv, carol, MessageRequest{Text: "hey"}, nil); code != http.StatusForbidden {
+		t.Errorf("sending as a non-member: status %d", code)
+	}
+}
+
+func TestDeleteMessageUpdatesLastMessage(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	s.login("bob")
+	conv := s.startConversation(alice, "bob")
+	s.send(alice, conv, "first")
+	second := s.send(alice, conv, "second")
+
+	path := fmt.Sprintf("/conversations/delete-message/%s/message/%s", conv, second.MessageID)
+	if code := s.do(http.MethodDelete, path, alice, nil, nil); code >= 300 {
+		t.Fatalf("deleting message: status %d", code)
+	}
+
+	var c database.Conversation
+	if code := s.do(http.MethodGet, "/conversations/get-details/"+conv, alice, nil, &c); code != http.StatusOK {
+		t.Fatalf("getting conversation: status %d", code)
+	}
+	if c.LastMessage != "first" {
+		t.Errorf("LastMessage = %q, want %q", c.LastMessage, "first")
+	}
+	if msgs := s.messages(alice, conv); len(msgs) != 1 {
+		t.Errorf("messages after deleting = %+v", msgs)
+	}
+}
+
+func TestReactionReplacement(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	conv := s.startConversation(alice, "bob")
+	msg := s.send(alice, conv, "hello")
+
+	path := fmt.Sprintf("/conversations/react/%s/messages/%s", conv, msg.MessageID)
+	for _, emoji := range []string{"👍", "😂"} {
+		if code := s.do(http.MethodPost, path, bob, ReactionRequest{Reaction: emoji}, nil); code >= 300 {
+			t.Fatalf("reacting with %s: status %d", emoji, code)
+		}
+	}
+
+	msgs := s.messages(alice, conv)
+	if len(msgs) != 1 || len(msgs[0].Reactions) != 1 || msgs[0].Reactions[0].Reaction != "😂" {
+		t.Errorf("reactions = %+v", msgs[0].Reactions)
+	}
+}
+
+func TestInvalidReaction(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	conv := s.startConversation(alice, "bob")
+	msg := s.send(alice, conv, "hello")
+
+	// Una reazione che non è un emoji viene rifiutata e non viene salvata
+	path := fmt.Sprintf("/conversations/react/%s/messages/%s", conv, msg.MessageID)
+	for _, reaction := range []string{"nice", "👍👍", ""} {
+		if p := s.problem(http.MethodPost, path, bob, ReactionRequest{Reaction: reaction}, http.StatusBadRequest); p.Code != CodeValidationFailed {
+			t.Errorf("reacting with %q: code %q", reaction, p.Code)
+		}
+	}
+	if msgs := s.messages(alice, conv); len(msgs) != 1 || len(msgs[0].Reactions) != 0 {
+		t.Errorf("reactions after invalid reactions = %+v", msgs)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+
+	// Un membro inesistente impedisce la creazione del gruppo
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob", "nobody"}}, nil); code != http.StatusBadRequest {
+		t.Errorf("creating a group with a missing member: status %d", code)
+	}
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	s.send(bob, group, "hello friends")
+
+	if code := s.do(http.MethodGet, "/conversations/messages/"+group, carol, nil, nil); code != http.StatusForbidden {
+		t.Errorf("reading as a non-member: status %d", code)
+	}
+
+	if code := s.do(http.MethodDelete, "/conversations/group/leave/"+group, bob, nil, nil); code >= 300 {
+		t.Fatalf("leaving group: status %d", code)
+	}
+	if code := s.do(http.MethodGet, "/conversations/messages/"+group, bob, nil, nil); code != http.StatusForbidden {
+		t.Errorf("reading after leaving: status %d", code)
+	}
+	// I messaggi di bob restano nel gruppo, seguiti dal messaggio di sistema che ne registra l'uscita
+	if msgs := s.messages(alice, group); len(msgs) != 2 || msgs[0].SenderID != s.userID("bob") || msgs[1].Kind != database.MessageKindSystem {
+		t.Errorf("messages = %+v", msgs)
+	}
+}
+
+func TestGroupRoles(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	s.login("dave")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob", "carol"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	promote := "/conversations/group/promote/" + group
+	demote := "/conversations/group/demote/" + group
+
+	// I membri semplici non possono gestire il gruppo
+	if p := s.problem(http.MethodPost, "/conversations/group/add/"+group, bob, UsernameRequest{Username: "dave"}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("adding as a member: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, promote, bob, UsernameRequest{Username: "carol"}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("promoting as a member: code %q", p.Code)
+	}
+
+	// Solo i membri possono essere promossi, e il ruolo del proprietario non cambia
+	if p := s.problem(http.MethodPost, promote, alice, UsernameRequest{Username: "dave"}, http.StatusNotFound); p.Code != CodeMemberNotFound {
+		t.Errorf("promoting a non-member: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, demote, alice, UsernameRequest{Username: "alice"}, http.StatusConflict); p.Code != CodeOwnerRoleFixed {
+		t.Errorf("demoting the owner: code %q", p.Code)
+	}
+
+	// Un amministratore può rinominare il gruppo, aggiungere membri ed eliminare i messaggi degli altri
+	if code := s.do(http.MethodPost, promote, alice, UsernameRequest{Username: "bob"}, nil); code != http.StatusNoContent {
+		t.Fatalf("promoting bob: status %d", code)
+	}
+	if code := s.do(http.MethodPatch, "/conversations/group/change-name/"+group, bob, NewGroupName{Name: "bob's friends"}, nil); code != http.StatusNoContent {
+		t.Errorf("renaming as an admin: status %d", code)
+	}
+	if code := s.do(http.MethodPost, "/conversations/group/add/"+group, bob, UsernameRequest{Username: "dave"}, nil); code != http.StatusNoContent {
+		t.Errorf("adding as an admin: status %d", code)
+	}
+	msg := s.send(carol, group, "spam")
+	if code := s.do(http.MethodDelete, "/conversations/delete-message/"+group+"/message/"+msg.MessageID, bob, nil, nil); code != http.StatusNoContent {
+		t.Errorf("deleting another member's message as an admin: status %d", code)
+	}
+	msg = s.send(bob, group, "hello")
+	if p := s.problem(http.MethodDelete, "/conversations/delete-message/"+group+"/message/"+msg.MessageID, carol, nil, http.StatusForbidden); p.Code != CodeNotSender {
+		t.Errorf("deleting another member's message as a member: code %q", p.Code)
+	}
+
+	// Solo il proprietario può eliminare il gruppo
+	if p := s.problem(http.MethodDelete, "/conversations/delete/"+group, bob, nil, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("deleting as an admin: code %q", p.Code)
+	}
+
+	// Dopo la retrocessione bob torna a essere un membro semplice
+	if code := s.do(http.MethodPost, demote, alice, UsernameRequest{Username: "bob"}, nil); code != http.StatusNoContent {
+		t.Fatalf("demoting bob: status %d", code)
+	}
+	if p := s.problem(http.MethodPatch, "/conversations/group/change-name/"+group, bob, NewGroupName{Name: "friends"}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("renaming after demotion: code %q", p.Code)
+	}
+	if code := s.do(http.MethodDelete, "/conversations/delete/"+group, alice, nil, nil); code != http.StatusNoContent {
+		t.Errorf("deleting as the owner: status %d", code)
+	}
+}
+
+func TestGroupOwnership(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	dave := s.login("dave")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob", "carol", "dave"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	remove := func(name string) string { return "/conversations/group/remove/" + group + "/members/" + s.userID(name) }
+	transfer := "/conversations/group/transfer-ownership/" + group
+	if code := s.do(http.MethodPost, "/conversations/group/promote/"+group, alice, UsernameRequest{Username: "bob"}, nil); code != http.StatusNoContent {
+		t.Fatalf("promoting bob: status %d", code)
+	}
+
+	// Si possono rimuovere solo i membri con un ruolo inferiore al proprio
+	if p := s.problem(http.MethodDelete, remove("bob"), dave, nil, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("removing as a member: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodDelete, remove("alice"), bob, nil, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("removing the owner as an admin: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodDelete, "/conversations/group/remove/"+group+"/members/999", bob, nil, http.StatusNotFound); p.Code != CodeMemberNotFound {
+		t.Errorf("removing a non-member: code %q", p.Code)
+	}
+	if code := s.do(http.MethodDelete, remove("carol"), bob, nil, nil); code != http.StatusNoContent {
+		t.Errorf("removing carol as an admin: status %d", code)
+	}
+	if code := s.do(http.MethodGet, "/conversations/messages/"+group, carol, nil, nil); code != http.StatusForbidden {
+		t.Errorf("reading after being removed: status %d", code)
+	}
+
+	// Dopo il trasferimento il vecchio proprietario è un amministratore
+	if p := s.problem(http.MethodPost, transfer, bob, UsernameRequest{Username: "bob"}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("transferring as an admin: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, transfer, alice, UsernameRequest{Username: "carol"}, http.StatusNotFound); p.Code != CodeMemberNotFound {
+		t.Errorf("transferring to a non-member: code %q", p.Code)
+	}
+	if code := s.do(http.MethodPost, transfer, alice, UsernameRequest{Username: "dave"}, nil); code != http.StatusNoContent {
+		t.Fatalf("transferring to dave: status %d", code)
+	}
+	var details database.Conversation
+	if code := s.do(http.MethodGet, "/conversations/get-details/"+group, bob, nil, &details); code != http.StatusOK || details.CreatorID != s.userID("dave") {
+		t.Errorf("group after the transfer: status %d, %+v", code, details)
+	}
+	if p := s.problem(http.MethodDelete, "/conversations/delete/"+group, alice, nil, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("deleting as the previous owner: code %q", p.Code)
+	}
+
+	// Il proprietario che esce lascia il gruppo all'amministratore entrato per primo
+	if code := s.do(http.MethodDelete, "/conversations/group/leave/"+group, dave, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("leaving as the owner: status %d", code)
+	}
+	if code := s.do(http.MethodDelete, "/conversations/delete/"+group, alice, nil, nil); code != http.StatusNoContent {
+		t.Errorf("deleting as the new owner: status %d", code)
+	}
+}
+
+func TestGroupProfile(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	dave := s.login("dave")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	if code := s.do(http.MethodPost, "/conversations/group/promote/"+group, alice, UsernameRequest{Username: "bob"}, nil); code != http.StatusNoContent {
+		t.Fatalf("promoting bob: status %d", code)
+	}
+	if code := s.do(http.MethodPost, "/conversations/group/add/"+group, bob, UsernameRequest{Username: "carol"}, nil); code != http.StatusNoContent {
+		t.Fatalf("adding carol: status %d", code)
+	}
+
+	// I membri riportano il ruolo e chi li ha aggiunti
+	var members GroupMembersResponse
+	if code := s.do(http.MethodGet, "/conversations/group/members/"+group, carol, nil, &members); code != http.StatusOK || len(members.Members) != 3 {
+		t.Fatalf("members: status %d, %+v", code, members)
+	}
+	for i, want := range []struct{ name, role, addedBy string }{
+		{"alice", database.RoleOwner, ""},
+		{"bob", database.RoleAdmin, s.userID("alice")},
+		{"carol", database.RoleMember, s.userID("bob")},
+	} {
+		if m := members.Members[i]; m.UserName != want.name || m.Role != want.role || m.AddedBy != want.addedBy || m.JoinedAt == "" {
+			t.Errorf("members[%d] = %+v", i, m)
+		}
+	}
+
+	// La descrizione può essere cambiata da amministratori e proprietario
+	describe := "/conversations/group/change-description/" + group
+	if p := s.problem(http.MethodPatch, describe, carol, NewGroupDescription{Description: "weekend plans"}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("changing the description as a member: code %q", p.Code)
+	}
+	if code := s.do(http.MethodPatch, describe, bob, NewGroupDescription{Description: "weekend plans"}, nil); code != http.StatusNoContent {
+		t.Fatalf("changing the description as an admin: status %d", code)
+	}
+
+	var profile database.GroupProfile
+	if code := s.do(http.MethodGet, "/conversations/group/profile/"+group, carol, nil, &profile); code != http.StatusOK {
+		t.Fatalf("profile: status %d", code)
+	}
+	if profile.Name != "friends" || profile.Description != "weekend plans" || profile.CreatorID != s.userID("alice") ||
+		profile.CreatorName != "alice" || profile.MemberCount != 3 || profile.CreatedAt == "" {
+		t.Errorf("profile = %+v", profile)
+	}
+
+	// Solo i membri vedono il profilo e i membri del gruppo
+	if p := s.problem(http.MethodGet, "/conversations/group/profile/"+group, dave, nil, http.StatusForbidden); p.Code != CodeNotMember {
+		t.Errorf("profile as a non-member: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodGet, "/conversations/group/members/"+group, dave, nil, http.StatusForbidden); p.Code != CodeNotMember {
+		t.Errorf("members as a non-member: code %q", p.Code)
+	}
+	conv := s.startConversation(alice, "dave")
+	if p := s.problem(http.MethodGet, "/conversations/group/profile/"+conv, dave, nil, http.StatusNotFound); p.Code != CodeGroupNotFound {
+		t.Errorf("profile of a private conversation: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodGet, "/conversations/group/members/"+conv, dave, nil, http.StatusBadRequest); p.Code != CodeNotGroup {
+		t.Errorf("members of a private conversation: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodGet, "/conversations/group/get-photo/"+conv, dave, nil, http.StatusBadRequest); p.Code != CodeNotGroup {
+		t.Errorf("photo of a private conversation: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodGet, "/conversations/group/get-photo/404", dave, nil, http.StatusNotFound); p.Code != CodeGroupNotFound {
+		t.Errorf("photo of a missing group: code %q", p.Code)
+	}
+}
+
+func TestGroupInvites(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	dave := s.login("dave")
+	erin := s.login("erin")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	create := "/conversations/group/create-invite/" + group
+
+	// Solo amministratori e proprietario gestiscono gli inviti
+	maxUses := 1
+	if p := s.problem(http.MethodPost, create, bob, NewInviteRequest{MaxUses: &maxUses}, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("creating an invite as a member: code %q", p.Code)
+	}
+	past := time.Now().Add(-time.Hour)
+	if p := s.problem(http.MethodPost, create, alice, NewInviteRequest{ExpiresAt: &past}, http.StatusBadRequest); p.Code != CodeValidationFailed {
+		t.Errorf("creating an expired invite: code %q", p.Code)
+	}
+	var once database.GroupInvite
+	if code := s.do(http.MethodPost, create, alice, NewInviteRequest{MaxUses: &maxUses}, &once); code != http.StatusCreated || once.MaxUses != 1 {
+		t.Fatalf("creating an invite: status %d, %+v", code, once)
+	}
+
+	var joined JoinGroupResponse
+	if code := s.do(http.MethodPost, "/invites/"+once.Token+"/join", carol, nil, &joined); code != http.StatusOK ||
+		joined.ConversationID != group || joined.Status != "joined" {
+		t.Fatalf("joining: status %d, %+v", code, joined)
+	}
+	if p := s.problem(http.MethodPost, "/invites/"+once.Token+"/join", carol, nil, http.StatusConflict); p.Code != CodeAlreadyMember {
+		t.Errorf("joining twice: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, "/invites/"+once.Token+"/join", dave, nil, http.StatusGone); p.Code != CodeInviteExhausted {
+		t.Errorf("joining with an exhausted invite: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, "/invites/missing/join", dave, nil, http.StatusNotFound); p.Code != CodeInviteNotFound {
+		t.Errorf("joining with a missing invite: code %q", p.Code)
+	}
+
+	// Con un invito che richiede l'approvazione l'utente entra solo dopo l'approvazione di un amministratore
+	var approval database.GroupInvite
+	if code := s.do(http.MethodPost, create, alice, NewInviteRequest{RequiresApproval: true}, &approval); code != http.StatusCreated {
+		t.Fatalf("creating an invite with approval: status %d", code)
+	}
+	for _, token := range []string{dave, erin} {
+		if code := s.do(http.MethodPost, "/invites/"+approval.Token+"/join", token, nil, &joined); code != http.StatusAccepted || joined.Status != "pending" {
+			t.Fatalf("requesting to join: status %d, %+v", code, joined)
+		}
+	}
+	if code := s.do(http.MethodGet, "/conversations/messages/"+group, dave, nil, nil); code != http.StatusForbidden {
+		t.Errorf("reading before the approval: status %d", code)
+	}
+	if p := s.problem(http.MethodGet, "/conversations/group/join-requests/"+group, bob, nil, http.StatusForbidden); p.Code != CodeInsufficientRole {
+		t.Errorf("listing the requests as a member: code %q", p.Code)
+	}
+	var requests JoinRequestsResponse
+	if code := s.do(http.MethodGet, "/conversations/group/join-requests/"+group, alice, nil, &requests); code != http.StatusOK ||
+		len(requests.Requests) != 2 || requests.Requests[0].UserName != "dave" {
+		t.Fatalf("join requests: status %d, %+v", code, requests)
+	}
+	approve := "/conversations/group/approve-request/" + group + "/requests/"
+	reject := "/conversations/group/reject-request/" + group + "/requests/"
+	if code := s.do(http.MethodPost, approve+s.userID("dave"), alice, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("approving dave: status %d", code)
+	}
+	if code := s.do(http.MethodGet, "/conversations/messages/"+group, dave, nil, nil); code != http.StatusOK {
+		t.Errorf("reading after the approval: status %d", code)
+	}
+	if code := s.do(http.MethodDelete, reject+s.userID("erin"), alice, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("rejecting erin: status %d", code)
+	}
+	if p := s.problem(http.MethodDelete, reject+s.userID("erin"), alice, nil, http.StatusNotFound); p.Code != CodeJoinRequestNotFound {
+		t.Errorf("rejecting twice: code %q", p.Code)
+	}
+
+	// Un invito revocato non può più essere usato
+	revoke := "/conversations/group/revoke-invite/" + group + "/invites/" + approval.Token
+	if code := s.do(http.MethodDelete, revoke, alice, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("revoking: status %d", code)
+	}
+	if p := s.problem(http.MethodDelete, revoke, alice, nil, http.StatusNotFound); p.Code != CodeInviteNotFound {
+		t.Errorf("revoking twice: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPost, "/invites/"+approval.Token+"/join", erin, nil, http.StatusNotFound); p.Code != CodeInviteNotFound {
+		t.Errorf("joining with a revoked invite: code %q", p.Code)
+	}
+	var invites GroupInvitesResponse
+	if code := s.do(http.MethodGet, "/conversations/group/invites/"+group, alice, nil, &invites); code != http.StatusOK ||
+		len(invites.Invites) != 1 || invites.Invites[0].Token != once.Token || invites.Invites[0].Uses != 1 {
+		t.Errorf("invites: status %d, %+v", code, invites)
+	}
+}
+
+func TestSystemMessages(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	s.send(bob, group, "hello friends")
+	if code := s.do(http.MethodPost, "/conversations/group/add/"+group, alice, UsernameRequest{Username: "carol"}, nil); code != http.StatusNoContent {
+		t.Fatalf("adding carol: status %d", code)
+	}
+	if code := s.do(http.MethodPatch, "/conversations/group/change-name/"+group, alice, NewGroupName{Name: "best friends"}, nil); code != http.StatusNoContent {
+		t.Fatalf("renaming group: status %d", code)
+	}
+	if code := s.do(http.MethodDelete, "/conversations/group/leave/"+group, carol, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("leaving group: status %d", code)
+	}
+
+	// Gli eventi del gruppo compaiono nella cronologia dopo i messaggi degli utenti
+	msgs := s.messages(bob, group)
+	if len(msgs) != 4 || msgs[0].Kind != database.MessageKindText {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	for i, want := range []struct {
+		sender  string
+		payload database.SystemPayload
+	}{
+		{"alice", database.SystemPayload{Type: database.SystemMemberAdded, UserID: s.userID("carol")}},
+		{"alice", database.SystemPayload{Type: database.SystemGroupRenamed, Name: "best friends"}},
+		{"carol", database.SystemPayload{Type: database.SystemMemberLeft, UserID: s.userID("carol")}},
+	} {
+		m := msgs[i+1]
+		if m.Kind != database.MessageKindSystem || m.SenderID != s.userID(want.sender) || m.Payload == nil || *m.Payload != want.payload {
+			t.Errorf("messages[%d] = %+v, payload %+v", i+1, m, m.Payload)
+		}
+	}
+
+	// L'ultimo evento è anche l'ultimo messaggio del gruppo
+	var c database.Conversation
+	if code := s.do(http.MethodGet, "/conversations/get-details/"+group, bob, nil, &c); code != http.StatusOK {
+		t.Fatalf("getting conversation: status %d", code)
+	}
+	if c.LastMessage != "carol left the group" {
+		t.Errorf("LastMessage = %q", c.LastMessage)
+	}
+
+	// I messaggi di sistema non possono ricevere reazioni, essere inoltrati o modificati, neanche dal mittente
+	system := msgs[2].MessageID
+	if p := s.problem(http.MethodPost, fmt.Sprintf("/conversations/react/%s/messages/%s", group, system), bob, ReactionRequest{Reaction: "👍"}, http.StatusForbidden); p.Code != CodeSystemMessage {
+		t.Errorf("reacting to a system message: code %q", p.Code)
+	}
+	conv := s.startConversation(alice, "bob")
+	if p := s.problem(http.MethodPost, fmt.Sprintf("/conversations/forward-message/%s/messages/%s", group, system), alice, ConversationsRequest{ID: conv}, http.StatusForbidden); p.Code != CodeSystemMessage {
+		t.Errorf("forwarding a system message: code %q", p.Code)
+	}
+	if p := s.problem(http.MethodPatch, fmt.Sprintf("/conversations/edit-message/%s/messages/%s", group, system), alice, MessageRequest{Text: "edited"}, http.StatusForbidden); p.Code != CodeSystemMessage {
+		t.Errorf("editing a system message: code %q", p.Code)
+	}
+}
+
+// TestMembershipSystemMessages verifica che rimozioni e cambi di proprietario, anche automatici, siano registrati
+// nella cronologia del gruppo
+func TestMembershipSystemMessages(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+	s.login("dave")
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob", "carol", "dave"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := res.ConversationID
+	if code := s.do(http.MethodDelete, "/conversations/group/remove/"+group+"/members/"+s.userID("dave"), alice, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("removing dave: status %d", code)
+	}
+	if code := s.do(http.MethodPost, "/conversations/group/transfer-ownership/"+group, alice, UsernameRequest{Username: "bob"}, nil); code != http.StatusNoContent {
+		t.Fatalf("transferring the ownership: status %d", code)
+	}
+	// Il gruppo passa ad alice, che dopo aver ceduto la proprietà è amministratrice
+	if code := s.do(http.MethodDelete, "/conversations/group/leave/"+group, bob, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("leaving group: status %d", code)
+	}
+
+	msgs := s.messages(carol, group)
+	want := []struct {
+		sender  string
+		payload database.SystemPayload
+	}{
+		{"alice", database.SystemPayload{Type: database.SystemMemberRemoved, UserID: s.userID("dave")}},
+		{"alice", database.SystemPayload{Type: database.SystemOwnerChanged, UserID: s.userID("bob")}},
+		{"bob", database.SystemPayload{Type: database.SystemMemberLeft, UserID: s.userID("bob")}},
+		{"bob", database.SystemPayload{Type: database.SystemOwnerChanged, UserID: s.userID("alice")}},
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	for i, want := range want {
+		m := msgs[i]
+		if m.Kind != database.MessageKindSystem || m.SenderID != s.userID(want.sender) || m.Payload == nil || *m.Payload != want.payload {
+			t.Errorf("messages[%d] = %+v, payload %+v", i, m, m.Payload)
+		}
+	}
+	for i, content := range []string{"alice removed dave", "bob is now the group owner"} {
+		if msgs[i].Content != content {
+			t.Errorf("messages[%d].Content = %q, want %q", i, msgs[i].Content, content)
+		}
+	}
+
+	var c database.Conversation
+	if code := s.do(http.MethodGet, "/conversations/get-details/"+group, carol, nil, &c); code != http.StatusOK {
+		t.Fatalf("getting conversation: status %d", code)
+	}
+	if c.LastMessage != "alice is now the group owner" {
+		t.Errorf("LastMessage = %q", c.LastMessage)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer(t)
+	if p := s.problem(http.MethodGet, "/conversations", "", nil, http.StatusUnauthorized); p.Code != CodeUnauthorized {
+		t.Errorf("without token: code %q", p.Code)
+	}
+
+	alice := s.login("alice")
+	bob := s.login("bob")
+	p := s.problem(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"nobody"}}, http.StatusBadRequest)
+	if p.Code != CodeValidationFailed || len(p.Errors) != 1 || p.Errors[0].Field != "members" {
+		t.Errorf("invalid members: problem = %+v", p)
+	}
+
+	var res ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &res); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	p = s.problem(http.MethodPatch, "/conversations/group/change-name/"+res.ConversationID, bob, NewGroupName{Name: "bob's friends"}, http.StatusForbidden)
+	if p.Code != CodeInsufficientRole {
+		t.Errorf("renaming as a member: code %q", p.Code)
+	}
+	p = s.problem(http.MethodPost, "/conversations/group/add/"+res.ConversationID, alice, UsernameRequest{Username: "bob"}, http.StatusConflict)
+	if p.Code != CodeAlreadyMember {
+		t.Errorf("adding a member twice: code %q", p.Code)
+	}
+	p = s.problem(http.MethodGet, "/conversations/messages/404", alice, nil, http.StatusNotFound)
+	if p.Code != CodeConversationNotFound {
+		t.Errorf("missing conversation: code %q", p.Code)
+	}
+}
+
+// TestBlobErrorHeaders verifica che le risposte di errore dei file non ereditino gli header del contenuto: un errore
+// con Cache-Control immutable resterebbe in cache per sempre, e con Content-Disposition verrebbe scaricato come file
+func TestBlobErrorHeaders(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.login("alice")
+	s.login("bob")
+	conv := s.startConversation(alice, "bob")
+	msg := s.sendWithFile(alice, conv, "the menu", "menu.txt", []byte("pizza margherita"))
+
+	var created ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "pizza club", Members: []string{"bob"}}, &created); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	photo := map[string]string{"photo": base64.StdEncoding.EncodeToString(testPNG(t, 300, 200))}
+	if code := s.do(http.MethodPatch, "/conversations/group/change-photo/"+created.ConversationID, alice, photo, nil); code != http.StatusNoContent {
+		t.Fatalf("changing the photo: status %d", code)
+	}
+	var details database.Conversation
+	if code := s.do(http.MethodGet, "/conversations/get-details/"+created.ConversationID, alice, nil, &details); code != http.StatusOK {
+		t.Fatalf("getting the group: status %d", code)
+	}
+
+	// Quando il file esiste, la risposta ha gli header del contenuto
+	res, _ := s.request(http.MethodGet, msg.Attachments[0].URL, alice, "", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Disposition") == "" || res.Header.Get("Cache-Control") != immutableCacheControl("private") {
+		t.Fatalf("attachment: status %d, headers %v", res.StatusCode, res.Header)
+	}
+	res, _ = s.request(http.MethodGet, details.Photo, alice, "", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Cache-Control") != immutableCacheControl("private") {
+		t.Fatalf("group photo: status %d, headers %v", res.StatusCode, res.Header)
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		path   string
+		status int
+	}{
+		{"missing attachment", storage.ErrNotFound, msg.Attachments[0].URL, http.StatusNotFound},
+		{"attachment storage error", errors.New("storage unavailable"), msg.Attachments[0].URL, http.StatusInternalServerError},
+		{"photo storage error", errors.New("storage unavailable"), details.Photo, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		s.blobs.setFailGet(tt.err)
+		res, _ := s.request(http.MethodGet, tt.path, alice, "", nil)
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: Content-Type %q", tt.name, ct)
+		}
+		for _, name := range []string{"Content-Disposition", "Cache-Control", "ETag"} {
+			if v := res.Header.Get(name); v != "" {
+				t.Errorf("%s: %s = %q", tt.name, name, v)
+			}
+		}
+	}
+
+	// Se la foto non si trova viene inviata quella predefinita, da verificare ogni volta
+	s.blobs.setFailGet(storage.ErrNotFound)
+	res, _ = s.request(http.MethodGet, details.Photo, alice, "", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("missing group photo: status %d, headers %v", res.StatusCode, res.Header)
+	}
+}
+
+// failingLookups è un database in cui, dopo la chiamata a fail, le ricerche degli utenti e delle conversazioni
+// falliscono con un errore diverso da sql.ErrNoRows
+type failingLookups struct {
+	database.AppDatabase
+
+	mu     sync.Mutex
+	failed bool
+}
+
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+func (db *failingLookups) fail() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.failed = true
+}
+
+func (db *failingLookups) err() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.failed {
+		return errDatabaseUnavailable
+	}
+	return nil
+}
+
+func (db *failingLookups) GetUserByName(ctx context.Context, name string) (string, error) {
+	if err := db.err(); err != nil {
+		return "", err
+	}
+	return db.AppDatabase.GetUserByName(ctx, name)
+}
+
+func (db *failingLookups) GetUserByID(ctx context.Context, id string) (string, error) {
+	if err := db.err(); err != nil {
+		return "", err
+	}
+	return db.AppDatabase.GetUserByID(ctx, id)
+}
+
+func (db *failingLookups) GetConversationByID(ctx context.Context, convID, userID string) (database.Conversation, error) {
+	if err := db.err(); err != nil {
+		return database.Conversation{}, err
+	}
+	return db.AppDatabase.GetConversationByID(ctx, convID, userID)
+}
+
+// TestLookupErrors verifica che un errore del database durante la ricerca di un utente o di una conversazione non
+// venga scambiato per un utente o una conversazione inesistente
+func TestLookupErrors(t *testing.T) {
+	db := &failingLookups{AppDatabase: database.NewMemory()}
+	s := startTestServer(t, db)
+	alice := s.login("alice")
+	s.login("bob")
+	bobID := s.userID("bob")
+	conv := s.startConversation(alice, "bob")
+	var created ConvIDResponse
+	if code := s.do(http.MethodPost, "/conversations/create-group", alice, GroupRequest{Name: "friends", Members: []string{"bob"}}, &created); code != http.StatusCreated {
+		t.Fatalf("creating group: status %d", code)
+	}
+	group := created.ConversationID
+
+	db.fail()
+	tests := []struct {
+		name, method, path string
+		body               interface{}
+	}{
+		{"starting a conversation", http.MethodPost, "/conversations/start-conversation", UsernameRequest{Username: "bob"}},
+		{"getting a conversation", http.MethodGet, "/conversations/get-details/" + conv, nil},
+		{"creating a group", http.MethodPost, "/conversations/create-group", GroupRequest{Name: "friends", Members: []string{"bob"}}},
+		{"adding a member", http.MethodPost, "/conversations/group/add/" + group, UsernameRequest{Username: "carol"}},
+		{"transferring the ownership", http.MethodPost, "/conversations/group/transfer-ownership/" + group, UsernameRequest{Username: "bob"}},
+		{"promoting a member", http.MethodPost, "/conversations/group/promote/" + group, UsernameRequest{Username: "bob"}},
+		{"getting a user photo", http.MethodGet, "/users/get-photo/" + bobID, nil},
+	}
+	for _, tt := range tests {
+		if p := s.problem(tt.method, tt.path, alice, tt.body, http.StatusInternalServerError); p.Code != CodeInternalError {
+			t.Errorf("%s: code %q", tt.name, p.Code)
+		}
+	}
+}
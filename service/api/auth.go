@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// errMissingToken viene restituito quando la richiesta non contiene un header Authorization di tipo Bearer
+var errMissingToken = errors.New("missing bearer token")
+
+// bearerToken estrae il token dall'header "Authorization: Bearer <token>"
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", errMissingToken
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	if token == "" {
+		return "", errMissingToken
+	}
+	return token, nil
+}
+
+// authenticate risolve il token di sessione della richiesta nell'id dell'utente chiamante. Se allowQueryToken è vero
+// e l'header Authorization manca, il token viene letto dal parametro `access_token` della query string
+func (rt *_router) authenticate(r *http.Request, allowQueryToken bool) (string, error) {
+	token, err := bearerToken(r)
+	if errors.Is(err, errMissingToken) && allowQueryToken && r.URL.Query().Get("access_token") != "" {
+		token, err = r.URL.Query().Get("access_token"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return rt.db.GetUserIDBySession(r.Context(), token)
+}
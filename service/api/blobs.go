@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/imaging"
+	"WasaTEXT/service/storage"
+)
+
+// defaultUserPhoto è la foto mostrata per gli utenti e i gruppi che non ne hanno impostata una
+//
+//go:embed assets/default_user_photo.jpg
+var defaultUserPhoto []byte
+
+// photoSizes sono le dimensioni (in pixel, del lato più lungo) delle versioni ridotte generate per ogni foto
+var photoSizes = []int{64, 256}
+
+// maxPhotoRequestSize è la dimensione massima del corpo di una richiesta di cambio foto (la foto è codificata in base64)
+const maxPhotoRequestSize = 16 << 20
+
+// photosPrefix è il prefisso delle chiavi delle foto degli utenti e dei gruppi nello storage
+const photosPrefix = "photos/"
+
+// errInvalidPhotoSize viene restituito quando il parametro size non è una delle dimensioni disponibili
+var errInvalidPhotoSize = errors.New("invalid photo size")
+
+// immutableCacheControl restituisce il Cache-Control per i contenuti che non cambiano mai. scope è "public" o "private"
+func immutableCacheControl(scope string) string {
+	return scope + ", max-age=31536000, immutable"
+}
+
+// serveBlob invia il contenuto del file salvato con la chiave specificata, gestendo le richieste condizionali e i
+// range. header contiene gli header della risposta (Content-Type, Cache-Control, ecc.), impostati solo se il file
+// viene letto: se serveBlob restituisce un errore la risposta è ancora vuota, e l'errore inviato dal chiamante non li
+// eredita. Se header non contiene un Content-Type, viene usato quello salvato o ricavato dal contenuto. Per i file
+// salvati con una chiave ricavata dal contenuto, l'ETag è il nome del file (lo SHA-256 e l'eventuale dimensione)
+func (rt *_router) serveBlob(w http.ResponseWriter, r *http.Request, key string, header http.Header) error {
+	blob, info, err := rt.storage.Get(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// Se il backend non permette di spostarsi nel file, il contenuto viene letto tutto in memoria
+	content, ok := blob.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	if storage.KeyHash(key) != "" {
+		w.Header().Set("ETag", `"`+strings.TrimSuffix(path.Base(key), path.Ext(key))+`"`)
+	}
+	if info.ContentType != "" && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	http.ServeContent(w, r, path.Base(key), info.ModTime, content)
+	return nil
+}
+
+// decodePhoto decodifica la foto inviata in base64, eventualmente come data URL ("data:image/png;base64,...")
+func decodePhoto(photo string) ([]byte, error) {
+	if strings.HasPrefix(photo, "data:") {
+		if i := strings.Index(photo, ","); i >= 0 {
+			photo = photo[i+1:]
+		}
+	}
+	return base64.StdEncoding.DecodeString(photo)
+}
+
+// parsePhotoSize legge il parametro size della richiesta: una delle dimensioni in photoSizes, oppure "original" (o
+// nessun valore) per la foto originale, indicata da 0
+func parsePhotoSize(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("size")
+	if value == "" || value == "original" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errInvalidPhotoSize
+	}
+	for _, s := range photoSizes {
+		if s == size {
+			return size, nil
+		}
+	}
+	return 0, errInvalidPhotoSize
+}
+
+// photoVariantKey restituisce la chiave della versione della foto con il lato più lungo di size pixel: per esempio
+// "photos/<sha256>_64.png" per "photos/<sha256>.png" (vedi storage.KeyHash). Se size è 0 restituisce la chiave della
+// foto originale
+func photoVariantKey(key string, size int) string {
+	if size == 0 {
+		return key
+	}
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "_" + strconv.Itoa(size) + ext
+}
+
+// savePhoto verifica che la foto sia un'immagine valida, la ricodifica (eliminando i metadati come EXIF e posizione
+// GPS) e la salva nello storage insieme alle versioni ridotte. La chiave della foto è ricavata dallo SHA-256 della foto
+// ricodificata, quindi le foto identiche vengono salvate una volta sola; le versioni ridotte hanno la stessa chiave
+// con la dimensione aggiunta (vedi photoVariantKey). Restituisce la chiave della foto originale, oppure
+// imaging.ErrNotImage o imaging.ErrTooLarge se la foto non è valida
+func (rt *_router) savePhoto(ctx context.Context, data []byte) (string, error) {
+	img, format, err := imaging.Decode(data)
+	if err != nil {
+		return "", err
+	}
+	original, err := imaging.Encode(img, format)
+	if err != nil {
+		return "", err
+	}
+	key := storage.ContentKey(photosPrefix, original, format.Ext())
+
+	// Le versioni ridotte vengono salvate prima dell'originale: se la foto originale esiste già, esistono anche le altre
+	if _, err := rt.storage.Stat(ctx, key); err == nil {
+		return key, nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+	for _, size := range photoSizes {
+		encoded, err := imaging.Encode(imaging.Fit(img, size), format)
+		if err != nil {
+			return "", err
+		}
+		err = storage.PutContent(ctx, rt.storage, photoVariantKey(key, size), encoded, format.ContentType())
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := storage.PutContent(ctx, rt.storage, key, original, format.ContentType()); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// servePhoto invia la versione della foto con la dimensione richiesta. Se la foto non è impostata viene inviata la
+// foto predefinita; se la versione ridotta non esiste (foto caricate prima dell'introduzione delle versioni ridotte)
+// viene inviata la foto originale.
+//
+// Gli URL delle foto contengono la versione della foto attuale nel parametro v (vedi database.UserPhotoURL): se
+// corrisponde, la risposta può restare in cache per sempre, perché una nuova foto avrà un URL diverso; altrimenti il
+// client deve verificare ogni volta con l'ETag che la foto non sia cambiata. scope è "public" o "private"
+func (rt *_router) servePhoto(w http.ResponseWriter, r *http.Request, key string, size int, scope string) error {
+	if key == "" {
+		return serveDefaultPhoto(w, r, size)
+	}
+
+	header := http.Header{}
+	if v := r.URL.Query().Get("v"); v != "" && v == database.PhotoVersion(key) {
+		header.Set("Cache-Control", immutableCacheControl(scope))
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	err := rt.serveBlob(w, r, photoVariantKey(key, size), header)
+	if errors.Is(err, storage.ErrNotFound) && size != 0 {
+		err = rt.serveBlob(w, r, key, header)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return serveDefaultPhoto(w, r, size)
+	}
+	return err
+}
+
+var (
+	defaultPhotosOnce sync.Once
+	defaultPhotos     map[int][]byte
+	defaultPhotosErr  error
+	defaultPhotoHash  string
+)
+
+// serveDefaultPhoto invia la versione della foto predefinita con la dimensione richiesta. Le versioni ridotte vengono
+// generate alla prima richiesta. La foto predefinita può cambiare con una nuova versione del server, quindi il client
+// deve sempre verificarla con l'ETag
+func serveDefaultPhoto(w http.ResponseWriter, r *http.Request, size int) error {
+	defaultPhotosOnce.Do(func() {
+		img, format, err := imaging.Decode(defaultUserPhoto)
+		if err != nil {
+			defaultPhotosErr = err
+			return
+		}
+		defaultPhotoHash = storage.ContentKey("", defaultUserPhoto, "")
+		defaultPhotos = map[int][]byte{0: defaultUserPhoto}
+		for _, s := range photoSizes {
+			if defaultPhotos[s], err = imaging.Encode(imaging.Fit(img, s), format); err != nil {
+				defaultPhotosErr = err
+				return
+			}
+		}
+	})
+	if defaultPhotosErr != nil {
+		return defaultPhotosErr
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	etag := defaultPhotoHash
+	if size != 0 {
+		etag += "_" + strconv.Itoa(size)
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, "default_user_photo.jpg", time.Time{}, bytes.NewReader(defaultPhotos[size]))
+	return nil
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// attachmentsPrefix è il prefisso delle chiavi dei file allegati ai messaggi nello storage
+	attachmentsPrefix = "attachments/"
+
+	// maxAttachments è il numero massimo di file allegati a un singolo messaggio
+	maxAttachments = 10
+
+	// maxMessageUploadSize è la dimensione massima del corpo di una richiesta multipart di invio messaggio
+	maxMessageUploadSize = 25 << 20
+
+	// multipartMemory è la parte del corpo multipart tenuta in memoria; il resto viene scritto in file temporanei
+	multipartMemory = 8 << 20
+)
+
+// errTooManyAttachments viene restituito quando un messaggio ha più di maxAttachments allegati
+var errTooManyAttachments = errors.New("too many attachments")
+
+// isMultipart indica se il corpo della richiesta è di tipo multipart/form-data
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// parseMessageForm legge un messaggio inviato come multipart/form-data: il testo nel campo "content", l'eventuale
+// messaggio citato in "reply_to" e gli allegati nei campi "files"
+func parseMessageForm(w http.ResponseWriter, r *http.Request) (MessageRequest, []*multipart.FileHeader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageUploadSize)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return MessageRequest{}, nil, err
+	}
+
+	req := MessageRequest{
+		Text:    r.FormValue("content"),
+		ReplyTo: r.FormValue("reply_to"),
+	}
+	files := r.MultipartForm.File["files"]
+	if len(files) > maxAttachments {
+		return MessageRequest{}, nil, errTooManyAttachments
+	}
+	return req, files, nil
+}
+
+// saveAttachments salva nello storage i file caricati e ne ricava i metadati. I file già salvati non vengono eliminati
+// se il salvataggio di un altro file fallisce, perché lo stesso contenuto potrebbe essere allegato ad altri messaggi
+func (rt *_router) saveAttachments(ctx context.Context, files []*multipart.FileHeader) ([]database.NewAttachment, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	attachments := make([]database.NewAttachment, 0, len(files))
+	for _, fh := range files {
+		att, err := rt.saveAttachment(ctx, fh)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, att)
+	}
+	return attachments, nil
+}
+
+// saveAttachment salva il file caricato con la chiave ricavata dal suo SHA-256 (con il prefisso attachmentsPrefix), così
+// i file identici vengono salvati una volta sola. Il tipo MIME è ricavato dal contenuto del file e, per le immagini,
+// vengono lette anche le dimensioni
+func (rt *_router) saveAttachment(ctx context.Context, fh *multipart.FileHeader) (database.NewAttachment, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return database.NewAttachment{}, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return database.NewAttachment{}, err
+	}
+
+	att := database.NewAttachment{
+		FileName: attachmentFileName(fh.Filename),
+		MimeType: http.DetectContentType(data),
+		Size:     int64(len(data)),
+	}
+	if strings.HasPrefix(att.MimeType, "image/") {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			att.Width, att.Height = cfg.Width, cfg.Height
+		}
+	}
+
+	att.Path = storage.ContentKey(attachmentsPrefix, data, "")
+	if err := storage.PutContent(ctx, rt.storage, att.Path, data, att.MimeType); err != nil {
+		return database.NewAttachment{}, err
+	}
+	return att, nil
+}
+
+// attachmentFileName ripulisce il nome originale del file, tenendo solo l'ultimo elemento del percorso
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// getAttachment handles GET /conversations/attachment/:conversation_id/attachments/:attachment_id
+func (rt *_router) getAttachment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera gli ID della conversazione e dell'allegato dalla richiesta
+	convID := ps.ByName("conversation_id")
+	attachmentID := ps.ByName("attachment_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Recupera l'allegato e verifica che appartenga a un messaggio della conversazione
+	attachment, attachmentConvID, key, err := rt.db.GetAttachment(r.Context(), attachmentID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && attachmentConvID != convID) {
+		sendError(w, ctx, http.StatusNotFound, CodeAttachmentNotFound, "Attachment not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching attachment")
+		return
+	}
+
+	// Le immagini vengono mostrate dal browser, gli altri file scaricati con il loro nome originale
+	disposition := "attachment"
+	if attachment.Width > 0 {
+		disposition = "inline"
+	}
+	header := http.Header{}
+	header.Set("Content-Type", attachment.MimeType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}))
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	// Il contenuto di un allegato non cambia mai, quindi il client può tenerlo in cache senza limiti
+	header.Set("Cache-Control", immutableCacheControl("private"))
+
+	// Serve il file; gli header vengono impostati solo se il file esiste, così gli errori non li ereditano
+	if err := rt.serveBlob(w, r, key, header); errors.Is(err, storage.ErrNotFound) {
+		sendError(w, ctx, http.StatusNotFound, CodeAttachmentNotFound, "Attachment not found")
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error reading attachment")
+	}
+}
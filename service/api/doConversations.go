@@ -1,11 +1,14 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"strings"
 
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/events"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -18,27 +21,15 @@ type UsernameRequest struct {
 }
 
 // Handler per GET /conversations
-func (rt *_router) getUserConversations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (rt *_router) getUserConversations(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 
-	// Recupera il creatorId dall'header Authorization
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
 
 	// Recupera le conversazioni dell'utente dal database
-	conversations, err := rt.db.GetUserConversations(userID)
+	conversations, err := rt.db.GetUserConversations(r.Context(), userID)
 	if err != nil {
-        log.Println(err)
-		http.Error(w, "Error fetching conversations", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error fetching conversations")
 		return
 	}
 
@@ -48,70 +39,51 @@ func (rt *_router) getUserConversations(w http.ResponseWriter, r *http.Request,
 }
 
 // Handler per POST /conversations/start-conversation
-func (rt *_router) postConversations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-
-	// Recupera il creatorId dall'header Authorization
-	creatorID := r.Header.Get("Authorization")
-
-
-    log.Println("DEBUG: creatorID:", creatorID)
-
-
-	// Verifica che il creatorID non sia vuoto
-	if creatorID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	
-	// Controlla se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(creatorID)
+func (rt *_router) postConversations(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 
-	// Se l'utente non esiste, ritorna errore
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    } 
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	creatorID := ctx.UserID
 
 	// Decodifica il requestBody
 	var req UsernameRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
 		return
 	}
 
 	//Verifica che il campo username non sia vuoto
 	if req.Username == "" {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "username", Message: "Username cannot be empty"})
         return
     }
 
-    log.Println("DEBUG: Nome username target: ", req.Username)
-
     // Converte il nome dell'utente in minuscolo
     lowername := strings.ToLower(req.Username)
 
 	// Recupera l'ID dell'utente dal database
-	targetUserID, err := rt.db.GetUserByName(lowername)
+	targetUserID, err := rt.db.GetUserByName(r.Context(), lowername)
 
 	// Se l'utente non esiste, ritorna errore
-	if err!= nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching user")
 		return
 	}
 
 	// Creazione della conversazione nel database
-	convID, err := rt.db.CreatePrivateConversation(creatorID, targetUserID)
-
-
-    log.Println("DEBUG: ID della conversazione appena creata:", convID)
-
+	convID, err := rt.db.CreatePrivateConversation(r.Context(), creatorID, targetUserID)
 
 	// Se la creazione fallisce, ritorna errore
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error creating conversation")
 		return
 	}
 
+	// Notifica i partecipanti della nuova conversazione
+	rt.publishToConversation(ctx, convID, events.Event{Type: events.TypeConversationCreated, ConversationID: convID})
+
 	// Invia l'ID della conversazione come risposta
 	res := ConvIDResponse{ConversationID : convID}
 	w.Header().Set("Content-Type", "application/json")
@@ -119,51 +91,41 @@ func (rt *_router) postConversations(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // Handler per GET /conversations/{convId}
-func (rt *_router) getConversationByID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) getConversationByID(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 
-    // Recupera l'ID dell'utente autenticato
-	userID := r.Header.Get("Authorization")
-
-	if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID della conversazione
     convID := ps.ByName("conversation_id")
 
-	exists, err := rt.db.ConversationExists(convID)
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exists {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
-	isMember, err := rt.db.IsUserInConversation(userID, convID)
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
 
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
         return
     }
 
-	conversation, err := rt.db.GetConversationByID(convID, userID)
-    log.Println("DEBUG: error:", err)
-	if err != nil {
-		http.Error(w, "Conversation not found", http.StatusNotFound)
+	conversation, err := rt.db.GetConversationByID(r.Context(), convID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching conversation")
 		return
 	}
 
@@ -172,78 +134,64 @@ func (rt *_router) getConversationByID(w http.ResponseWriter, r *http.Request, p
 }
 
 // Handler per DELETE /conversations/{convId}/delete
-func (rt *_router) deleteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) deleteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
     convID := ps.ByName("conversation_id")
 
-    // Recupera l'ID dell'utente autenticato
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Controlla se la conversazione esiste
-    exists, err := rt.db.ConversationExists(convID)
+    exists, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        log.Println("Error checking conversation existence:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exists {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica se la conversazione è privata o di gruppo
-    isPrivate, err := rt.db.IsConversationPrivate(convID)
+    isPrivate, err := rt.db.IsConversationPrivate(r.Context(), convID)
     if err != nil {
-        log.Println("Error checking conversation type:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation type")
         return
     }
 
     if isPrivate {
         // Controlla che l'utente sia un membro
-        isMember, err := rt.db.IsUserInConversation(userID, convID)
+        isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
         if err != nil {
-            log.Println("Error checking membership:", err)
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
+            sendInternalError(w, ctx, err, "error checking membership")
             return
         }
         if !isMember {
-            http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+            sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
             return
         }
     } else {
-        // Controlla che l'utente sia il creatore
-        isCreator, err := rt.db.IsUserCreatorOfGroup(userID, convID)
-        if err != nil {
-            log.Println("Error checking conversation creator:", err)
-            http.Error(w, "Internal server error", http.StatusInternalServerError)
-            return
-        }
-        if !isCreator {
-            http.Error(w, "Forbidden: You are not the creator of this conversation", http.StatusForbidden)
+        // Controlla che il ruolo dell'utente nel gruppo permetta di eliminarlo
+        if !rt.requireGroupPermission(w, r, ctx, convID, actionDeleteGroup) {
             return
         }
     }
 
+    // Recupera i membri prima dell'eliminazione, per poterli notificare
+    members, err := rt.db.GetConversationMembers(r.Context(), convID)
+    if err != nil {
+        sendInternalError(w, ctx, err, "error fetching conversation members")
+        return
+    }
+
     // Elimina la conversazione
-    err = rt.db.DeleteConversation(convID)
+    err = rt.db.DeleteConversation(r.Context(), convID)
     if err != nil {
-        log.Println("Error deleting conversation:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error deleting conversation")
         return
     }
 
-    log.Println("Conversation deleted successfully:", convID)
+    ctx.Logger.WithField("conversation-id", convID).Info("conversation deleted")
+    rt.publishToUsers(ctx, members, events.Event{Type: events.TypeConversationDeleted, ConversationID: convID})
     w.WriteHeader(http.StatusNoContent)
 }
 
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
+	"WasaTEXT/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+type MessageEditsResponse struct {
+	Edits []database.MessageEdit `json:"edits"`
+}
+
+// editMessage handles PATCH /conversations/edit-message/:conversation_id/messages/:message_id
+func (rt *_router) editMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera gli ID della conversazione e del messaggio dalla richiesta
+	convID := ps.ByName("conversation_id")
+	messageID := ps.ByName("message_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Verifica che il messaggio esista e appartenga alla conversazione
+	message, err := rt.db.GetMessageFromID(r.Context(), messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching message")
+		return
+	}
+	if message.ConversationID != convID {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
+		return
+	}
+
+	// I messaggi di sistema non possono essere modificati
+	if message.Kind == database.MessageKindSystem {
+		sendError(w, ctx, http.StatusForbidden, CodeSystemMessage, "System messages cannot be edited")
+		return
+	}
+
+	// Solo il mittente può modificare il messaggio
+	if message.SenderID != userID {
+		sendError(w, ctx, http.StatusForbidden, CodeNotSender, "You are not the sender of this message")
+		return
+	}
+
+	// Se è configurato un limite di tempo, verifica che il messaggio sia stato inviato da abbastanza poco
+	if rt.messageEditWindow > 0 {
+		sentAt, err := time.Parse(time.RFC3339Nano, message.Timestamp)
+		if err != nil {
+			sendInternalError(w, ctx, err, "error parsing message timestamp")
+			return
+		}
+		if globaltime.Since(sentAt) > rt.messageEditWindow {
+			sendError(w, ctx, http.StatusForbidden, CodeEditWindowExpired, "The message can no longer be edited")
+			return
+		}
+	}
+
+	// Decodifica il body della richiesta
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+
+	// Controlla che il nuovo testo del messaggio non sia vuoto
+	if req.Text == "" {
+		sendValidationError(w, ctx, FieldError{Field: "content", Message: "Message content cannot be empty"})
+		return
+	}
+
+	// Se il testo non cambia non c'è niente da modificare
+	if req.Text != message.Content {
+		message, err = rt.db.EditMessage(r.Context(), messageID, req.Text)
+		if err != nil {
+			sendInternalError(w, ctx, err, "error editing message")
+			return
+		}
+
+		// Notifica i membri della conversazione
+		rt.publishToConversation(ctx, convID, events.Event{Type: events.TypeMessageEdited, ConversationID: convID, Payload: message})
+	}
+
+	// Invia il messaggio aggiornato come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+// getMessageEdits handles GET /conversations/message-edits/:conversation_id/messages/:message_id
+func (rt *_router) getMessageEdits(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera gli ID della conversazione e del messaggio dalla richiesta
+	convID := ps.ByName("conversation_id")
+	messageID := ps.ByName("message_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Verifica che il messaggio esista e appartenga alla conversazione
+	message, err := rt.db.GetMessageFromID(r.Context(), messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching message")
+		return
+	}
+	if message.ConversationID != convID {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
+		return
+	}
+
+	// Recupera lo storico delle modifiche
+	edits, err := rt.db.GetMessageEdits(r.Context(), messageID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching message edits")
+		return
+	}
+
+	// Invia lo storico come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageEditsResponse{Edits: edits})
+}
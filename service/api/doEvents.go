@@ -0,0 +1,245 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/events"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// streamWriteWait è il tempo massimo concesso per scrivere un messaggio sullo stream di eventi
+	streamWriteWait = 10 * time.Second
+
+	// wsPongWait è il tempo massimo di attesa di un pong dal client
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod è l'intervallo tra due ping; deve essere minore di wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// sseHeartbeatPeriod è l'intervallo tra due commenti di keep-alive sullo stream SSE, per evitare che i proxy
+	// chiudano le connessioni inattive
+	sseHeartbeatPeriod = 30 * time.Second
+
+	// sseReplayBatch è il numero di eventi letti dal database per volta durante la ripresa dello stream
+	sseReplayBatch = 200
+)
+
+// wsUpgrader accetta connessioni da qualsiasi origine, come la policy CORS del server: l'autenticazione avviene
+// tramite token, non tramite cookie
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// getEvents handles GET /events (WebSocket)
+func (rt *_router) getEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	// Registra il client presso l'hub degli eventi
+	sub, err := rt.hub.Subscribe(ctx.UserID)
+	if err != nil {
+		sendError(w, ctx, http.StatusServiceUnavailable, CodeServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer sub.Close()
+
+	// Effettua l'upgrade della connessione (in caso di errore l'upgrader ha già risposto al client)
+	upgrader := wsUpgrader
+	upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		sendError(w, ctx, status, CodeBadHandshake, reason.Error())
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		ctx.Logger.WithError(err).Debug("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+	ctx.Logger.Debug("event stream connected")
+
+	// Legge (e scarta) i messaggi del client, così da gestire pong e chiusura della connessione
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(512)
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				// Hub chiuso o client troppo lento: chiude la connessione, il client dovrà riconnettersi
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(streamWriteWait))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				ctx.Logger.WithError(err).Debug("can't write to the event stream")
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+		case <-done:
+			ctx.Logger.Debug("event stream disconnected")
+			return
+		}
+	}
+}
+
+// getEventsSSE handles GET /events/sse (Server-Sent Events)
+func (rt *_router) getEventsSSE(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	// Legge l'ultimo evento ricevuto dal client: EventSource lo invia nell'header Last-Event-ID quando si riconnette
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastSeq int64
+	if lastEventID != "" {
+		var err error
+		lastSeq, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastSeq < 0 {
+			sendValidationError(w, ctx, FieldError{Field: "Last-Event-ID", Message: "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	// Registra il client presso l'hub prima di leggere gli eventi persi, così nessun evento va perduto nel frattempo
+	sub, err := rt.hub.Subscribe(ctx.UserID)
+	if err != nil {
+		sendError(w, ctx, http.StatusServiceUnavailable, CodeServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer sub.Close()
+
+	// Lo stream resta aperto a tempo indeterminato: rimuove i timeout del server per questa connessione
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		sendInternalError(w, ctx, err, "can't clear the read deadline of the event stream")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev events.Event) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(streamWriteWait)); err != nil {
+			return err
+		}
+		if err := writeSSE(w, ev); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	// Invia gli eventi persi dal client dall'ultima connessione
+	if lastEventID != "" {
+		lastSeq, err = rt.replayEvents(r, ctx, lastSeq, send)
+		if err != nil {
+			ctx.Logger.WithError(err).Debug("can't replay the event stream")
+			return
+		}
+	} else if err := rc.Flush(); err != nil {
+		return
+	}
+	ctx.Logger.Debug("event stream connected")
+
+	heartbeat := time.NewTicker(sseHeartbeatPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				// Hub chiuso o client troppo lento: chiude la connessione, il client si riconnetterà da dove era rimasto
+				return
+			}
+			if ev.Seq <= lastSeq {
+				// Evento già inviato durante la ripresa dello stream
+				continue
+			}
+			if err := send(ev); err != nil {
+				ctx.Logger.WithError(err).Debug("can't write to the event stream")
+				return
+			}
+			lastSeq = ev.Seq
+		case <-heartbeat.C:
+			if err := rc.SetWriteDeadline(time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			ctx.Logger.Debug("event stream disconnected")
+			return
+		}
+	}
+}
+
+// replayEvents invia tramite send gli eventi dell'utente successivi a lastSeq e restituisce il numero di sequenza
+// dell'ultimo evento inviato. Se alcuni di questi eventi non sono più disponibili invia un evento
+// events.TypeStreamReset, perché il client deve ricaricare il proprio stato
+func (rt *_router) replayEvents(r *http.Request, ctx reqcontext.RequestContext, lastSeq int64, send func(events.Event) error) (int64, error) {
+	first, last, err := rt.db.GetUserEventBounds(r.Context(), ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't load the event stream bounds")
+		return 0, err
+	}
+	if lastSeq > last || lastSeq < first-1 {
+		return last, send(events.Event{Seq: last, Type: events.TypeStreamReset})
+	}
+
+	for {
+		userEvents, err := rt.db.GetUserEventsAfter(r.Context(), ctx.UserID, lastSeq, sseReplayBatch)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("can't load the missed events")
+			return 0, err
+		}
+		for _, userEvent := range userEvents {
+			ev := events.Event{Seq: userEvent.Seq, Type: userEvent.Type, ConversationID: userEvent.ConversationID}
+			if userEvent.Payload != "" {
+				ev.Payload = json.RawMessage(userEvent.Payload)
+			}
+			if err := send(ev); err != nil {
+				return 0, err
+			}
+			lastSeq = userEvent.Seq
+		}
+		if len(userEvents) < sseReplayBatch {
+			return lastSeq, nil
+		}
+	}
+}
+
+// writeSSE scrive l'evento nel formato Server-Sent Events, usando il numero di sequenza come id
+func writeSSE(w http.ResponseWriter, ev events.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.Seq, data)
+	return err
+}
@@ -1,16 +1,20 @@
 package api
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
+	"WasaTEXT/service/imaging"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -23,39 +27,52 @@ type NewGroupName struct {
 	Name string `json:"name"`
 }
 
-// createGroup handles POST /groups/create-group
-func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	
-	// Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+type NewGroupDescription struct {
+	Description string `json:"description"`
+}
 
-	// Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
+type GroupMembersResponse struct {
+	Members []database.GroupMember `json:"members"`
+}
+
+// maxGroupDescriptionLength è la lunghezza massima (in caratteri) della descrizione di un gruppo
+const maxGroupDescriptionLength = 500
+
+// addSystemMessage registra l'evento nella cronologia del gruppo con un messaggio di sistema, che diventa l'ultimo
+// messaggio del gruppo, e ne restituisce l'id. Va chiamata nella stessa transazione che modifica il gruppo
+func addSystemMessage(ctx context.Context, tx database.AppDatabase, groupID, senderID string, payload database.SystemPayload) (string, error) {
+	messageID, err := tx.InsertSystemMessage(ctx, groupID, senderID, payload)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return "", fmt.Errorf("inserting system message: %w", err)
+	}
+	if err := tx.UpdateLastMessage(ctx, groupID, messageID); err != nil {
+		return "", fmt.Errorf("updating last message: %w", err)
 	}
+	return messageID, nil
+}
+
+// createGroup handles POST /groups/create-group
+func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
 
 	// Decodifica il body della richiesta
 	var req GroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
 		return
 	}
 
 	// Controllo se il nome del gruppo è vuoto
 	if req.Name == "" {
-		http.Error(w, "Invalid group name", http.StatusBadRequest)
+		sendValidationError(w, ctx, FieldError{Field: "name", Message: "Invalid group name"})
 		return
 	}
 
 	// Controllo se il gruppo ha almeno un membro
 	if len(req.Members) == 0 {
-		http.Error(w, "Group must have at least one member", http.StatusBadRequest)
+		sendValidationError(w, ctx, FieldError{Field: "members", Message: "Group must have at least one member"})
 		return
 	}
 
@@ -63,42 +80,54 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, _ httprou
 	var invalidMembers []string
 	for _, memberName := range req.Members {
 		
-		_, err := rt.db.GetUserByName(strings.ToLower(memberName))
-		if err != nil {
-			log.Println(err)
+		_, err := rt.db.GetUserByName(r.Context(), strings.ToLower(memberName))
+		if errors.Is(err, sql.ErrNoRows) {
+			ctx.Logger.WithError(err).Debug("group member not found")
 			invalidMembers = append(invalidMembers, strings.ToLower(memberName))
+		} else if err != nil {
+			sendInternalError(w, ctx, err, "error fetching group member")
+			return
 		}
 	}
 	if len(invalidMembers) > 0 {
-		http.Error(w, "Invalid members: "+strings.Join(invalidMembers, ", "), http.StatusBadRequest)
+		sendValidationError(w, ctx, FieldError{Field: "members", Message: "Invalid members: "+strings.Join(invalidMembers, ", ")})
 		return
 	}
 
-	// Creazione del gruppo
-	groupId, err := rt.db.CreateGroup(req.Name, userID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
-	}
+	// Creazione del gruppo insieme ai suoi membri: se un inserimento fallisce il gruppo non viene creato
+	var groupId string
+	err := rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		var err error
+		groupId, err = tx.CreateGroup(r.Context(), req.Name, userID)
+		if err != nil {
+			return err
+		}
 
-	// Aggiungo il creatore al gruppo
-	if err := rt.db.AddUserToGroup(groupId, userID); err != nil {
-		log.Println(err)
-		rt.db.DeleteConversation(groupId)
-		http.Error(w, "Error adding creator to group", http.StatusInternalServerError)
-		return
-	}
+		// Aggiungo il creatore al gruppo come proprietario
+		if err := tx.AddUserToGroup(r.Context(), groupId, userID, database.RoleOwner, ""); err != nil {
+			return fmt.Errorf("adding creator to group: %w", err)
+		}
 
-	// Aggiungo i membri al gruppo
-	for _, memberName := range req.Members {
-		memberId, _ := rt.db.GetUserByName(strings.ToLower(memberName))
-		if err := rt.db.AddUserToGroup(groupId, memberId); err != nil {
-			rt.db.DeleteConversation(groupId)
-			http.Error(w, "Error adding members to group", http.StatusInternalServerError)
-			return
+		// Aggiungo i membri al gruppo
+		for _, memberName := range req.Members {
+			memberId, err := tx.GetUserByName(r.Context(), strings.ToLower(memberName))
+			if err != nil {
+				return err
+			}
+			if err := tx.AddUserToGroup(r.Context(), groupId, memberId, database.RoleMember, userID); err != nil {
+				return fmt.Errorf("adding members to group: %w", err)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		sendInternalError(w, ctx, err, "error creating group")
+		return
 	}
 	
+	// Notifica i membri del nuovo gruppo
+	rt.publishToConversation(ctx, groupId, events.Event{Type: events.TypeConversationCreated, ConversationID: groupId})
+
 	res := ConvIDResponse{ConversationID: groupId}
 
 	// Risposta
@@ -108,55 +137,17 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, _ httprou
 }
 
 // renameGroup handles PATCH conversations/groups/change-name/:groupId
-func (rt *_router) renameGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
+func (rt *_router) renameGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Recupera il groupId dai parametri
 	groupID := ps.ByName("conversation_id")
 
-	// Controllo se il gruppo esiste
-	exist , err := rt.db.ConversationExists(groupID)
-	if err != nil {
-		http.Error(w, "Error", http.StatusNotFound)
-		return
-	}
-	if !exist {
-		http.Error(w, "Group not found", http.StatusNotFound)
-		return
-	}
-
-	// Se esiste, controllo se è un gruppo
-	isPrivate, err := rt.db.IsConversationPrivate(groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
-	}
-	if isPrivate {
-		http.Error(w, "Conversation is not a group", http.StatusBadRequest)
-		return
-	}
-
-	// Controllo se l'utente è il creatore del gruppo
-	isCreator, err := rt.db.IsUserCreatorOfGroup(userID, groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
 		return
 	}
 
-	if !isCreator {
-		http.Error(w, "Forbidden: You are not the creator of this group", http.StatusForbidden)
+	// Controllo se il ruolo dell'utente nel gruppo permette di cambiarne il nome
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionRename) {
 		return
 	}
 
@@ -164,82 +155,64 @@ func (rt *_router) renameGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	// Decodifica il body della richiesta
 	var req NewGroupName
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
 		return
 	}
 
 	// Controllo se il nome del gruppo è vuoto
 	if req.Name == "" {
-		http.Error(w, "Invalid group name", http.StatusBadRequest)
+		sendValidationError(w, ctx, FieldError{Field: "name", Message: "Invalid group name"})
 		return
 	}
 
 	// Controllo se il nome del gruppo è valido
 	if len(req.Name) < 3 || len(req.Name) > 50 {
-		http.Error(w, "Group name must be between 3 and 50 characters", http.StatusBadRequest)
+		sendValidationError(w, ctx, FieldError{Field: "name", Message: "Group name must be between 3 and 50 characters"})
 		return
 	}
 
-	// Cambio il nome del gruppo
-	err = rt.db.ChangeGroupName(groupID, req.Name)
+	// Cambio il nome del gruppo e registro il cambio nella cronologia del gruppo
+	var messageID string
+	err := rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.ChangeGroupName(r.Context(), groupID, req.Name); err != nil {
+			return err
+		}
+		var err error
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemGroupRenamed, Name: req.Name})
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error changing group name")
 		return
 	}
 
+	// Notifica i membri del gruppo
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeGroupRenamed,
+		ConversationID: groupID,
+		Payload:        map[string]string{"name": req.Name},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+
 	// Risposta
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // addToGroup handles POST conversations/groups/add-user/:groupId
-func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
 
 	// Recupera il groupId dai parametri
 	groupID := ps.ByName("conversation_id")
 
-	// Controllo se il gruppo esiste
-	exist , err := rt.db.ConversationExists(groupID)
-	if err != nil {
-		http.Error(w, "Error", http.StatusNotFound)
-		return
-	}
-	if !exist {
-		http.Error(w, "Group not found", http.StatusNotFound)
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
 		return
 	}
 
-	// Se esiste, controllo se è un gruppo
-	isPrivate, err := rt.db.IsConversationPrivate(groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
-	}
-	if isPrivate {
-		http.Error(w, "Conversation is not a group", http.StatusBadRequest)
-		return
-	}
-
-	// Controllo se l'utente è nel gruppo
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
-	}
-	if !isMember {
-		http.Error(w, "Who is trying to add, is not in the selected group", http.StatusBadRequest)
+	// Controllo se il ruolo dell'utente nel gruppo permette di aggiungere membri
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionAddMember) {
 		return
 	}
 
@@ -249,159 +222,368 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
 		return
 	}
 	lowerUsername := strings.ToLower(req.Username)
 	// Controllo se l'utente esiste nel database
-	user2ID , err := rt.db.GetUserByName(lowerUsername)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	user2ID , err := rt.db.GetUserByName(r.Context(), lowerUsername)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching user")
 		return
 	}
 
 	// Controllo se l'utente è già nel gruppo
-	isMember, err = rt.db.IsUserInConversation(user2ID, groupID)
+	isMember, err := rt.db.IsUserInConversation(r.Context(), user2ID, groupID)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error checking conversation membership")
 		return
 	}
 	if isMember {
-		http.Error(w, "User is already in the group", http.StatusBadRequest)
+		sendError(w, ctx, http.StatusConflict, CodeAlreadyMember, "User is already in the group")
 		return
 	}
 
-	// Aggiungo l'utente al gruppo
-	err = rt.db.AddUserToGroup(groupID, user2ID)
+	// Aggiungo l'utente al gruppo e registro l'ingresso nella cronologia del gruppo
+	var messageID string
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.AddUserToGroup(r.Context(), groupID, user2ID, database.RoleMember, userID); err != nil {
+			return err
+		}
+		var err error
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, userID, database.SystemPayload{Type: database.SystemMemberAdded, UserID: user2ID})
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error adding user to group")
 		return
 	}
 
+	// Notifica i membri del gruppo, compreso il nuovo membro
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeMemberAdded,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": user2ID, "added_by": userID},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+
 	// Risposta
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // leaveGroup handles DELETE conversations/groups/leave/:groupId
-func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
 
-	// Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
 		return
 	}
 
-	// Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
+	// Controllo se l'utente è nel gruppo
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, groupID)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
 		return
 	}
 
-	// Recupera il groupId dai parametri
-	groupID := ps.ByName("conversation_id")
+	// Recupera i membri prima dell'uscita, per notificare anche chi esce
+	members, err := rt.db.GetConversationMembers(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching conversation members")
+		return
+	}
 
-	// Controllo se il gruppo esiste
-	exist , err := rt.db.ConversationExists(groupID)
+	// Tolgo l'utente dal gruppo: se è il proprietario, il gruppo passa al suo successore. L'uscita e il cambio di
+	// proprietario vengono registrati nella cronologia del gruppo, che l'utente non vede più
+	var newOwnerID string
+	var messageIDs []string
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		var err error
+		newOwnerID, err = tx.LeaveGroup(r.Context(), groupID, userID)
+		if err != nil {
+			return err
+		}
+		payloads := []database.SystemPayload{{Type: database.SystemMemberLeft, UserID: userID}}
+		if newOwnerID != "" {
+			payloads = append(payloads, database.SystemPayload{Type: database.SystemOwnerChanged, UserID: newOwnerID})
+		}
+		for _, payload := range payloads {
+			messageID, err := addSystemMessage(r.Context(), tx, groupID, userID, payload)
+			if err != nil {
+				return err
+			}
+			messageIDs = append(messageIDs, messageID)
+		}
+		return nil
+	})
 	if err != nil {
-		http.Error(w, "Error", http.StatusNotFound)
+		sendInternalError(w, ctx, err, "error leaving group")
+		return
+	}
+
+	// Notifica i membri del gruppo
+	if newOwnerID != "" {
+		rt.publishToUsers(ctx, members, events.Event{
+			Type:           events.TypeOwnerChanged,
+			ConversationID: groupID,
+			Payload:        map[string]string{"user_id": newOwnerID, "previous_owner_id": userID},
+		})
+	}
+	rt.publishToUsers(ctx, members, events.Event{
+		Type:           events.TypeMemberLeft,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": userID},
+	})
+	for _, messageID := range messageIDs {
+		rt.publishSystemMessage(ctx, groupID, messageID)
+	}
+
+	// Risposta
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeMember handles DELETE conversations/group/remove/:conversation_id/members/:user_id
+func (rt *_router) removeMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera il groupId e l'ID del membro da rimuovere dai parametri
+	groupID := ps.ByName("conversation_id")
+	memberID := ps.ByName("user_id")
+
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
 		return
 	}
-	if !exist {
-		http.Error(w, "Group not found", http.StatusNotFound)
+
+	// Controllo se l'utente è nel gruppo
+	role, err := rt.db.GetGroupRole(r.Context(), groupID, ctx.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error checking group role")
 		return
 	}
 
-	// Se esiste, controllo se è un gruppo
-	isPrivate, err := rt.db.IsConversationPrivate(groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	// Controllo se il membro è nel gruppo
+	memberRole, err := rt.db.GetGroupRole(r.Context(), groupID, memberID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMemberNotFound, "User is not a member of the group")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error checking group role")
 		return
 	}
-	if isPrivate {
-		http.Error(w, "Conversation is not a group", http.StatusBadRequest)
+
+	// Il ruolo dell'utente deve permettere di rimuovere membri, e solo i membri con un ruolo inferiore
+	if !canPerform(role, actionRemoveMember) || !outranks(role, memberRole) {
+		sendError(w, ctx, http.StatusForbidden, CodeInsufficientRole, "Your role in this group does not allow removing this member")
 		return
 	}
 
-	// Controllo se l'utente è nel gruppo
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
+	// Recupera i membri prima della rimozione, per notificare anche chi viene rimosso
+	members, err := rt.db.GetConversationMembers(r.Context(), groupID)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error fetching conversation members")
 		return
 	}
-	if !isMember {
-		http.Error(w, "User is not in the group", http.StatusBadRequest)
+
+	// Tolgo il membro dal gruppo e registro la rimozione nella cronologia del gruppo
+	var messageID string
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.RemoveGroupMember(r.Context(), groupID, memberID); err != nil {
+			return err
+		}
+		var err error
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemMemberRemoved, UserID: memberID})
+		return err
+	})
+	if err != nil {
+		sendInternalError(w, ctx, err, "error removing group member")
 		return
 	}
 
-	// Controllo se l'utente è il creatore del gruppo
-	isCreator, err := rt.db.IsUserCreatorOfGroup(userID, groupID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	// Notifica i membri del gruppo
+	rt.publishToUsers(ctx, members, events.Event{
+		Type:           events.TypeMemberRemoved,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": memberID, "removed_by": ctx.UserID},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+
+	// Risposta
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// transferOwnership handles POST conversations/group/transfer-ownership/:conversation_id
+func (rt *_router) transferOwnership(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
+
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
 		return
 	}
-	if isCreator {
-		http.Error(w, "Forbidden: Creator cannot leave the group", http.StatusForbidden)
+
+	// Controllo se il ruolo dell'utente nel gruppo permette di cederne la proprietà
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionTransferOwnership) {
 		return
 	}
 
-	// Tolgo l'utente dal gruppo
-	err = rt.db.LeaveGroup(groupID, userID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	// Decodifica il body della richiesta
+	var req UsernameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+
+	// Controllo se l'utente esiste nel database
+	newOwnerID, err := rt.db.GetUserByName(r.Context(), strings.ToLower(req.Username))
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching user")
+		return
+	}
+
+	// Se l'utente è già il proprietario non c'è niente da cambiare
+	if newOwnerID == ctx.UserID {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Cedo la proprietà del gruppo e registro il cambio di proprietario nella cronologia del gruppo
+	var messageID string
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.TransferGroupOwnership(r.Context(), groupID, newOwnerID); err != nil {
+			return err
+		}
+		var err error
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemOwnerChanged, UserID: newOwnerID})
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMemberNotFound, "User is not a member of the group")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error transferring group ownership")
 		return
 	}
 
+	// Notifica i membri del gruppo
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeOwnerChanged,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": newOwnerID, "previous_owner_id": ctx.UserID},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+
 	// Risposta
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// updatePhotoGroup handles PATCH conversations/groups/update-photo/:groupId 
-func (rt *_router) updateGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-    // Recupera l'userId dal Authorization Header
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+// promoteMember handles POST conversations/group/promote/:conversation_id
+func (rt *_router) promoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, ctx, database.RoleAdmin)
+}
 
-    // Controllo se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+// demoteMember handles POST conversations/group/demote/:conversation_id
+func (rt *_router) demoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, ctx, database.RoleMember)
+}
 
-    // Recupera il groupId dai parametri
-    groupID := ps.ByName("conversation_id")
+// changeMemberRole assegna il ruolo specificato al membro del gruppo indicato nel body della richiesta. Il ruolo del
+// proprietario non può essere cambiato
+func (rt *_router) changeMemberRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext, newRole string) {
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
 
-    // Controlla se il gruppo esiste
-    exists, err := rt.db.ConversationExists(groupID)
-    if err != nil || !exists {
-        http.Error(w, "Group not found", http.StatusNotFound)
-        return
-    }
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
+		return
+	}
 
-	// Controlla se il gruppo è di tipo "group"
-	isPrivate, err := rt.db.IsConversationPrivate(groupID)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Controllo se il ruolo dell'utente nel gruppo permette di cambiare i ruoli degli altri membri
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionManageRoles) {
 		return
 	}
-	if isPrivate {
-		http.Error(w, "Group not found", http.StatusNotFound)
+
+	// Decodifica il body della richiesta
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
 		return
 	}
 
-    // Controlla se l'utente fa parte del gruppo
-	isMember, err := rt.db.IsUserInConversation(userID, groupID)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Controllo se l'utente esiste nel database
+	memberID, err := rt.db.GetUserByName(r.Context(), strings.ToLower(req.Username))
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching user")
 		return
 	}
-	if !isMember {
-		http.Error(w, "Forbidden: You are not a member of this group", http.StatusForbidden)
+
+	// Controllo se l'utente è nel gruppo e qual è il suo ruolo attuale
+	role, err := rt.db.GetGroupRole(r.Context(), groupID, memberID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMemberNotFound, "User is not a member of the group")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error checking group role")
+		return
+	}
+	if role == database.RoleOwner {
+		sendError(w, ctx, http.StatusConflict, CodeOwnerRoleFixed, "The role of the owner cannot be changed")
+		return
+	}
+
+	// Se il membro ha già il ruolo richiesto non c'è niente da cambiare
+	if role != newRole {
+		if err := rt.db.SetGroupRole(r.Context(), groupID, memberID, newRole); err != nil {
+			sendInternalError(w, ctx, err, "error changing group role")
+			return
+		}
+
+		// Notifica i membri del gruppo
+		rt.publishToConversation(ctx, groupID, events.Event{
+			Type:           events.TypeMemberRoleChanged,
+			ConversationID: groupID,
+			Payload:        map[string]string{"user_id": memberID, "role": newRole, "changed_by": ctx.UserID},
+		})
+	}
+
+	// Risposta
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updatePhotoGroup handles PATCH conversations/groups/update-photo/:groupId 
+func (rt *_router) updateGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera il groupId dai parametri
+    groupID := ps.ByName("conversation_id")
+
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
+		return
+	}
+
+    // Controlla se il ruolo dell'utente nel gruppo permette di cambiarne la foto
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionChangePhoto) {
 		return
 	}
 
@@ -409,119 +591,225 @@ func (rt *_router) updateGroupPhoto(w http.ResponseWriter, r *http.Request, ps h
     var req struct {
         PhotoBase64 string `json:"photo"`
     }
+    r.Body = http.MaxBytesReader(w, r.Body, maxPhotoRequestSize)
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            sendError(w, ctx, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Photo too large")
+            return
+        }
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che la foto non sia vuota
     if req.PhotoBase64 == "" {
-        http.Error(w, "Photo cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "photo", Message: "Photo cannot be empty"})
         return
     }
 
-	// Rimuovi l'intestazione "data:image/png;base64," o "data:image/jpeg;base64,"
-    photoData := strings.TrimPrefix(req.PhotoBase64, "data:image/png;base64,")
-    photoData = strings.TrimPrefix(photoData, "data:image/jpeg;base64,")
-
-    // Decodifica l'immagine Base64
-    decodedPhoto, err := base64.StdEncoding.DecodeString(photoData)
+    // Decodifica l'immagine Base64, eventualmente inviata come data URL
+    decodedPhoto, err := decodePhoto(req.PhotoBase64)
     if err != nil {
-        http.Error(w, "Invalid Base64 string", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "photo", Message: "Invalid base64 encoding"})
         return
     }
 
-    // Percorso per la directory e il file
-	dirPath := "service/uploads/groups/"
-	filePath := fmt.Sprintf("%s%s_photo.png", dirPath, groupID)
-
-	// Assicurati che la directory esista
-	err = os.MkdirAll(dirPath, os.ModePerm)
-	if err != nil {
-		log.Println("Failed to create directory:", err)
-		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+	// Verifica l'immagine e la salva nello storage insieme alle versioni ridotte
+	photoKey, err := rt.savePhoto(r.Context(), decodedPhoto)
+	if errors.Is(err, imaging.ErrNotImage) {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidPhoto, "Photo must be a PNG, JPEG or GIF image")
 		return
-	}
-
-	// Salva l'immagine nel file
-	err = os.WriteFile(filePath, decodedPhoto, 0644)
-	if err != nil {
-		log.Println("Failed to save image:", err)
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+	} else if errors.Is(err, imaging.ErrTooLarge) {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidPhoto, "Photo dimensions too large")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "failed to save image")
 		return
 	}
 
 
-    // Aggiorna il percorso della foto nel database
-    err = rt.db.UpdateGroupPhoto(groupID, filePath)
+    // Aggiorna la chiave della foto nel database e registra il cambio nella cronologia del gruppo
+    var messageID string
+    err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+        if err := tx.UpdateGroupPhoto(r.Context(), groupID, photoKey); err != nil {
+            return err
+        }
+        var err error
+        messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemGroupPhotoUpdated})
+        return err
+    })
     if err != nil {
-        http.Error(w, "Internal error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error updating group photo")
         return
     }
 
+    // Notifica i membri del gruppo
+    rt.publishToConversation(ctx, groupID, events.Event{
+        Type:           events.TypeGroupPhotoUpdated,
+        ConversationID: groupID,
+        Payload:        map[string]string{"photo": database.GroupPhotoURL(groupID, photoKey)},
+    })
+    rt.publishSystemMessage(ctx, groupID, messageID)
+
     // Rispondi con successo
     w.WriteHeader(http.StatusNoContent)
 }
 
 // getGroupPhoto handles GET conversations/groups/photo/:conversation_id
-func (rt *_router) getGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+func (rt *_router) getGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
 
     // Recupera l'ID della conversazione
     conversationID := ps.ByName("conversation_id")
 
-
-    // Verifica che la conversazione esista e sia di tipo "group"
-	isPrivate, err := rt.db.IsConversationPrivate(conversationID)
+	// Recupera la dimensione richiesta
+	size, err := parsePhotoSize(r)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		sendValidationError(w, ctx, FieldError{Field: "size", Message: "Invalid photo size"})
 		return
 	}
-	if isPrivate {
-		http.Error(w, "Group not found", http.StatusNotFound)
+
+
+	// Verifica che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, conversationID) {
 		return
 	}
 
 	// Verifica che l'utente faccia parte del gruppo
-	isMember, err := rt.db.IsUserInConversation(userID, conversationID)
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, conversationID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		sendInternalError(w, ctx, err, "error checking conversation membership")
 		return
 	}
 	if !isMember {
-		http.Error(w, "Forbidden: You are not a member of this group", http.StatusForbidden)
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
 		return
 	}
 
 	// Recupera il percorso della foto dal database
-	photoPath, err := rt.db.GetGroupPhotoByID(conversationID)
+	photoPath, err := rt.db.GetGroupPhotoByID(r.Context(), conversationID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Group not found or photo not set", http.StatusNotFound)
+			sendError(w, ctx, http.StatusNotFound, CodePhotoNotFound, "Group not found or photo not set")
 			return
 		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			sendInternalError(w, ctx, err, "error fetching group photo")
 			return
 		}
 	}
 
-    // Usa una foto predefinita se il campo photo è NULL o vuoto
-	if photoPath == "" {
-		photoPath = "service/uploads/default_user_photo.jpg"
+    // Serve il file immagine (la foto predefinita se il campo photo è NULL o vuoto)
+	if err := rt.servePhoto(w, r, photoPath, size, "private"); err != nil {
+		sendInternalError(w, ctx, err, "failed to read group photo")
+	}
+}
+
+// getGroupMembers handles GET conversations/group/members/:conversation_id
+func (rt *_router) getGroupMembers(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
+
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
+		return
+	}
+
+	// Solo i membri del gruppo possono vederne i membri
+	isMember, err := rt.db.IsUserInConversation(r.Context(), ctx.UserID, groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
+		return
+	}
+
+	// Recupera i membri del gruppo
+	members, err := rt.db.GetGroupMembers(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching group members")
+		return
+	}
+
+	// Invia i membri come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupMembersResponse{Members: members})
+}
+
+// getGroupProfile handles GET conversations/group/profile/:conversation_id
+func (rt *_router) getGroupProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
+
+	// Recupera il profilo del gruppo (sql.ErrNoRows se il gruppo non esiste o la conversazione è privata)
+	profile, err := rt.db.GetGroupProfile(r.Context(), groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeGroupNotFound, "Group not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching group profile")
+		return
+	}
+
+	// Solo i membri del gruppo possono vederne il profilo
+	isMember, err := rt.db.IsUserInConversation(r.Context(), ctx.UserID, groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
+		return
+	}
+
+	// Invia il profilo come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// changeGroupDescription handles PATCH conversations/group/change-description/:conversation_id
+func (rt *_router) changeGroupDescription(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera il groupId dai parametri
+	groupID := ps.ByName("conversation_id")
+
+	// Controllo che la conversazione esista e sia un gruppo
+	if !rt.requireGroup(w, r, ctx, groupID) {
+		return
+	}
+
+	// Controllo se il ruolo dell'utente nel gruppo permette di cambiarne le impostazioni
+	if !rt.requireGroupPermission(w, r, ctx, groupID, actionEditSettings) {
+		return
 	}
 
-    // Serve il file immagine
-    http.ServeFile(w, r, photoPath)
+	// Decodifica il body della richiesta; una descrizione vuota rimuove quella attuale
+	var req NewGroupDescription
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if utf8.RuneCountInString(req.Description) > maxGroupDescriptionLength {
+		sendValidationError(w, ctx, FieldError{Field: "description", Message: "Group description must be at most "+strconv.Itoa(maxGroupDescriptionLength)+" characters"})
+		return
+	}
+
+	// Cambio la descrizione del gruppo
+	if err := rt.db.ChangeGroupDescription(r.Context(), groupID, req.Description); err != nil {
+		sendInternalError(w, ctx, err, "error changing group description")
+		return
+	}
+
+	// Notifica i membri del gruppo
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeGroupDescription,
+		ConversationID: groupID,
+		Payload:        map[string]string{"description": req.Description},
+	})
+
+	// Risposta
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,266 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
+	"WasaTEXT/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Stati della risposta a POST /invites/:token/join
+const (
+	joinStatusJoined  = "joined"
+	joinStatusPending = "pending"
+)
+
+type NewInviteRequest struct {
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxUses          *int       `json:"max_uses,omitempty"`
+	RequiresApproval bool       `json:"requires_approval"`
+}
+
+type GroupInvitesResponse struct {
+	Invites []database.GroupInvite `json:"invites"`
+}
+
+type JoinRequestsResponse struct {
+	Requests []database.JoinRequest `json:"requests"`
+}
+
+type JoinGroupResponse struct {
+	ConversationID string `json:"conversation_id"`
+	Status         string `json:"status"`
+}
+
+// createInvite handles POST /conversations/group/create-invite/:conversation_id
+func (rt *_router) createInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	// Decodifica il body della richiesta: senza scadenza né limite di utilizzi l'invito resta valido fino alla revoca
+	var req NewInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+	var invite database.NewGroupInvite
+	var invalid []FieldError
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(globaltime.Now()) {
+			invalid = append(invalid, FieldError{Field: "expires_at", Message: "Expiry must be in the future"})
+		}
+		invite.ExpiresAt = *req.ExpiresAt
+	}
+	if req.MaxUses != nil {
+		if *req.MaxUses < 1 {
+			invalid = append(invalid, FieldError{Field: "max_uses", Message: "Max uses must be at least 1"})
+		}
+		invite.MaxUses = *req.MaxUses
+	}
+	if len(invalid) > 0 {
+		sendValidationError(w, ctx, invalid...)
+		return
+	}
+	invite.RequiresApproval = req.RequiresApproval
+
+	created, err := rt.db.CreateGroupInvite(r.Context(), groupID, ctx.UserID, invite)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error creating group invite")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// getInvites handles GET /conversations/group/invites/:conversation_id
+func (rt *_router) getInvites(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	invites, err := rt.db.GetGroupInvites(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching group invites")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupInvitesResponse{Invites: invites})
+}
+
+// revokeInvite handles DELETE /conversations/group/revoke-invite/:conversation_id/invites/:token
+func (rt *_router) revokeInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	err := rt.db.RevokeGroupInvite(r.Context(), groupID, ps.ByName("token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeInviteNotFound, "Invite not found in this group")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error revoking group invite")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// joinWithInvite handles POST /invites/:token/join
+func (rt *_router) joinWithInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	token := ps.ByName("token")
+	invite, err := rt.db.GetGroupInvite(r.Context(), token)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeInviteNotFound, "Invite not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching group invite")
+		return
+	}
+	groupID := invite.ConversationID
+
+	isMember, err := rt.db.IsUserInConversation(r.Context(), ctx.UserID, groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if isMember {
+		sendError(w, ctx, http.StatusConflict, CodeAlreadyMember, "You are already a member of this group")
+		return
+	}
+
+	// L'invito viene controllato di nuovo nella transazione che lo usa, perché potrebbe essere stato revocato o
+	// esaurito nel frattempo. L'ingresso diretto viene registrato nella cronologia del gruppo
+	var pending bool
+	var messageID string
+	err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		var err error
+		pending, err = tx.JoinGroupWithInvite(r.Context(), token, ctx.UserID)
+		if err != nil || pending {
+			return err
+		}
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemMemberAdded, UserID: ctx.UserID})
+		return err
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		sendError(w, ctx, http.StatusNotFound, CodeInviteNotFound, "Invite not found")
+		return
+	case errors.Is(err, database.ErrInviteExpired):
+		sendError(w, ctx, http.StatusGone, CodeInviteExpired, "The invite has expired")
+		return
+	case errors.Is(err, database.ErrInviteExhausted):
+		sendError(w, ctx, http.StatusGone, CodeInviteExhausted, "The invite has reached its maximum number of uses")
+		return
+	case err != nil:
+		sendInternalError(w, ctx, err, "error joining group with invite")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if pending {
+		// Notifica gli amministratori, che devono approvare la richiesta
+		rt.publishToGroupAdmins(ctx, groupID, events.Event{
+			Type:           events.TypeJoinRequested,
+			ConversationID: groupID,
+			Payload:        map[string]string{"user_id": ctx.UserID},
+		})
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(JoinGroupResponse{ConversationID: groupID, Status: joinStatusPending})
+		return
+	}
+
+	// Notifica i membri del gruppo, compreso il nuovo membro
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeMemberAdded,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": ctx.UserID, "added_by": invite.CreatedBy},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+	json.NewEncoder(w).Encode(JoinGroupResponse{ConversationID: groupID, Status: joinStatusJoined})
+}
+
+// getJoinRequests handles GET /conversations/group/join-requests/:conversation_id
+func (rt *_router) getJoinRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	requests, err := rt.db.GetJoinRequests(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching join requests")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JoinRequestsResponse{Requests: requests})
+}
+
+// approveJoinRequest handles POST /conversations/group/approve-request/:conversation_id/requests/:user_id
+func (rt *_router) approveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	userID := ps.ByName("user_id")
+	var messageID string
+	err := rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+		if err := tx.ApproveJoinRequest(r.Context(), groupID, userID, ctx.UserID); err != nil {
+			return err
+		}
+		var err error
+		messageID, err = addSystemMessage(r.Context(), tx, groupID, ctx.UserID, database.SystemPayload{Type: database.SystemMemberAdded, UserID: userID})
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeJoinRequestNotFound, "No pending join request from this user")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error approving join request")
+		return
+	}
+
+	// Notifica i membri del gruppo, compreso il nuovo membro
+	rt.publishToConversation(ctx, groupID, events.Event{
+		Type:           events.TypeMemberAdded,
+		ConversationID: groupID,
+		Payload:        map[string]string{"user_id": userID, "added_by": ctx.UserID},
+	})
+	rt.publishSystemMessage(ctx, groupID, messageID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectJoinRequest handles DELETE /conversations/group/reject-request/:conversation_id/requests/:user_id
+func (rt *_router) rejectJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	groupID := ps.ByName("conversation_id")
+	if !rt.requireGroup(w, r, ctx, groupID) || !rt.requireGroupPermission(w, r, ctx, groupID, actionManageInvites) {
+		return
+	}
+
+	err := rt.db.RejectJoinRequest(r.Context(), groupID, ps.ByName("user_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeJoinRequestNotFound, "No pending join request from this user")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error rejecting join request")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,10 +1,13 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
+	"WasaTEXT/service/api/reqcontext"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -14,48 +17,80 @@ type LoginRequest struct {
 
 type LoginResponse struct {
     Identifier string `json:"user_id"`
+    Token      string `json:"token"`
 }
 
 
 // doLogin handles POST /session
-func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
 
     // Decodifica il corpo della richiesta
     var req LoginRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request", http.StatusBadRequest)
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che il campo Name non sia vuoto
     if req.Name == "" {
-        http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "username", Message: "Name cannot be empty"})
         return
     }
 
     // Verifica che il nome sia tra 3 e 50 caratteri
     if len(req.Name) < 3 || len(req.Name) > 50 {
-        http.Error(w, "Name must be between 3 and 50 characters", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "username", Message: "Name must be between 3 and 50 characters"})
         return
     }
 
     lowername := strings.ToLower(req.Name)
     // Controlla se l'utente esiste nel database
-    id, err := rt.db.GetUserByName(lowername)
-    if err != nil {
+    id, err := rt.db.GetUserByName(r.Context(), lowername)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        sendInternalError(w, ctx, err, "error fetching user")
+        return
+    } else if err != nil {
 
         // Se l'utente non esiste, crea un nuovo utente
-        id, err = rt.db.CreateUser(lowername)
+        id, err = rt.db.CreateUser(r.Context(), lowername)
         if err != nil {
 
             // Se c'è un errore nella creazione dell'utente, ritorna errore
-            http.Error(w, "Error creating user", http.StatusInternalServerError)
+            sendInternalError(w, ctx, err, "error creating user")
             return
         }
     }
-    
-    // Invia l'ID dell'utente come risposta
-    res := LoginResponse{Identifier: id}
+
+
+    // Crea una nuova sessione per l'utente
+    token, err := rt.db.CreateSession(r.Context(), id)
+    if err != nil {
+        sendInternalError(w, ctx, err, "error creating session")
+        return
+    }
+
+    // Invia l'ID dell'utente e il token di sessione come risposta
+    res := LoginResponse{Identifier: id, Token: token}
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(res)
 }
+
+// doLogout handles DELETE /session
+func (rt *_router) doLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+
+    // Recupera il token dall'header Authorization
+    token, err := bearerToken(r)
+    if err != nil {
+        sendError(w, ctx, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid session token")
+        return
+    }
+
+    // Revoca la sessione
+    if err := rt.db.DeleteSession(r.Context(), token); err != nil {
+        sendInternalError(w, ctx, err, "error deleting session")
+        return
+    }
+
+    // Invia una risposta vuota
+    w.WriteHeader(http.StatusNoContent)
+}
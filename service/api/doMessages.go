@@ -4,15 +4,21 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"unicode/utf8"
 
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
 	"github.com/julienschmidt/httprouter"
 )
 
 type MessageRequest struct {
-    Text string `json:"content"`
+    Text    string `json:"content"`
+    ReplyTo string `json:"reply_to,omitempty"`
 }
 
 type ConversationsRequest struct {
@@ -23,88 +29,120 @@ type ReactionRequest struct {
     Reaction string `json:"emoji"`
 }
 
+type MessagesResponse struct {
+    Messages   []database.Message `json:"messages"`
+    NextCursor string             `json:"next_cursor,omitempty"`
+}
+
 // postMessage handles POST /conversations/:conversation_id/send-message
-func (rt *_router) postMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) postMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 
-    // Recupera l'userID dall'header Authorization
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID della conversazione dal parametro URL
     convID := ps.ByName("conversation_id")
     if convID == "" {
-        http.Error(w, "Conversation ID cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "conversation_id", Message: "Conversation ID cannot be empty"})
         return
     }
 
     // Verifica che la conversazione esista
-    exist, err := rt.db.ConversationExists(convID)
+    exist, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica se l'utente è un membro della conversazione
-    isMember, err := rt.db.IsUserInConversation(userID, convID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+        return
+    }
+
+    // Decodifica il body della richiesta: JSON per i soli messaggi di testo, multipart/form-data per quelli con allegati
+    var req MessageRequest
+    var files []*multipart.FileHeader
+    if isMultipart(r) {
+        req, files, err = parseMessageForm(w, r)
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            sendError(w, ctx, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Request body too large")
+            return
+        } else if errors.Is(err, errTooManyAttachments) {
+            sendError(w, ctx, http.StatusBadRequest, CodeTooManyAttachments, "Too many attachments")
+            return
+        } else if err != nil {
+            sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+            return
+        }
+    } else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
-    // Decodifica il body della richiesta
-    var req struct {
-        Text string `json:"content"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    // Controlla che il messaggio abbia un testo o almeno un allegato
+    if req.Text == "" && len(files) == 0 {
+        sendValidationError(w, ctx, FieldError{Field: "content", Message: "Message content cannot be empty"})
         return
     }
 
-    // Controlla che il testo del messaggio non sia vuoto
-    if req.Text == "" {
-        http.Error(w, "Message content cannot be empty", http.StatusBadRequest)
-        return
+    // Se il messaggio è una risposta, verifica che il messaggio citato esista nella stessa conversazione
+    if req.ReplyTo != "" {
+        quoted, err := rt.db.GetMessageFromID(r.Context(), req.ReplyTo)
+        if errors.Is(err, sql.ErrNoRows) || (err == nil && quoted.ConversationID != convID) {
+            sendValidationError(w, ctx, FieldError{Field: "reply_to", Message: "Replied message not found in this conversation"})
+            return
+        } else if err != nil {
+            sendInternalError(w, ctx, err, "error fetching replied message")
+            return
+        }
     }
 
-    // Inserisce il messaggio nel database
-    messageID, err := rt.db.InsertMessage(convID, userID, req.Text)
+    // Salva i file allegati
+    attachments, err := rt.saveAttachments(r.Context(), files)
     if err != nil {
-        http.Error(w, "Error inserting message", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error saving attachments")
         return
     }
 
-    // Aggiorna l'ultimo messaggio della conversazione
-    if err := rt.db.UpdateLastMessage(convID, messageID); err != nil {
-        log.Println(err)
-        http.Error(w, "Error updating last message", http.StatusInternalServerError)
+    // Inserisce il messaggio nel database e aggiorna l'ultimo messaggio della conversazione in una sola transazione
+    var messageID string
+    err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+        var err error
+        messageID, err = tx.InsertMessage(r.Context(), convID, userID, req.Text, req.ReplyTo, attachments)
+        if err != nil {
+            return err
+        }
+        if err := tx.UpdateLastMessage(r.Context(), convID, messageID); err != nil {
+            return fmt.Errorf("updating last message: %w", err)
+        }
+        return nil
+    })
+    if err != nil {
+        sendInternalError(w, ctx, err, "error inserting message")
         return
     }
 
     // Recupera il messaggio completo dal database
-    messageResponse, err := rt.db.GetMessageFromID(messageID)
+    messageResponse, err := rt.db.GetMessageFromID(r.Context(), messageID)
     if err != nil {
-        http.Error(w, "Error fetching message", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error fetching message")
         return
     }
 
+    // Notifica i membri della conversazione
+    rt.publishToConversation(ctx, convID, events.Event{Type: events.TypeMessageCreated, ConversationID: convID, Payload: messageResponse})
+
     // Invia il messaggio come risposta
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
@@ -112,20 +150,9 @@ func (rt *_router) postMessage(w http.ResponseWriter, r *http.Request, ps httpro
 }
 
 // deleteMessage handles DELETE /conversations/:conversation_id/messages/:message_id
-func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-    // Recupera il creatorId dall'header Authorization
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
 
     // Recupera l'ID del messaggio dalla richiesta
@@ -135,97 +162,107 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
     convID := ps.ByName("conversation_id")
 
     // Verifica che la conversazione esista
-    exist, err := rt.db.ConversationExists(convID)
+    exist, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente appartenga alla conversazione 
-    isMember, err := rt.db.IsUserInConversation(userID, convID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
         return
     }
 
     // Verifica che il messaggio esista
-    message, err := rt.db.GetMessageFromID(messageID)
-    log.Println("DEBUG: message->", message)
-    log.Println("DEBUG: message.SenderID->", message.SenderID)
-    log.Println("DEBUG: err->", err)
+    message, err := rt.db.GetMessageFromID(r.Context(), messageID)
     if err != nil {
         // Se il messaggio non esiste restituisce 404
         if errors.Is(err, sql.ErrNoRows) {
-        http.Error(w, "Message not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
     } else {
 
         // Altrimenti restituisce un errore interno del server
-        http.Error(w, "Error fetching message", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error fetching message")
     }
         return
     }
 
     // Verifica che il messaggio appartenga alla conversazione
     if message.ConversationID != convID {
-        http.Error(w, "Forbidden: Message does not belong to this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
         return
     }
 
-    // Verifica che l'utente sia il mittente del messaggio
+    // Verifica che l'utente sia il mittente del messaggio: nei gruppi i ruoli che lo permettono possono eliminare
+    // anche i messaggi degli altri membri
     if message.SenderID != userID {
-        http.Error(w, "Forbidden: You are not the sender of this message", http.StatusForbidden)
-        return
+        isPrivate, err := rt.db.IsConversationPrivate(r.Context(), convID)
+        if err != nil {
+            sendInternalError(w, ctx, err, "error checking conversation type")
+            return
+        }
+        if isPrivate {
+            sendError(w, ctx, http.StatusForbidden, CodeNotSender, "You are not the sender of this message")
+            return
+        }
+        role, err := rt.db.GetGroupRole(r.Context(), convID, userID)
+        if err != nil {
+            sendInternalError(w, ctx, err, "error checking group role")
+            return
+        }
+        if !canPerform(role, actionDeleteOthersMessages) {
+            sendError(w, ctx, http.StatusForbidden, CodeNotSender, "You are not the sender of this message")
+            return
+        }
     }
 
-    // Cancella il messaggio dal database
-    if err := rt.db.DeleteMessage(messageID); err != nil {
-        http.Error(w, "Error deleting message", http.StatusInternalServerError)
-        return
-    }
+    err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+        // Cancella il messaggio dal database
+        if err := tx.DeleteMessage(r.Context(), messageID); err != nil {
+            return err
+        }
 
-    // Trova il nuovo ultimo messaggio della conversazione
-    newLastMessageID, err := rt.db.GetLastMessageID(message.ConversationID)
+        // Trova il nuovo ultimo messaggio della conversazione e aggiorna il lastMessageId della conversazione
+        newLastMessageID, err := tx.GetLastMessageID(r.Context(), message.ConversationID)
+        if err != nil {
+            return fmt.Errorf("retrieving last message: %w", err)
+        }
+        if err := tx.UpdateLastMessage(r.Context(), message.ConversationID, newLastMessageID); err != nil {
+            return fmt.Errorf("updating last message: %w", err)
+        }
+        return nil
+    })
     if err != nil {
-        log.Println("Error retrieving last message:", err)
-        http.Error(w, "Error updating last message", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error deleting message")
         return
     }
 
-    // Aggiorna il lastMessageId della conversazione
-    if err := rt.db.UpdateLastMessage(message.ConversationID, newLastMessageID); err != nil {
-        log.Println("Error updating conversation last message:", err)
-        http.Error(w, "Error updating last message", http.StatusInternalServerError)
-        return
-    }
+    // Notifica i membri della conversazione
+    rt.publishToConversation(ctx, convID, events.Event{
+        Type:           events.TypeMessageDeleted,
+        ConversationID: convID,
+        Payload:        map[string]string{"message_id": messageID},
+    })
 
     // Invia una risposta vuota
     w.WriteHeader(http.StatusNoContent)
 }
 
 // postMessage handles POST /conversations/:conversation_id/messages/:message_id
-func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
     
-    // Recupera il creatorId dall'header Authorization
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID del messaggio dalla richiesta
     messageID := ps.ByName("message_id")
@@ -234,120 +271,130 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
     convID := ps.ByName("conversation_id")
 
     // Verifica che la conversazione esista
-    exist, err := rt.db.ConversationExists(convID)
+    exist, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente sia un membro della conversazione
-    isMember, err := rt.db.IsUserInConversation(userID, convID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
         return
     }
 
     // Verifica che il messaggio esista
-    message, err := rt.db.GetMessageFromID(messageID)
+    message, err := rt.db.GetMessageFromID(r.Context(), messageID)
     if err != nil {
         if errors.Is(err, sql.ErrNoRows) {
-            http.Error(w, "Message not found", http.StatusNotFound)
+            sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
         } else {
-            http.Error(w, "Error fetching message", http.StatusInternalServerError)
+            sendInternalError(w, ctx, err, "error fetching message")
         }
         return
     }
 
     // Verifica che il messaggio appartenga alla conversazione
     if message.ConversationID != convID {
-        http.Error(w, "Forbidden: Message does not belong to this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
+        return
+    }
+
+    // I messaggi di sistema non possono essere inoltrati
+    if message.Kind == database.MessageKindSystem {
+        sendError(w, ctx, http.StatusForbidden, CodeSystemMessage, "System messages cannot be forwarded")
         return
     }
 
     // Lettura del body della richiesta
     var req ConversationsRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che il campo Id non sia vuoto
     if req.ID == "" {
-        http.Error(w, "Destination conversation ID cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "conversation_id", Message: "Destination conversation ID cannot be empty"})
         return
     }
 
     // Verifica che la conversazione esista
-    exist, err = rt.db.ConversationExists(req.ID)
+    exist, err = rt.db.ConversationExists(r.Context(), req.ID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente sia un membro della conversazione di destinazione
-    isMember, err = rt.db.IsUserInConversation(userID, req.ID)
+    isMember, err = rt.db.IsUserInConversation(r.Context(), userID, req.ID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of the target conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of the target conversation")
         return
     }
 
-    // Inserisce il messaggio nel database
-    newMessageID, err := rt.db.InsertMessage(req.ID, userID, message.Content)
-    if err != nil {
-        http.Error(w, "Error inserting message", http.StatusInternalServerError)
-        return
-    }
+    var newMessageID string
+    err = rt.db.WithTx(r.Context(), func(tx database.AppDatabase) error {
+        // Inserisce il messaggio nel database
+        var err error
+        newMessageID, err = tx.InsertMessage(r.Context(), req.ID, userID, message.Content, "", nil)
+        if err != nil {
+            return err
+        }
+
+        // Allega al nuovo messaggio gli stessi file del messaggio inoltrato
+        if err := tx.CopyAttachments(r.Context(), messageID, newMessageID); err != nil {
+            return fmt.Errorf("copying attachments: %w", err)
+        }
 
-    // Aggiorna l'ultimo messaggio della conversazione
-    if err := rt.db.UpdateLastMessage(req.ID, newMessageID); err != nil {
-        log.Println(err)
-        http.Error(w, "Error updating last message", http.StatusInternalServerError)
+        // Aggiorna l'ultimo messaggio della conversazione
+        if err := tx.UpdateLastMessage(r.Context(), req.ID, newMessageID); err != nil {
+            return fmt.Errorf("updating last message: %w", err)
+        }
+        return nil
+    })
+    if err != nil {
+        sendInternalError(w, ctx, err, "error forwarding message")
         return
     }
 
     // Recupera il messaggio completo dal database
-    messageResponse, err := rt.db.GetMessageFromID(newMessageID)
+    messageResponse, err := rt.db.GetMessageFromID(r.Context(), newMessageID)
     if err != nil {
-        http.Error(w, "Error fetching message", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error fetching message")
         return
     }
 
+    // Notifica i membri della conversazione di destinazione
+    rt.publishToConversation(ctx, req.ID, events.Event{Type: events.TypeMessageCreated, ConversationID: req.ID, Payload: messageResponse})
+
     // Invia il messaggio come risposta
     w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(messageResponse)
 }
 
 // commentMessage handles POST /conversations/:conversation_id/messages/:message_id/reaction
-func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-    // Recupera il creatorId dall'header Authorization
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID del messaggio dalla richiesta
     messageID := ps.ByName("message_id")
@@ -356,82 +403,84 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
     convID := ps.ByName("conversation_id")
 
     // Verifica che la conversazione esista
-    exist, err := rt.db.ConversationExists(convID)
+    exist, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente sia un membro della conversazione associata al messaggio
-    isMember, err := rt.db.IsUserInConversation(userID, convID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of the message's conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of the message's conversation")
         return
     }
 
     // Verifica che il messaggio esista
-    message, err := rt.db.GetMessageFromID(messageID)
+    message, err := rt.db.GetMessageFromID(r.Context(), messageID)
     if err != nil {
         if errors.Is(err, sql.ErrNoRows) {
-            http.Error(w, "Message not found", http.StatusNotFound)
+            sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
         } else {
-            http.Error(w, "Error fetching message", http.StatusInternalServerError)
+            sendInternalError(w, ctx, err, "error fetching message")
         }
         return
     }
 
     // Verifica che il messaggio appartenga alla conversazione
     if message.ConversationID != convID {
-        http.Error(w, "Forbidden: Message does not belong to this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
+        return
+    }
+
+    // I messaggi di sistema non possono ricevere reazioni
+    if message.Kind == database.MessageKindSystem {
+        sendError(w, ctx, http.StatusForbidden, CodeSystemMessage, "System messages cannot receive reactions")
         return
     }
 
     // Lettura del body della richiesta
     var req ReactionRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che il campo reaction sia un emoji
     if !isSingleEmoji(req.Reaction) {
-        http.Error(w, "Invalid reaction: must be an emoji and not a combination of emojis", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "emoji", Message: "Invalid reaction: must be an emoji and not a combination of emojis"})
+        return
     }
-    
 
     // Inserisci la reazione nel database associando a userID e messageID
-    if err := rt.db.InsertReaction(userID, messageID, req.Reaction); err != nil {
-        http.Error(w, "Error inserting reaction", http.StatusInternalServerError)
+    if err := rt.db.InsertReaction(r.Context(), userID, messageID, req.Reaction); err != nil {
+        sendInternalError(w, ctx, err, "error inserting reaction")
         return
     }
 
+    // Notifica i membri della conversazione
+    rt.publishToConversation(ctx, convID, events.Event{
+        Type:           events.TypeReactionAdded,
+        ConversationID: convID,
+        Payload:        map[string]string{"message_id": messageID, "user_id": userID, "reaction": req.Reaction},
+    })
+
     // Invia una risposta vuota
     w.WriteHeader(http.StatusNoContent)
 }
 
 // unCommentMessage handles DELETE /conversations/:conversation_id/messages/:message_id/reaction
-func (rt *_router) unCommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-    // Recupera l'userID dall'header Authorization
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controlla se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+func (rt *_router) unCommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID del messaggio dalla richiesta
     messageID := ps.ByName("message_id")
@@ -440,116 +489,143 @@ func (rt *_router) unCommentMessage(w http.ResponseWriter, r *http.Request, ps h
     convID := ps.ByName("conversation_id")
 
     // Verifica che la conversazione esista
-    exist, err := rt.db.ConversationExists(convID)
+    exist, err := rt.db.ConversationExists(r.Context(), convID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exist {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente sia un membro della conversazione associata al messaggio
-    isMember, err := rt.db.IsUserInConversation(userID, convID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of the message's conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of the message's conversation")
         return
     }
 
     // Verifica che il messaggio esista
-    message, err := rt.db.GetMessageFromID(messageID)
+    message, err := rt.db.GetMessageFromID(r.Context(), messageID)
     if err != nil {
         if errors.Is(err, sql.ErrNoRows) {
-            http.Error(w, "Message not found", http.StatusNotFound)
+            sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
         } else {
-            http.Error(w, "Error fetching message", http.StatusInternalServerError)
+            sendInternalError(w, ctx, err, "error fetching message")
         }
         return
     }
 
     // Verifica che il messaggio appartenga alla conversazione
     if message.ConversationID != convID {
-        http.Error(w, "Forbidden: Message does not belong to this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
         return
     }
 
     // Controlla se l'utente ha già reagito al messaggio
-    hasReaction, err := rt.db.UserHasReaction(messageID, userID)
+    hasReaction, err := rt.db.UserHasReaction(r.Context(), messageID, userID)
     if err != nil {
-        http.Error(w, "Error checking reaction", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking reaction")
         return
     }
     if !hasReaction {
-        http.Error(w, "Reaction not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeReactionNotFound, "Reaction not found")
         return
     }
 
     // Elimina la reazione dal database
-    if err := rt.db.DeleteReaction(messageID, userID); err != nil {
-        http.Error(w, "Error deleting reaction", http.StatusInternalServerError)
+    if err := rt.db.DeleteReaction(r.Context(), messageID, userID); err != nil {
+        sendInternalError(w, ctx, err, "error deleting reaction")
         return
     }
 
+    // Notifica i membri della conversazione
+    rt.publishToConversation(ctx, convID, events.Event{
+        Type:           events.TypeReactionRemoved,
+        ConversationID: convID,
+        Payload:        map[string]string{"message_id": messageID, "user_id": userID},
+    })
+
     // Invia una risposta vuota
     w.WriteHeader(http.StatusNoContent)
 }
 
-// Handler per GET /conversations/{convId}/messages
-func (rt *_router) getMessagesFromConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-    // Recupera l'userID dall'header Authorization
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Verifica che l'utente esista nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+// Handler per GET /conversations/messages/:conversation_id?before=&after=&limit=
+func (rt *_router) getMessagesFromConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Recupera l'ID della conversazione dalla richiesta
     conversationID := ps.ByName("conversation_id")
 
     // Verifica che la conversazione esista
-    exists, err := rt.db.ConversationExists(conversationID)
+    exists, err := rt.db.ConversationExists(r.Context(), conversationID)
     if err != nil {
-        http.Error(w, "Error checking conversation existence", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation existence")
         return
     }
     if !exists {
-        http.Error(w, "Conversation not found", http.StatusNotFound)
+        sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
         return
     }
 
     // Verifica che l'utente sia un membro della conversazione
-    isMember, err := rt.db.IsUserInConversation(userID, conversationID)
+    isMember, err := rt.db.IsUserInConversation(r.Context(), userID, conversationID)
     if err != nil {
-        http.Error(w, "Error checking conversation membership", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error checking conversation membership")
         return
     }
     if !isMember {
-        http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+        sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
         return
     }
 
-    // Recupera tutti i messaggi della conversazione
-    messages, err := rt.db.GetMessagesFromConversation(conversationID)
-    if err != nil {
-        http.Error(w, "Error fetching messages", http.StatusInternalServerError)
+    // Registra la consegna all'utente dei messaggi della conversazione
+    if err := rt.db.MarkConversationDelivered(r.Context(), conversationID, userID); err != nil {
+        sendInternalError(w, ctx, err, "error marking messages as delivered")
+        return
+    }
+
+    // Legge i parametri di paginazione
+    query := database.MessageQuery{
+        Before: r.URL.Query().Get("before"),
+        After:  r.URL.Query().Get("after"),
+    }
+    if query.Before != "" && query.After != "" {
+        sendValidationError(w, ctx, FieldError{Field: "after", Message: "Parameters before and after cannot be used together"})
+        return
+    }
+    if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+        limit, err := strconv.Atoi(rawLimit)
+        if err != nil || limit < 1 || limit > database.MaxMessageLimit {
+            sendValidationError(w, ctx, FieldError{Field: "limit", Message: "Invalid limit: must be between 1 and "+strconv.Itoa(database.MaxMessageLimit)})
+            return
+        }
+        query.Limit = limit
+    }
+
+    // Recupera la pagina di messaggi richiesta
+    page, err := rt.db.GetMessagesFromConversation(r.Context(), conversationID, query)
+    if errors.Is(err, database.ErrInvalidCursor) {
+        field := "after"
+        if query.Before != "" {
+            field = "before"
+        }
+        sendValidationError(w, ctx, FieldError{Field: field, Message: "Invalid cursor"})
+        return
+    } else if err != nil {
+        sendInternalError(w, ctx, err, "error fetching messages")
         return
     }
 
     // Invia i messaggi come risposta
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(messages)
+    json.NewEncoder(w).Encode(MessagesResponse{Messages: page.Messages, NextCursor: page.NextCursor})
 }
 
 // isSingleEmoji verifica se una stringa è un singolo emoji
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"WasaTEXT/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+)
+
+// markConversationRead handles POST /conversations/read/:conversation_id
+func (rt *_router) markConversationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera l'ID della conversazione dalla richiesta
+	convID := ps.ByName("conversation_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Segna come letti tutti i messaggi ricevuti dall'utente nella conversazione
+	if err := rt.db.MarkConversationRead(r.Context(), convID, userID); err != nil {
+		sendInternalError(w, ctx, err, "error marking messages as read")
+		return
+	}
+
+	// Invia una risposta vuota
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMessageReceipts handles GET /conversations/receipts/:conversation_id/messages/:message_id
+func (rt *_router) getMessageReceipts(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera gli ID della conversazione e del messaggio dalla richiesta
+	convID := ps.ByName("conversation_id")
+	messageID := ps.ByName("message_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Verifica che il messaggio esista e appartenga alla conversazione
+	message, err := rt.db.GetMessageFromID(r.Context(), messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error fetching message")
+		return
+	}
+	if message.ConversationID != convID {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found in this conversation")
+		return
+	}
+
+	// Solo il mittente può vedere chi ha ricevuto e letto il messaggio
+	if message.SenderID != userID {
+		sendError(w, ctx, http.StatusForbidden, CodeNotSender, "You are not the sender of this message")
+		return
+	}
+
+	// Recupera le conferme di consegna e lettura
+	receipts, err := rt.db.GetMessageReceipts(r.Context(), messageID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching receipts")
+		return
+	}
+
+	// Invia le conferme come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipts)
+}
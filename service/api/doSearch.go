@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxSearchQueryLength è la lunghezza massima (in caratteri) del testo da cercare
+const maxSearchQueryLength = 200
+
+type SearchResponse struct {
+	Results    []database.SearchResult `json:"results"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// searchMessages handles GET /search/messages?q=&conversation_id=&limit=&cursor=
+func (rt *_router) searchMessages(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Legge il testo da cercare
+	text := r.URL.Query().Get("q")
+	if text == "" {
+		sendValidationError(w, ctx, FieldError{Field: "q", Message: "Search query cannot be empty"})
+		return
+	}
+	if utf8.RuneCountInString(text) > maxSearchQueryLength {
+		sendValidationError(w, ctx, FieldError{Field: "q", Message: "Search query must be at most " + strconv.Itoa(maxSearchQueryLength) + " characters"})
+		return
+	}
+
+	// Legge il limite di risultati
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > database.MaxMessageLimit {
+			sendValidationError(w, ctx, FieldError{Field: "limit", Message: "Invalid limit: must be between 1 and " + strconv.Itoa(database.MaxMessageLimit)})
+			return
+		}
+	}
+
+	// Se la ricerca è limitata a una conversazione, verifica che l'utente ne faccia parte
+	convID := r.URL.Query().Get("conversation_id")
+	if convID != "" {
+		exists, err := rt.db.ConversationExists(r.Context(), convID)
+		if err != nil {
+			sendInternalError(w, ctx, err, "error checking conversation existence")
+			return
+		}
+		if !exists {
+			sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+			return
+		}
+
+		isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+		if err != nil {
+			sendInternalError(w, ctx, err, "error checking conversation membership")
+			return
+		}
+		if !isMember {
+			sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+			return
+		}
+	}
+
+	// Esegue la ricerca
+	page, err := rt.db.SearchMessages(r.Context(), userID, text, convID, limit, r.URL.Query().Get("cursor"))
+	if errors.Is(err, database.ErrInvalidSearchQuery) {
+		sendValidationError(w, ctx, FieldError{Field: "q", Message: "Search query must contain at least one word"})
+		return
+	} else if errors.Is(err, database.ErrInvalidCursor) {
+		sendValidationError(w, ctx, FieldError{Field: "cursor", Message: "Invalid cursor"})
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error searching messages")
+		return
+	}
+
+	// Invia i risultati come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SearchResponse{Results: page.Results, NextCursor: page.NextCursor})
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+type SyncResponse struct {
+	Changes    []database.Change `json:"changes"`
+	NextSince  int64             `json:"next_since"`
+	HasMore    bool              `json:"has_more"`
+	FullResync bool              `json:"full_resync"`
+}
+
+// syncChanges handles GET /sync?since=&limit=
+func (rt *_router) syncChanges(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Legge l'ultima modifica ricevuta dal client (0 alla prima sincronizzazione)
+	var since int64
+	if rawSince := r.URL.Query().Get("since"); rawSince != "" {
+		var err error
+		since, err = strconv.ParseInt(rawSince, 10, 64)
+		if err != nil || since < 0 {
+			sendValidationError(w, ctx, FieldError{Field: "since", Message: "Invalid since: must be a non-negative integer"})
+			return
+		}
+	}
+
+	// Legge il numero massimo di modifiche da restituire
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > database.MaxChangeLimit {
+			sendValidationError(w, ctx, FieldError{Field: "limit", Message: "Invalid limit: must be between 1 and " + strconv.Itoa(database.MaxChangeLimit)})
+			return
+		}
+	}
+
+	// Recupera le modifiche dal change log dell'utente
+	page, err := rt.db.GetChanges(r.Context(), userID, since, limit)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error loading changes")
+		return
+	}
+
+	// Invia le modifiche come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SyncResponse{
+		Changes:    page.Changes,
+		NextSince:  page.NextSince,
+		HasMore:    page.HasMore,
+		FullResync: page.FullResync,
+	})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+type ThreadResponse struct {
+	Message *database.Message  `json:"message,omitempty"`
+	Replies []database.Message `json:"replies"`
+}
+
+// getThread handles GET /conversations/thread/:conversation_id/messages/:message_id
+func (rt *_router) getThread(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Recupera l'ID dell'utente autenticato dal contesto della richiesta
+	userID := ctx.UserID
+
+	// Recupera gli ID della conversazione e del messaggio dalla richiesta
+	convID := ps.ByName("conversation_id")
+	messageID := ps.ByName("message_id")
+
+	// Verifica che la conversazione esista
+	exists, err := rt.db.ConversationExists(r.Context(), convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return
+	}
+	if !exists {
+		sendError(w, ctx, http.StatusNotFound, CodeConversationNotFound, "Conversation not found")
+		return
+	}
+
+	// Verifica che l'utente sia un membro della conversazione
+	isMember, err := rt.db.IsUserInConversation(r.Context(), userID, convID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation membership")
+		return
+	}
+	if !isMember {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this conversation")
+		return
+	}
+
+	// Recupera il messaggio iniziale del thread, che potrebbe essere stato eliminato
+	var response ThreadResponse
+	message, err := rt.db.GetMessageFromID(r.Context(), messageID)
+	if err == nil && message.ConversationID == convID {
+		response.Message = &message
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		sendInternalError(w, ctx, err, "error fetching message")
+		return
+	}
+
+	// Recupera le risposte al messaggio
+	response.Replies, err = rt.db.GetReplies(r.Context(), convID, messageID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error fetching replies")
+		return
+	}
+
+	// Se il messaggio non esiste e nessuno gli ha risposto, il thread non esiste
+	if response.Message == nil && len(response.Replies) == 0 {
+		sendError(w, ctx, http.StatusNotFound, CodeMessageNotFound, "Message not found")
+		return
+	}
+
+	// Invia il thread come risposta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -2,14 +2,15 @@ package api
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strings"
 
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+	"WasaTEXT/service/events"
+	"WasaTEXT/service/imaging"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -18,158 +19,155 @@ type NewName struct {
 } 
 
 // getUserPhoto handles GET /users/get-photo/:user_id
-func (rt *_router) getUserPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (rt *_router) getUserPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
     // Recupera l'userId dai parametri
     userID := ps.ByName("user_id")
 
-    // Controllo se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
+    // Recupera la dimensione richiesta
+    size, err := parsePhotoSize(r)
     if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+        sendValidationError(w, ctx, FieldError{Field: "size", Message: "Invalid photo size"})
+        return
+    }
+
+    // Controllo se l'utente esiste nel database
+    _, err = rt.db.GetUserByID(r.Context(), userID)
+    if errors.Is(err, sql.ErrNoRows) {
+        sendError(w, ctx, http.StatusNotFound, CodeUserNotFound, "User not found")
+        return
+    } else if err != nil {
+        sendInternalError(w, ctx, err, "error fetching user")
         return
     }
 
     // Recupera il percorso della foto dal database
-    photoPath, err := rt.db.GetUserPhotoByID(userID)
+    photoPath, err := rt.db.GetUserPhotoByID(r.Context(), userID)
     if err != nil {
         if errors.Is(err, sql.ErrNoRows) {
-            http.Error(w, "User not found or photo not set", http.StatusNotFound)
+            sendError(w, ctx, http.StatusNotFound, CodePhotoNotFound, "User not found or photo not set")
             return
         }
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error fetching user photo")
         return
     }
-    // Se la foto non è impostata, restituisci una foto predefinita
-    if photoPath == "" {
-        photoPath = "service/uploads/default_user_photo.jpg" // Percorso della foto predefinita
+    // Serve il file immagine (la foto predefinita se non è impostata)
+    if err := rt.servePhoto(w, r, photoPath, size, "public"); err != nil {
+        sendInternalError(w, ctx, err, "failed to read user photo")
     }
-
-    // Serve il file immagine
-    http.ServeFile(w, r, photoPath)
 }
 
 // modifyUserName handles PATCH /users/modify-name
-func (rt *_router) modifyUserName(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-    // Recupera l'userId dal Authorization Header
-	userID := r.Header.Get("Authorization")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-    // Controllo se l'utente esiste nel database
-	_, err := rt.db.GetUserByID(userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+func (rt *_router) modifyUserName(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Decodifica il corpo della richiesta
     var req NewName
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request", http.StatusBadRequest)
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che il campo Name non sia vuoto
     if req.Name == "" {
-        http.Error(w, "Name cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "new_name", Message: "Name cannot be empty"})
         return
     }
 
     // Verifica che il nome sia tra 3 e 50 caratteri
     if len(req.Name) < 3 || len(req.Name) > 50 {
-        http.Error(w, "Name must be between 3 and 50 characters", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "new_name", Message: "Name must be between 3 and 50 characters"})
         return
     }
 
     lowername := strings.ToLower(req.Name)
     // Verifico che il nome non esista già
-    _, err = rt.db.GetUserByName(lowername)
+    _, err := rt.db.GetUserByName(r.Context(), lowername)
     if err == nil {
-        http.Error(w, "Name already exists", http.StatusBadRequest)
+        sendError(w, ctx, http.StatusConflict, CodeNameTaken, "Name already exists")
+        return
+    } else if !errors.Is(err, sql.ErrNoRows) {
+        sendInternalError(w, ctx, err, "error fetching user")
         return
     }
 
     // Modifica il nome dell'utente
-    err = rt.db.ModifyUserName(userID, lowername)
+    err = rt.db.ModifyUserName(r.Context(), userID, lowername)
     if err != nil {
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error modifying username")
         return
     }
 
+    // Notifica l'utente e i suoi contatti
+    rt.publishToContacts(ctx, userID, events.Event{
+        Type:    events.TypeUserRenamed,
+        Payload: map[string]string{"user_id": userID, "name": lowername},
+    })
+
     // Risposta
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]string{"message": "Username updated successfully"})
 }
 
 // updateUserPhoto handles PATCH /users/update-photo
-func (rt *_router) updateUserPhoto(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-    // Recupero l'userId dal Authorization Header
-    userID := r.Header.Get("Authorization")
-    if userID == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    // Controllo se l'utente esiste nel database
-    _, err := rt.db.GetUserByID(userID)
-    if err != nil {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+func (rt *_router) updateUserPhoto(w http.ResponseWriter, r *http.Request, _ httprouter.Params, ctx reqcontext.RequestContext) {
+    // Recupera l'ID dell'utente autenticato dal contesto della richiesta
+    userID := ctx.UserID
 
     // Decodifica il corpo della richiesta
     var req struct {
         PhotoBase64 string `json:"photo"`
     }
+    r.Body = http.MaxBytesReader(w, r.Body, maxPhotoRequestSize)
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            sendError(w, ctx, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Photo too large")
+            return
+        }
+        sendError(w, ctx, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
         return
     }
 
     // Verifica che il campo photo non sia vuoto
     if req.PhotoBase64 == "" {
-        http.Error(w, "Photo cannot be empty", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "photo", Message: "Photo cannot be empty"})
         return
     }
 
-    // Rimuovi il prefisso se presente tra PNG e JPEG
-    photoData := strings.TrimPrefix(req.PhotoBase64, "data:image/png;base64,")
-    photoData = strings.TrimPrefix(photoData, "data:image/jpeg;base64,")
-
-    // Decodifica l'immagine Base64
-    decodedPhoto, err := base64.StdEncoding.DecodeString(photoData)
+    // Decodifica l'immagine Base64, eventualmente inviata come data URL
+    decodedPhoto, err := decodePhoto(req.PhotoBase64)
     if err != nil {
-        http.Error(w, "Invalid Base64 encoding", http.StatusBadRequest)
+        sendValidationError(w, ctx, FieldError{Field: "photo", Message: "Invalid base64 encoding"})
         return
     }
 
-    // Percorso per la directory e il file
-	dirPath := "service/uploads/users/"
-	filePath := fmt.Sprintf("%s%s_photo.png", dirPath, userID)
-
-	// Assicurati che la directory esista
-	err = os.MkdirAll(dirPath, os.ModePerm)
-	if err != nil {
-		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+	// Verifica l'immagine e la salva nello storage insieme alle versioni ridotte
+	photoKey, err := rt.savePhoto(r.Context(), decodedPhoto)
+	if errors.Is(err, imaging.ErrNotImage) {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidPhoto, "Photo must be a PNG, JPEG or GIF image")
 		return
-	}
-
-	// Salva l'immagine nel file
-	err = os.WriteFile(filePath, decodedPhoto, 0644)
-	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+	} else if errors.Is(err, imaging.ErrTooLarge) {
+		sendError(w, ctx, http.StatusBadRequest, CodeInvalidPhoto, "Photo dimensions too large")
+		return
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "failed to save image")
 		return
 	}
 
-    // Aggiorna il percorso della foto nel database
-    err = rt.db.UpdateUserPhoto(userID, filePath)
+    // Aggiorna la chiave della foto nel database
+    err = rt.db.UpdateUserPhoto(r.Context(), userID, photoKey)
     if err != nil {
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+        sendInternalError(w, ctx, err, "error updating user photo")
         return
     }
 
+    // Notifica l'utente e i suoi contatti
+    rt.publishToContacts(ctx, userID, events.Event{
+        Type:    events.TypeUserPhotoUpdated,
+        Payload: map[string]string{"user_id": userID, "photo": database.UserPhotoURL(userID, photoKey)},
+    })
+
     // Risposta
     w.WriteHeader(http.StatusNoContent)
 }
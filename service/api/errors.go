@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"WasaTEXT/service/api/reqcontext"
+	"github.com/gofrs/uuid"
+)
+
+// Codici di errore delle risposte application/problem+json. Sono stabili: i client li usano per distinguere gli errori
+// invece di confrontare i messaggi, che possono cambiare
+const (
+	CodeInvalidBody          = "invalid_body"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeNotMember            = "not_a_member"
+	CodeNotSender            = "not_the_sender"
+	CodeInsufficientRole     = "insufficient_role"
+	CodeNotGroup             = "not_a_group"
+	CodeAlreadyMember        = "already_a_member"
+	CodeOwnerRoleFixed       = "owner_role_fixed"
+	CodeEditWindowExpired    = "edit_window_expired"
+	CodeSystemMessage        = "system_message"
+	CodeNameTaken            = "name_taken"
+	CodeInvalidPhoto         = "invalid_photo"
+	CodeTooManyAttachments   = "too_many_attachments"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeConversationNotFound = "conversation_not_found"
+	CodeGroupNotFound        = "group_not_found"
+	CodeMessageNotFound      = "message_not_found"
+	CodeUserNotFound         = "user_not_found"
+	CodeMemberNotFound       = "member_not_found"
+	CodeAttachmentNotFound   = "attachment_not_found"
+	CodeReactionNotFound     = "reaction_not_found"
+	CodePhotoNotFound        = "photo_not_found"
+	CodeInviteNotFound       = "invite_not_found"
+	CodeInviteExpired        = "invite_expired"
+	CodeInviteExhausted      = "invite_exhausted"
+	CodeJoinRequestNotFound  = "join_request_not_found"
+	CodeBadHandshake         = "bad_handshake"
+	CodeServiceUnavailable   = "service_unavailable"
+	CodeInternalError        = "internal_error"
+)
+
+// problemContentType è il Content-Type delle risposte di errore
+const problemContentType = "application/problem+json"
+
+// Problem è il corpo delle risposte di errore, nel formato application/problem+json (RFC 7807). Code è il codice
+// stabile dell'errore, Detail un messaggio per le persone e RequestID l'ID della richiesta presente nei log del server.
+// Errors elenca i campi non validi della richiesta, se presenti
+type Problem struct {
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError descrive un campo (del body, della query o un header) non valido
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// sendError invia una risposta di errore application/problem+json con lo status, il codice e il messaggio specificati
+func sendError(w http.ResponseWriter, ctx reqcontext.RequestContext, status int, code, detail string, fields ...FieldError) {
+	problem := Problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Errors: fields,
+	}
+	if ctx.ReqUUID != uuid.Nil {
+		problem.RequestID = ctx.ReqUUID.String()
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+// sendValidationError invia una risposta 400 con i campi non validi della richiesta
+func sendValidationError(w http.ResponseWriter, ctx reqcontext.RequestContext, fields ...FieldError) {
+	sendError(w, ctx, http.StatusBadRequest, CodeValidationFailed, "The request contains invalid fields", fields...)
+}
+
+// sendInternalError registra l'errore nel log della richiesta e invia una risposta 500, senza esporre i dettagli
+// dell'errore al client
+func sendInternalError(w http.ResponseWriter, ctx reqcontext.RequestContext, err error, msg string) {
+	ctx.Logger.WithError(err).Error(msg)
+	sendError(w, ctx, http.StatusInternalServerError, CodeInternalError, "Internal server error")
+}
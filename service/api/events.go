@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/events"
+)
+
+// publishToConversation invia l'evento a tutti i membri attuali della conversazione. Gli errori vengono solo
+// registrati nel log: la modifica che ha generato l'evento è già stata salvata. Per lo stesso motivo le query non usano
+// il contesto della richiesta, così l'evento viene pubblicato anche se il client si è già disconnesso
+func (rt *_router) publishToConversation(ctx reqcontext.RequestContext, convID string, ev events.Event) {
+	members, err := rt.db.GetConversationMembers(context.Background(), convID)
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("event", ev.Type).Error("can't load the recipients of the event")
+		return
+	}
+	rt.publishToUsers(ctx, members, ev)
+}
+
+// publishSystemMessage invia ai membri attuali del gruppo il messaggio di sistema appena inserito, come un nuovo
+// messaggio
+func (rt *_router) publishSystemMessage(ctx reqcontext.RequestContext, groupID, messageID string) {
+	message, err := rt.db.GetMessageFromID(context.Background(), messageID)
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("event", events.TypeMessageCreated).Error("can't load the system message")
+		return
+	}
+	rt.publishToConversation(ctx, groupID, events.Event{Type: events.TypeMessageCreated, ConversationID: groupID, Payload: message})
+}
+
+// publishToGroupAdmins invia l'evento ai membri del gruppo che possono gestire inviti e richieste di ingresso
+func (rt *_router) publishToGroupAdmins(ctx reqcontext.RequestContext, groupID string, ev events.Event) {
+	members, err := rt.db.GetGroupMembers(context.Background(), groupID)
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("event", ev.Type).Error("can't load the recipients of the event")
+		return
+	}
+	var admins []string
+	for _, m := range members {
+		if canPerform(m.Role, actionManageInvites) {
+			admins = append(admins, m.UserID)
+		}
+	}
+	rt.publishToUsers(ctx, admins, ev)
+}
+
+// publishToUsers salva l'evento nello stream di ciascun utente specificato e lo invia ai client connessi
+func (rt *_router) publishToUsers(ctx reqcontext.RequestContext, userIDs []string, ev events.Event) {
+	var payload []byte
+	if ev.Payload != nil {
+		var err error
+		payload, err = json.Marshal(ev.Payload)
+		if err != nil {
+			ctx.Logger.WithError(err).WithField("event", ev.Type).Error("can't encode the event payload")
+			return
+		}
+	}
+
+	// Salvataggio e invio avvengono sotto lo stesso lock, così i client ricevono gli eventi in ordine di sequenza
+	rt.publishMu.Lock()
+	defer rt.publishMu.Unlock()
+
+	stored, err := rt.db.AppendUserEvent(context.Background(), userIDs, ev.Type, ev.ConversationID, string(payload))
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("event", ev.Type).Error("can't save the event")
+		return
+	}
+	for _, userEvent := range stored {
+		ev.Seq = userEvent.Seq
+		rt.hub.Publish([]string{userEvent.UserID}, ev)
+	}
+}
+
+// publishToContacts invia l'evento all'utente e a tutti gli utenti con cui ha almeno una conversazione in comune
+func (rt *_router) publishToContacts(ctx reqcontext.RequestContext, userID string, ev events.Event) {
+	contacts, err := rt.db.GetContactIDs(context.Background(), userID)
+	if err != nil {
+		ctx.Logger.WithError(err).WithField("event", ev.Type).Error("can't load the recipients of the event")
+		return
+	}
+	rt.publishToUsers(ctx, append(contacts, userID), ev)
+}
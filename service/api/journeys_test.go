@@ -0,0 +1,323 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"WasaTEXT/service/database"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// I test di questo file percorrono le operazioni dell'API come farebbe un client, su un database SQLite temporaneo.
+// Ogni scambio viene validato rispetto a doc/api.yaml da testServer.request
+
+// newSQLiteServer avvia l'API su un database SQLite vuoto in una directory temporanea
+func newSQLiteServer(t *testing.T) *testServer {
+	t.Helper()
+	conn, err := sql.Open(string(database.SQLite), filepath.Join(t.TempDir(), "wasatext.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	db, err := database.New(conn, database.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestServer(t, db)
+}
+
+// testPNG restituisce un'immagine PNG di prova con le dimensioni specificate
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sendWithFile invia un messaggio con un allegato come multipart/form-data e restituisce il messaggio salvato
+func (s *testServer) sendWithFile(token, convID, text, fileName string, data []byte) database.Message {
+	s.t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("content", text); err != nil {
+		s.t.Fatal(err)
+	}
+	part, err := form.CreateFormFile("files", fileName)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err := part.Write(data); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		s.t.Fatal(err)
+	}
+
+	res, resBody := s.request(http.MethodPost, "/conversations/send-message/"+convID, token, form.FormDataContentType(), body.Bytes())
+	if res.StatusCode != http.StatusCreated {
+		s.t.Fatalf("sending message with attachment: status %d: %s", res.StatusCode, resBody)
+	}
+	var msg database.Message
+	if err := json.Unmarshal(resBody, &msg); err != nil {
+		s.t.Fatal(err)
+	}
+	return msg
+}
+
+// expect controlla lo status code di un passo del percorso
+func (s *testServer) expect(step string, code, want int) {
+	s.t.Helper()
+	if code != want {
+		s.t.Fatalf("%s: status %d, want %d", step, code, want)
+	}
+}
+
+func TestJourneyPrivateChat(t *testing.T) {
+	s := newSQLiteServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+
+	var convs []database.Conversation
+	s.expect("listing no conversations", s.do(http.MethodGet, "/conversations", alice, nil, &convs), http.StatusOK)
+	if len(convs) != 0 {
+		t.Errorf("conversations before starting one = %+v", convs)
+	}
+
+	conv := s.startConversation(alice, "bob")
+	s.expect("starting a conversation with a missing user",
+		s.do(http.MethodPost, "/conversations/start-conversation", alice, UsernameRequest{Username: "nobody"}, nil), http.StatusNotFound)
+
+	// Messaggi, risposte e allegati
+	hello := s.send(alice, conv, "hello bob, pizza tonight?")
+	var reply database.Message
+	s.expect("replying", s.do(http.MethodPost, "/conversations/send-message/"+conv, bob,
+		MessageRequest{Text: "sure!", ReplyTo: hello.MessageID}, &reply), http.StatusCreated)
+	if reply.ReplyTo == nil || reply.ReplyTo.MessageID != hello.MessageID {
+		t.Errorf("reply_to = %+v", reply.ReplyTo)
+	}
+	photo := s.sendWithFile(alice, conv, "the place", "place.png", testPNG(t, 8, 6))
+	if len(photo.Attachments) != 1 || photo.Attachments[0].Width != 8 {
+		t.Fatalf("attachments = %+v", photo.Attachments)
+	}
+	res, _ := s.request(http.MethodGet, photo.Attachments[0].URL, bob, "", nil)
+	s.expect("downloading the attachment", res.StatusCode, http.StatusOK)
+
+	// Paginazione all'indietro
+	var page MessagesResponse
+	s.expect("first page", s.do(http.MethodGet, "/conversations/messages/"+conv+"?limit=2", bob, nil, &page), http.StatusOK)
+	if len(page.Messages) != 2 || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	path := "/conversations/messages/" + conv + "?limit=2&before=" + url.QueryEscape(page.NextCursor)
+	s.expect("second page", s.do(http.MethodGet, path, bob, nil, &page), http.StatusOK)
+	if len(page.Messages) != 1 || page.Messages[0].MessageID != hello.MessageID {
+		t.Errorf("second page = %+v", page)
+	}
+
+	// Reazioni
+	react := fmt.Sprintf("/conversations/react/%s/messages/%s", conv, hello.MessageID)
+	s.expect("reacting", s.do(http.MethodPost, react, bob, ReactionRequest{Reaction: "👍"}, nil), http.StatusNoContent)
+	s.expect("replacing the reaction", s.do(http.MethodPost, react, bob, ReactionRequest{Reaction: "🍕"}, nil), http.StatusNoContent)
+	unreact := fmt.Sprintf("/conversations/delete-react/%s/messages/%s", conv, hello.MessageID)
+	s.expect("removing the reaction", s.do(http.MethodDelete, unreact, bob, nil, nil), http.StatusNoContent)
+
+	// Conferme di lettura
+	s.expect("marking as read", s.do(http.MethodPost, "/conversations/read/"+conv, bob, nil, nil), http.StatusNoContent)
+	var receipts []database.Receipt
+	s.expect("getting receipts", s.do(http.MethodGet, fmt.Sprintf("/conversations/receipts/%s/messages/%s", conv, hello.MessageID), alice, nil, &receipts), http.StatusOK)
+	if len(receipts) != 1 || receipts[0].ReadAt == "" {
+		t.Errorf("receipts = %+v", receipts)
+	}
+	s.expect("getting receipts as a recipient", s.do(http.MethodGet, fmt.Sprintf("/conversations/receipts/%s/messages/%s", conv, hello.MessageID), bob, nil, nil), http.StatusForbidden)
+
+	// Modifiche
+	var edited database.Message
+	s.expect("editing", s.do(http.MethodPatch, fmt.Sprintf("/conversations/edit-message/%s/messages/%s", conv, hello.MessageID), alice,
+		MessageRequest{Text: "hello bob, pizza tomorrow?"}, &edited), http.StatusOK)
+	if edited.EditedAt == "" {
+		t.Errorf("edited message = %+v", edited)
+	}
+	var edits MessageEditsResponse
+	s.expect("getting edits", s.do(http.MethodGet, fmt.Sprintf("/conversations/message-edits/%s/messages/%s", conv, hello.MessageID), bob, nil, &edits), http.StatusOK)
+	if len(edits.Edits) != 1 || edits.Edits[0].Content != "hello bob, pizza tonight?" {
+		t.Errorf("edits = %+v", edits.Edits)
+	}
+
+	// Thread e ricerca
+	var thread ThreadResponse
+	s.expect("getting the thread", s.do(http.MethodGet, fmt.Sprintf("/conversations/thread/%s/messages/%s", conv, hello.MessageID), bob, nil, &thread), http.StatusOK)
+	if thread.Message == nil || len(thread.Replies) != 1 {
+		t.Errorf("thread = %+v", thread)
+	}
+	var results SearchResponse
+	s.expect("searching", s.do(http.MethodGet, "/search/messages?q=pizza&conversation_id="+conv, bob, nil, &results), http.StatusOK)
+	if len(results.Results) != 1 || !strings.Contains(results.Results[0].Snippet, database.SnippetStart) {
+		t.Errorf("search results = %+v", results.Results)
+	}
+
+	// Sincronizzazione
+	var sync SyncResponse
+	s.expect("syncing", s.do(http.MethodGet, "/sync?since=0&limit=100", bob, nil, &sync), http.StatusOK)
+	if len(sync.Changes) == 0 || sync.FullResync {
+		t.Errorf("sync = %+v", sync)
+	}
+
+	// Eliminazione
+	s.expect("deleting someone else's message", s.do(http.MethodDelete,
+		fmt.Sprintf("/conversations/delete-message/%s/message/%s", conv, hello.MessageID), bob, nil, nil), http.StatusForbidden)
+	s.expect("deleting the message", s.do(http.MethodDelete,
+		fmt.Sprintf("/conversations/delete-message/%s/message/%s", conv, hello.MessageID), alice, nil, nil), http.StatusNoContent)
+	s.expect("deleting the conversation", s.do(http.MethodDelete, "/conversations/delete/"+conv, alice, nil, nil), http.StatusNoContent)
+	s.expect("getting the deleted conversation", s.do(http.MethodGet, "/conversations/get-details/"+conv, alice, nil, nil), http.StatusNotFound)
+
+	s.expect("logging out", s.do(http.MethodDelete, "/session", alice, nil, nil), http.StatusNoContent)
+	s.expect("listing after logout", s.do(http.MethodGet, "/conversations", alice, nil, nil), http.StatusUnauthorized)
+}
+
+func TestJourneyGroup(t *testing.T) {
+	s := newSQLiteServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	carol := s.login("carol")
+
+	s.expect("creating a group with a missing member", s.do(http.MethodPost, "/conversations/create-group", alice,
+		GroupRequest{Name: "pizza club", Members: []string{"bob", "nobody"}}, nil), http.StatusBadRequest)
+	var created ConvIDResponse
+	s.expect("creating the group", s.do(http.MethodPost, "/conversations/create-group", alice,
+		GroupRequest{Name: "pizza club", Members: []string{"bob"}}, &created), http.StatusCreated)
+	group := created.ConversationID
+
+	s.expect("renaming as a member", s.do(http.MethodPatch, "/conversations/group/change-name/"+group, bob,
+		NewGroupName{Name: "bob's club"}, nil), http.StatusForbidden)
+	s.expect("renaming", s.do(http.MethodPatch, "/conversations/group/change-name/"+group, alice,
+		NewGroupName{Name: "pizza lovers"}, nil), http.StatusNoContent)
+	s.expect("adding as a member", s.do(http.MethodPost, "/conversations/group/add/"+group, bob,
+		UsernameRequest{Username: "carol"}, nil), http.StatusForbidden)
+	s.expect("promoting bob", s.do(http.MethodPost, "/conversations/group/promote/"+group, alice,
+		UsernameRequest{Username: "bob"}, nil), http.StatusNoContent)
+	s.expect("adding carol", s.do(http.MethodPost, "/conversations/group/add/"+group, bob,
+		UsernameRequest{Username: "carol"}, nil), http.StatusNoContent)
+	s.expect("adding carol again", s.do(http.MethodPost, "/conversations/group/add/"+group, bob,
+		UsernameRequest{Username: "carol"}, nil), http.StatusConflict)
+
+	// Foto del gruppo
+	photo := map[string]string{"photo": base64.StdEncoding.EncodeToString(testPNG(t, 300, 200))}
+	s.expect("changing the photo as a member", s.do(http.MethodPatch, "/conversations/group/change-photo/"+group, carol, photo, nil), http.StatusForbidden)
+	s.expect("changing the photo", s.do(http.MethodPatch, "/conversations/group/change-photo/"+group, bob, photo, nil), http.StatusNoContent)
+	var details database.Conversation
+	s.expect("getting the group", s.do(http.MethodGet, "/conversations/get-details/"+group, carol, nil, &details), http.StatusOK)
+	if details.Name != "pizza lovers" || details.Type != "group" || details.Photo == "" {
+		t.Fatalf("group = %+v", details)
+	}
+	res, _ := s.request(http.MethodGet, details.Photo+"&size=64", carol, "", nil)
+	s.expect("getting the photo", res.StatusCode, http.StatusOK)
+
+	// Profilo e membri del gruppo
+	s.expect("describing the group", s.do(http.MethodPatch, "/conversations/group/change-description/"+group, bob,
+		NewGroupDescription{Description: "friday night pizza"}, nil), http.StatusNoContent)
+	var profile database.GroupProfile
+	s.expect("getting the profile", s.do(http.MethodGet, "/conversations/group/profile/"+group, carol, nil, &profile), http.StatusOK)
+	if profile.Description != "friday night pizza" || profile.Photo != details.Photo || profile.MemberCount != 3 || profile.CreatedAt == "" {
+		t.Errorf("profile = %+v", profile)
+	}
+	var members GroupMembersResponse
+	s.expect("listing the members", s.do(http.MethodGet, "/conversations/group/members/"+group, carol, nil, &members), http.StatusOK)
+	if len(members.Members) != 3 || members.Members[2].UserName != "carol" || members.Members[2].AddedBy != members.Members[1].UserID {
+		t.Errorf("members = %+v", members.Members)
+	}
+
+	// Ingresso tramite un link di invito con approvazione
+	dave := s.login("dave")
+	expiresAt := time.Now().Add(24 * time.Hour)
+	var invite database.GroupInvite
+	s.expect("creating an invite", s.do(http.MethodPost, "/conversations/group/create-invite/"+group, bob,
+		NewInviteRequest{ExpiresAt: &expiresAt, RequiresApproval: true}, &invite), http.StatusCreated)
+	s.expect("requesting to join", s.do(http.MethodPost, "/invites/"+invite.Token+"/join", dave, nil, nil), http.StatusAccepted)
+	var invites GroupInvitesResponse
+	s.expect("listing the invites", s.do(http.MethodGet, "/conversations/group/invites/"+group, alice, nil, &invites), http.StatusOK)
+	if len(invites.Invites) != 1 || invites.Invites[0].Uses != 1 || invites.Invites[0].ExpiresAt == "" {
+		t.Errorf("invites = %+v", invites.Invites)
+	}
+	var requests JoinRequestsResponse
+	s.expect("listing the join requests", s.do(http.MethodGet, "/conversations/group/join-requests/"+group, bob, nil, &requests), http.StatusOK)
+	if len(requests.Requests) != 1 || requests.Requests[0].UserName != "dave" || requests.Requests[0].InviteToken != invite.Token {
+		t.Fatalf("join requests = %+v", requests.Requests)
+	}
+	s.expect("approving dave", s.do(http.MethodPost, "/conversations/group/approve-request/"+group+"/requests/"+requests.Requests[0].UserID,
+		bob, nil, nil), http.StatusNoContent)
+	s.expect("reading after joining", s.do(http.MethodGet, "/conversations/messages/"+group, dave, nil, nil), http.StatusOK)
+
+	// Inoltro di un messaggio del gruppo in una conversazione privata
+	msg := s.send(carol, group, "who brings the pizza?")
+	private := s.startConversation(alice, "bob")
+	var forwarded database.Message
+	s.expect("forwarding", s.do(http.MethodPost, fmt.Sprintf("/conversations/forward-message/%s/messages/%s", group, msg.MessageID), alice,
+		ConversationsRequest{ID: private}, &forwarded), http.StatusCreated)
+	if forwarded.ConversationID != private || forwarded.Content != msg.Content || forwarded.SenderID == msg.SenderID {
+		t.Errorf("forwarded message = %+v", forwarded)
+	}
+	s.expect("forwarding to a conversation of others", s.do(http.MethodPost, fmt.Sprintf("/conversations/forward-message/%s/messages/%s", group, msg.MessageID), carol,
+		ConversationsRequest{ID: private}, nil), http.StatusForbidden)
+
+	// Uscita dal gruppo
+	s.expect("leaving", s.do(http.MethodDelete, "/conversations/group/leave/"+group, carol, nil, nil), http.StatusNoContent)
+	s.expect("reading after leaving", s.do(http.MethodGet, "/conversations/messages/"+group, carol, nil, nil), http.StatusForbidden)
+	s.expect("getting the photo after leaving", s.do(http.MethodGet, "/conversations/group/get-photo/"+group, carol, nil, nil), http.StatusForbidden)
+
+	var convs []database.Conversation
+	s.expect("listing conversations", s.do(http.MethodGet, "/conversations", bob, nil, &convs), http.StatusOK)
+	if len(convs) != 2 {
+		t.Errorf("bob's conversations = %+v", convs)
+	}
+
+	// Il proprietario che esce lascia il gruppo all'amministratore
+	s.expect("leaving as the owner", s.do(http.MethodDelete, "/conversations/group/leave/"+group, alice, nil, nil), http.StatusNoContent)
+	s.expect("deleting as the new owner", s.do(http.MethodDelete, "/conversations/delete/"+group, bob, nil, nil), http.StatusNoContent)
+}
+
+func TestJourneyProfile(t *testing.T) {
+	s := newSQLiteServer(t)
+	alice := s.login("alice")
+	bob := s.login("bob")
+	conv := s.startConversation(bob, "alice")
+
+	s.expect("taking a used name", s.do(http.MethodPatch, "/users/modify-username", alice, NewName{Name: "bob"}, nil), http.StatusConflict)
+	s.expect("renaming", s.do(http.MethodPatch, "/users/modify-username", alice, NewName{Name: "alicia"}, nil), http.StatusOK)
+
+	photo := map[string]string{"photo": "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG(t, 40, 40))}
+	s.expect("changing the photo", s.do(http.MethodPatch, "/users/update-photo", alice, photo, nil), http.StatusNoContent)
+
+	var c database.Conversation
+	s.expect("getting the conversation", s.do(http.MethodGet, "/conversations/get-details/"+conv, bob, nil, &c), http.StatusOK)
+	if c.Name != "alicia" || !strings.HasPrefix(c.Photo, "/users/get-photo/") {
+		t.Fatalf("conversation = %+v", c)
+	}
+
+	// La foto di un utente è pubblica
+	res, _ := s.request(http.MethodGet, c.Photo, "", "", nil)
+	s.expect("getting the photo without a session", res.StatusCode, http.StatusOK)
+	res, _ = s.request(http.MethodGet, "/users/get-photo/404", "", "", nil)
+	s.expect("getting the photo of a missing user", res.StatusCode, http.StatusNotFound)
+}
@@ -9,7 +9,7 @@ import (
 // resources are not ready), this should reply with HTTP Status 500. Otherwise, with HTTP Status 200
 func (rt *_router) liveness(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	/* Example of liveness check:
-	if err := rt.DB.Ping(); err != nil {
+	if err := rt.DB.Ping(r.Context()); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}*/
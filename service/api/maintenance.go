@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// maintenanceInterval is the time between two runs of the background maintenance tasks
+const maintenanceInterval = time.Hour
+
+// runMaintenance compacts the change log and deletes expired sessions and user events at startup and then
+// periodically, until rt.stopMaintenance is closed
+func (rt *_router) runMaintenance() {
+	defer close(rt.maintenanceDone)
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		if err := rt.db.CompactChangeLog(context.Background()); err != nil {
+			rt.baseLogger.WithError(err).Error("can't compact the change log")
+		}
+		if err := rt.db.DeleteExpiredSessions(context.Background()); err != nil {
+			rt.baseLogger.WithError(err).Error("can't delete expired sessions")
+		}
+		if err := rt.db.DeleteExpiredUserEvents(context.Background()); err != nil {
+			rt.baseLogger.WithError(err).Error("can't delete expired user events")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-rt.stopMaintenance:
+			return
+		}
+	}
+}
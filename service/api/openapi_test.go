@@ -0,0 +1,621 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
+)
+
+// specPath è il percorso della specifica OpenAPI rispetto alla directory del package
+const specPath = "../../doc/api.yaml"
+
+// undocumentedRoutes sono le route registrate in api-handler.go che non fanno parte dell'API e quindi non compaiono
+// nella specifica
+var undocumentedRoutes = map[string]bool{
+	"GET /":         true,
+	"GET /context":  true,
+	"GET /liveness": true,
+}
+
+// openAPISpec è il sottoinsieme di OpenAPI 3 usato da doc/api.yaml, sufficiente a validare richieste e risposte
+type openAPISpec struct {
+	Paths      map[string]map[string]*specOperation `yaml:"paths"`
+	Components struct {
+		Parameters map[string]*specParameter `yaml:"parameters"`
+		Responses  map[string]*specResponse  `yaml:"responses"`
+		Schemas    map[string]*specSchema    `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type specOperation struct {
+	OperationID string                   `yaml:"operationId"`
+	Security    *[]map[string][]string   `yaml:"security"`
+	Parameters  []*specParameter         `yaml:"parameters"`
+	RequestBody *specRequestBody         `yaml:"requestBody"`
+	Responses   map[string]*specResponse `yaml:"responses"`
+}
+
+type specParameter struct {
+	Ref      string      `yaml:"$ref"`
+	Name     string      `yaml:"name"`
+	In       string      `yaml:"in"`
+	Required bool        `yaml:"required"`
+	Schema   *specSchema `yaml:"schema"`
+}
+
+type specRequestBody struct {
+	Required bool                  `yaml:"required"`
+	Content  map[string]*specMedia `yaml:"content"`
+}
+
+type specResponse struct {
+	Ref     string                `yaml:"$ref"`
+	Content map[string]*specMedia `yaml:"content"`
+}
+
+type specMedia struct {
+	Schema *specSchema `yaml:"schema"`
+}
+
+type specSchema struct {
+	Ref        string                 `yaml:"$ref"`
+	Type       string                 `yaml:"type"`
+	Format     string                 `yaml:"format"`
+	Properties map[string]*specSchema `yaml:"properties"`
+	Required   []string               `yaml:"required"`
+	Items      *specSchema            `yaml:"items"`
+	Enum       []interface{}          `yaml:"enum"`
+	Nullable   bool                   `yaml:"nullable"`
+	AllOf      []*specSchema          `yaml:"allOf"`
+	Pattern    string                 `yaml:"pattern"`
+	MinLength  *int                   `yaml:"minLength"`
+	MaxLength  *int                   `yaml:"maxLength"`
+	Minimum    *float64               `yaml:"minimum"`
+	Maximum    *float64               `yaml:"maximum"`
+}
+
+// loadSpec carica doc/api.yaml
+func loadSpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPISpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("parsing %s: %v", specPath, err)
+	}
+	return &spec
+}
+
+// secured indica se l'operazione richiede il token di sessione. La specifica non ha una security globale, quindi
+// un'operazione senza security è pubblica
+func (op *specOperation) secured() bool {
+	return op.Security != nil && len(*op.Security) > 0
+}
+
+// findOperation restituisce l'operazione documentata per il metodo e il percorso (senza query) e il template del
+// percorso. Se più template corrispondono viene scelto quello con più segmenti letterali, come fa il router
+func (spec *openAPISpec) findOperation(method, path string) (*specOperation, string) {
+	segments := strings.Split(path, "/")
+	best, bestLiterals := "", -1
+	for template := range spec.Paths {
+		parts := strings.Split(template, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		literals := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				if segments[i] == "" {
+					literals = -1
+					break
+				}
+				continue
+			}
+			if part != segments[i] {
+				literals = -1
+				break
+			}
+			literals++
+		}
+		if literals > bestLiterals {
+			best, bestLiterals = template, literals
+		}
+	}
+	if best == "" {
+		return nil, ""
+	}
+	return spec.Paths[best][strings.ToLower(method)], best
+}
+
+// parameter risolve il riferimento a un parametro
+func (spec *openAPISpec) parameter(p *specParameter) *specParameter {
+	for p != nil && p.Ref != "" {
+		p = spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+// response risolve il riferimento a una risposta
+func (spec *openAPISpec) response(r *specResponse) *specResponse {
+	for r != nil && r.Ref != "" {
+		r = spec.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+// schema risolve il riferimento a uno schema
+func (spec *openAPISpec) schema(s *specSchema) *specSchema {
+	for s != nil && s.Ref != "" {
+		s = spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validateRequest controlla che la richiesta sia documentata e rispetti la specifica: parametri di query e header,
+// Content-Type e schema del body. Restituisce gli errori trovati
+func (spec *openAPISpec) validateRequest(req *http.Request, body []byte) []string {
+	op, template := spec.findOperation(req.Method, req.URL.Path)
+	if op == nil {
+		return []string{"operation not documented"}
+	}
+
+	var errs []string
+	query := req.URL.Query()
+	documented := map[string]bool{}
+	for _, p := range op.Parameters {
+		if p = spec.parameter(p); p == nil {
+			continue
+		}
+		var values []string
+		switch p.In {
+		case "path":
+			continue
+		case "query":
+			documented[p.Name] = true
+			values = query[p.Name]
+		case "header":
+			values = req.Header.Values(p.Name)
+		}
+		if len(values) == 0 {
+			if p.Required {
+				errs = append(errs, fmt.Sprintf("missing required %s parameter %q", p.In, p.Name))
+			}
+			continue
+		}
+		errs = append(errs, spec.validateParameter(p, values[0])...)
+	}
+	for name := range query {
+		if !documented[name] {
+			errs = append(errs, fmt.Sprintf("undocumented query parameter %q", name))
+		}
+	}
+
+	if len(body) == 0 {
+		if op.RequestBody != nil && op.RequestBody.Required {
+			errs = append(errs, "missing required request body")
+		}
+		return errs
+	}
+	if op.RequestBody == nil {
+		return append(errs, fmt.Sprintf("%s %s does not document a request body", req.Method, template))
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return append(errs, fmt.Sprintf("invalid request Content-Type: %v", err))
+	}
+	media, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		return append(errs, fmt.Sprintf("request Content-Type %q not documented", mediaType))
+	}
+
+	var value interface{}
+	switch mediaType {
+	case "application/json":
+		if value, err = decodeJSON(body); err != nil {
+			return append(errs, fmt.Sprintf("invalid JSON request body: %v", err))
+		}
+	case "multipart/form-data":
+		if value, err = decodeMultipart(body, params["boundary"]); err != nil {
+			return append(errs, fmt.Sprintf("invalid multipart request body: %v", err))
+		}
+	default:
+		return errs
+	}
+	return append(errs, spec.validate(media.Schema, value, "request")...)
+}
+
+// validateParameter controlla il valore di un parametro di query o header, convertito secondo il tipo dello schema
+func (spec *openAPISpec) validateParameter(p *specParameter, raw string) []string {
+	where := fmt.Sprintf("%s parameter %q", p.In, p.Name)
+	if p.Schema == nil {
+		return nil
+	}
+	var value interface{} = raw
+	switch spec.schema(p.Schema).Type {
+	case "integer":
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return []string{fmt.Sprintf("%s: %q is not an integer", where, raw)}
+		}
+		value = json.Number(raw)
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %q is not a boolean", where, raw)}
+		}
+		value = b
+	}
+	return spec.validate(p.Schema, value, where)
+}
+
+// validateResponse controlla che lo status code della risposta sia documentato per l'operazione e che il body
+// rispetti il Content-Type e lo schema documentati
+func (spec *openAPISpec) validateResponse(req *http.Request, res *http.Response, body []byte) []string {
+	op, _ := spec.findOperation(req.Method, req.URL.Path)
+	if op == nil {
+		return nil
+	}
+	documented, ok := op.Responses[strconv.Itoa(res.StatusCode)]
+	if !ok {
+		return []string{fmt.Sprintf("status %d not documented", res.StatusCode)}
+	}
+	if documented = spec.response(documented); documented == nil {
+		return []string{fmt.Sprintf("status %d: unresolved response", res.StatusCode)}
+	}
+
+	if len(documented.Content) == 0 {
+		if len(body) > 0 {
+			return []string{fmt.Sprintf("status %d documents no content, got %q", res.StatusCode, body)}
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return []string{fmt.Sprintf("invalid response Content-Type: %v", err)}
+	}
+	var media *specMedia
+	for documentedType, m := range documented.Content {
+		if mediaTypeMatches(documentedType, mediaType) {
+			media = m
+			break
+		}
+	}
+	if media == nil {
+		return []string{fmt.Sprintf("response Content-Type %q not documented for status %d", mediaType, res.StatusCode)}
+	}
+	if !isJSON(mediaType) || media.Schema == nil {
+		return nil
+	}
+	value, err := decodeJSON(body)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid JSON response body: %v", err)}
+	}
+	return spec.validate(media.Schema, value, "response")
+}
+
+// mediaTypeMatches indica se il media type appartiene al media range documentato (ad es. */* o image/*)
+func mediaTypeMatches(documented, mediaType string) bool {
+	if documented == "*/*" || documented == mediaType {
+		return true
+	}
+	return strings.HasSuffix(documented, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(documented, "*"))
+}
+
+// isJSON indica se il media type è JSON, come application/json o application/problem+json
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON decodifica un valore JSON mantenendo i numeri come json.Number, per distinguere gli interi
+func decodeJSON(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return value, nil
+}
+
+// decodeMultipart converte un body multipart/form-data in un oggetto da validare: i campi diventano stringhe e i file
+// array di stringhe (binarie) con il nome della parte
+func decodeMultipart(body []byte, boundary string) (interface{}, error) {
+	form := map[string]interface{}{}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			files, _ := form[part.FormName()].([]interface{})
+			form[part.FormName()] = append(files, string(data))
+		} else {
+			form[part.FormName()] = string(data)
+		}
+	}
+}
+
+// validate controlla che il valore rispetti lo schema. Gli oggetti con proprietà documentate sono validati in modo
+// stretto: una proprietà non documentata è un errore, così come un campo obbligatorio mancante
+func (spec *openAPISpec) validate(s *specSchema, value interface{}, where string) []string {
+	if s == nil {
+		return nil
+	}
+	if s = spec.schema(s); s == nil {
+		return []string{where + ": unresolved schema"}
+	}
+	if value == nil {
+		if s.Nullable {
+			return nil
+		}
+		return []string{where + ": null is not allowed"}
+	}
+
+	var errs []string
+	for _, sub := range s.AllOf {
+		errs = append(errs, spec.validate(sub, value, where)...)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", where, value, s.Enum))
+		}
+	}
+
+	typ := s.Type
+	if typ == "" && s.Properties != nil {
+		typ = "object"
+	}
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected an object, got %T", where, value))
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %q", where, name))
+			}
+		}
+		if s.Properties == nil {
+			return errs
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: undocumented property %q", where, name))
+				continue
+			}
+			errs = append(errs, spec.validate(prop, obj[name], where+"."+name)...)
+		}
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected an array, got %T", where, value))
+		}
+		for i, item := range arr {
+			errs = append(errs, spec.validate(s.Items, item, fmt.Sprintf("%s[%d]", where, i))...)
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected a string, got %T", where, value))
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			errs = append(errs, fmt.Sprintf("%s: %q is shorter than %d", where, str, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s: %q is longer than %d", where, str, *s.MaxLength))
+		}
+		if s.Pattern != "" {
+			if matched, err := regexp.MatchString(s.Pattern, str); err != nil || !matched {
+				errs = append(errs, fmt.Sprintf("%s: %q does not match %s", where, str, s.Pattern))
+			}
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", where, str))
+			}
+		}
+
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected a number, got %T", where, value))
+		}
+		if typ == "integer" {
+			if _, err := num.Int64(); err != nil {
+				return append(errs, fmt.Sprintf("%s: %s is not an integer", where, num))
+			}
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return append(errs, fmt.Sprintf("%s: %s is not a number", where, num))
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: %s is less than %v", where, num, *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: %s is greater than %v", where, num, *s.Maximum))
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected a boolean, got %T", where, value))
+		}
+	}
+	return errs
+}
+
+// routeKey normalizza metodo e percorso di una route, sostituendo i parametri con {} perché specifica e router
+// possono chiamarli in modo diverso
+func routeKey(method, path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || (strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}")) {
+			parts[i] = "{}"
+		}
+	}
+	return strings.ToUpper(method) + " " + strings.Join(parts, "/")
+}
+
+// registeredRoutes restituisce le route registrate in api-handler.go, cercando le chiamate rt.router.METODO("percorso", ...)
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "api-handler.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		recv, ok := sel.X.(*ast.SelectorExpr)
+		if !ok || recv.Sel.Name != "router" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		path, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, sel.Sel.Name+" "+path)
+		return true
+	})
+	return routes
+}
+
+// TestSpecCoversRoutes controlla che ogni operazione documentata sia gestita dal router e che ogni route dell'API
+// registrata sia documentata
+func TestSpecCoversRoutes(t *testing.T) {
+	spec := loadSpec(t)
+	s := newTestServer(t)
+	router, ok := s.handler.(*httprouter.Router)
+	if !ok {
+		t.Fatalf("Handler() returned %T, want *httprouter.Router", s.handler)
+	}
+
+	documented := map[string]bool{}
+	placeholder := regexp.MustCompile(`\{[^}]+\}`)
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			documented[routeKey(method, path)] = true
+			handle, _, _ := router.Lookup(strings.ToUpper(method), placeholder.ReplaceAllString(path, "x"))
+			if handle == nil {
+				t.Errorf("%s %s (%s) is documented but not routed", strings.ToUpper(method), path, op.OperationID)
+			}
+		}
+	}
+
+	routes := registeredRoutes(t)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in api-handler.go")
+	}
+	for _, route := range routes {
+		if undocumentedRoutes[route] {
+			continue
+		}
+		fields := strings.Fields(route)
+		if !documented[routeKey(fields[0], fields[1])] {
+			t.Errorf("%s is routed but not documented in %s", route, specPath)
+		}
+	}
+}
+
+// TestSpecOperations controlla che ogni operazione abbia un operationId univoco e documenti, se protetta, la
+// risposta 401, e che tutti i riferimenti della specifica siano risolvibili
+func TestSpecOperations(t *testing.T) {
+	spec := loadSpec(t)
+	ids := map[string]string{}
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			name := strings.ToUpper(method) + " " + path
+			if op.OperationID == "" {
+				t.Errorf("%s: missing operationId", name)
+			} else if other, ok := ids[op.OperationID]; ok {
+				t.Errorf("%s: operationId %q already used by %s", name, op.OperationID, other)
+			}
+			ids[op.OperationID] = name
+
+			if _, ok := op.Responses["401"]; op.secured() && !ok {
+				t.Errorf("%s: secured operation without a 401 response", name)
+			}
+			for _, p := range op.Parameters {
+				if spec.parameter(p) == nil {
+					t.Errorf("%s: unresolved parameter %s", name, p.Ref)
+				}
+			}
+			for code, r := range op.Responses {
+				if spec.response(r) == nil {
+					t.Errorf("%s %s: unresolved response %s", name, code, r.Ref)
+				}
+			}
+		}
+	}
+
+	// Ogni $ref a uno schema deve puntare a uno schema esistente
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range regexp.MustCompile(`#/components/schemas/(\w+)`).FindAllStringSubmatch(string(data), -1) {
+		if _, ok := spec.Components.Schemas[m[1]]; !ok {
+			t.Errorf("unresolved schema %s", m[0])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"WasaTEXT/service/api/reqcontext"
+	"WasaTEXT/service/database"
+)
+
+// groupAction è un'azione su un gruppo che richiede un ruolo minimo
+type groupAction string
+
+const (
+	actionRename               groupAction = "rename"
+	actionChangePhoto          groupAction = "change_photo"
+	actionAddMember            groupAction = "add_member"
+	actionRemoveMember         groupAction = "remove_member"
+	actionDeleteOthersMessages groupAction = "delete_others_messages"
+	actionEditSettings         groupAction = "edit_settings"
+	actionManageInvites        groupAction = "manage_invites"
+	actionManageRoles          groupAction = "manage_roles"
+	actionTransferOwnership    groupAction = "transfer_ownership"
+	actionDeleteGroup          groupAction = "delete_group"
+)
+
+// roleRank ordina i ruoli: ogni ruolo può compiere tutte le azioni permesse ai ruoli di rango inferiore
+var roleRank = map[string]int{
+	database.RoleMember: 1,
+	database.RoleAdmin:  2,
+	database.RoleOwner:  3,
+}
+
+// groupPermissions è la matrice dei permessi dei gruppi: associa a ogni azione il ruolo minimo necessario per
+// compierla. Deve restare allineata alla tabella nella descrizione dell'API (doc/api.yaml)
+var groupPermissions = map[groupAction]string{
+	actionRename:               database.RoleAdmin,
+	actionChangePhoto:          database.RoleAdmin,
+	actionAddMember:            database.RoleAdmin,
+	actionRemoveMember:         database.RoleAdmin,
+	actionDeleteOthersMessages: database.RoleAdmin,
+	actionEditSettings:         database.RoleAdmin,
+	actionManageInvites:        database.RoleAdmin,
+	actionManageRoles:          database.RoleOwner,
+	actionTransferOwnership:    database.RoleOwner,
+	actionDeleteGroup:          database.RoleOwner,
+}
+
+// canPerform controlla se un membro con il ruolo specificato può compiere l'azione sul gruppo
+func canPerform(role string, action groupAction) bool {
+	minRole, ok := groupPermissions[action]
+	return ok && roleRank[role] >= roleRank[minRole]
+}
+
+// outranks controlla se il ruolo role è superiore al ruolo other
+func outranks(role, other string) bool {
+	return roleRank[role] > roleRank[other]
+}
+
+// requireGroup controlla che la conversazione esista e sia un gruppo. Altrimenti risponde al client e restituisce false
+func (rt *_router) requireGroup(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, groupID string) bool {
+	exist, err := rt.db.ConversationExists(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation existence")
+		return false
+	}
+	if !exist {
+		sendError(w, ctx, http.StatusNotFound, CodeGroupNotFound, "Group not found")
+		return false
+	}
+	isPrivate, err := rt.db.IsConversationPrivate(r.Context(), groupID)
+	if err != nil {
+		sendInternalError(w, ctx, err, "error checking conversation type")
+		return false
+	}
+	if isPrivate {
+		sendError(w, ctx, http.StatusBadRequest, CodeNotGroup, "Conversation is not a group")
+		return false
+	}
+	return true
+}
+
+// requireGroupPermission controlla che l'utente autenticato sia un membro del gruppo con un ruolo che permette
+// l'azione. Altrimenti risponde al client e restituisce false
+func (rt *_router) requireGroupPermission(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, groupID string, action groupAction) bool {
+	role, err := rt.db.GetGroupRole(r.Context(), groupID, ctx.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(w, ctx, http.StatusForbidden, CodeNotMember, "You are not a member of this group")
+		return false
+	} else if err != nil {
+		sendInternalError(w, ctx, err, "error checking group role")
+		return false
+	}
+	if !canPerform(role, action) {
+		sendError(w, ctx, http.StatusForbidden, CodeInsufficientRole, "Your role in this group does not allow this action")
+		return false
+	}
+	return true
+}
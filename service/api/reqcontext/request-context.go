@@ -18,4 +18,10 @@ type RequestContext struct {
 
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// UserID is the ID of the authenticated user. It is empty for requests that do not require authentication
+	UserID string
+
+	// UserName is the name of the authenticated user. It is empty for requests that do not require authentication
+	UserName string
 }
@@ -2,5 +2,11 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	// Disconnect all the clients of the event stream
+	rt.hub.Close()
+
+	// Stop the background maintenance tasks and wait for them to finish
+	close(rt.stopMaintenance)
+	<-rt.maintenanceDone
 	return nil
 }
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// attachmentURL restituisce l'endpoint da cui scaricare l'allegato
+func attachmentURL(convID, attachmentID string) string {
+	return fmt.Sprintf("/conversations/attachment/%s/attachments/%s", convID, attachmentID)
+}
+
+// insertAttachments salva gli allegati del messaggio
+func (db *appdbimpl) insertAttachments(ctx context.Context, messageID string, attachments []NewAttachment) error {
+	for _, att := range attachments {
+		_, err := db.c.ExecContext(ctx,
+			"INSERT INTO attachments (message_id, path, filename, mime_type, size, width, height) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			messageID, att.Path, att.FileName, att.MimeType, att.Size, att.Width, att.Height,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAttachments recupera con una sola query gli allegati dei messaggi specificati
+func (db *appdbimpl) loadAttachments(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(messages))
+	placeholders := make([]string, len(messages))
+	args := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		index[msg.MessageID] = i
+		placeholders[i] = "?"
+		args[i] = msg.MessageID
+	}
+
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT message_id, id, filename, mime_type, size, width, height
+		FROM attachments
+		WHERE message_id IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY id ASC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var att Attachment
+		if err := rows.Scan(&messageID, &att.AttachmentID, &att.FileName, &att.MimeType, &att.Size, &att.Width, &att.Height); err != nil {
+			return err
+		}
+		if i, ok := index[messageID]; ok {
+			att.URL = attachmentURL(messages[i].ConversationID, att.AttachmentID)
+			messages[i].Attachments = append(messages[i].Attachments, att)
+		}
+	}
+	return rows.Err()
+}
+
+// GetAttachment restituisce l'allegato, l'id della conversazione del messaggio a cui appartiene e la chiave del file
+// nello storage
+func (db *appdbimpl) GetAttachment(ctx context.Context, attachmentID string) (Attachment, string, string, error) {
+	var att Attachment
+	var convID, key string
+	err := db.c.QueryRowContext(ctx, `
+		SELECT a.id, a.filename, a.mime_type, a.size, a.width, a.height, m.conversation_id, a.path
+		FROM attachments a
+		JOIN messages m ON m.id = a.message_id
+		WHERE a.id = ?`, attachmentID,
+	).Scan(&att.AttachmentID, &att.FileName, &att.MimeType, &att.Size, &att.Width, &att.Height, &convID, &key)
+	if err != nil {
+		return Attachment{}, "", "", err
+	}
+	att.URL = attachmentURL(convID, att.AttachmentID)
+	return att, convID, key, nil
+}
+
+// CopyAttachments allega al messaggio toMessageID gli stessi file allegati al messaggio fromMessageID. I file non
+// vengono duplicati: le copie puntano alla stessa chiave
+func (db *appdbimpl) CopyAttachments(ctx context.Context, fromMessageID, toMessageID string) error {
+	_, err := db.c.ExecContext(ctx, `
+		INSERT INTO attachments (message_id, path, filename, mime_type, size, width, height)
+		SELECT CAST(? AS INTEGER), path, filename, mime_type, size, width, height
+		FROM attachments
+		WHERE message_id = ?
+		ORDER BY id ASC`, toMessageID, fromMessageID)
+	return err
+}
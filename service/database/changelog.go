@@ -0,0 +1,285 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// Tipi delle modifiche salvate nel change log
+const (
+	ChangeConversationCreated = "conversation.created"
+	ChangeConversationDeleted = "conversation.deleted"
+	ChangeMessageCreated      = "message.created"
+	ChangeMessageDeleted      = "message.deleted"
+	ChangeMessageEdited       = "message.edited"
+	ChangeMessageStatus       = "message.status_updated"
+	ChangeReactionAdded       = "reaction.added"
+	ChangeReactionRemoved     = "reaction.removed"
+	ChangeGroupRenamed        = "group.renamed"
+	ChangeGroupPhotoUpdated   = "group.photo_updated"
+	ChangeGroupDescription    = "group.description_updated"
+	ChangeMemberAdded         = "group.member_added"
+	ChangeMemberLeft          = "group.member_left"
+	ChangeMemberRemoved       = "group.member_removed"
+	ChangeMemberRoleChanged   = "group.member_role_changed"
+	ChangeOwnerChanged        = "group.owner_changed"
+	ChangeUserRenamed         = "user.renamed"
+	ChangeUserPhotoUpdated    = "user.photo_updated"
+)
+
+// ChangeLogRetention è per quanto tempo le modifiche restano nel change log: un client che non si sincronizza da più
+// tempo deve ricaricare tutto il proprio stato
+const ChangeLogRetention = 30 * 24 * time.Hour
+
+// DefaultChangeLimit e MaxChangeLimit sono il numero predefinito e massimo di modifiche restituite da GetChanges
+const (
+	DefaultChangeLimit = 500
+	MaxChangeLimit     = 1000
+)
+
+// conversationRecipients è una subquery che restituisce gli id dei membri della conversazione; i parametri sono
+// l'id della conversazione ripetuto tre volte
+const conversationRecipients = `
+	SELECT creator_id FROM conversations WHERE id = ? AND type = 'private'
+	UNION SELECT otherUser FROM conversations WHERE id = ? AND type = 'private'
+	UNION SELECT user_id FROM group_members WHERE conversation_id = ?`
+
+// contactRecipients è una subquery che restituisce l'id dell'utente e quelli degli utenti con cui ha almeno una
+// conversazione in comune; i parametri sono l'id dell'utente ripetuto cinque volte
+const contactRecipients = `
+	SELECT CAST(? AS INTEGER)
+	UNION SELECT otherUser FROM conversations WHERE type = 'private' AND creator_id = ?
+	UNION SELECT creator_id FROM conversations WHERE type = 'private' AND otherUser = ?
+	UNION SELECT gm2.user_id FROM group_members gm1
+	JOIN group_members gm2 ON gm2.conversation_id = gm1.conversation_id
+	WHERE gm1.user_id = ? AND gm2.user_id != ?`
+
+// recordConversationChange salva la modifica nel change log di tutti i membri attuali della conversazione
+func (db *appdbimpl) recordConversationChange(ctx context.Context, change Change) error {
+	return db.recordChange(ctx, change, conversationRecipients,
+		change.ConversationID, change.ConversationID, change.ConversationID)
+}
+
+// recordUserChange salva la modifica al profilo dell'utente change.UserID nel change log dell'utente e dei suoi
+// contatti
+func (db *appdbimpl) recordUserChange(ctx context.Context, change Change) error {
+	return db.recordChange(ctx, change, contactRecipients,
+		change.UserID, change.UserID, change.UserID, change.UserID, change.UserID)
+}
+
+// recordReactionChange salva l'aggiunta o la rimozione della reazione dell'utente al messaggio nel change log dei
+// membri della conversazione
+func (db *appdbimpl) recordReactionChange(ctx context.Context, changeType, messageID, userID, reaction string) error {
+	convID, err := db.conversationOfMessage(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	return db.recordConversationChange(ctx, Change{
+		Type:           changeType,
+		ConversationID: convID,
+		MessageID:      messageID,
+		UserID:         userID,
+		Value:          reaction,
+	})
+}
+
+// conversationOfMessage restituisce l'id della conversazione a cui appartiene il messaggio
+func (db *appdbimpl) conversationOfMessage(ctx context.Context, messageID string) (string, error) {
+	var convID string
+	err := db.c.QueryRowContext(ctx, "SELECT conversation_id FROM messages WHERE id = ?", messageID).Scan(&convID)
+	return convID, err
+}
+
+// recordChange salva la modifica nel change log di ogni utente restituito dalla subquery recipients. I seq vengono
+// presi da change_log_head, la cui riga resta bloccata fino alla fine della transazione: le transazioni che salvano
+// modifiche terminano quindi nell'ordine dei loro seq, e GetChanges non può restituire un seq prima che siano visibili
+// tutte le modifiche con un seq più basso
+func (db *appdbimpl) recordChange(ctx context.Context, change Change, recipients string, args ...interface{}) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// L'aggiornamento blocca la riga anche se non cambia il valore, che viene aggiornato dopo l'inserimento
+		var head int64
+		err := tx.c.QueryRowContext(ctx, "UPDATE change_log_head SET seq = seq WHERE id = 1 RETURNING seq").Scan(&head)
+		if err != nil {
+			return err
+		}
+
+		params := append([]interface{}{
+			head,
+			change.Type,
+			nullIfEmpty(change.ConversationID),
+			nullIfEmpty(change.MessageID),
+			nullIfEmpty(change.UserID),
+			change.Value,
+			globaltime.Now().UTC(),
+		}, args...)
+		res, err := tx.c.ExecContext(ctx, `
+			INSERT INTO change_log (seq, user_id, type, conversation_id, message_id, subject_id, value, created_at)
+			SELECT CAST(? AS BIGINT) + ROW_NUMBER() OVER (ORDER BY u.id), u.id, ?, CAST(? AS INTEGER), CAST(? AS INTEGER),
+				CAST(? AS INTEGER), ?, `+tx.conn.dialect.timestampParam()+`
+			FROM users u
+			WHERE u.id IN (`+recipients+`)`, params...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.c.ExecContext(ctx, "UPDATE change_log_head SET seq = ? WHERE id = 1", head+n)
+		return err
+	})
+}
+
+// nullIfEmpty converte la stringa vuota in NULL
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// GetChanges restituisce, in ordine, al massimo limit modifiche rilevanti per l'utente successive a since. Se alcune
+// di queste modifiche sono già state eliminate dal change log, la pagina ha FullResync impostato e nessuna modifica
+func (db *appdbimpl) GetChanges(ctx context.Context, userID string, since int64, limit int) (ChangePage, error) {
+	if limit <= 0 {
+		limit = DefaultChangeLimit
+	} else if limit > MaxChangeLimit {
+		limit = MaxChangeLimit
+	}
+
+	// Il client deve ricaricare tutto se ha perso modifiche già compattate o se since non è mai stato restituito
+	floor, head, err := db.changeLogBounds(ctx)
+	if err != nil {
+		return ChangePage{}, err
+	}
+	if since < floor || since > head {
+		return ChangePage{Changes: []Change{}, NextSince: head, FullResync: true}, nil
+	}
+
+	// Legge una modifica in più del limite per sapere se ce ne sono altre. Il messaggio viene incluso per le
+	// modifiche di tipo ChangeMessageCreated, se non è stato eliminato nel frattempo
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT cl.seq, cl.type, cl.conversation_id, cl.message_id, cl.subject_id, cl.value, cl.created_at,
+			m.sender_id, m.content, m.timestamp, m.status, m.edited_at, m.reply_to, m.kind, m.payload
+		FROM change_log cl
+		LEFT JOIN messages m ON cl.type = ? AND m.id = cl.message_id
+		WHERE cl.user_id = ? AND cl.seq > ?
+		ORDER BY cl.seq ASC
+		LIMIT ?`, ChangeMessageCreated, userID, since, limit+1)
+	if err != nil {
+		return ChangePage{}, err
+	}
+	defer rows.Close()
+
+	page := ChangePage{Changes: []Change{}, NextSince: since}
+	for rows.Next() {
+		var change Change
+		var convID, messageID, subjectID, senderID, content, timestamp, status, editedAt, replyTo, kind, payload sql.NullString
+		err := rows.Scan(&change.Seq, &change.Type, &convID, &messageID, &subjectID, &change.Value, &change.CreatedAt,
+			&senderID, &content, &timestamp, &status, &editedAt, &replyTo, &kind, &payload)
+		if err != nil {
+			return ChangePage{}, err
+		}
+		change.ConversationID = convID.String
+		change.MessageID = messageID.String
+		change.UserID = subjectID.String
+		if senderID.Valid {
+			change.Message = &Message{
+				MessageID:      change.MessageID,
+				ConversationID: change.ConversationID,
+				SenderID:       senderID.String,
+				Content:        content.String,
+				Timestamp:      timestamp.String,
+				Status:         status.String,
+				EditedAt:       editedAt.String,
+				ReplyTo:        replyPreview(replyTo),
+				Attachments:    []Attachment{},
+				Reactions:      []Reaction{},
+				Kind:           kind.String,
+			}
+			if change.Message.Payload, err = systemPayload(payload); err != nil {
+				return ChangePage{}, err
+			}
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return ChangePage{}, err
+	}
+
+	if len(page.Changes) > limit {
+		page.Changes = page.Changes[:limit]
+		page.HasMore = true
+	}
+	if len(page.Changes) > 0 {
+		page.NextSince = page.Changes[len(page.Changes)-1].Seq
+	}
+
+	// Completa le anteprime dei messaggi citati dai messaggi inclusi e i loro allegati
+	var messages []Message
+	for _, change := range page.Changes {
+		if change.Message != nil {
+			messages = append(messages, *change.Message)
+		}
+	}
+	if err := db.loadReplyPreviews(ctx, messages); err != nil {
+		return ChangePage{}, err
+	}
+	if err := db.loadAttachments(ctx, messages); err != nil {
+		return ChangePage{}, err
+	}
+	for i, j := 0, 0; i < len(page.Changes); i++ {
+		if page.Changes[i].Message != nil {
+			page.Changes[i].Message = &messages[j]
+			j++
+		}
+	}
+	return page, nil
+}
+
+// changeLogBounds restituisce il numero di sequenza dell'ultima modifica compattata (0 se il change log non è mai
+// stato compattato) e quello dell'ultima modifica salvata
+func (db *appdbimpl) changeLogBounds(ctx context.Context) (int64, int64, error) {
+	var floor int64
+	err := db.c.QueryRowContext(ctx, "SELECT seq FROM change_log_floor WHERE id = 1").Scan(&floor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+
+	var head int64
+	if err := db.c.QueryRowContext(ctx, "SELECT seq FROM change_log_head WHERE id = 1").Scan(&head); err != nil {
+		return 0, 0, err
+	}
+	if head < floor {
+		return floor, floor, nil
+	}
+	return floor, head, nil
+}
+
+// CompactChangeLog elimina le modifiche più vecchie di ChangeLogRetention. I client che non le hanno ancora ricevute
+// dovranno ricaricare tutto il proprio stato
+func (db *appdbimpl) CompactChangeLog(ctx context.Context) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var floor sql.NullInt64
+		err := tx.c.QueryRowContext(ctx, "SELECT MAX(seq) FROM change_log WHERE created_at <= ?",
+			globaltime.Now().UTC().Add(-ChangeLogRetention)).Scan(&floor)
+		if err != nil {
+			return err
+		}
+		if !floor.Valid {
+			// Niente da compattare
+			return nil
+		}
+
+		if _, err := tx.c.ExecContext(ctx, "DELETE FROM change_log WHERE seq <= ?", floor.Int64); err != nil {
+			return err
+		}
+		_, err = tx.c.ExecContext(ctx, `
+			INSERT INTO change_log_floor (id, seq) VALUES (1, ?)
+			ON CONFLICT (id) DO UPDATE SET seq = CASE
+				WHEN excluded.seq > change_log_floor.seq THEN excluded.seq ELSE change_log_floor.seq
+			END`, floor.Int64)
+		return err
+	})
+}
@@ -0,0 +1,1412 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// I test di questo file verificano che tutte le implementazioni di AppDatabase abbiano la stessa semantica: ogni
+// implementazione esegue la stessa suite (testAppDatabase) su un database vuoto
+
+func TestMemory(t *testing.T) {
+	testAppDatabase(t, func(t *testing.T) AppDatabase {
+		return NewMemory()
+	})
+}
+
+// TestMemoryConcurrent verifica che l'implementazione in memoria possa essere usata da più goroutine (go test -race)
+func TestMemoryConcurrent(t *testing.T) {
+	db := NewMemory()
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+
+	const senders = 8
+	errs := make(chan error, senders)
+	for i := 0; i < senders; i++ {
+		go func(i int) {
+			errs <- db.WithTx(ctx, func(tx AppDatabase) error {
+				messageID, err := tx.InsertMessage(ctx, conv, alice, fmt.Sprint(i), "", nil)
+				if err != nil {
+					return err
+				}
+				if err := tx.UpdateLastMessage(ctx, conv, messageID); err != nil {
+					return err
+				}
+				return tx.MarkConversationRead(ctx, conv, bob)
+			})
+		}(i)
+	}
+	for i := 0; i < senders; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != senders {
+		t.Errorf("got %d messages, want %d", len(page.Messages), senders)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	testAppDatabase(t, func(t *testing.T) AppDatabase {
+		conn, err := sql.Open(string(SQLite), filepath.Join(t.TempDir(), "wasatext.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+
+		db, err := New(conn, SQLite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+// TestSQLiteSearchModule controlla che l'indice di ricerca usi FTS5 se il driver è compilato con il tag sqlite_fts5,
+// come fanno i comandi di build e la CI, e FTS4 altrimenti
+func TestSQLiteSearchModule(t *testing.T) {
+	conn, err := sql.Open(string(SQLite), filepath.Join(t.TempDir(), "wasatext.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	db, err := New(conn, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fts := db.(*appdbimpl).fts; fts != wantSearchModule {
+		t.Errorf("search index module = %q, want %q", fts, wantSearchModule)
+	}
+}
+
+// TestPostgres viene eseguito solo se la variabile d'ambiente WASATEXT_TEST_POSTGRES_DSN contiene il DSN di un
+// database PostgreSQL di prova, come nella CI
+func TestPostgres(t *testing.T) {
+	testAppDatabase(t, postgresOpener(t))
+}
+
+// TestPostgresChangeLogOrder verifica che una modifica salvata da una transazione non ancora terminata non venga
+// scavalcata: una transazione concorrente che salva un'altra modifica attende che la prima termini, altrimenti un
+// client che si sincronizza nel frattempo riceverebbe il seq più alto e non riceverebbe mai quello più basso
+func TestPostgresChangeLogOrder(t *testing.T) {
+	db := postgresOpener(t)(t)
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+
+	recorded := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- db.WithTx(ctx, func(tx AppDatabase) error {
+			if _, err := tx.InsertMessage(ctx, conv, alice, "first", "", nil); err != nil {
+				return err
+			}
+			close(recorded)
+			<-release
+			return nil
+		})
+	}()
+	select {
+	case <-recorded:
+	case err := <-done:
+		t.Fatal(err)
+	}
+	go func() {
+		_, err := db.InsertMessage(ctx, conv, bob, "second", "", nil)
+		done <- err
+	}()
+
+	// Finché la prima transazione è aperta, nessuna delle due modifiche è visibile
+	time.Sleep(200 * time.Millisecond)
+	page, err := db.GetChanges(ctx, alice, 0, 0)
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Changes) != 1 || page.Changes[0].Type != ChangeConversationCreated {
+		t.Errorf("changes while the first transaction is open = %+v", page.Changes)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rest, err := db.GetChanges(ctx, alice, page.NextSince, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest.Changes) != 2 || rest.Changes[0].Message == nil || rest.Changes[0].Message.Content != "first" ||
+		rest.Changes[1].Message == nil || rest.Changes[1].Message.Content != "second" {
+		t.Errorf("changes after the commit = %+v", rest.Changes)
+	}
+}
+
+// postgresOpener restituisce la funzione che apre un database PostgreSQL vuoto per testAppDatabase, o salta il test se
+// WASATEXT_TEST_POSTGRES_DSN non è impostata. Ogni database usa uno schema separato, eliminato alla fine del test
+func postgresOpener(t *testing.T) func(t *testing.T) AppDatabase {
+	dsn := os.Getenv("WASATEXT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("WASATEXT_TEST_POSTGRES_DSN not set")
+	}
+	admin, err := sql.Open(string(Postgres), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+
+	n := 0
+	return func(t *testing.T) AppDatabase {
+		n++
+		schema := fmt.Sprintf("wasatext_test_%d_%d", time.Now().UnixNano(), n)
+		if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+		conn, err := sql.Open(string(Postgres), withSearchPath(dsn, schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+
+		db, err := New(conn, Postgres)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+}
+
+// withSearchPath aggiunge al DSN il parametro search_path, sia in formato URL che key=value
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", schema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
+
+// testAppDatabase esegue la suite di conformità: open deve restituire un database nuovo e vuoto
+func testAppDatabase(t *testing.T, open func(t *testing.T) AppDatabase) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db AppDatabase)
+	}{
+		{"Users", testUsers},
+		{"Sessions", testSessions},
+		{"PrivateConversations", testPrivateConversations},
+		{"Groups", testGroups},
+		{"GroupOwnership", testGroupOwnership},
+		{"GroupProfile", testGroupProfile},
+		{"GroupInvites", testGroupInvites},
+		{"SystemMessages", testSystemMessages},
+		{"LastMessage", testLastMessage},
+		{"Reactions", testReactions},
+		{"CascadeDelete", testCascadeDelete},
+		{"Replies", testReplies},
+		{"Pagination", testPagination},
+		{"Receipts", testReceipts},
+		{"Transactions", testTransactions},
+		{"ChangeLog", testChangeLog},
+		{"UserEvents", testUserEvents},
+		{"Edits", testEdits},
+		{"Search", testSearch},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+// mustUser crea un utente e ne restituisce l'id
+func mustUser(t *testing.T, db AppDatabase, name string) string {
+	t.Helper()
+	id, err := db.CreateUser(context.Background(), name)
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", name, err)
+	}
+	return id
+}
+
+// mustPrivate crea una conversazione privata tra due utenti e ne restituisce l'id
+func mustPrivate(t *testing.T, db AppDatabase, user1, user2 string) string {
+	t.Helper()
+	id, err := db.CreatePrivateConversation(context.Background(), user1, user2)
+	if err != nil {
+		t.Fatalf("CreatePrivateConversation: %v", err)
+	}
+	return id
+}
+
+// mustGroup crea un gruppo con il creatore (come proprietario) e gli altri membri specificati e ne restituisce l'id
+func mustGroup(t *testing.T, db AppDatabase, name, creator string, members ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	id, err := db.CreateGroup(ctx, name, creator)
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if err := db.AddUserToGroup(ctx, id, creator, RoleOwner, ""); err != nil {
+		t.Fatalf("AddUserToGroup: %v", err)
+	}
+	for _, userID := range members {
+		if err := db.AddUserToGroup(ctx, id, userID, RoleMember, creator); err != nil {
+			t.Fatalf("AddUserToGroup: %v", err)
+		}
+	}
+	return id
+}
+
+// mustSend invia un messaggio e lo rende l'ultimo della conversazione, come fa l'API
+func mustSend(t *testing.T, db AppDatabase, convID, userID, text, replyTo string, attachments ...NewAttachment) string {
+	t.Helper()
+	ctx := context.Background()
+	var messageID string
+	err := db.WithTx(ctx, func(tx AppDatabase) error {
+		var err error
+		messageID, err = tx.InsertMessage(ctx, convID, userID, text, replyTo, attachments)
+		if err != nil {
+			return err
+		}
+		return tx.UpdateLastMessage(ctx, convID, messageID)
+	})
+	if err != nil {
+		t.Fatalf("sending message: %v", err)
+	}
+	return messageID
+}
+
+// equalIDs confronta due liste di id
+func equalIDs(a, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+func testUsers(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	if _, err := db.CreateUser(ctx, "alice"); err == nil {
+		t.Error("creating a user with a duplicate name succeeded")
+	}
+
+	if id, err := db.GetUserByName(ctx, "alice"); err != nil || id != alice {
+		t.Errorf("GetUserByName = %q, %v; want %q", id, err, alice)
+	}
+	if _, err := db.GetUserByName(ctx, "nobody"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByName of a missing user: %v, want sql.ErrNoRows", err)
+	}
+	if _, err := db.GetUserByID(ctx, "999"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByID of a missing user: %v, want sql.ErrNoRows", err)
+	}
+
+	if err := db.ModifyUserName(ctx, alice, "alicia"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := db.GetUserByID(ctx, alice); name != "alicia" {
+		t.Errorf("name after ModifyUserName = %q", name)
+	}
+	if photo, err := db.GetUserPhotoByID(ctx, alice); err != nil || photo != "" {
+		t.Errorf("GetUserPhotoByID = %q, %v; want no photo", photo, err)
+	}
+	if err := db.UpdateUserPhoto(ctx, alice, "photo-key"); err != nil {
+		t.Fatal(err)
+	}
+	if photo, _ := db.GetUserPhotoByID(ctx, alice); photo != "photo-key" {
+		t.Errorf("photo after UpdateUserPhoto = %q", photo)
+	}
+}
+
+func testSessions(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	token, err := db.CreateSession(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := db.GetUserIDBySession(ctx, token); err != nil || id != alice {
+		t.Errorf("GetUserIDBySession = %q, %v; want %q", id, err, alice)
+	}
+	if _, err := db.GetUserIDBySession(ctx, "not-a-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetUserIDBySession of an unknown token: %v", err)
+	}
+	if err := db.DeleteSession(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserIDBySession(ctx, token); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetUserIDBySession of a revoked token: %v", err)
+	}
+}
+
+func testPrivateConversations(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+
+	if _, err := db.CreatePrivateConversation(ctx, alice, alice); err == nil {
+		t.Error("creating a conversation with yourself succeeded")
+	}
+	conv := mustPrivate(t, db, alice, bob)
+	if again := mustPrivate(t, db, bob, alice); again != conv {
+		t.Errorf("second conversation between the same users: %q, want %q", again, conv)
+	}
+
+	for _, tc := range []struct {
+		user string
+		want bool
+	}{{alice, true}, {bob, true}, {carol, false}} {
+		if in, err := db.IsUserInConversation(ctx, tc.user, conv); err != nil || in != tc.want {
+			t.Errorf("IsUserInConversation(%s) = %v, %v; want %v", tc.user, in, err, tc.want)
+		}
+	}
+	if in, err := db.IsUserInConversation(ctx, alice, "999"); err != nil || in {
+		t.Errorf("IsUserInConversation of a missing conversation = %v, %v", in, err)
+	}
+	if members, _ := db.GetConversationMembers(ctx, conv); !equalIDs(members, []string{alice, bob}) {
+		t.Errorf("GetConversationMembers = %v", members)
+	}
+	if private, _ := db.IsConversationPrivate(ctx, conv); !private {
+		t.Error("IsConversationPrivate = false")
+	}
+	if _, err := db.IsUserCreatorOfGroup(ctx, alice, conv); err == nil {
+		t.Error("IsUserCreatorOfGroup of a private conversation succeeded")
+	}
+
+	// Il nome della conversazione è quello dell'altro utente
+	c, err := db.GetConversationByID(ctx, conv, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "alice" || c.Type != "private" || c.Photo != UserPhotoURL(alice, "") {
+		t.Errorf("conversation seen by bob = %+v", c)
+	}
+	if _, err := db.GetConversationByID(ctx, "999", alice); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetConversationByID of a missing conversation: %v", err)
+	}
+
+	if convs, _ := db.GetUserConversations(ctx, bob); len(convs) != 1 || convs[0].ConvID != conv {
+		t.Errorf("GetUserConversations(bob) = %+v", convs)
+	}
+	if convs, _ := db.GetUserConversations(ctx, carol); len(convs) != 0 {
+		t.Errorf("GetUserConversations(carol) = %+v", convs)
+	}
+}
+
+func testGroups(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+
+	group := mustGroup(t, db, "friends", alice, bob)
+	if err := db.AddUserToGroup(ctx, group, bob, RoleMember, alice); err == nil {
+		t.Error("adding a member twice succeeded")
+	}
+	if err := db.AddUserToGroup(ctx, group, "999", RoleMember, alice); err == nil {
+		t.Error("adding a missing user succeeded")
+	}
+	if err := db.AddUserToGroup(ctx, group, carol, "superuser", alice); err == nil {
+		t.Error("adding a member with an invalid role succeeded")
+	}
+
+	if role, err := db.GetGroupRole(ctx, group, alice); err != nil || role != RoleOwner {
+		t.Errorf("GetGroupRole(alice) = %q, %v", role, err)
+	}
+	if role, err := db.GetGroupRole(ctx, group, bob); err != nil || role != RoleMember {
+		t.Errorf("GetGroupRole(bob) = %q, %v", role, err)
+	}
+	if _, err := db.GetGroupRole(ctx, group, carol); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetGroupRole of a non-member: %v", err)
+	}
+	if err := db.SetGroupRole(ctx, group, bob, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := db.GetGroupRole(ctx, group, bob); role != RoleAdmin {
+		t.Errorf("GetGroupRole(bob) after promotion = %q", role)
+	}
+	if page, _ := db.GetChanges(ctx, alice, 0, 0); len(page.Changes) == 0 ||
+		page.Changes[len(page.Changes)-1].Type != ChangeMemberRoleChanged || page.Changes[len(page.Changes)-1].Value != RoleAdmin {
+		t.Errorf("changes after promotion = %+v", page.Changes)
+	}
+	if err := db.SetGroupRole(ctx, group, carol, RoleAdmin); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetGroupRole of a non-member: %v", err)
+	}
+	if err := db.SetGroupRole(ctx, group, bob, "superuser"); err == nil {
+		t.Error("SetGroupRole with an invalid role succeeded")
+	}
+	if role, _ := db.GetGroupRole(ctx, group, bob); role != RoleAdmin {
+		t.Errorf("GetGroupRole(bob) after an invalid change = %q", role)
+	}
+
+	if creator, err := db.IsUserCreatorOfGroup(ctx, alice, group); err != nil || !creator {
+		t.Errorf("IsUserCreatorOfGroup(alice) = %v, %v", creator, err)
+	}
+	if creator, _ := db.IsUserCreatorOfGroup(ctx, bob, group); creator {
+		t.Error("IsUserCreatorOfGroup(bob) = true")
+	}
+	if in, _ := db.IsUserInConversation(ctx, carol, group); in {
+		t.Error("carol is in the group before being added")
+	}
+	if contacts, _ := db.GetContactIDs(ctx, bob); !equalIDs(contacts, []string{alice}) {
+		t.Errorf("GetContactIDs(bob) = %v", contacts)
+	}
+
+	if err := db.ChangeGroupName(ctx, group, "best friends"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateGroupPhoto(ctx, group, "group-key"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.GetConversationByID(ctx, group, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "best friends" || c.Type != "group" || c.CreatorID != alice || c.Photo != GroupPhotoURL(group, "group-key") {
+		t.Errorf("group = %+v", c)
+	}
+
+	if newOwner, err := db.LeaveGroup(ctx, group, bob); err != nil || newOwner != "" {
+		t.Fatalf("LeaveGroup(bob) = %q, %v", newOwner, err)
+	}
+	if in, _ := db.IsUserInConversation(ctx, bob, group); in {
+		t.Error("bob is still in the group after leaving")
+	}
+	if members, _ := db.GetConversationMembers(ctx, group); !equalIDs(members, []string{alice}) {
+		t.Errorf("GetConversationMembers after leaving = %v", members)
+	}
+	if convs, _ := db.GetUserConversations(ctx, bob); len(convs) != 0 {
+		t.Errorf("GetUserConversations(bob) after leaving = %+v", convs)
+	}
+}
+
+func testGroupOwnership(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	dave := mustUser(t, db, "dave")
+	erin := mustUser(t, db, "erin")
+
+	// erin entra nel gruppo prima degli altri membri, anche se ha l'id maggiore
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	globaltime.FixedTime = time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	group := mustGroup(t, db, "friends", alice, erin)
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Minute)
+	for _, userID := range []string{bob, carol, dave} {
+		if err := db.AddUserToGroup(ctx, group, userID, RoleMember, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	globaltime.FixedTime = time.Time{}
+
+	// Il proprietario non può essere rimosso
+	if err := db.RemoveGroupMember(ctx, group, alice); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RemoveGroupMember of the owner: %v", err)
+	}
+	if err := db.RemoveGroupMember(ctx, group, "999"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RemoveGroupMember of a non-member: %v", err)
+	}
+	if err := db.RemoveGroupMember(ctx, group, dave); err != nil {
+		t.Fatal(err)
+	}
+	if in, _ := db.IsUserInConversation(ctx, dave, group); in {
+		t.Error("dave is still in the group after being removed")
+	}
+	if page, _ := db.GetChanges(ctx, dave, 0, 0); len(page.Changes) == 0 || page.Changes[len(page.Changes)-1].Type != ChangeMemberRemoved {
+		t.Errorf("dave's changes after the removal = %+v", page.Changes)
+	}
+
+	// Il trasferimento cambia anche il creatore della conversazione, e il vecchio proprietario diventa amministratore
+	if err := db.TransferGroupOwnership(ctx, group, dave); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("TransferGroupOwnership to a non-member: %v", err)
+	}
+	if err := db.TransferGroupOwnership(ctx, group, bob); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := db.GetGroupRole(ctx, group, bob); role != RoleOwner {
+		t.Errorf("GetGroupRole(bob) after the transfer = %q", role)
+	}
+	if role, _ := db.GetGroupRole(ctx, group, alice); role != RoleAdmin {
+		t.Errorf("GetGroupRole(alice) after the transfer = %q", role)
+	}
+	if creator, _ := db.IsUserCreatorOfGroup(ctx, bob, group); !creator {
+		t.Error("bob is not the creator of the group after the transfer")
+	}
+	if c, _ := db.GetConversationByID(ctx, group, carol); c.CreatorID != bob {
+		t.Errorf("CreatorID after the transfer = %q", c.CreatorID)
+	}
+	if page, _ := db.GetChanges(ctx, carol, 0, 0); len(page.Changes) == 0 ||
+		page.Changes[len(page.Changes)-1].Type != ChangeOwnerChanged || page.Changes[len(page.Changes)-1].UserID != bob {
+		t.Errorf("carol's changes after the transfer = %+v", page.Changes)
+	}
+
+	// Il proprietario che esce lascia il gruppo a un amministratore, anche se altri membri sono entrati prima
+	if newOwner, err := db.LeaveGroup(ctx, group, bob); err != nil || newOwner != alice {
+		t.Fatalf("LeaveGroup(bob) = %q, %v; want %q", newOwner, err, alice)
+	}
+	if err := db.SetGroupRole(ctx, group, carol, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if newOwner, err := db.LeaveGroup(ctx, group, alice); err != nil || newOwner != carol {
+		t.Fatalf("LeaveGroup(alice) = %q, %v; want %q", newOwner, err, carol)
+	}
+	if role, _ := db.GetGroupRole(ctx, group, carol); role != RoleOwner {
+		t.Errorf("GetGroupRole(carol) after the owner left = %q", role)
+	}
+	if convs, _ := db.GetUserConversations(ctx, alice); len(convs) != 0 {
+		t.Errorf("GetUserConversations(alice) after leaving = %+v", convs)
+	}
+
+	// Senza amministratori il gruppo passa al membro entrato per primo
+	if err := db.AddUserToGroup(ctx, group, bob, RoleMember, alice); err != nil {
+		t.Fatal(err)
+	}
+	if newOwner, err := db.LeaveGroup(ctx, group, carol); err != nil || newOwner != erin {
+		t.Fatalf("LeaveGroup(carol) = %q, %v; want %q", newOwner, err, erin)
+	}
+	if newOwner, err := db.LeaveGroup(ctx, group, erin); err != nil || newOwner != bob {
+		t.Fatalf("LeaveGroup(erin) = %q, %v; want %q", newOwner, err, bob)
+	}
+
+	// L'ultimo membro esce senza successori
+	if newOwner, err := db.LeaveGroup(ctx, group, bob); err != nil || newOwner != "" {
+		t.Fatalf("LeaveGroup(bob) = %q, %v", newOwner, err)
+	}
+	if members, _ := db.GetConversationMembers(ctx, group); len(members) != 0 {
+		t.Errorf("GetConversationMembers after everyone left = %v", members)
+	}
+}
+
+func testGroupProfile(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	if err := db.UpdateUserPhoto(ctx, bob, "bob-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	globaltime.FixedTime = created
+	group := mustGroup(t, db, "friends", alice, bob)
+	globaltime.FixedTime = created.Add(time.Minute)
+	if err := db.AddUserToGroup(ctx, group, carol, RoleMember, bob); err != nil {
+		t.Fatal(err)
+	}
+	globaltime.FixedTime = time.Time{}
+	if err := db.AddUserToGroup(ctx, group, carol, RoleMember, "999"); err == nil {
+		t.Error("adding a member on behalf of a missing user succeeded")
+	}
+
+	// I membri sono in ordine di ingresso nel gruppo
+	members, err := db.GetGroupMembers(ctx, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("GetGroupMembers = %+v", members)
+	}
+	want := []GroupMember{
+		{UserID: alice, UserName: "alice", Photo: UserPhotoURL(alice, ""), Role: RoleOwner},
+		{UserID: bob, UserName: "bob", Photo: UserPhotoURL(bob, "bob-key"), Role: RoleMember, AddedBy: alice},
+		{UserID: carol, UserName: "carol", Photo: UserPhotoURL(carol, ""), Role: RoleMember, AddedBy: bob},
+	}
+	for i, m := range members {
+		joined := m.JoinedAt
+		m.JoinedAt = ""
+		if m != want[i] {
+			t.Errorf("GetGroupMembers[%d] = %+v, want %+v", i, m, want[i])
+		}
+		wantJoined := created
+		if i == 2 {
+			wantJoined = created.Add(time.Minute)
+		}
+		if at, err := time.Parse(time.RFC3339Nano, joined); err != nil || !at.Equal(wantJoined) {
+			t.Errorf("GetGroupMembers[%d].JoinedAt = %q, want %v", i, joined, wantJoined)
+		}
+	}
+
+	profile, err := db.GetGroupProfile(ctx, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := profile.CreatedAt
+	profile.CreatedAt = ""
+	wantProfile := GroupProfile{
+		ConvID:      group,
+		Name:        "friends",
+		Photo:       GroupPhotoURL(group, ""),
+		CreatorID:   alice,
+		CreatorName: "alice",
+		MemberCount: 3,
+	}
+	if profile != wantProfile {
+		t.Errorf("GetGroupProfile = %+v, want %+v", profile, wantProfile)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, createdAt); err != nil || !at.Equal(created) {
+		t.Errorf("GetGroupProfile.CreatedAt = %q, want %v", createdAt, created)
+	}
+
+	if err := db.ChangeGroupDescription(ctx, group, "weekend plans"); err != nil {
+		t.Fatal(err)
+	}
+	if profile, _ := db.GetGroupProfile(ctx, group); profile.Description != "weekend plans" {
+		t.Errorf("description after the change = %q", profile.Description)
+	}
+	if page, _ := db.GetChanges(ctx, carol, 0, 0); len(page.Changes) == 0 ||
+		page.Changes[len(page.Changes)-1].Type != ChangeGroupDescription || page.Changes[len(page.Changes)-1].Value != "weekend plans" {
+		t.Errorf("changes after the description change = %+v", page.Changes)
+	}
+
+	// Il profilo segue il proprietario e i membri attuali
+	if _, err := db.LeaveGroup(ctx, group, alice); err != nil {
+		t.Fatal(err)
+	}
+	if profile, _ := db.GetGroupProfile(ctx, group); profile.CreatorID != bob || profile.CreatorName != "bob" || profile.MemberCount != 2 {
+		t.Errorf("GetGroupProfile after the owner left = %+v", profile)
+	}
+
+	conv := mustPrivate(t, db, alice, bob)
+	if _, err := db.GetGroupProfile(ctx, conv); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetGroupProfile of a private conversation: %v", err)
+	}
+	if _, err := db.GetGroupProfile(ctx, "999"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetGroupProfile of a missing group: %v", err)
+	}
+}
+
+func testGroupInvites(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	dave := mustUser(t, db, "dave")
+	erin := mustUser(t, db, "erin")
+	frank := mustUser(t, db, "frank")
+
+	// Ogni invito viene creato un minuto dopo il precedente, così l'ordine degli inviti non dipende dal token
+	defer func() { globaltime.FixedTime = time.Time{} }()
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	globaltime.FixedTime = now
+	group := mustGroup(t, db, "friends", alice, bob)
+	once, err := db.CreateGroupInvite(ctx, group, alice, NewGroupInvite{MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if once.Token == "" || once.ConversationID != group || once.CreatedBy != alice || once.MaxUses != 1 || once.Uses != 0 ||
+		once.ExpiresAt != "" || once.RequiresApproval {
+		t.Errorf("CreateGroupInvite = %+v", once)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, once.CreatedAt); err != nil || !at.Equal(now) {
+		t.Errorf("CreateGroupInvite.CreatedAt = %q, want %v", once.CreatedAt, now)
+	}
+	if invite, err := db.GetGroupInvite(ctx, once.Token); err != nil || invite != once {
+		t.Errorf("GetGroupInvite = %+v, %v", invite, err)
+	}
+
+	// Un invito senza approvazione aggiunge subito l'utente, fino al numero massimo di utilizzi
+	if pending, err := db.JoinGroupWithInvite(ctx, once.Token, carol); err != nil || pending {
+		t.Fatalf("JoinGroupWithInvite(carol) = %v, %v", pending, err)
+	}
+	if role, _ := db.GetGroupRole(ctx, group, carol); role != RoleMember {
+		t.Errorf("GetGroupRole(carol) after joining = %q", role)
+	}
+	if members, _ := db.GetGroupMembers(ctx, group); len(members) != 3 || members[2].UserID != carol || members[2].AddedBy != alice {
+		t.Errorf("GetGroupMembers after joining = %+v", members)
+	}
+	if invite, _ := db.GetGroupInvite(ctx, once.Token); invite.Uses != 1 {
+		t.Errorf("invite after joining = %+v", invite)
+	}
+	if _, err := db.JoinGroupWithInvite(ctx, once.Token, dave); !errors.Is(err, ErrInviteExhausted) {
+		t.Errorf("JoinGroupWithInvite with an exhausted invite: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	globaltime.FixedTime = now
+	expiring, err := db.CreateGroupInvite(ctx, group, bob, NewGroupInvite{ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at, err := time.Parse(time.RFC3339Nano, expiring.ExpiresAt); err != nil || !at.Equal(now.Add(time.Hour)) || expiring.MaxUses != 0 {
+		t.Errorf("CreateGroupInvite with an expiry = %+v", expiring)
+	}
+	globaltime.FixedTime = now.Add(time.Hour)
+	if _, err := db.JoinGroupWithInvite(ctx, expiring.Token, dave); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("JoinGroupWithInvite with an expired invite: %v", err)
+	}
+	if _, err := db.JoinGroupWithInvite(ctx, "missing", dave); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("JoinGroupWithInvite with a missing invite: %v", err)
+	}
+
+	// Un invito con approvazione crea una richiesta di ingresso; ripetere la richiesta non consuma l'invito
+	now = now.Add(time.Minute)
+	globaltime.FixedTime = now
+	approval, err := db.CreateGroupInvite(ctx, group, alice, NewGroupInvite{RequiresApproval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{dave, dave, erin, frank} {
+		if pending, err := db.JoinGroupWithInvite(ctx, approval.Token, userID); err != nil || !pending {
+			t.Fatalf("JoinGroupWithInvite(%s) with approval = %v, %v", userID, pending, err)
+		}
+	}
+	if in, _ := db.IsUserInConversation(ctx, dave, group); in {
+		t.Error("dave is in the group before being approved")
+	}
+	if invite, _ := db.GetGroupInvite(ctx, approval.Token); invite.Uses != 3 {
+		t.Errorf("invite after the requests = %+v", invite)
+	}
+	requests, err := db.GetJoinRequests(ctx, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || requests[0].UserID != dave || requests[0].UserName != "dave" || requests[0].InviteToken != approval.Token ||
+		requests[0].Photo != UserPhotoURL(dave, "") || requests[0].RequestedAt == "" {
+		t.Errorf("GetJoinRequests = %+v", requests)
+	}
+
+	// Revocando l'invito le richieste restano in attesa
+	if err := db.RevokeGroupInvite(ctx, group, approval.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RevokeGroupInvite(ctx, group, approval.Token); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RevokeGroupInvite twice: %v", err)
+	}
+	if _, err := db.GetGroupInvite(ctx, approval.Token); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetGroupInvite of a revoked invite: %v", err)
+	}
+	if requests, _ := db.GetJoinRequests(ctx, group); len(requests) != 3 || requests[0].InviteToken != "" {
+		t.Errorf("GetJoinRequests after the revocation = %+v", requests)
+	}
+	if invites, _ := db.GetGroupInvites(ctx, group); len(invites) != 2 || invites[0].Token != once.Token || invites[1].Token != expiring.Token {
+		t.Errorf("GetGroupInvites = %+v", invites)
+	}
+
+	if err := db.ApproveJoinRequest(ctx, group, dave, bob); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := db.GetGroupMembers(ctx, group); len(members) != 4 || members[3].UserID != dave || members[3].AddedBy != bob {
+		t.Errorf("GetGroupMembers after the approval = %+v", members)
+	}
+	if err := db.ApproveJoinRequest(ctx, group, dave, bob); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ApproveJoinRequest twice: %v", err)
+	}
+	if err := db.RejectJoinRequest(ctx, group, erin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RejectJoinRequest(ctx, group, erin); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RejectJoinRequest twice: %v", err)
+	}
+	if in, _ := db.IsUserInConversation(ctx, erin, group); in {
+		t.Error("erin is in the group after being rejected")
+	}
+
+	// Aggiungere direttamente un utente elimina la sua richiesta
+	if err := db.AddUserToGroup(ctx, group, frank, RoleMember, alice); err != nil {
+		t.Fatal(err)
+	}
+	if requests, _ := db.GetJoinRequests(ctx, group); len(requests) != 0 {
+		t.Errorf("GetJoinRequests after adding frank = %+v", requests)
+	}
+
+	// Gli inviti vengono eliminati insieme al gruppo
+	if err := db.DeleteConversation(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetGroupInvite(ctx, once.Token); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetGroupInvite after deleting the group: %v", err)
+	}
+}
+
+func testSystemMessages(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	group := mustGroup(t, db, "friends", alice, bob)
+	mustSend(t, db, group, bob, "hello friends", "")
+
+	// Il contenuto descrive l'evento con i nomi degli utenti; chi entra con un invito è il mittente del messaggio
+	events := []struct {
+		sender  string
+		payload SystemPayload
+		content string
+	}{
+		{alice, SystemPayload{Type: SystemMemberAdded, UserID: carol}, "alice added carol"},
+		{carol, SystemPayload{Type: SystemMemberAdded, UserID: carol}, "carol joined the group"},
+		{bob, SystemPayload{Type: SystemGroupRenamed, Name: "best friends"}, `bob changed the group name to "best friends"`},
+		{bob, SystemPayload{Type: SystemGroupPhotoUpdated}, "bob changed the group photo"},
+		{alice, SystemPayload{Type: SystemMemberRemoved, UserID: carol}, "alice removed carol"},
+		{alice, SystemPayload{Type: SystemOwnerChanged, UserID: bob}, "bob is now the group owner"},
+		{bob, SystemPayload{Type: SystemMemberLeft, UserID: bob}, "bob left the group"},
+	}
+	var ids []string
+	for _, ev := range events {
+		id, err := db.InsertSystemMessage(ctx, group, ev.sender, ev.payload)
+		if err != nil {
+			t.Fatalf("InsertSystemMessage(%+v): %v", ev.payload, err)
+		}
+		ids = append(ids, id)
+
+		msg, err := db.GetMessageFromID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Kind != MessageKindSystem || msg.SenderID != ev.sender || msg.Content != ev.content ||
+			msg.Payload == nil || *msg.Payload != ev.payload {
+			t.Errorf("GetMessageFromID = %+v, payload %+v", msg, msg.Payload)
+		}
+	}
+	if _, err := db.InsertSystemMessage(ctx, group, "999", SystemPayload{Type: SystemGroupPhotoUpdated}); err == nil {
+		t.Error("inserting a system message from a missing user succeeded")
+	}
+
+	// I messaggi di sistema compaiono nella cronologia insieme a quelli degli utenti
+	page, err := db.GetMessagesFromConversation(ctx, group, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != len(events)+1 || page.Messages[0].Kind != MessageKindText || page.Messages[0].Payload != nil {
+		t.Fatalf("GetMessagesFromConversation = %+v", page.Messages)
+	}
+	for i, msg := range page.Messages[1:] {
+		if msg.MessageID != ids[i] || msg.Kind != MessageKindSystem || msg.Payload == nil || *msg.Payload != events[i].payload {
+			t.Errorf("messages[%d] = %+v, payload %+v", i+1, msg, msg.Payload)
+		}
+	}
+
+	// Il messaggio viene incluso nel change log come i messaggi degli utenti
+	changes, err := db.GetChanges(ctx, alice, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := changes.Changes[len(changes.Changes)-1]
+	if last.Type != ChangeMessageCreated || last.Message == nil || last.Message.Kind != MessageKindSystem ||
+		last.Message.Payload == nil || last.Message.Payload.Type != SystemMemberLeft {
+		t.Errorf("last change = %+v", last)
+	}
+
+	// La ricerca considera solo i messaggi degli utenti
+	if page, err := db.SearchMessages(ctx, alice, "friends", "", 0, ""); err != nil || len(page.Results) != 1 ||
+		page.Results[0].Message.Kind != MessageKindText {
+		t.Errorf("SearchMessages = %+v, %v", page.Results, err)
+	}
+}
+
+func testLastMessage(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+
+	first := mustSend(t, db, conv, alice, "first", "")
+	second := mustSend(t, db, conv, bob, "second", "")
+	if c, _ := db.GetConversationByID(ctx, conv, alice); c.LastMessage != "second" {
+		t.Errorf("LastMessage = %q, want %q", c.LastMessage, "second")
+	}
+	if last, _ := db.GetLastMessageID(ctx, conv); last != second {
+		t.Errorf("GetLastMessageID = %q, want %q", last, second)
+	}
+
+	// Eliminando l'ultimo messaggio la conversazione non ha più un ultimo messaggio finché non viene aggiornato
+	if err := db.DeleteMessage(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := db.GetConversationByID(ctx, conv, alice); c.LastMessage != "" {
+		t.Errorf("LastMessage after deleting it = %q", c.LastMessage)
+	}
+	if last, _ := db.GetLastMessageID(ctx, conv); last != first {
+		t.Errorf("GetLastMessageID after deleting = %q, want %q", last, first)
+	}
+
+	if err := db.DeleteMessage(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := db.GetLastMessageID(ctx, conv); err != nil || last != "" {
+		t.Errorf("GetLastMessageID of an empty conversation = %q, %v", last, err)
+	}
+	if err := db.UpdateLastMessage(ctx, conv, ""); err != nil {
+		t.Errorf("UpdateLastMessage with no message: %v", err)
+	}
+	if err := db.DeleteMessage(ctx, first); err != nil {
+		t.Errorf("deleting a missing message: %v", err)
+	}
+}
+
+func testReactions(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+	msg := mustSend(t, db, conv, alice, "hello", "")
+
+	// La seconda reazione dello stesso utente sostituisce la prima
+	for _, r := range []struct{ user, emoji string }{{alice, "👍"}, {bob, "😂"}, {alice, "❤️"}} {
+		if err := db.InsertReaction(ctx, r.user, msg, r.emoji); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, r := range page.Messages[0].Reactions {
+		got[r.UserID] = r.Reaction
+	}
+	if len(page.Messages[0].Reactions) != 2 || got[alice] != "❤️" || got[bob] != "😂" {
+		t.Errorf("reactions = %+v", page.Messages[0].Reactions)
+	}
+
+	if err := db.DeleteReaction(ctx, msg, bob); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := db.UserHasReaction(ctx, msg, bob); has {
+		t.Error("UserHasReaction(bob) after deleting = true")
+	}
+	if has, _ := db.UserHasReaction(ctx, msg, alice); !has {
+		t.Error("UserHasReaction(alice) = false")
+	}
+	if err := db.InsertReaction(ctx, alice, "999", "👍"); err == nil {
+		t.Error("reacting to a missing message succeeded")
+	}
+}
+
+func testCascadeDelete(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	group := mustGroup(t, db, "friends", alice, bob)
+	msg := mustSend(t, db, group, alice, "hello", "", NewAttachment{Path: "key", FileName: "a.txt", MimeType: "text/plain", Size: 3})
+	if err := db.InsertReaction(ctx, bob, msg, "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := db.GetMessageFromID(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Attachments) != 1 {
+		t.Fatalf("attachments = %+v", m.Attachments)
+	}
+	att, convID, key, err := db.GetAttachment(ctx, m.Attachments[0].AttachmentID)
+	if err != nil || convID != group || key != "key" || att.FileName != "a.txt" || att.URL != m.Attachments[0].URL {
+		t.Errorf("GetAttachment = %+v, %q, %q, %v", att, convID, key, err)
+	}
+
+	if err := db.DeleteConversation(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := db.ConversationExists(ctx, group); exists {
+		t.Error("the conversation still exists")
+	}
+	if exists, _ := db.MessageExists(ctx, msg); exists {
+		t.Error("the message still exists")
+	}
+	if has, _ := db.UserHasReaction(ctx, msg, bob); has {
+		t.Error("the reaction still exists")
+	}
+	if _, _, _, err := db.GetAttachment(ctx, att.AttachmentID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetAttachment after deleting the conversation: %v", err)
+	}
+	if in, _ := db.IsUserInConversation(ctx, bob, group); in {
+		t.Error("bob is still a member")
+	}
+}
+
+func testReplies(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+	quoted := mustSend(t, db, conv, alice, "question", "")
+	reply := mustSend(t, db, conv, bob, "answer", quoted)
+
+	m, err := db.GetMessageFromID(ctx, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MessagePreview{MessageID: quoted, SenderID: alice, SenderName: "alice", Snippet: "question"}
+	if m.ReplyTo == nil || *m.ReplyTo != want {
+		t.Errorf("ReplyTo = %+v, want %+v", m.ReplyTo, want)
+	}
+	if replies, _ := db.GetReplies(ctx, conv, quoted); len(replies) != 1 || replies[0].MessageID != reply {
+		t.Errorf("GetReplies = %+v", replies)
+	}
+
+	if err := db.DeleteMessage(ctx, quoted); err != nil {
+		t.Fatal(err)
+	}
+	m, err = db.GetMessageFromID(ctx, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ReplyTo == nil || *m.ReplyTo != (MessagePreview{MessageID: quoted, Deleted: true}) {
+		t.Errorf("ReplyTo of a deleted message = %+v", m.ReplyTo)
+	}
+}
+
+func testPagination(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, mustSend(t, db, conv, alice, fmt.Sprintf("message %d", i), ""))
+	}
+
+	// Senza cursori viene restituita la pagina più recente; poi si va indietro con Before
+	var got []string
+	q := MessageQuery{Limit: 2}
+	for {
+		page, err := db.GetMessagesFromConversation(ctx, conv, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pageIDs []string
+		for _, m := range page.Messages {
+			pageIDs = append(pageIDs, m.MessageID)
+		}
+		got = append(pageIDs, got...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Before = page.NextCursor
+	}
+	if !equalIDs(got, ids) {
+		t.Errorf("messages read backwards = %v, want %v", got, ids)
+	}
+
+	// Con After si va avanti a partire da un messaggio
+	first, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	older, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{Before: first.NextCursor, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(older.Messages) != 1 || older.Messages[0].MessageID != ids[0] || older.NextCursor != "" {
+		t.Fatalf("oldest page = %+v", older)
+	}
+	after, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{After: first.NextCursor, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Messages) != 2 || after.Messages[0].MessageID != ids[2] || after.Messages[1].MessageID != ids[3] || after.NextCursor == "" {
+		t.Errorf("page after = %+v", after)
+	}
+
+	if _, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{Before: first.NextCursor, After: first.NextCursor}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("both cursors: %v", err)
+	}
+	if _, err := db.GetMessagesFromConversation(ctx, conv, MessageQuery{Before: "!"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("malformed cursor: %v", err)
+	}
+}
+
+func testReceipts(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	group := mustGroup(t, db, "friends", alice, bob, carol)
+	msg := mustSend(t, db, group, alice, "hello", "")
+
+	status := func() string {
+		t.Helper()
+		m, err := db.GetMessageFromID(ctx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Status
+	}
+
+	// Lo stato cambia solo quando tutti i destinatari hanno ricevuto o letto il messaggio
+	if err := db.MarkConversationDelivered(ctx, group, bob); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "sent" {
+		t.Errorf("status after one delivery = %q", s)
+	}
+	if err := db.MarkConversationRead(ctx, group, carol); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "received" {
+		t.Errorf("status after all deliveries = %q", s)
+	}
+	if err := db.MarkConversationRead(ctx, group, bob); err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "read" {
+		t.Errorf("status after all reads = %q", s)
+	}
+
+	receipts, err := db.GetMessageReceipts(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 || receipts[0].UserName != "bob" || receipts[1].UserName != "carol" {
+		t.Fatalf("receipts = %+v", receipts)
+	}
+	for _, r := range receipts {
+		if r.DeliveredAt == "" || r.ReadAt == "" {
+			t.Errorf("receipt = %+v", r)
+		}
+	}
+}
+
+func testTransactions(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+
+	// Le modifiche sono visibili all'interno della transazione e vengono annullate se fn restituisce un errore
+	err := db.WithTx(ctx, func(tx AppDatabase) error {
+		if _, err := tx.CreateUser(ctx, "alice"); err != nil {
+			return err
+		}
+		if _, err := tx.GetUserByName(ctx, "alice"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithTx = %v, want %v", err, errRollback)
+	}
+	if _, err := db.GetUserByName(ctx, "alice"); err == nil {
+		t.Error("the rolled back user exists")
+	}
+
+	// Le transazioni annidate fanno parte di quella esterna
+	err = db.WithTx(ctx, func(tx AppDatabase) error {
+		return tx.WithTx(ctx, func(inner AppDatabase) error {
+			_, err := inner.CreateUser(ctx, "bob")
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserByName(ctx, "bob"); err != nil {
+		t.Errorf("the committed user is missing: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.CreateUser(canceled, "carol"); err == nil {
+		t.Error("CreateUser with a canceled context succeeded")
+	}
+}
+
+func testChangeLog(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	conv := mustPrivate(t, db, alice, bob)
+	msg := mustSend(t, db, conv, alice, "hello", "")
+	if err := db.InsertReaction(ctx, bob, msg, "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := db.GetChanges(ctx, bob, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, c := range page.Changes {
+		types = append(types, c.Type)
+	}
+	want := []string{ChangeConversationCreated, ChangeMessageCreated, ChangeReactionAdded}
+	if !equalIDs(types, want) {
+		t.Fatalf("changes = %v, want %v", types, want)
+	}
+	created := page.Changes[1]
+	if created.Message == nil || created.Message.Content != "hello" || created.Message.Attachments == nil || created.UserID != alice {
+		t.Errorf("message.created change = %+v", created)
+	}
+	if page.Changes[2].Value != "👍" || page.Changes[2].UserID != bob {
+		t.Errorf("reaction.added change = %+v", page.Changes[2])
+	}
+	if page.NextSince != page.Changes[2].Seq || page.HasMore || page.FullResync {
+		t.Errorf("page = %+v", page)
+	}
+
+	// La paginazione riprende da NextSince
+	first, err := db.GetChanges(ctx, bob, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Changes) != 1 || !first.HasMore {
+		t.Errorf("first page = %+v", first)
+	}
+	rest, err := db.GetChanges(ctx, bob, first.NextSince, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest.Changes) != 2 || rest.HasMore {
+		t.Errorf("second page = %+v", rest)
+	}
+
+	if empty, _ := db.GetChanges(ctx, carol, page.NextSince, 0); len(empty.Changes) != 0 || empty.FullResync {
+		t.Errorf("carol's changes = %+v", empty)
+	}
+	if resync, _ := db.GetChanges(ctx, bob, page.NextSince+100, 0); !resync.FullResync {
+		t.Errorf("changes after the head = %+v", resync)
+	}
+	if err := db.CompactChangeLog(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := db.GetChanges(ctx, bob, 0, 0); len(after.Changes) != 3 {
+		t.Errorf("recent changes were compacted: %+v", after)
+	}
+}
+
+func testUserEvents(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+
+	if first, last, err := db.GetUserEventBounds(ctx, alice); err != nil || first != 1 || last != 0 {
+		t.Errorf("bounds with no events = %d, %d, %v", first, last, err)
+	}
+	for i := 0; i < 3; i++ {
+		stored, err := db.AppendUserEvent(ctx, []string{alice, bob, alice}, "test", "", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 2 || stored[0].Seq != int64(i+1) {
+			t.Fatalf("stored events = %+v", stored)
+		}
+	}
+
+	events, err := db.GetUserEventsAfter(ctx, alice, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Seq != 2 || events[0].Payload != "1" || events[1].Seq != 3 {
+		t.Errorf("events after 1 = %+v", events)
+	}
+	if events, _ := db.GetUserEventsAfter(ctx, alice, 0, 1); len(events) != 1 {
+		t.Errorf("events with limit 1 = %+v", events)
+	}
+	if first, last, _ := db.GetUserEventBounds(ctx, alice); first != 1 || last != 3 {
+		t.Errorf("bounds = %d, %d", first, last)
+	}
+}
+
+func testEdits(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	conv := mustPrivate(t, db, alice, bob)
+	msg := mustSend(t, db, conv, alice, "helo", "")
+
+	edited, err := db.EditMessage(ctx, msg, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Content != "hello" || edited.EditedAt == "" || edited.Reactions == nil {
+		t.Errorf("edited message = %+v", edited)
+	}
+	if c, _ := db.GetConversationByID(ctx, conv, bob); c.LastMessage != "hello" {
+		t.Errorf("LastMessage after editing = %q", c.LastMessage)
+	}
+	edits, err := db.GetMessageEdits(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 1 || edits[0].Content != "helo" {
+		t.Errorf("edits = %+v", edits)
+	}
+	if _, err := db.EditMessage(ctx, "999", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("editing a missing message: %v", err)
+	}
+}
+
+func testSearch(t *testing.T, db AppDatabase) {
+	ctx := context.Background()
+	alice := mustUser(t, db, "alice")
+	bob := mustUser(t, db, "bob")
+	carol := mustUser(t, db, "carol")
+	withBob := mustPrivate(t, db, alice, bob)
+	withCarol := mustPrivate(t, db, alice, carol)
+	first := mustSend(t, db, withBob, alice, "Pizza tonight?", "")
+	mustSend(t, db, withBob, bob, "no thanks", "")
+	second := mustSend(t, db, withCarol, carol, "I love pizza", "")
+
+	// I risultati vanno dal più recente al più vecchio e comprendono solo le conversazioni dell'utente
+	page, err := db.SearchMessages(ctx, alice, "PIZZA", "", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 1 || page.Results[0].Message.MessageID != second || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	res := page.Results[0]
+	if !strings.Contains(res.Snippet, SnippetStart+"pizza"+SnippetEnd) || res.Conversation.Name != "carol" {
+		t.Errorf("result = %+v", res)
+	}
+	page, err = db.SearchMessages(ctx, alice, "pizza", "", 1, page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 1 || page.Results[0].Message.MessageID != first || page.NextCursor != "" {
+		t.Errorf("second page = %+v", page)
+	}
+
+	if page, _ := db.SearchMessages(ctx, bob, "pizza", "", 0, ""); len(page.Results) != 1 {
+		t.Errorf("bob's results = %+v", page.Results)
+	}
+	if page, _ := db.SearchMessages(ctx, alice, "pizza", withBob, 0, ""); len(page.Results) != 1 {
+		t.Errorf("results in one conversation = %+v", page.Results)
+	}
+	if page, _ := db.SearchMessages(ctx, alice, "pizza love", "", 0, ""); len(page.Results) != 1 {
+		t.Errorf("results with two words = %+v", page.Results)
+	}
+	if _, err := db.SearchMessages(ctx, alice, "  ", "", 0, ""); !errors.Is(err, ErrInvalidSearchQuery) {
+		t.Errorf("empty query: %v", err)
+	}
+
+	// Lo snippet è HTML: il contenuto del messaggio viene sottoposto a escape e solo l'evidenziazione resta un tag
+	mustSend(t, db, withBob, bob, `<img src=x onerror=alert(1)> burger`, "")
+	page, err = db.SearchMessages(ctx, alice, "burger", "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "&lt;img src=x onerror=alert(1)&gt; " + SnippetStart + "burger" + SnippetEnd
+	if len(page.Results) != 1 || page.Results[0].Snippet != want {
+		t.Errorf("escaped snippet = %+v, want %q", page.Results, want)
+	}
+}
@@ -1,14 +1,15 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
 
 // GetUserConversations recupera tutte le conversazioni di un utente
-func (db *appdbimpl) GetUserConversations(userID string) ([]Conversation, error) {
+func (db *appdbimpl) GetUserConversations(ctx context.Context, userID string) ([]Conversation, error) {
     // Esegui la query SQL per recuperare gli id delle conversazioni dell'utente
-    rows, err := db.c.Query(`
+    rows, err := db.c.QueryContext(ctx, `
         SELECT DISTINCT c.id 
         FROM conversations c
         LEFT JOIN group_members gm ON c.id = gm.conversation_id
@@ -19,7 +20,7 @@ func (db *appdbimpl) GetUserConversations(userID string) ([]Conversation, error)
     defer rows.Close()
 
     // Inizializza una slice di conversazioni vuota
-    var conversations []Conversation
+    conversations := []Conversation{}
     // Per ogni conversazione trovata
     for rows.Next() {
         var convID string
@@ -28,7 +29,7 @@ func (db *appdbimpl) GetUserConversations(userID string) ([]Conversation, error)
             return nil, err
         }
         // Recupera i dettagli della conversazione
-        conv, err := db.GetConversationByID(convID, userID)
+        conv, err := db.GetConversationByID(ctx, convID, userID)
         if err != nil {
             return nil, err
         }
@@ -41,7 +42,7 @@ func (db *appdbimpl) GetUserConversations(userID string) ([]Conversation, error)
 }
 
 // GetConversationByID retrieves a specific conversation from the database by its ID.
-func (db *appdbimpl) GetConversationByID(convID, userID string) (Conversation, error) {
+func (db *appdbimpl) GetConversationByID(ctx context.Context, convID, userID string) (Conversation, error) {
     var conv Conversation
     var lastMessageID sql.NullString
     var name sql.NullString
@@ -49,7 +50,7 @@ func (db *appdbimpl) GetConversationByID(convID, userID string) (Conversation, e
     var otherUser sql.NullString
 
     // Esegui la query SQL per recuperare la conversazione
-    err := db.c.QueryRow(`
+    err := db.c.QueryRowContext(ctx, `
     SELECT  c.name, c.type, c.creator_id, c.photo, c.lastMessageId, c.otherUser
     FROM conversations c
     WHERE c.id = ?`, convID).Scan(&name, &conv.Type, &conv.CreatorID, &photo, &lastMessageID, &otherUser)
@@ -63,29 +64,37 @@ func (db *appdbimpl) GetConversationByID(convID, userID string) (Conversation, e
     if conv.Type == "private" {
         // Controlla se l'utente è il creatore o l'altro utente della conversazione
         if userID == conv.CreatorID {
-            otherUserName, err := db.GetUserByID(otherUser.String)
+            otherUserName, err := db.GetUserByID(ctx, otherUser.String)
             if err != nil {
                 return conv, err
             }
             conv.Name = otherUserName
-            conv.Photo = fmt.Sprintf("/users/get-photo/%s", otherUser.String) // Endpoint foto utente
+            otherPhoto, err := db.GetUserPhotoByID(ctx, otherUser.String)
+            if err != nil {
+                return conv, err
+            }
+            conv.Photo = UserPhotoURL(otherUser.String, otherPhoto) // Endpoint foto utente
         } else {
-            creatorName, err := db.GetUserByID(conv.CreatorID)
+            creatorName, err := db.GetUserByID(ctx, conv.CreatorID)
             if err != nil {
                 return conv, err
             }
             conv.Name = creatorName
-            conv.Photo = fmt.Sprintf("/users/get-photo/%s", conv.CreatorID) // Endpoint foto utente
+            creatorPhoto, err := db.GetUserPhotoByID(ctx, conv.CreatorID)
+            if err != nil {
+                return conv, err
+            }
+            conv.Photo = UserPhotoURL(conv.CreatorID, creatorPhoto) // Endpoint foto utente
         }
     } else {
         // Se la conversazione è di gruppo, usa il nome e l'endpoint della foto della conversazione
         conv.Name = name.String
-        conv.Photo = fmt.Sprintf("/conversations/group/get-photo/%s", convID)
+        conv.Photo = GroupPhotoURL(convID, photo.String)
     }
 
     // Recupera l'ultimo messaggio della conversazione
     if lastMessageID.String != "" {
-        msg, err := db.GetContentFromMessageID(lastMessageID.String)
+        msg, err := db.GetContentFromMessageID(ctx, lastMessageID.String)
         if err != nil {
             return conv, err
         }
@@ -101,18 +110,26 @@ func (db *appdbimpl) GetConversationByID(convID, userID string) (Conversation, e
 }
 
 // DeleteConversation deletes a conversation from the database by its ID.
-func (db *appdbimpl) DeleteConversation(convID string) error {
-    // Execute the SQL command to delete the conversation by ID
-    _, err := db.c.Exec(`DELETE FROM conversations WHERE id = ?`, convID)
-    if err != nil {
-        return err 
-    }
+func (db *appdbimpl) DeleteConversation(ctx context.Context, convID string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        // Record the change before deleting the conversation, while its members are still known
+        err := tx.recordConversationChange(ctx, Change{Type: ChangeConversationDeleted, ConversationID: convID})
+        if err != nil {
+            return err
+        }
+
+        // Execute the SQL command to delete the conversation by ID
+        _, err = tx.c.ExecContext(ctx, `DELETE FROM conversations WHERE id = ?`, convID)
+        if err != nil {
+            return err
+        }
 
-    return nil 
+        return nil
+    })
 }
 
 // CreatePrivateConversation crea una nuova conversazione privata tra due utenti
-func (db *appdbimpl) CreatePrivateConversation(user1 string, user2 string) (string, error) {
+func (db *appdbimpl) CreatePrivateConversation(ctx context.Context, user1 string, user2 string) (string, error) {
 
     // Controllo se l'utente sta cercando di creare una conversazione con se stesso
     if user1 == user2 {
@@ -121,7 +138,7 @@ func (db *appdbimpl) CreatePrivateConversation(user1 string, user2 string) (stri
 
     // Controlla se la conversazione esiste già con user1 come creator_id e user2 come other_user (o viceversa)
     var convID string
-    err := db.c.QueryRow(`
+    err := db.c.QueryRowContext(ctx, `
         SELECT id 
         FROM conversations
         WHERE 
@@ -133,41 +150,33 @@ func (db *appdbimpl) CreatePrivateConversation(user1 string, user2 string) (stri
         return convID, nil
     }
 
-    // Inizia una transazione per garantire la coerenza
-    tx, err := db.c.Begin()
-    if err != nil {
-        return "", err
-    }
-
-    // Inserisce una nuova conversazione nella tabella conversations
-    result, err := tx.Exec(`
-        INSERT INTO conversations (name, type, creator_id, photo, lastMessageId, otherUser)
-        VALUES (NULL, 'private', ?, NULL, NULL, ?)`, user1, user2)
-    if err != nil {
-        tx.Rollback()
-        return "", err
-    }
+    // Usa una transazione per garantire la coerenza
+    err = db.withTx(ctx, func(tx *appdbimpl) error {
+        // Inserisce una nuova conversazione nella tabella conversations e ne recupera l'ID
+        var newConvID int64
+        err := tx.c.QueryRowContext(ctx, `
+            INSERT INTO conversations (name, type, creator_id, photo, lastMessageId, otherUser)
+            VALUES (NULL, 'private', ?, NULL, NULL, ?) RETURNING id`, user1, user2).Scan(&newConvID)
+        if err != nil {
+            return err
+        }
 
-    // Recupera l'ID della nuova conversazione
-    newConvID, err := result.LastInsertId()
+        // Registra la nuova conversazione nel change log di entrambi gli utenti
+        convID = fmt.Sprintf("%d", newConvID)
+        return tx.recordConversationChange(ctx, Change{Type: ChangeConversationCreated, ConversationID: convID})
+    })
     if err != nil {
-        tx.Rollback()
-        return "", err
-    }
-
-    // Conferma la transazione
-    if err := tx.Commit(); err != nil {
         return "", err
     }
 
     // Restituisci l'ID della nuova conversazione
-    return fmt.Sprintf("%d", newConvID),  nil
+    return convID,  nil
 }
 
 // IsUserInConversation verifica se un utente è membro di una conversazione
-func (db *appdbimpl) IsUserInConversation(userID, convID string) (bool, error) {
+func (db *appdbimpl) IsUserInConversation(ctx context.Context, userID, convID string) (bool, error) {
     // Controlla il tipo di conversazione
-    isPrivate, err := db.IsConversationPrivate(convID)
+    isPrivate, err := db.IsConversationPrivate(ctx, convID)
     if err != nil {
         return false, err
     }
@@ -176,7 +185,7 @@ func (db *appdbimpl) IsUserInConversation(userID, convID string) (bool, error) {
     if isPrivate {
         // Esegui la query SQL per verificare se l'utente è membro della conversazione privata
         var creatorID, otherUserID string
-        err := db.c.QueryRow(`
+        err := db.c.QueryRowContext(ctx, `
             SELECT creator_id, otherUser FROM conversations WHERE id = ? AND type = 'private'
         `, convID).Scan(&creatorID, &otherUserID)
 
@@ -194,7 +203,7 @@ func (db *appdbimpl) IsUserInConversation(userID, convID string) (bool, error) {
     } else {
         // Esegui la query SQL per verificare se l'utente è membro della conversazione di gruppo
         var exists bool
-        err := db.c.QueryRow(`
+        err := db.c.QueryRowContext(ctx, `
             SELECT EXISTS (
                 SELECT 1 FROM group_members WHERE conversation_id = ? AND user_id = ?
             )
@@ -212,9 +221,9 @@ func (db *appdbimpl) IsUserInConversation(userID, convID string) (bool, error) {
 }
 
 // ConversationExists verifica se una conversazione esiste nel database
-func (db *appdbimpl) ConversationExists(convID string) (bool, error) {
+func (db *appdbimpl) ConversationExists(ctx context.Context, convID string) (bool, error) {
     var exists bool
-    err := db.c.QueryRow(`
+    err := db.c.QueryRowContext(ctx, `
         SELECT EXISTS (
             SELECT 1 FROM conversations WHERE id = ?
         )
@@ -223,9 +232,9 @@ func (db *appdbimpl) ConversationExists(convID string) (bool, error) {
 }
 
 // isConversationPrivate verifica se una conversazione è di tipo privato
-func (db *appdbimpl) IsConversationPrivate(convID string) (bool, error) {
+func (db *appdbimpl) IsConversationPrivate(ctx context.Context, convID string) (bool, error) {
     var isPrivate bool
-    err := db.c.QueryRow(`
+    err := db.c.QueryRowContext(ctx, `
         SELECT EXISTS (
             SELECT 1 FROM conversations WHERE id = ? AND type = 'private'
         )
@@ -239,14 +248,14 @@ func (db *appdbimpl) IsConversationPrivate(convID string) (bool, error) {
 }
 
 // isUserCreatorOfConversation verifica se un utente è il creatore di una conversazione
-func (db *appdbimpl) IsUserCreatorOfGroup(userID, convID string) (bool, error) {
-    isPrivate, err := db.IsConversationPrivate(convID)
+func (db *appdbimpl) IsUserCreatorOfGroup(ctx context.Context, userID, convID string) (bool, error) {
+    isPrivate, err := db.IsConversationPrivate(ctx, convID)
     if err != nil {
         return false, err
     }
     if !isPrivate {
         var isCreator bool
-        err := db.c.QueryRow(`
+        err := db.c.QueryRowContext(ctx, `
             SELECT EXISTS (
                 SELECT 1 FROM conversations WHERE id = ? AND creator_id = ?
             )
@@ -260,4 +269,50 @@ func (db *appdbimpl) IsUserCreatorOfGroup(userID, convID string) (bool, error) {
     } else {
         return false, fmt.Errorf("400: conversation is private")
     }
-}
\ No newline at end of file
+}
+
+// GetConversationMembers restituisce gli id di tutti i membri di una conversazione
+func (db *appdbimpl) GetConversationMembers(ctx context.Context, convID string) ([]string, error) {
+    rows, err := db.c.QueryContext(ctx, `
+        SELECT creator_id FROM conversations WHERE id = ? AND type = 'private'
+        UNION SELECT otherUser FROM conversations WHERE id = ? AND type = 'private' AND otherUser IS NOT NULL
+        UNION SELECT user_id FROM group_members WHERE conversation_id = ?`, convID, convID, convID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var members []string
+    for rows.Next() {
+        var userID string
+        if err := rows.Scan(&userID); err != nil {
+            return nil, err
+        }
+        members = append(members, userID)
+    }
+    return members, rows.Err()
+}
+
+// GetContactIDs restituisce gli id di tutti gli utenti che hanno almeno una conversazione in comune con l'utente
+func (db *appdbimpl) GetContactIDs(ctx context.Context, userID string) ([]string, error) {
+    rows, err := db.c.QueryContext(ctx, `
+        SELECT otherUser FROM conversations WHERE type = 'private' AND creator_id = ? AND otherUser IS NOT NULL
+        UNION SELECT creator_id FROM conversations WHERE type = 'private' AND otherUser = ?
+        UNION SELECT gm2.user_id FROM group_members gm1
+        JOIN group_members gm2 ON gm2.conversation_id = gm1.conversation_id
+        WHERE gm1.user_id = ? AND gm2.user_id != ?`, userID, userID, userID, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var contacts []string
+    for rows.Next() {
+        var contactID string
+        if err := rows.Scan(&contactID); err != nil {
+            return nil, err
+        }
+        contacts = append(contacts, contactID)
+    }
+    return contacts, rows.Err()
+}
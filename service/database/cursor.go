@@ -0,0 +1,42 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	// DefaultMessageLimit è il numero di messaggi restituiti se il client non specifica un limite
+	DefaultMessageLimit = 50
+
+	// MaxMessageLimit è il numero massimo di messaggi restituiti in una singola pagina
+	MaxMessageLimit = 200
+)
+
+// ErrInvalidCursor viene restituito quando un cursore di paginazione non è valido
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// messageCursor identifica la posizione di un messaggio nell'ordinamento (timestamp, id)
+type messageCursor struct {
+	Timestamp string
+	ID        string
+}
+
+// encode restituisce la rappresentazione opaca del cursore da inviare al client
+func (c messageCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Timestamp + "|" + c.ID))
+}
+
+// decodeMessageCursor decodifica un cursore ricevuto dal client
+func decodeMessageCursor(s string) (messageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return messageCursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return messageCursor{}, ErrInvalidCursor
+	}
+	return messageCursor{Timestamp: parts[0], ID: parts[1]}, nil
+}
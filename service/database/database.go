@@ -2,8 +2,10 @@
 Package database is the middleware between the app database and the code. All data (de)serialization (save/load) from a
 persistent database are handled here. Database specific logic should never escape this package.
 
-To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+To use this package you need to connect to the database (using the driver and data source name from config), and then
+initialize an instance of AppDatabase from the DB connection: New applies the pending schema migrations. SQLite
+(driver "sqlite3") and PostgreSQL (driver "postgres") are supported; queries are written with "?" placeholders and
+converted to the syntax of the database (see Dialect).
 
 For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
 main.WebAPIConfiguration structure):
@@ -27,10 +29,26 @@ This is an example on how to migrate the DB and connect to it:
 	}()
 
 Then you can initialize the AppDatabase and pass it to the api package.
+
+Every AppDatabase method takes a context.Context: queries are aborted when the context is canceled (e.g., when the client
+of an HTTP request disconnects). Use WithTx to run several calls as a single unit that is committed or rolled back as a
+whole:
+
+	err := db.WithTx(ctx, func(tx AppDatabase) error {
+		messageID, err := tx.InsertMessage(ctx, convID, userID, text, "", nil)
+		if err != nil {
+			return err
+		}
+		return tx.UpdateLastMessage(ctx, convID, messageID)
+	})
+
+NewMemory returns an AppDatabase with the same behavior that keeps all data in memory: use it in tests (e.g., to test
+the api package with httptest) when a real database is not needed.
 */
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -38,135 +56,171 @@ import (
 
 // AppDatabase is the high level interface for the DB
 type AppDatabase interface {
-	GetName() (string, error)
-	SetName(name string) error
-
-	CreateUser(name string) (string, error)
-	GetUserByID(id string) (string, error)
-    GetUserPhotoByID(id string) (string, error)
-	GetUserByName(name string) (string, error)
-    ModifyUserName(id string, name string) error
-    UpdateUserPhoto(id string, photoPath string) error
-
-    GetUserConversations(userID string) ([]Conversation, error)
-    GetConversationByID(convID, userID string) (Conversation, error)
-    DeleteConversation(convID string) error
-    CreatePrivateConversation(user1 string, user2 string) (string, error)
-    IsUserInConversation(userID, convID string) (bool, error)
-    ConversationExists(convID string) (bool, error)
-    GetMessagesFromConversation(conversationID string) ([]Message, error)
-    IsConversationPrivate(convID string) (bool, error)
-    IsUserCreatorOfGroup(userID, convID string) (bool, error)
+	GetName(ctx context.Context) (string, error)
+	SetName(ctx context.Context, name string) error
+
+	CreateUser(ctx context.Context, name string) (string, error)
+	CreateSession(ctx context.Context, userID string) (string, error)
+	GetUserIDBySession(ctx context.Context, token string) (string, error)
+	DeleteSession(ctx context.Context, token string) error
+	DeleteExpiredSessions(ctx context.Context) error
+
+	GetUserByID(ctx context.Context, id string) (string, error)
+    GetUserPhotoByID(ctx context.Context, id string) (string, error)
+	GetUserByName(ctx context.Context, name string) (string, error)
+    ModifyUserName(ctx context.Context, id string, name string) error
+    UpdateUserPhoto(ctx context.Context, id string, photoPath string) error
+
+    GetUserConversations(ctx context.Context, userID string) ([]Conversation, error)
+    GetConversationByID(ctx context.Context, convID, userID string) (Conversation, error)
+    DeleteConversation(ctx context.Context, convID string) error
+    CreatePrivateConversation(ctx context.Context, user1 string, user2 string) (string, error)
+    IsUserInConversation(ctx context.Context, userID, convID string) (bool, error)
+    ConversationExists(ctx context.Context, convID string) (bool, error)
+    GetMessagesFromConversation(ctx context.Context, conversationID string, q MessageQuery) (MessagePage, error)
+    IsConversationPrivate(ctx context.Context, convID string) (bool, error)
+    IsUserCreatorOfGroup(ctx context.Context, userID, convID string) (bool, error)
+    GetConversationMembers(ctx context.Context, convID string) ([]string, error)
+    GetContactIDs(ctx context.Context, userID string) ([]string, error)
 	
-    InsertMessage(convID string, userID string, text string) (string, error)
-    GetMessageFromID(messageID string) (Message, error)
-    UpdateLastMessage(convID string, messageID string) error
-    MessageExists(messageID string) (bool, error)
-    DeleteMessage(messageID string) error
-    GetLastMessageID(convID string) (string, error)
-    InsertReaction(messageID string, userID string, reaction string) error
-    DeleteReaction(messageID, userID string) error
-    UserHasReaction(messageID, userID string) (bool, error)
-    GetContentFromMessageID(messageID string) (string, error)
-
-    CreateGroup(name, creatorID string) (string, error)
-    AddUserToGroup(groupID, userID string) error
-    ChangeGroupName(groupID, name string) error
-    LeaveGroup(groupID, userID string) error
-    GetGroupPhotoByID(groupID string) (string, error)
-    UpdateGroupPhoto(groupID, photoPath string) error
-
-	Ping() error
+    InsertMessage(ctx context.Context, convID string, userID string, text string, replyTo string, attachments []NewAttachment) (string, error)
+    InsertSystemMessage(ctx context.Context, groupID, senderID string, payload SystemPayload) (string, error)
+    GetMessageFromID(ctx context.Context, messageID string) (Message, error)
+    UpdateLastMessage(ctx context.Context, convID string, messageID string) error
+    MessageExists(ctx context.Context, messageID string) (bool, error)
+    DeleteMessage(ctx context.Context, messageID string) error
+    GetLastMessageID(ctx context.Context, convID string) (string, error)
+    InsertReaction(ctx context.Context, userID string, messageID string, reaction string) error
+    DeleteReaction(ctx context.Context, messageID, userID string) error
+    UserHasReaction(ctx context.Context, messageID, userID string) (bool, error)
+    GetContentFromMessageID(ctx context.Context, messageID string) (string, error)
+    MarkConversationDelivered(ctx context.Context, convID, userID string) error
+    MarkConversationRead(ctx context.Context, convID, userID string) error
+    GetMessageReceipts(ctx context.Context, messageID string) ([]Receipt, error)
+    AppendUserEvent(ctx context.Context, userIDs []string, eventType, convID, payload string) ([]UserEvent, error)
+    GetUserEventsAfter(ctx context.Context, userID string, afterSeq int64, limit int) ([]UserEvent, error)
+    GetUserEventBounds(ctx context.Context, userID string) (int64, int64, error)
+    DeleteExpiredUserEvents(ctx context.Context) error
+    GetChanges(ctx context.Context, userID string, since int64, limit int) (ChangePage, error)
+    CompactChangeLog(ctx context.Context) error
+    SearchMessages(ctx context.Context, userID, text, convID string, limit int, cursor string) (SearchPage, error)
+    EditMessage(ctx context.Context, messageID, content string) (Message, error)
+    GetMessageEdits(ctx context.Context, messageID string) ([]MessageEdit, error)
+    GetReplies(ctx context.Context, convID, messageID string) ([]Message, error)
+    GetAttachment(ctx context.Context, attachmentID string) (Attachment, string, string, error)
+    CopyAttachments(ctx context.Context, fromMessageID, toMessageID string) error
+
+    CreateGroup(ctx context.Context, name, creatorID string) (string, error)
+    AddUserToGroup(ctx context.Context, groupID, userID, role, addedBy string) error
+    GetGroupMembers(ctx context.Context, groupID string) ([]GroupMember, error)
+    GetGroupProfile(ctx context.Context, groupID string) (GroupProfile, error)
+    ChangeGroupDescription(ctx context.Context, groupID, description string) error
+    GetGroupRole(ctx context.Context, groupID, userID string) (string, error)
+    SetGroupRole(ctx context.Context, groupID, userID, role string) error
+    ChangeGroupName(ctx context.Context, groupID, name string) error
+    LeaveGroup(ctx context.Context, groupID, userID string) (string, error)
+    RemoveGroupMember(ctx context.Context, groupID, userID string) error
+    TransferGroupOwnership(ctx context.Context, groupID, newOwnerID string) error
+    GetGroupPhotoByID(ctx context.Context, groupID string) (string, error)
+    UpdateGroupPhoto(ctx context.Context, groupID, photoPath string) error
+
+    CreateGroupInvite(ctx context.Context, groupID, createdBy string, invite NewGroupInvite) (GroupInvite, error)
+    GetGroupInvite(ctx context.Context, token string) (GroupInvite, error)
+    GetGroupInvites(ctx context.Context, groupID string) ([]GroupInvite, error)
+    RevokeGroupInvite(ctx context.Context, groupID, token string) error
+    JoinGroupWithInvite(ctx context.Context, token, userID string) (bool, error)
+    GetJoinRequests(ctx context.Context, groupID string) ([]JoinRequest, error)
+    ApproveJoinRequest(ctx context.Context, groupID, userID, approvedBy string) error
+    RejectJoinRequest(ctx context.Context, groupID, userID string) error
+
+	Ping(ctx context.Context) error
+
+	// WithTx esegue fn in una transazione: le chiamate a tx fanno parte della transazione, che viene confermata se fn
+	// restituisce nil e annullata altrimenti. Chiamato su una transazione, WithTx esegue fn nella stessa transazione
+	WithTx(ctx context.Context, fn func(tx AppDatabase) error) error
 }
 
 type appdbimpl struct {
-	c *sql.DB
+	conn dbConn
+
+	// c esegue le query: è conn, oppure la transazione tx all'interno di WithTx
+	c  querier
+	tx *dbTx
+
+	// fts è il modulo SQLite usato per l'indice full-text dei messaggi ("fts5" o "fts4"), oppure "tsvector" con
+	// PostgreSQL
+	fts string
 }
 
-// New returns a new instance of AppDatabase based on the SQLite connection `db`.
+// New returns a new instance of AppDatabase based on the connection `db`, opened with the database/sql driver of
+// `dialect` (SQLite or Postgres).
 // `db` is required - an error will be returned if `db` is `nil`.
-func New(db *sql.DB) (AppDatabase, error) {
+// The pending schema migrations are applied (see Migrate); if the schema of `db` is newer than the latest migration
+// known by this build, an error wrapping ErrSchemaTooNew is returned and `db` is left untouched.
+func New(db *sql.DB, dialect Dialect) (AppDatabase, error) {
     if db == nil {
         return nil, errors.New("database is required when building a AppDatabase")
     }
-    
-    // Enable foreign keys
-	_, err := db.Exec("PRAGMA foreign_keys = ON;")
-	if err != nil {
-		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
-	}
+    if err := dialect.validate(); err != nil {
+        return nil, err
+    }
 
-    // Check if tables exist. If not, the database is empty, and we need to create the structure
-    tables := []string{"users", "conversations", "messages", "group_members", "reactions"}
-    for _, table := range tables {
-        var tableName string
-        err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name=?;`, table).Scan(&tableName)
-        if errors.Is(err, sql.ErrNoRows) {
-            var sqlStmt string
-            switch table {
-            case "users":
-                sqlStmt = `CREATE TABLE users (
-                    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-                    name TEXT NOT NULL UNIQUE,
-					photo TEXT 
-                );`
-            case "conversations":
-                sqlStmt = `CREATE TABLE conversations (
-                    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-                    name TEXT,
-                    type TEXT CHECK(type IN ('private', 'group')) NOT NULL,
-                    creator_id INTEGER NOT NULL,
-					photo TEXT,
-                    lastMessageId INTEGER,
-                    otherUser INTEGER,
-                    FOREIGN KEY (creator_id) REFERENCES users(id),
-                    FOREIGN KEY (lastMessageId) REFERENCES messages(id) ON DELETE SET NULL,
-                    FOREIGN KEY (otherUser) REFERENCES users(id) ON DELETE SET NULL
-                );`
-            case "messages":
-                sqlStmt = `CREATE TABLE messages (
-                    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-                    conversation_id INTEGER NOT NULL,
-                    sender_id INTEGER NOT NULL,
-                    content TEXT NOT NULL,
-                    reaction_count INTEGER DEFAULT 0,
-                    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-                    status TEXT CHECK(status IN ('sent', 'received', 'read')) NOT NULL,
-                    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
-                    FOREIGN KEY (sender_id) REFERENCES users(id)
-                );`
-            case "group_members":
-                sqlStmt = `CREATE TABLE group_members (
-                    conversation_id INTEGER NOT NULL,
-                    user_id INTEGER NOT NULL,
-                    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
-                    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
-                    PRIMARY KEY (conversation_id, user_id)
-                );`
-            case "reactions":
-                sqlStmt = `CREATE TABLE reactions (
-                    message_id INTEGER NOT NULL,
-                    user_id INTEGER NOT NULL,
-                    reaction TEXT NOT NULL,
-                    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-                    PRIMARY KEY (message_id, user_id), 
-                    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
-                    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-                );`
-
-            }
-            _, err = db.Exec(sqlStmt)
-            if err != nil {
-                return nil, fmt.Errorf("error creating table %s: %w", table, err)
-            }
+    // Enable foreign keys (always enforced by PostgreSQL)
+    if dialect == SQLite {
+        _, err := db.Exec("PRAGMA foreign_keys = ON;")
+        if err != nil {
+            return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
         }
     }
 
+    // Aggiorna lo schema del database all'ultima versione
+    if err := Migrate(db, dialect); err != nil {
+        return nil, err
+    }
+
+    // Crea l'indice full-text dei messaggi (con PostgreSQL fa parte dello schema)
+    fts := "tsvector"
+    if dialect == SQLite {
+        var err error
+        fts, err = ensureSearchIndex(db)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    conn := dbConn{DB: db, dialect: dialect}
     return &appdbimpl{
-        c: db,
+        conn: conn,
+        c:    conn,
+        fts:  fts,
     }, nil
 }
 
-func (db *appdbimpl) Ping() error {
-	return db.c.Ping()
+func (db *appdbimpl) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
+}
+
+func (db *appdbimpl) WithTx(ctx context.Context, fn func(tx AppDatabase) error) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		return fn(tx)
+	})
+}
+
+// withTx esegue fn in una transazione, aprendone una nuova solo se db non è già una transazione. I metodi che
+// eseguono più query le raggruppano con withTx, così sono atomici anche quando sono chiamati all'interno di WithTx
+func (db *appdbimpl) withTx(ctx context.Context, fn func(tx *appdbimpl) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+
+	tx, err := db.conn.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(&appdbimpl{conn: db.conn, c: tx, tx: tx, fts: db.fts}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
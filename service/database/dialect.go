@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect identifica il database a cui è collegato AppDatabase. Il valore è il nome del driver database/sql
+type Dialect string
+
+const (
+	// SQLite usa il driver github.com/mattn/go-sqlite3
+	SQLite Dialect = "sqlite3"
+
+	// Postgres usa il driver github.com/lib/pq
+	Postgres Dialect = "postgres"
+)
+
+// validate restituisce un errore se il dialetto non è supportato
+func (d Dialect) validate() error {
+	if d != SQLite && d != Postgres {
+		return fmt.Errorf("unsupported database driver %q", d)
+	}
+	return nil
+}
+
+// rebind converte i segnaposto "?" delle query nella sintassi del dialetto: PostgreSQL usa "$1", "$2", ... I punti
+// interrogativi all'interno di stringhe e identificatori tra virgolette vengono lasciati invariati
+func (d Dialect) rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			// Le virgolette raddoppiate chiudono e riaprono la stringa, quindi non serve gestirle a parte
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// timestampParam restituisce il segnaposto di un parametro di tipo timestamp, per i punti della query in cui il
+// database non può ricavarne il tipo dal contesto (per esempio la lista di una SELECT usata da INSERT ... SELECT).
+// Per i parametri interi basta CAST(? AS INTEGER), che funziona con entrambi i dialetti
+func (d Dialect) timestampParam() string {
+	if d == Postgres {
+		return "CAST(? AS TIMESTAMP)"
+	}
+	return "?"
+}
+
+// querier contiene i metodi usati da appdbimpl per eseguire le query, implementati sia da dbConn sia da dbTx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// dbConn è la connessione al database usata da appdbimpl: le query sono scritte con i segnaposto "?" e vengono
+// convertite nella sintassi del dialetto prima di essere eseguite
+type dbConn struct {
+	*sql.DB
+	dialect Dialect
+}
+
+func (c dbConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return c.DB.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) BeginTx(ctx context.Context) (*dbTx, error) {
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: c.dialect}, nil
+}
+
+// dbTx è una transazione di dbConn, con la stessa conversione dei segnaposto
+type dbTx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx *dbTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.dialect.rebind(query), args...)
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// EditMessage sostituisce il contenuto del messaggio, salvando quello precedente nello storico delle modifiche, e
+// restituisce il messaggio aggiornato
+func (db *appdbimpl) EditMessage(ctx context.Context, messageID, content string) (Message, error) {
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		// Il contenuto attuale è stato scritto all'invio del messaggio o con l'ultima modifica
+		var convID, oldContent, writtenAt string
+		err := tx.c.QueryRowContext(ctx,
+			"SELECT conversation_id, content, COALESCE(edited_at, timestamp) FROM messages WHERE id = ?",
+			messageID,
+		).Scan(&convID, &oldContent, &writtenAt)
+		if err != nil {
+			return err
+		}
+
+		now := globaltime.Now().UTC()
+		_, err = tx.c.ExecContext(ctx,
+			"INSERT INTO message_edits (message_id, content, created_at, replaced_at) VALUES (?, ?, ?, ?)",
+			messageID, oldContent, writtenAt, now,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.c.ExecContext(ctx, "UPDATE messages SET content = ?, edited_at = ? WHERE id = ?", content, now, messageID)
+		if err != nil {
+			return err
+		}
+
+		// Registra la modifica nel change log dei membri della conversazione
+		return tx.recordConversationChange(ctx, Change{
+			Type:           ChangeMessageEdited,
+			ConversationID: convID,
+			MessageID:      messageID,
+			Value:          content,
+		})
+	})
+	if err != nil {
+		return Message{}, err
+	}
+
+	message, err := db.GetMessageFromID(ctx, messageID)
+	if err != nil {
+		return Message{}, err
+	}
+	messages := []Message{message}
+	if err := db.loadReactions(ctx, messages); err != nil {
+		return Message{}, err
+	}
+	return messages[0], nil
+}
+
+// GetMessageEdits restituisce le versioni precedenti del contenuto del messaggio, dalla più vecchia alla più recente
+func (db *appdbimpl) GetMessageEdits(ctx context.Context, messageID string) ([]MessageEdit, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT content, created_at, replaced_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY id ASC`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.Content, &edit.CreatedAt, &edit.ReplacedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
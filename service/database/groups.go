@@ -1,31 +1,259 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// Ruoli dei membri di un gruppo. Il proprietario è inizialmente il creatore del gruppo: conversations.creator_id è
+// sempre il proprietario attuale
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
 )
 
-func (db *appdbimpl) CreateGroup(name, creatorID string) (string, error) {
+func (db *appdbimpl) CreateGroup(ctx context.Context, name, creatorID string) (string, error) {
 	var groupID string
-	err := db.c.QueryRow(
-		"INSERT INTO conversations (name, creator_id, type, photo, lastMessageId, otherUser) VALUES (?, ?, 'group', '', NULL, NULL) RETURNING id;",
-		name, creatorID,
-	).Scan(&groupID)
-	return groupID, err
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		err := tx.c.QueryRowContext(ctx,
+			"INSERT INTO conversations (name, creator_id, type, photo, lastMessageId, otherUser, created_at) VALUES (?, ?, 'group', '', NULL, NULL, ?) RETURNING id;",
+			name, creatorID, globaltime.Now().UTC(),
+		).Scan(&groupID)
+		if err != nil {
+			return err
+		}
+
+		// Il gruppo non ha ancora membri: la creazione viene registrata solo nel change log del creatore
+		return tx.recordChange(ctx, Change{Type: ChangeConversationCreated, ConversationID: groupID}, "SELECT CAST(? AS INTEGER)", creatorID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return groupID, nil
 }
 
-func (db *appdbimpl) AddUserToGroup(groupID, userID string) error {
-	_, err := db.c.Exec(
-		"INSERT INTO group_members (conversation_id, user_id) VALUES (?, ?);",
+// AddUserToGroup aggiunge l'utente al gruppo con il ruolo specificato. addedBy è l'id dell'utente che lo aggiunge,
+// vuoto per il creatore del gruppo. L'eventuale richiesta di ingresso in attesa dell'utente viene eliminata
+func (db *appdbimpl) AddUserToGroup(ctx context.Context, groupID, userID, role, addedBy string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx,
+			"INSERT INTO group_members (conversation_id, user_id, role, joined_at, added_by) VALUES (?, ?, ?, ?, ?);",
+			groupID, userID, role, globaltime.Now().UTC(), sql.NullString{String: addedBy, Valid: addedBy != ""},
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.c.ExecContext(ctx,
+			"DELETE FROM group_join_requests WHERE conversation_id = ? AND user_id = ?",
+			groupID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.recordConversationChange(ctx, Change{Type: ChangeMemberAdded, ConversationID: groupID, UserID: userID})
+	})
+}
+
+// GetGroupMembers restituisce i membri del gruppo, in ordine di ingresso nel gruppo
+func (db *appdbimpl) GetGroupMembers(ctx context.Context, groupID string) ([]GroupMember, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT u.id, u.name, u.photo, gm.role, gm.joined_at, gm.added_by
+		FROM group_members gm JOIN users u ON u.id = gm.user_id
+		WHERE gm.conversation_id = ?
+		ORDER BY gm.joined_at, gm.user_id`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []GroupMember{}
+	for rows.Next() {
+		var member GroupMember
+		var photo, joinedAt, addedBy sql.NullString
+		if err := rows.Scan(&member.UserID, &member.UserName, &photo, &member.Role, &joinedAt, &addedBy); err != nil {
+			return nil, err
+		}
+		member.Photo = UserPhotoURL(member.UserID, photo.String)
+		member.JoinedAt = joinedAt.String
+		member.AddedBy = addedBy.String
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// GetGroupProfile restituisce il profilo del gruppo; se il gruppo non esiste (o la conversazione è privata)
+// restituisce sql.ErrNoRows
+func (db *appdbimpl) GetGroupProfile(ctx context.Context, groupID string) (GroupProfile, error) {
+	var profile GroupProfile
+	var name, photo, createdAt sql.NullString
+	err := db.c.QueryRowContext(ctx, `
+		SELECT c.id, c.name, c.description, c.photo, c.creator_id, u.name, c.created_at,
+			(SELECT COUNT(*) FROM group_members gm WHERE gm.conversation_id = c.id)
+		FROM conversations c JOIN users u ON u.id = c.creator_id
+		WHERE c.id = ? AND c.type = 'group'`,
+		groupID,
+	).Scan(&profile.ConvID, &name, &profile.Description, &photo, &profile.CreatorID, &profile.CreatorName, &createdAt, &profile.MemberCount)
+	if err != nil {
+		return GroupProfile{}, err
+	}
+	profile.Name = name.String
+	profile.Photo = GroupPhotoURL(profile.ConvID, photo.String)
+	profile.CreatedAt = createdAt.String
+	return profile, nil
+}
+
+// ChangeGroupDescription cambia la descrizione del gruppo con l'id specificato
+func (db *appdbimpl) ChangeGroupDescription(ctx context.Context, groupID, description string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx, "UPDATE conversations SET description = ? WHERE id = ?", description, groupID)
+		if err != nil {
+			return err
+		}
+		return tx.recordConversationChange(ctx, Change{Type: ChangeGroupDescription, ConversationID: groupID, Value: description})
+	})
+}
+
+// GetGroupRole restituisce il ruolo dell'utente nel gruppo, oppure sql.ErrNoRows se l'utente non è un membro del gruppo
+func (db *appdbimpl) GetGroupRole(ctx context.Context, groupID, userID string) (string, error) {
+	var role string
+	err := db.c.QueryRowContext(ctx,
+		"SELECT role FROM group_members WHERE conversation_id = ? AND user_id = ?",
 		groupID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// SetGroupRole cambia il ruolo di un membro del gruppo; se l'utente non è un membro del gruppo restituisce
+// sql.ErrNoRows
+func (db *appdbimpl) SetGroupRole(ctx context.Context, groupID, userID, role string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		res, err := tx.c.ExecContext(ctx,
+			"UPDATE group_members SET role = ? WHERE conversation_id = ? AND user_id = ?",
+			role, groupID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return sql.ErrNoRows
+		}
+		return tx.recordConversationChange(ctx, Change{Type: ChangeMemberRoleChanged, ConversationID: groupID, UserID: userID, Value: role})
+	})
+}
+
+// TransferGroupOwnership rende l'utente il proprietario del gruppo; il proprietario precedente diventa un
+// amministratore. Se l'utente non è un membro del gruppo restituisce sql.ErrNoRows
+func (db *appdbimpl) TransferGroupOwnership(ctx context.Context, groupID, newOwnerID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		var ownerID string
+		err := tx.c.QueryRowContext(ctx,
+			"SELECT user_id FROM group_members WHERE conversation_id = ? AND role = 'owner'",
+			groupID,
+		).Scan(&ownerID)
+		if err != nil {
+			return err
+		}
+		if ownerID == newOwnerID {
+			return nil
+		}
+		return tx.transferOwnership(ctx, groupID, ownerID, newOwnerID)
+	})
+}
+
+// transferOwnership passa la proprietà del gruppo da ownerID a newOwnerID, che diventa anche il creator_id della
+// conversazione. L'ex proprietario, se è ancora un membro, diventa un amministratore
+func (db *appdbimpl) transferOwnership(ctx context.Context, groupID, ownerID, newOwnerID string) error {
+	res, err := db.c.ExecContext(ctx,
+		"UPDATE group_members SET role = 'owner' WHERE conversation_id = ? AND user_id = ?",
+		groupID, newOwnerID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = db.c.ExecContext(ctx,
+		"UPDATE group_members SET role = 'admin' WHERE conversation_id = ? AND user_id = ?",
+		groupID, ownerID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = db.c.ExecContext(ctx, "UPDATE conversations SET creator_id = ? WHERE id = ?", newOwnerID, groupID)
+	if err != nil {
+		return err
+	}
+	return db.recordConversationChange(ctx, Change{Type: ChangeOwnerChanged, ConversationID: groupID, UserID: newOwnerID})
+}
+
+// groupSuccessor restituisce il membro che diventa proprietario quando il proprietario ownerID esce dal gruppo:
+// l'amministratore che fa parte del gruppo da più tempo oppure, se non ce ne sono, il membro che ne fa parte da più
+// tempo. Se il proprietario è l'unico membro restituisce sql.ErrNoRows.
+//
+// La successione è gestita solo da LeaveGroup perché non esiste l'eliminazione degli account. Se verrà aggiunta, dovrà
+// passare la proprietà dei gruppi dell'utente prima di eliminarlo: l'eliminazione a cascata di group_members
+// lascerebbe i gruppi senza proprietario
+func (db *appdbimpl) groupSuccessor(ctx context.Context, groupID, ownerID string) (string, error) {
+	var successor string
+	err := db.c.QueryRowContext(ctx, `
+		SELECT user_id FROM group_members
+		WHERE conversation_id = ? AND user_id != ?
+		ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at, user_id
+		LIMIT 1`,
+		groupID, ownerID,
+	).Scan(&successor)
+	return successor, err
+}
+
+// RemoveGroupMember rimuove dal gruppo un membro diverso dal proprietario; se l'utente non è un membro del gruppo
+// restituisce sql.ErrNoRows
+func (db *appdbimpl) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// Registra la rimozione prima di rimuovere l'utente, così la riceve anche l'utente stesso
+		err := tx.recordConversationChange(ctx, Change{Type: ChangeMemberRemoved, ConversationID: groupID, UserID: userID})
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.c.ExecContext(ctx,
+			"DELETE FROM group_members WHERE conversation_id = ? AND user_id = ? AND role != 'owner'",
+			groupID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		removed, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
 }
 
 // GetNameFromGroupID restituisce il nome del gruppo con l'id specificato
-func (db *appdbimpl) GetNameFromGroupID(groupID string) (string, error) {
+func (db *appdbimpl) GetNameFromGroupID(ctx context.Context, groupID string) (string, error) {
 	// Controlla che il gruppo sia effettivamente un gruppo
-	isPrivate, err := db.IsConversationPrivate(groupID)
+	isPrivate, err := db.IsConversationPrivate(ctx, groupID)
 	if err != nil {
 		return "", err
 	}
@@ -33,28 +261,70 @@ func (db *appdbimpl) GetNameFromGroupID(groupID string) (string, error) {
 		return "", fmt.Errorf("404: Group not found")
 	}
 	var name string
-	err2 := db.c.QueryRow("SELECT name FROM conversations WHERE id = ? ", groupID).Scan(&name)
+	err2 := db.c.QueryRowContext(ctx, "SELECT name FROM conversations WHERE id = ? ", groupID).Scan(&name)
 	return name, err2
 }
 
 // ChangeGroupName cambia il nome del gruppo con l'id specificato
-func (db *appdbimpl) ChangeGroupName(groupID, name string) error {
-	// Esegue la query per cambiare il nome del gruppo
-	_, err := db.c.Exec("UPDATE conversations SET name = ? WHERE id = ?", name, groupID)
-	return err
+func (db *appdbimpl) ChangeGroupName(ctx context.Context, groupID, name string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// Esegue la query per cambiare il nome del gruppo
+		_, err := tx.c.ExecContext(ctx, "UPDATE conversations SET name = ? WHERE id = ?", name, groupID)
+		if err != nil {
+			return err
+		}
+		return tx.recordConversationChange(ctx, Change{Type: ChangeGroupRenamed, ConversationID: groupID, Value: name})
+	})
 }
 
-// leaveGroup rimuove l'utente con l'id specificato dal gruppo con l'id specificato
-func (db *appdbimpl) LeaveGroup(groupID, userID string) error {
-	// Esegue la query per rimuovere l'utente dal gruppo
-	_, err := db.c.Exec("DELETE FROM group_members WHERE conversation_id = ? AND user_id = ?", groupID, userID)
-	return err
+// LeaveGroup rimuove l'utente con l'id specificato dal gruppo con l'id specificato. Se l'utente è il proprietario, la
+// proprietà passa al successore (vedi groupSuccessor) e LeaveGroup ne restituisce l'id; altrimenti restituisce una
+// stringa vuota
+func (db *appdbimpl) LeaveGroup(ctx context.Context, groupID, userID string) (string, error) {
+	var newOwnerID string
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		var role string
+		err := tx.c.QueryRowContext(ctx,
+			"SELECT role FROM group_members WHERE conversation_id = ? AND user_id = ?",
+			groupID, userID,
+		).Scan(&role)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		// Il proprietario lascia il gruppo al successore, se il gruppo ha altri membri
+		if role == RoleOwner {
+			successor, err := tx.groupSuccessor(ctx, groupID, userID)
+			if err == nil {
+				if err := tx.transferOwnership(ctx, groupID, userID, successor); err != nil {
+					return err
+				}
+				newOwnerID = successor
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		// Registra l'uscita prima di rimuovere l'utente, così la riceve anche l'utente stesso
+		err = tx.recordConversationChange(ctx, Change{Type: ChangeMemberLeft, ConversationID: groupID, UserID: userID})
+		if err != nil {
+			return err
+		}
+
+		// Esegue la query per rimuovere l'utente dal gruppo
+		_, err = tx.c.ExecContext(ctx, "DELETE FROM group_members WHERE conversation_id = ? AND user_id = ?", groupID, userID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return newOwnerID, nil
 }
 
 // getGroupPhotoByID restituisce la foto del gruppo con l'id specificato
-func (db *appdbimpl) GetGroupPhotoByID(groupID string) (string, error) {
+func (db *appdbimpl) GetGroupPhotoByID(ctx context.Context, groupID string) (string, error) {
 	var photo sql.NullString
-	err2 := db.c.QueryRow("SELECT photo FROM conversations WHERE id = ? ", groupID).Scan(&photo)
+	err2 := db.c.QueryRowContext(ctx, "SELECT photo FROM conversations WHERE id = ? ", groupID).Scan(&photo)
 	if err2 != nil {
 		return "", err2
 	}
@@ -66,8 +336,13 @@ func (db *appdbimpl) GetGroupPhotoByID(groupID string) (string, error) {
 }
 
 // UpdateGroupPhoto cambia la foto del gruppo con l'id specificato
-func (db *appdbimpl) UpdateGroupPhoto(groupID, photoPath string) error {
-	// Esegue la query per cambiare la foto del gruppo
-	_, err := db.c.Exec("UPDATE conversations SET photo = ? WHERE id = ?", photoPath, groupID)
-	return err
+func (db *appdbimpl) UpdateGroupPhoto(ctx context.Context, groupID, photoPath string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		// Esegue la query per cambiare la foto del gruppo
+		_, err := tx.c.ExecContext(ctx, "UPDATE conversations SET photo = ? WHERE id = ?", photoPath, groupID)
+		if err != nil {
+			return err
+		}
+		return tx.recordConversationChange(ctx, Change{Type: ChangeGroupPhotoUpdated, ConversationID: groupID})
+	})
 }
\ No newline at end of file
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// ErrInviteExpired viene restituito quando si usa un invito scaduto
+var ErrInviteExpired = errors.New("invite expired")
+
+// ErrInviteExhausted viene restituito quando si usa un invito che ha raggiunto il numero massimo di utilizzi
+var ErrInviteExhausted = errors.New("invite exhausted")
+
+// newInviteToken genera il token di un nuovo invito. A differenza dei token di sessione viene salvato in chiaro, perché
+// gli amministratori del gruppo devono poter recuperare il link da condividere
+func newInviteToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// groupInviteColumns sono le colonne lette da scanGroupInvite
+const groupInviteColumns = "token, conversation_id, created_by, created_at, expires_at, max_uses, uses, requires_approval"
+
+// scanGroupInvite legge un invito selezionato con groupInviteColumns
+func scanGroupInvite(scan func(dest ...interface{}) error) (GroupInvite, error) {
+	var invite GroupInvite
+	var createdBy, expiresAt sql.NullString
+	var maxUses sql.NullInt64
+	err := scan(&invite.Token, &invite.ConversationID, &createdBy, &invite.CreatedAt, &expiresAt, &maxUses,
+		&invite.Uses, &invite.RequiresApproval)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	invite.CreatedBy = createdBy.String
+	invite.ExpiresAt = expiresAt.String
+	invite.MaxUses = int(maxUses.Int64)
+	return invite, nil
+}
+
+// CreateGroupInvite crea un nuovo invito al gruppo con le condizioni specificate
+func (db *appdbimpl) CreateGroupInvite(ctx context.Context, groupID, createdBy string, invite NewGroupInvite) (GroupInvite, error) {
+	token, err := newInviteToken()
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	_, err = db.c.ExecContext(ctx,
+		"INSERT INTO group_invites (token, conversation_id, created_by, created_at, expires_at, max_uses, requires_approval) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		token, groupID, createdBy, globaltime.Now().UTC(),
+		sql.NullTime{Time: invite.ExpiresAt.UTC(), Valid: !invite.ExpiresAt.IsZero()},
+		sql.NullInt64{Int64: int64(invite.MaxUses), Valid: invite.MaxUses > 0},
+		invite.RequiresApproval,
+	)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	return db.GetGroupInvite(ctx, token)
+}
+
+// GetGroupInvite restituisce l'invito con il token specificato, oppure sql.ErrNoRows se non esiste o è stato revocato
+func (db *appdbimpl) GetGroupInvite(ctx context.Context, token string) (GroupInvite, error) {
+	row := db.c.QueryRowContext(ctx, "SELECT "+groupInviteColumns+" FROM group_invites WHERE token = ?", token)
+	return scanGroupInvite(row.Scan)
+}
+
+// GetGroupInvites restituisce gli inviti del gruppo, compresi quelli scaduti o esauriti, dal meno recente
+func (db *appdbimpl) GetGroupInvites(ctx context.Context, groupID string) ([]GroupInvite, error) {
+	rows, err := db.c.QueryContext(ctx,
+		"SELECT "+groupInviteColumns+" FROM group_invites WHERE conversation_id = ? ORDER BY created_at, token",
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []GroupInvite{}
+	for rows.Next() {
+		invite, err := scanGroupInvite(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeGroupInvite elimina l'invito del gruppo; le richieste di ingresso già inviate restano in attesa. Se il gruppo
+// non ha un invito con il token specificato restituisce sql.ErrNoRows
+func (db *appdbimpl) RevokeGroupInvite(ctx context.Context, groupID, token string) error {
+	res, err := db.c.ExecContext(ctx, "DELETE FROM group_invites WHERE conversation_id = ? AND token = ?", groupID, token)
+	if err != nil {
+		return err
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// JoinGroupWithInvite usa l'invito per aggiungere l'utente al gruppo. Se l'invito richiede l'approvazione, registra
+// invece una richiesta di ingresso e restituisce true; una richiesta già in attesa non consuma un altro utilizzo.
+// Restituisce sql.ErrNoRows se l'invito non esiste, ErrInviteExpired o ErrInviteExhausted se non può più essere usato
+func (db *appdbimpl) JoinGroupWithInvite(ctx context.Context, token, userID string) (bool, error) {
+	var pending bool
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		var groupID string
+		var createdBy sql.NullString
+		var expiresAt sql.NullTime
+		var requiresApproval bool
+		err := tx.c.QueryRowContext(ctx,
+			"SELECT conversation_id, created_by, expires_at, requires_approval FROM group_invites WHERE token = ?",
+			token,
+		).Scan(&groupID, &createdBy, &expiresAt, &requiresApproval)
+		if err != nil {
+			return err
+		}
+		now := globaltime.Now().UTC()
+		if expiresAt.Valid && !now.Before(expiresAt.Time) {
+			return ErrInviteExpired
+		}
+
+		if requiresApproval {
+			var requests int
+			err := tx.c.QueryRowContext(ctx,
+				"SELECT COUNT(*) FROM group_join_requests WHERE conversation_id = ? AND user_id = ?",
+				groupID, userID,
+			).Scan(&requests)
+			if err != nil {
+				return err
+			}
+			if requests > 0 {
+				pending = true
+				return nil
+			}
+		}
+
+		// Il controllo sul numero di utilizzi fa parte dell'aggiornamento, così due utenti non possono superarlo
+		res, err := tx.c.ExecContext(ctx,
+			"UPDATE group_invites SET uses = uses + 1 WHERE token = ? AND (max_uses IS NULL OR uses < max_uses)",
+			token,
+		)
+		if err != nil {
+			return err
+		}
+		used, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if used == 0 {
+			return ErrInviteExhausted
+		}
+
+		if requiresApproval {
+			pending = true
+			_, err := tx.c.ExecContext(ctx,
+				"INSERT INTO group_join_requests (conversation_id, user_id, invite_token, requested_at) VALUES (?, ?, ?, ?)",
+				groupID, userID, token, now,
+			)
+			return err
+		}
+		return tx.AddUserToGroup(ctx, groupID, userID, RoleMember, createdBy.String)
+	})
+	return pending, err
+}
+
+// GetJoinRequests restituisce le richieste di ingresso nel gruppo in attesa di approvazione, dalla meno recente
+func (db *appdbimpl) GetJoinRequests(ctx context.Context, groupID string) ([]JoinRequest, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT u.id, u.name, u.photo, r.invite_token, r.requested_at
+		FROM group_join_requests r JOIN users u ON u.id = r.user_id
+		WHERE r.conversation_id = ?
+		ORDER BY r.requested_at, r.user_id`,
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []JoinRequest{}
+	for rows.Next() {
+		var request JoinRequest
+		var photo, inviteToken sql.NullString
+		if err := rows.Scan(&request.UserID, &request.UserName, &photo, &inviteToken, &request.RequestedAt); err != nil {
+			return nil, err
+		}
+		request.Photo = UserPhotoURL(request.UserID, photo.String)
+		request.InviteToken = inviteToken.String
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveJoinRequest accetta la richiesta di ingresso dell'utente, che entra nel gruppo come membro aggiunto da
+// approvedBy. Se l'utente non ha una richiesta in attesa restituisce sql.ErrNoRows
+func (db *appdbimpl) ApproveJoinRequest(ctx context.Context, groupID, userID, approvedBy string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		if err := tx.RejectJoinRequest(ctx, groupID, userID); err != nil {
+			return err
+		}
+		return tx.AddUserToGroup(ctx, groupID, userID, RoleMember, approvedBy)
+	})
+}
+
+// RejectJoinRequest elimina la richiesta di ingresso dell'utente; se l'utente non ha una richiesta in attesa
+// restituisce sql.ErrNoRows
+func (db *appdbimpl) RejectJoinRequest(ctx context.Context, groupID, userID string) error {
+	res, err := db.c.ExecContext(ctx,
+		"DELETE FROM group_join_requests WHERE conversation_id = ? AND user_id = ?",
+		groupID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// conversation restituisce la conversazione vista dall'utente, come GetConversationByID
+func (s *memState) conversation(convID, userID string) (Conversation, error) {
+	c, ok := s.conversations[convID]
+	if !ok {
+		return Conversation{}, sql.ErrNoRows
+	}
+
+	conv := Conversation{ConvID: convID, Type: c.typ, CreatorID: c.creatorID}
+	if c.typ == "private" {
+		// Il nome e la foto sono quelli dell'altro utente
+		otherID := c.otherUser
+		if userID != c.creatorID {
+			otherID = c.creatorID
+		}
+		other, ok := s.users[otherID]
+		if !ok {
+			return Conversation{}, sql.ErrNoRows
+		}
+		conv.Name = other.name
+		conv.Photo = UserPhotoURL(otherID, other.photo)
+	} else {
+		conv.Name = c.name
+		conv.Photo = GroupPhotoURL(convID, c.photo)
+	}
+
+	if c.lastMessageID != "" {
+		msg, ok := s.messages[c.lastMessageID]
+		if !ok {
+			return Conversation{}, sql.ErrNoRows
+		}
+		conv.LastMessage = msg.content
+	}
+	return conv, nil
+}
+
+func (db *memdb) GetUserConversations(ctx context.Context, userID string) ([]Conversation, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var ids []string
+	for id, c := range db.s.conversations {
+		if c.creatorID == userID || (c.typ == "private" && c.otherUser == userID) || c.members[userID].role != "" {
+			ids = append(ids, id)
+		}
+	}
+	sortIDs(ids)
+
+	conversations := []Conversation{}
+	for _, id := range ids {
+		conv, err := db.s.conversation(id, userID)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conv)
+	}
+	return conversations, nil
+}
+
+func (db *memdb) GetConversationByID(ctx context.Context, convID, userID string) (Conversation, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer unlock()
+
+	return db.s.conversation(convID, userID)
+}
+
+func (db *memdb) DeleteConversation(ctx context.Context, convID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// La modifica viene registrata prima dell'eliminazione, quando i membri sono ancora noti
+	db.s.recordConversationChange(Change{Type: ChangeConversationDeleted, ConversationID: convID})
+	if _, ok := db.s.conversations[convID]; !ok {
+		return nil
+	}
+
+	// Elimina a cascata i messaggi, con reazioni, conferme, modifiche e allegati, e i membri del gruppo
+	for id, msg := range db.s.messages {
+		if msg.convID == convID {
+			db.s.deleteMessage(id)
+		}
+	}
+	delete(db.s.conversations, convID)
+	return nil
+}
+
+func (db *memdb) CreatePrivateConversation(ctx context.Context, user1 string, user2 string) (string, error) {
+	if user1 == user2 {
+		return "", fmt.Errorf("400: cannot create a conversation with yourself")
+	}
+
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Restituisce la conversazione esistente tra i due utenti, in qualunque direzione sia stata creata
+	var existing []string
+	for id, c := range db.s.conversations {
+		if c.typ == "private" && ((c.creatorID == user1 && c.otherUser == user2) || (c.creatorID == user2 && c.otherUser == user1)) {
+			existing = append(existing, id)
+		}
+	}
+	if len(existing) > 0 {
+		sortIDs(existing)
+		return existing[0], nil
+	}
+
+	if _, ok := db.s.users[user1]; !ok {
+		return "", fmt.Errorf("%w: conversations.creator_id", errMemConstraint)
+	}
+	if _, ok := db.s.users[user2]; !ok {
+		return "", fmt.Errorf("%w: conversations.otherUser", errMemConstraint)
+	}
+	convID := db.s.newID("conversations")
+	db.s.conversations[convID] = memConversation{id: convID, typ: "private", creatorID: user1, otherUser: user2}
+	db.s.recordConversationChange(Change{Type: ChangeConversationCreated, ConversationID: convID})
+	return convID, nil
+}
+
+func (db *memdb) IsUserInConversation(ctx context.Context, userID, convID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	return db.s.isMember(userID, convID), nil
+}
+
+func (db *memdb) ConversationExists(ctx context.Context, convID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	_, ok := db.s.conversations[convID]
+	return ok, nil
+}
+
+func (db *memdb) IsConversationPrivate(ctx context.Context, convID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[convID]
+	return ok && c.typ == "private", nil
+}
+
+func (db *memdb) IsUserCreatorOfGroup(ctx context.Context, userID, convID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[convID]
+	if !ok {
+		return false, nil
+	}
+	if c.typ == "private" {
+		return false, fmt.Errorf("400: conversation is private")
+	}
+	return c.creatorID == userID, nil
+}
+
+func (db *memdb) GetConversationMembers(ctx context.Context, convID string) ([]string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return db.s.members(convID), nil
+}
+
+func (db *memdb) GetContactIDs(ctx context.Context, userID string) ([]string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return db.s.contacts(userID), nil
+}
+
+func (db *memdb) CreateGroup(ctx context.Context, name, creatorID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, ok := db.s.users[creatorID]; !ok {
+		return "", fmt.Errorf("%w: conversations.creator_id", errMemConstraint)
+	}
+	groupID := db.s.newID("conversations")
+	db.s.conversations[groupID] = memConversation{
+		id:        groupID,
+		name:      name,
+		typ:       "group",
+		creatorID: creatorID,
+		createdAt: globaltime.Now().UTC(),
+		members:   make(map[string]memMember),
+
+		invites:      make(map[string]memInvite),
+		joinRequests: make(map[string]memJoinRequest),
+	}
+
+	// Il gruppo non ha ancora membri: la creazione viene registrata solo nel change log del creatore
+	db.s.recordChange(Change{Type: ChangeConversationCreated, ConversationID: groupID}, []string{creatorID})
+	return groupID, nil
+}
+
+func (db *memdb) AddUserToGroup(ctx context.Context, groupID, userID, role, addedBy string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return db.s.addGroupMember(groupID, userID, role, addedBy)
+}
+
+// addGroupMember aggiunge l'utente al gruppo, come appdbimpl.AddUserToGroup
+func (s *memState) addGroupMember(groupID, userID, role, addedBy string) error {
+	c, ok := s.conversations[groupID]
+	if !ok {
+		return fmt.Errorf("%w: group_members.conversation_id", errMemConstraint)
+	}
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("%w: group_members.user_id", errMemConstraint)
+	}
+	if _, ok := c.members[userID]; ok {
+		return fmt.Errorf("%w: group_members.conversation_id, group_members.user_id", errMemConstraint)
+	}
+	if !isGroupRole(role) {
+		return fmt.Errorf("%w: group_members.role", errMemConstraint)
+	}
+	if _, ok := s.users[addedBy]; addedBy != "" && !ok {
+		return fmt.Errorf("%w: group_members.added_by", errMemConstraint)
+	}
+	c.members[userID] = memMember{role: role, joinedAt: globaltime.Now().UTC(), addedBy: addedBy}
+	delete(c.joinRequests, userID)
+	s.recordConversationChange(Change{Type: ChangeMemberAdded, ConversationID: groupID, UserID: userID})
+	return nil
+}
+
+func (db *memdb) GetGroupMembers(ctx context.Context, groupID string) ([]GroupMember, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	ids := make([]string, 0, len(c.members))
+	for id := range c.members {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return c.members[ids[i]].joinedAt.Before(c.members[ids[j]].joinedAt)
+	})
+
+	members := make([]GroupMember, 0, len(ids))
+	for _, id := range ids {
+		m, u := c.members[id], db.s.users[id]
+		members = append(members, GroupMember{
+			UserID:   id,
+			UserName: u.name,
+			Photo:    UserPhotoURL(id, u.photo),
+			Role:     m.role,
+			JoinedAt: formatTime(m.joinedAt),
+			AddedBy:  m.addedBy,
+		})
+	}
+	return members, nil
+}
+
+func (db *memdb) GetGroupProfile(ctx context.Context, groupID string) (GroupProfile, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return GroupProfile{}, err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[groupID]
+	if !ok || c.typ != "group" {
+		return GroupProfile{}, sql.ErrNoRows
+	}
+	return GroupProfile{
+		ConvID:      groupID,
+		Name:        c.name,
+		Description: c.description,
+		Photo:       GroupPhotoURL(groupID, c.photo),
+		CreatorID:   c.creatorID,
+		CreatorName: db.s.users[c.creatorID].name,
+		CreatedAt:   formatTime(c.createdAt),
+		MemberCount: len(c.members),
+	}, nil
+}
+
+func (db *memdb) ChangeGroupDescription(ctx context.Context, groupID, description string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if c, ok := db.s.conversations[groupID]; ok {
+		c.description = description
+		db.s.conversations[groupID] = c
+	}
+	db.s.recordConversationChange(Change{Type: ChangeGroupDescription, ConversationID: groupID, Value: description})
+	return nil
+}
+
+func (db *memdb) GetGroupRole(ctx context.Context, groupID, userID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	m, ok := db.s.conversations[groupID].members[userID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return m.role, nil
+}
+
+func (db *memdb) SetGroupRole(ctx context.Context, groupID, userID, role string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, ok := db.s.conversations[groupID].members[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if !isGroupRole(role) {
+		return fmt.Errorf("%w: group_members.role", errMemConstraint)
+	}
+	m.role = role
+	db.s.conversations[groupID].members[userID] = m
+	db.s.recordConversationChange(Change{Type: ChangeMemberRoleChanged, ConversationID: groupID, UserID: userID, Value: role})
+	return nil
+}
+
+func (db *memdb) TransferGroupOwnership(ctx context.Context, groupID, newOwnerID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	if _, ok := c.members[newOwnerID]; !ok {
+		return sql.ErrNoRows
+	}
+	if c.creatorID == newOwnerID {
+		return nil
+	}
+	db.s.transferOwnership(groupID, newOwnerID)
+	return nil
+}
+
+// transferOwnership passa la proprietà del gruppo a newOwnerID, come appdbimpl.transferOwnership
+func (s *memState) transferOwnership(groupID, newOwnerID string) {
+	c := s.conversations[groupID]
+	if owner, ok := c.members[c.creatorID]; ok {
+		owner.role = RoleAdmin
+		c.members[c.creatorID] = owner
+	}
+	m := c.members[newOwnerID]
+	m.role = RoleOwner
+	c.members[newOwnerID] = m
+	c.creatorID = newOwnerID
+	s.conversations[groupID] = c
+	s.recordConversationChange(Change{Type: ChangeOwnerChanged, ConversationID: groupID, UserID: newOwnerID})
+}
+
+// groupSuccessor restituisce il successore del proprietario ownerID, come appdbimpl.groupSuccessor
+func (s *memState) groupSuccessor(groupID, ownerID string) (string, bool) {
+	var candidates []string
+	for id := range s.conversations[groupID].members {
+		if id != ownerID {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	sortIDs(candidates)
+
+	members := s.conversations[groupID].members
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := members[candidates[i]], members[candidates[j]]
+		if (a.role == RoleAdmin) != (b.role == RoleAdmin) {
+			return a.role == RoleAdmin
+		}
+		return a.joinedAt.Before(b.joinedAt)
+	})
+	return candidates[0], true
+}
+
+func (db *memdb) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	if m, ok := c.members[userID]; !ok || m.role == RoleOwner {
+		return sql.ErrNoRows
+	}
+
+	// La rimozione viene registrata prima di rimuovere l'utente, così la riceve anche l'utente stesso
+	db.s.recordConversationChange(Change{Type: ChangeMemberRemoved, ConversationID: groupID, UserID: userID})
+	delete(c.members, userID)
+	return nil
+}
+
+// isGroupRole controlla se role è uno dei ruoli ammessi dal vincolo CHECK di group_members.role
+func isGroupRole(role string) bool {
+	return role == RoleOwner || role == RoleAdmin || role == RoleMember
+}
+
+func (db *memdb) ChangeGroupName(ctx context.Context, groupID, name string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if c, ok := db.s.conversations[groupID]; ok {
+		c.name = name
+		db.s.conversations[groupID] = c
+	}
+	db.s.recordConversationChange(Change{Type: ChangeGroupRenamed, ConversationID: groupID, Value: name})
+	return nil
+}
+
+func (db *memdb) LeaveGroup(ctx context.Context, groupID, userID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Il proprietario lascia il gruppo al successore, se il gruppo ha altri membri
+	var newOwnerID string
+	if db.s.conversations[groupID].members[userID].role == RoleOwner {
+		if successor, ok := db.s.groupSuccessor(groupID, userID); ok {
+			db.s.transferOwnership(groupID, successor)
+			newOwnerID = successor
+		}
+	}
+
+	// L'uscita viene registrata prima di rimuovere l'utente, così la riceve anche l'utente stesso
+	db.s.recordConversationChange(Change{Type: ChangeMemberLeft, ConversationID: groupID, UserID: userID})
+	if c, ok := db.s.conversations[groupID]; ok {
+		delete(c.members, userID)
+	}
+	return newOwnerID, nil
+}
+
+func (db *memdb) GetGroupPhotoByID(ctx context.Context, groupID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[groupID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return c.photo, nil
+}
+
+func (db *memdb) UpdateGroupPhoto(ctx context.Context, groupID, photoPath string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if c, ok := db.s.conversations[groupID]; ok {
+		c.photo = photoPath
+		db.s.conversations[groupID] = c
+	}
+	db.s.recordConversationChange(Change{Type: ChangeGroupPhotoUpdated, ConversationID: groupID})
+	return nil
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"WasaTEXT/service/globaltime"
+)
+
+func (db *memdb) CreateGroupInvite(ctx context.Context, groupID, createdBy string, invite NewGroupInvite) (GroupInvite, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[groupID]
+	if !ok || c.invites == nil {
+		return GroupInvite{}, fmt.Errorf("%w: group_invites.conversation_id", errMemConstraint)
+	}
+	if _, ok := db.s.users[createdBy]; !ok {
+		return GroupInvite{}, fmt.Errorf("%w: group_invites.created_by", errMemConstraint)
+	}
+	token, err := newInviteToken()
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	inv := memInvite{
+		createdBy:        createdBy,
+		createdAt:        globaltime.Now().UTC(),
+		expiresAt:        invite.ExpiresAt.UTC(),
+		requiresApproval: invite.RequiresApproval,
+	}
+	if invite.MaxUses > 0 {
+		inv.maxUses = invite.MaxUses
+	}
+	c.invites[token] = inv
+	return inv.groupInvite(token, groupID), nil
+}
+
+// groupInvite converte l'invito nella struttura restituita dall'interfaccia AppDatabase
+func (inv memInvite) groupInvite(token, groupID string) GroupInvite {
+	return GroupInvite{
+		Token:            token,
+		ConversationID:   groupID,
+		CreatedBy:        inv.createdBy,
+		CreatedAt:        formatTime(inv.createdAt),
+		ExpiresAt:        formatTime(inv.expiresAt),
+		MaxUses:          inv.maxUses,
+		Uses:             inv.uses,
+		RequiresApproval: inv.requiresApproval,
+	}
+}
+
+// findInvite restituisce l'invito con il token specificato e il gruppo a cui appartiene
+func (s *memState) findInvite(token string) (memInvite, string, bool) {
+	for id, c := range s.conversations {
+		if inv, ok := c.invites[token]; ok {
+			return inv, id, true
+		}
+	}
+	return memInvite{}, "", false
+}
+
+func (db *memdb) GetGroupInvite(ctx context.Context, token string) (GroupInvite, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return GroupInvite{}, err
+	}
+	defer unlock()
+
+	inv, groupID, ok := db.s.findInvite(token)
+	if !ok {
+		return GroupInvite{}, sql.ErrNoRows
+	}
+	return inv.groupInvite(token, groupID), nil
+}
+
+func (db *memdb) GetGroupInvites(ctx context.Context, groupID string) ([]GroupInvite, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	tokens := make([]string, 0, len(c.invites))
+	for token := range c.invites {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return c.invites[tokens[i]].createdAt.Before(c.invites[tokens[j]].createdAt)
+	})
+
+	invites := make([]GroupInvite, 0, len(tokens))
+	for _, token := range tokens {
+		invites = append(invites, c.invites[token].groupInvite(token, groupID))
+	}
+	return invites, nil
+}
+
+func (db *memdb) RevokeGroupInvite(ctx context.Context, groupID, token string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	if _, ok := c.invites[token]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(c.invites, token)
+
+	// Le richieste di ingresso restano in attesa senza invito, come con ON DELETE SET NULL
+	for id, r := range c.joinRequests {
+		if r.inviteToken == token {
+			r.inviteToken = ""
+			c.joinRequests[id] = r
+		}
+	}
+	return nil
+}
+
+func (db *memdb) JoinGroupWithInvite(ctx context.Context, token, userID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	inv, groupID, ok := db.s.findInvite(token)
+	if !ok {
+		return false, sql.ErrNoRows
+	}
+	now := globaltime.Now().UTC()
+	if !inv.expiresAt.IsZero() && !now.Before(inv.expiresAt) {
+		return false, ErrInviteExpired
+	}
+	c := db.s.conversations[groupID]
+	if _, ok := c.joinRequests[userID]; ok && inv.requiresApproval {
+		return true, nil
+	}
+	if inv.maxUses > 0 && inv.uses >= inv.maxUses {
+		return false, ErrInviteExhausted
+	}
+
+	if inv.requiresApproval {
+		if _, ok := db.s.users[userID]; !ok {
+			return false, fmt.Errorf("%w: group_join_requests.user_id", errMemConstraint)
+		}
+		c.joinRequests[userID] = memJoinRequest{inviteToken: token, requestedAt: now}
+	} else if err := db.s.addGroupMember(groupID, userID, RoleMember, inv.createdBy); err != nil {
+		return false, err
+	}
+	inv.uses++
+	c.invites[token] = inv
+	return inv.requiresApproval, nil
+}
+
+func (db *memdb) GetJoinRequests(ctx context.Context, groupID string) ([]JoinRequest, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	ids := make([]string, 0, len(c.joinRequests))
+	for id := range c.joinRequests {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return c.joinRequests[ids[i]].requestedAt.Before(c.joinRequests[ids[j]].requestedAt)
+	})
+
+	requests := make([]JoinRequest, 0, len(ids))
+	for _, id := range ids {
+		r, u := c.joinRequests[id], db.s.users[id]
+		requests = append(requests, JoinRequest{
+			UserID:      id,
+			UserName:    u.name,
+			Photo:       UserPhotoURL(id, u.photo),
+			InviteToken: r.inviteToken,
+			RequestedAt: formatTime(r.requestedAt),
+		})
+	}
+	return requests, nil
+}
+
+func (db *memdb) ApproveJoinRequest(ctx context.Context, groupID, userID, approvedBy string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := db.s.conversations[groupID].joinRequests[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	return db.s.addGroupMember(groupID, userID, RoleMember, approvedBy)
+}
+
+func (db *memdb) RejectJoinRequest(ctx context.Context, groupID, userID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c := db.s.conversations[groupID]
+	if _, ok := c.joinRequests[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(c.joinRequests, userID)
+	return nil
+}
@@ -0,0 +1,672 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// sortedMessages restituisce i messaggi per cui keep è vero, ordinati per (timestamp, id)
+func (s *memState) sortedMessages(keep func(m memMessage) bool) []memMessage {
+	var messages []memMessage
+	for _, m := range s.messages {
+		if keep(m) {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messageBefore(messages[i], messages[j])
+	})
+	return messages
+}
+
+// messageBefore confronta due messaggi nell'ordinamento (timestamp, id)
+func messageBefore(a, b memMessage) bool {
+	if !a.timestamp.Equal(b.timestamp) {
+		return a.timestamp.Before(b.timestamp)
+	}
+	x, _ := strconv.ParseInt(a.id, 10, 64)
+	y, _ := strconv.ParseInt(b.id, 10, 64)
+	return x < y
+}
+
+// cursorOf restituisce il cursore di paginazione del messaggio
+func cursorOf(m memMessage) messageCursor {
+	return messageCursor{Timestamp: m.timestamp.Format(memTimestampLayout), ID: m.id}
+}
+
+// compareCursor confronta la posizione del messaggio con quella del cursore: restituisce un numero negativo se il
+// messaggio viene prima, zero se coincidono e positivo se viene dopo
+func compareCursor(m memMessage, cur messageCursor) int {
+	ts := m.timestamp.Format(memTimestampLayout)
+	switch {
+	case ts < cur.Timestamp:
+		return -1
+	case ts > cur.Timestamp:
+		return 1
+	}
+	x, _ := strconv.ParseInt(m.id, 10, 64)
+	y, _ := strconv.ParseInt(cur.ID, 10, 64)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// toMessage converte il messaggio nel tipo restituito dall'interfaccia, completando l'anteprima del messaggio citato e
+// gli allegati. Le reazioni vengono incluse solo se withReactions è vero
+func (s *memState) toMessage(m memMessage, withReactions bool) Message {
+	msg := Message{
+		MessageID:      m.id,
+		ConversationID: m.convID,
+		SenderID:       m.senderID,
+		Content:        m.content,
+		Timestamp:      formatTime(m.timestamp),
+		Status:         m.status,
+		EditedAt:       formatTime(m.editedAt),
+		Attachments:    s.messageAttachments(m),
+		Reactions:      []Reaction{},
+		Kind:           m.kind,
+		Payload:        m.payload,
+	}
+	if m.replyTo != "" {
+		preview := MessagePreview{MessageID: m.replyTo, Deleted: true}
+		if quoted, ok := s.messages[m.replyTo]; ok {
+			if sender, ok := s.users[quoted.senderID]; ok {
+				preview = MessagePreview{
+					MessageID:  quoted.id,
+					SenderID:   quoted.senderID,
+					SenderName: sender.name,
+					Snippet:    quoteSnippet(quoted.content),
+				}
+			}
+		}
+		msg.ReplyTo = &preview
+	}
+	if withReactions {
+		for _, r := range m.reactions {
+			msg.Reactions = append(msg.Reactions, Reaction{UserID: r.userID, Reaction: r.reaction})
+		}
+	}
+	return msg
+}
+
+// messageAttachments restituisce gli allegati del messaggio in ordine di id
+func (s *memState) messageAttachments(m memMessage) []Attachment {
+	var ids []string
+	for id, a := range s.attachments {
+		if a.messageID == m.id {
+			ids = append(ids, id)
+		}
+	}
+	sortIDs(ids)
+
+	attachments := []Attachment{}
+	for _, id := range ids {
+		att := s.attachments[id].att
+		att.URL = attachmentURL(m.convID, id)
+		attachments = append(attachments, att)
+	}
+	return attachments
+}
+
+// deleteMessage elimina il messaggio con i suoi allegati, come farebbero le chiavi esterne ON DELETE CASCADE e
+// ON DELETE SET NULL dello schema SQL. Reazioni, conferme e modifiche sono salvate nel messaggio stesso
+func (s *memState) deleteMessage(messageID string) {
+	for id, a := range s.attachments {
+		if a.messageID == messageID {
+			delete(s.attachments, id)
+		}
+	}
+	for id, c := range s.conversations {
+		if c.lastMessageID == messageID {
+			c.lastMessageID = ""
+			s.conversations[id] = c
+		}
+	}
+	delete(s.messages, messageID)
+}
+
+// addAttachment allega il file al messaggio
+func (s *memState) addAttachment(messageID string, path string, att Attachment) {
+	id := s.newID("attachments")
+	att.AttachmentID = id
+	s.attachments[id] = memAttachment{messageID: messageID, path: path, att: att}
+}
+
+func (db *memdb) InsertMessage(ctx context.Context, convID string, userID string, text string, replyTo string, attachments []NewAttachment) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, ok := db.s.conversations[convID]; !ok {
+		return "", fmt.Errorf("%w: messages.conversation_id", errMemConstraint)
+	}
+	if _, ok := db.s.users[userID]; !ok {
+		return "", fmt.Errorf("%w: messages.sender_id", errMemConstraint)
+	}
+
+	// Come CURRENT_TIMESTAMP, il timestamp del messaggio ha una precisione di un secondo
+	messageID := db.s.newID("messages")
+	db.s.messages[messageID] = memMessage{
+		id:        messageID,
+		convID:    convID,
+		senderID:  userID,
+		content:   text,
+		timestamp: globaltime.Now().UTC().Truncate(time.Second),
+		status:    "sent",
+		replyTo:   replyTo,
+		kind:      MessageKindText,
+		receipts:  make(map[string]memReceipt),
+	}
+	for _, att := range attachments {
+		db.s.addAttachment(messageID, att.Path, Attachment{
+			FileName: att.FileName,
+			MimeType: att.MimeType,
+			Size:     att.Size,
+			Width:    att.Width,
+			Height:   att.Height,
+		})
+	}
+
+	db.s.recordConversationChange(Change{
+		Type:           ChangeMessageCreated,
+		ConversationID: convID,
+		MessageID:      messageID,
+		UserID:         userID,
+	})
+	return messageID, nil
+}
+
+func (db *memdb) InsertSystemMessage(ctx context.Context, groupID, senderID string, payload SystemPayload) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, ok := db.s.conversations[groupID]; !ok {
+		return "", fmt.Errorf("%w: messages.conversation_id", errMemConstraint)
+	}
+	sender, ok := db.s.users[senderID]
+	if !ok {
+		return "", fmt.Errorf("%w: messages.sender_id", errMemConstraint)
+	}
+
+	messageID := db.s.newID("messages")
+	db.s.messages[messageID] = memMessage{
+		id:        messageID,
+		convID:    groupID,
+		senderID:  senderID,
+		content:   systemContent(payload, senderID, sender.name, db.s.users[payload.UserID].name),
+		timestamp: globaltime.Now().UTC().Truncate(time.Second),
+		status:    "sent",
+		kind:      MessageKindSystem,
+		payload:   &payload,
+		receipts:  make(map[string]memReceipt),
+	}
+
+	db.s.recordConversationChange(Change{
+		Type:           ChangeMessageCreated,
+		ConversationID: groupID,
+		MessageID:      messageID,
+		UserID:         senderID,
+	})
+	return messageID, nil
+}
+
+func (db *memdb) GetMessageFromID(ctx context.Context, messageID string) (Message, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return Message{}, sql.ErrNoRows
+	}
+	return db.s.toMessage(m, false), nil
+}
+
+func (db *memdb) UpdateLastMessage(ctx context.Context, convID string, messageID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c, ok := db.s.conversations[convID]
+	if !ok {
+		return nil
+	}
+	if _, ok := db.s.messages[messageID]; messageID != "" && !ok {
+		return fmt.Errorf("%w: conversations.lastMessageId", errMemConstraint)
+	}
+	c.lastMessageID = messageID
+	db.s.conversations[convID] = c
+	return nil
+}
+
+func (db *memdb) MessageExists(ctx context.Context, messageID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	_, ok := db.s.messages[messageID]
+	return ok, nil
+}
+
+func (db *memdb) DeleteMessage(ctx context.Context, messageID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return nil
+	}
+	db.s.deleteMessage(messageID)
+	db.s.recordConversationChange(Change{Type: ChangeMessageDeleted, ConversationID: m.convID, MessageID: messageID})
+	return nil
+}
+
+func (db *memdb) GetLastMessageID(ctx context.Context, convID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	messages := db.s.sortedMessages(func(m memMessage) bool { return m.convID == convID })
+	if len(messages) == 0 {
+		return "", nil
+	}
+	return messages[len(messages)-1].id, nil
+}
+
+func (db *memdb) InsertReaction(ctx context.Context, userID string, messageID string, reaction string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return fmt.Errorf("%w: reactions.message_id", errMemConstraint)
+	}
+	if _, ok := db.s.users[userID]; !ok {
+		return fmt.Errorf("%w: reactions.user_id", errMemConstraint)
+	}
+
+	// La nuova reazione sostituisce quella precedente dell'utente e diventa la più recente
+	reactions := []memReaction{}
+	for _, r := range m.reactions {
+		if r.userID != userID {
+			reactions = append(reactions, r)
+		}
+	}
+	m.reactions = append(reactions, memReaction{userID: userID, reaction: reaction})
+	db.s.messages[messageID] = m
+
+	db.s.recordConversationChange(Change{
+		Type:           ChangeReactionAdded,
+		ConversationID: m.convID,
+		MessageID:      messageID,
+		UserID:         userID,
+		Value:          reaction,
+	})
+	return nil
+}
+
+func (db *memdb) DeleteReaction(ctx context.Context, messageID, userID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	reactions := []memReaction{}
+	for _, r := range m.reactions {
+		if r.userID != userID {
+			reactions = append(reactions, r)
+		}
+	}
+	m.reactions = reactions
+	db.s.messages[messageID] = m
+
+	db.s.recordConversationChange(Change{
+		Type:           ChangeReactionRemoved,
+		ConversationID: m.convID,
+		MessageID:      messageID,
+		UserID:         userID,
+	})
+	return nil
+}
+
+func (db *memdb) UserHasReaction(ctx context.Context, messageID, userID string) (bool, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	for _, r := range db.s.messages[messageID].reactions {
+		if r.userID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *memdb) GetMessagesFromConversation(ctx context.Context, conversationID string, q MessageQuery) (MessagePage, error) {
+	if q.Before != "" && q.After != "" {
+		return MessagePage{}, ErrInvalidCursor
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultMessageLimit
+	}
+	if limit > MaxMessageLimit {
+		limit = MaxMessageLimit
+	}
+
+	var before, after *messageCursor
+	if q.Before != "" {
+		cur, err := decodeMessageCursor(q.Before)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		before = &cur
+	}
+	if q.After != "" {
+		cur, err := decodeMessageCursor(q.After)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		after = &cur
+	}
+
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer unlock()
+
+	messages := db.s.sortedMessages(func(m memMessage) bool {
+		return m.convID == conversationID &&
+			(before == nil || compareCursor(m, *before) < 0) &&
+			(after == nil || compareCursor(m, *after) > 0)
+	})
+
+	// Senza cursore After viene restituita la pagina più recente, cioè gli ultimi limit messaggi
+	page := MessagePage{Messages: []Message{}}
+	if len(messages) > limit {
+		if after != nil {
+			messages = messages[:limit]
+			page.NextCursor = cursorOf(messages[limit-1]).encode()
+		} else {
+			messages = messages[len(messages)-limit:]
+			page.NextCursor = cursorOf(messages[0]).encode()
+		}
+	}
+	for _, m := range messages {
+		page.Messages = append(page.Messages, db.s.toMessage(m, true))
+	}
+	return page, nil
+}
+
+func (db *memdb) GetContentFromMessageID(ctx context.Context, messageID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return m.content, nil
+}
+
+func (db *memdb) GetReplies(ctx context.Context, convID, messageID string) ([]Message, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	replies := []Message{}
+	for _, m := range db.s.sortedMessages(func(m memMessage) bool { return m.convID == convID && m.replyTo == messageID }) {
+		replies = append(replies, db.s.toMessage(m, true))
+	}
+	return replies, nil
+}
+
+func (db *memdb) GetAttachment(ctx context.Context, attachmentID string) (Attachment, string, string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return Attachment{}, "", "", err
+	}
+	defer unlock()
+
+	a, ok := db.s.attachments[attachmentID]
+	if !ok {
+		return Attachment{}, "", "", sql.ErrNoRows
+	}
+	m, ok := db.s.messages[a.messageID]
+	if !ok {
+		return Attachment{}, "", "", sql.ErrNoRows
+	}
+	att := a.att
+	att.URL = attachmentURL(m.convID, attachmentID)
+	return att, m.convID, a.path, nil
+}
+
+func (db *memdb) CopyAttachments(ctx context.Context, fromMessageID, toMessageID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var ids []string
+	for id, a := range db.s.attachments {
+		if a.messageID == fromMessageID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, ok := db.s.messages[toMessageID]; !ok {
+		return fmt.Errorf("%w: attachments.message_id", errMemConstraint)
+	}
+	sortIDs(ids)
+	for _, id := range ids {
+		a := db.s.attachments[id]
+		db.s.addAttachment(toMessageID, a.path, a.att)
+	}
+	return nil
+}
+
+func (db *memdb) EditMessage(ctx context.Context, messageID, content string) (Message, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer unlock()
+
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return Message{}, sql.ErrNoRows
+	}
+
+	// Il contenuto attuale è stato scritto all'invio del messaggio o con l'ultima modifica
+	writtenAt := m.timestamp
+	if !m.editedAt.IsZero() {
+		writtenAt = m.editedAt
+	}
+	now := globaltime.Now().UTC()
+	m.edits = append(m.edits, MessageEdit{Content: m.content, CreatedAt: formatTime(writtenAt), ReplacedAt: formatTime(now)})
+	m.content = content
+	m.editedAt = now
+	db.s.messages[messageID] = m
+
+	db.s.recordConversationChange(Change{
+		Type:           ChangeMessageEdited,
+		ConversationID: m.convID,
+		MessageID:      messageID,
+		Value:          content,
+	})
+	return db.s.toMessage(m, true), nil
+}
+
+func (db *memdb) GetMessageEdits(ctx context.Context, messageID string) ([]MessageEdit, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return append([]MessageEdit{}, db.s.messages[messageID].edits...), nil
+}
+
+// messageRecipients restituisce gli id dei destinatari del messaggio: i membri della conversazione tranne il mittente
+func (s *memState) messageRecipients(m memMessage) []string {
+	var recipients []string
+	for _, id := range s.members(m.convID) {
+		if _, ok := s.users[id]; ok && id != m.senderID {
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+// markConversation registra con mark la conferma dell'utente per tutti i messaggi della conversazione ricevuti finora
+// e aggiorna lo stato dei messaggi
+func (s *memState) markConversation(convID, userID string, mark func(r memReceipt) memReceipt) error {
+	for id, m := range s.messages {
+		if m.convID == convID && m.senderID != userID {
+			if _, ok := s.users[userID]; !ok {
+				return fmt.Errorf("%w: message_receipts.user_id", errMemConstraint)
+			}
+			m.receipts[userID] = mark(m.receipts[userID])
+			s.messages[id] = m
+		}
+	}
+	s.refreshMessageStatuses(convID)
+	return nil
+}
+
+// refreshMessageStatuses aggiorna lo stato aggregato dei messaggi della conversazione: un messaggio diventa 'received'
+// quando tutti i destinatari lo hanno ricevuto e 'read' quando tutti lo hanno letto. Lo stato non torna mai indietro
+func (s *memState) refreshMessageStatuses(convID string) {
+	changed := false
+	for id, m := range s.messages {
+		if m.convID != convID || m.status == "read" {
+			continue
+		}
+		read, delivered := true, true
+		for _, userID := range s.messageRecipients(m) {
+			r := m.receipts[userID]
+			read = read && !r.readAt.IsZero()
+			delivered = delivered && !r.deliveredAt.IsZero()
+		}
+		switch {
+		case read:
+			m.status = "read"
+		case delivered && m.status == "sent":
+			m.status = "received"
+		default:
+			continue
+		}
+		s.messages[id] = m
+		changed = true
+	}
+
+	// Se lo stato di almeno un messaggio è cambiato, lo registra nel change log dei membri della conversazione
+	if changed {
+		s.recordConversationChange(Change{Type: ChangeMessageStatus, ConversationID: convID})
+	}
+}
+
+func (db *memdb) MarkConversationDelivered(ctx context.Context, convID, userID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := globaltime.Now().UTC()
+	return db.s.markConversation(convID, userID, func(r memReceipt) memReceipt {
+		if r.deliveredAt.IsZero() {
+			r.deliveredAt = now
+		}
+		return r
+	})
+}
+
+func (db *memdb) MarkConversationRead(ctx context.Context, convID, userID string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := globaltime.Now().UTC()
+	return db.s.markConversation(convID, userID, func(r memReceipt) memReceipt {
+		if r.deliveredAt.IsZero() {
+			r.deliveredAt = now
+		}
+		if r.readAt.IsZero() {
+			r.readAt = now
+		}
+		return r
+	})
+}
+
+func (db *memdb) GetMessageReceipts(ctx context.Context, messageID string) ([]Receipt, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	receipts := []Receipt{}
+	m, ok := db.s.messages[messageID]
+	if !ok {
+		return receipts, nil
+	}
+	for _, userID := range db.s.messageRecipients(m) {
+		r := m.receipts[userID]
+		receipts = append(receipts, Receipt{
+			UserID:      userID,
+			UserName:    db.s.users[userID].name,
+			DeliveredAt: formatTime(r.deliveredAt),
+			ReadAt:      formatTime(r.readAt),
+		})
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].UserName < receipts[j].UserName })
+	return receipts, nil
+}
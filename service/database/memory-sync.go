@@ -0,0 +1,353 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"WasaTEXT/service/globaltime"
+)
+
+func (db *memdb) AppendUserEvent(ctx context.Context, userIDs []string, eventType, convID, payload string) ([]UserEvent, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Controlla i destinatari prima di salvare gli eventi, così in caso di errore non ne viene salvato nessuno
+	for _, userID := range userIDs {
+		if _, ok := db.s.users[userID]; !ok {
+			return nil, fmt.Errorf("%w: event_sequences.user_id", errMemConstraint)
+		}
+	}
+
+	now := globaltime.Now().UTC()
+	stored := make([]UserEvent, 0, len(userIDs))
+	seen := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+
+		db.s.eventSeq[userID]++
+		ev := UserEvent{
+			UserID:         userID,
+			Seq:            db.s.eventSeq[userID],
+			Type:           eventType,
+			ConversationID: convID,
+			Payload:        payload,
+			CreatedAt:      now.Format(time.RFC3339),
+		}
+		db.s.events[userID] = append(db.s.events[userID], memUserEvent{event: ev, createdAt: now})
+		stored = append(stored, ev)
+	}
+	return stored, nil
+}
+
+func (db *memdb) GetUserEventsAfter(ctx context.Context, userID string, afterSeq int64, limit int) ([]UserEvent, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Come LIMIT in SQL, un limite negativo indica nessun limite
+	userEvents := []UserEvent{}
+	for _, ev := range db.s.events[userID] {
+		if limit >= 0 && len(userEvents) >= limit {
+			break
+		}
+		if ev.event.Seq > afterSeq {
+			e := ev.event
+			e.CreatedAt = formatTime(ev.createdAt)
+			userEvents = append(userEvents, e)
+		}
+	}
+	return userEvents, nil
+}
+
+func (db *memdb) GetUserEventBounds(ctx context.Context, userID string) (int64, int64, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	last := db.s.eventSeq[userID]
+	if events := db.s.events[userID]; len(events) > 0 {
+		return events[0].event.Seq, last, nil
+	}
+	return last + 1, last, nil
+}
+
+func (db *memdb) DeleteExpiredUserEvents(ctx context.Context) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cutoff := globaltime.Now().UTC().Add(-UserEventRetention)
+	for userID, events := range db.s.events {
+		kept := []memUserEvent{}
+		for _, ev := range events {
+			if ev.createdAt.After(cutoff) {
+				kept = append(kept, ev)
+			}
+		}
+		db.s.events[userID] = kept
+	}
+	return nil
+}
+
+// changeLogBounds restituisce il numero di sequenza dell'ultima modifica compattata e quello dell'ultima modifica
+// salvata, come changeLogBounds di appdbimpl
+func (s *memState) changeLogBounds() (int64, int64) {
+	if len(s.changes) == 0 {
+		return s.changeFloor, s.changeFloor
+	}
+	head := s.changes[len(s.changes)-1].change.Seq
+	if head < s.changeFloor {
+		return s.changeFloor, s.changeFloor
+	}
+	return s.changeFloor, head
+}
+
+func (db *memdb) GetChanges(ctx context.Context, userID string, since int64, limit int) (ChangePage, error) {
+	if limit <= 0 {
+		limit = DefaultChangeLimit
+	} else if limit > MaxChangeLimit {
+		limit = MaxChangeLimit
+	}
+
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return ChangePage{}, err
+	}
+	defer unlock()
+
+	// Il client deve ricaricare tutto se ha perso modifiche già compattate o se since non è mai stato restituito
+	floor, head := db.s.changeLogBounds()
+	if since < floor || since > head {
+		return ChangePage{Changes: []Change{}, NextSince: head, FullResync: true}, nil
+	}
+
+	page := ChangePage{Changes: []Change{}, NextSince: since}
+	for _, c := range db.s.changes {
+		if c.userID != userID || c.change.Seq <= since {
+			continue
+		}
+		if len(page.Changes) == limit {
+			page.HasMore = true
+			break
+		}
+
+		// Il messaggio viene incluso per le modifiche di tipo ChangeMessageCreated, se non è stato eliminato
+		change := c.change
+		change.CreatedAt = formatTime(c.createdAt)
+		if m, ok := db.s.messages[change.MessageID]; ok && change.Type == ChangeMessageCreated {
+			msg := db.s.toMessage(m, false)
+			change.Message = &msg
+		}
+		page.Changes = append(page.Changes, change)
+		page.NextSince = change.Seq
+	}
+	return page, nil
+}
+
+func (db *memdb) CompactChangeLog(ctx context.Context) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Le modifiche sono in ordine di sequenza e quindi di tempo: vengono eliminate tutte quelle fino all'ultima
+	// modifica più vecchia di ChangeLogRetention
+	cutoff := globaltime.Now().UTC().Add(-ChangeLogRetention)
+	n := 0
+	for i, c := range db.s.changes {
+		if !c.createdAt.After(cutoff) {
+			n = i + 1
+		}
+	}
+	if n == 0 {
+		// Niente da compattare
+		return nil
+	}
+	if floor := db.s.changes[n-1].change.Seq; floor > db.s.changeFloor {
+		db.s.changeFloor = floor
+	}
+	db.s.changes = append([]memChange(nil), db.s.changes[n:]...)
+	return nil
+}
+
+// searchToken è una parola del testo di un messaggio: start e end sono le posizioni del primo e dell'ultimo byte + 1
+type searchToken struct {
+	text       string
+	start, end int
+}
+
+// tokenize divide il testo in token di lettere e cifre, confrontati senza distinguere le maiuscole, come il tokenizer
+// predefinito dell'indice full-text di SQLite
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		inToken := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inToken && start < 0:
+			start = i
+		case !inToken && start >= 0:
+			tokens = append(tokens, searchToken{text: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{text: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// matchPhrases restituisce, per ogni token del testo, se fa parte di una delle frasi cercate. Il secondo valore è
+// falso se almeno una frase non compare nel testo
+func matchPhrases(tokens []searchToken, phrases [][]searchToken) ([]bool, bool) {
+	matched := make([]bool, len(tokens))
+	for _, phrase := range phrases {
+		found := false
+		for i := 0; i+len(phrase) <= len(tokens); i++ {
+			j := 0
+			for j < len(phrase) && tokens[i+j].text == phrase[j].text {
+				j++
+			}
+			if j == len(phrase) {
+				found = true
+				for k := i; k < i+len(phrase); k++ {
+					matched[k] = true
+				}
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return matched, true
+}
+
+// searchSnippet restituisce al massimo snippetTokens token del testo a partire dal primo termine trovato, con i termini
+// trovati evidenziati, come la funzione snippet dell'indice full-text di SQLite
+func searchSnippet(text string, tokens []searchToken, matched []bool) string {
+	first := 0
+	for first < len(matched) && !matched[first] {
+		first++
+	}
+	start := first
+	if start+snippetTokens > len(tokens) {
+		start = len(tokens) - snippetTokens
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetTokens
+	if end > len(tokens) {
+		end = len(tokens)
+	}
+
+	var b strings.Builder
+	pos := tokens[start].start
+	if start > 0 {
+		b.WriteString("…")
+	} else {
+		pos = 0
+	}
+	for i := start; i < end; i++ {
+		b.WriteString(text[pos:tokens[i].start])
+		if matched[i] {
+			b.WriteString(snippetOpen + text[tokens[i].start:tokens[i].end] + snippetClose)
+		} else {
+			b.WriteString(text[tokens[i].start:tokens[i].end])
+		}
+		pos = tokens[i].end
+	}
+	if end < len(tokens) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(text[pos:])
+	}
+	return highlightSnippet(b.String())
+}
+
+func (db *memdb) SearchMessages(ctx context.Context, userID, text, convID string, limit int, cursor string) (SearchPage, error) {
+	if _, err := buildMatchQuery(text); err != nil {
+		return SearchPage{}, err
+	}
+	if limit <= 0 {
+		limit = DefaultMessageLimit
+	}
+	if limit > MaxMessageLimit {
+		limit = MaxMessageLimit
+	}
+	var cur *messageCursor
+	if cursor != "" {
+		c, err := decodeMessageCursor(cursor)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		cur = &c
+	}
+
+	// Ogni parola del testo è una frase che deve comparire nel messaggio
+	var phrases [][]searchToken
+	for _, word := range strings.Fields(text) {
+		if phrase := tokenize(word); len(phrase) > 0 {
+			phrases = append(phrases, phrase)
+		}
+	}
+	if len(phrases) == 0 {
+		return SearchPage{Results: []SearchResult{}}, nil
+	}
+
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer unlock()
+
+	messages := db.s.sortedMessages(func(m memMessage) bool {
+		return db.s.isMember(userID, m.convID) && m.kind == MessageKindText &&
+			(convID == "" || m.convID == convID) &&
+			(cur == nil || compareCursor(m, *cur) < 0)
+	})
+
+	// I risultati vanno dal più recente al più vecchio
+	page := SearchPage{Results: []SearchResult{}}
+	var last memMessage
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		tokens := tokenize(m.content)
+		matched, ok := matchPhrases(tokens, phrases)
+		if !ok {
+			continue
+		}
+		if len(page.Results) == limit {
+			page.NextCursor = cursorOf(last).encode()
+			break
+		}
+
+		conv, err := db.s.conversation(m.convID, userID)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		page.Results = append(page.Results, SearchResult{
+			Message:      db.s.toMessage(m, false),
+			Snippet:      searchSnippet(m.content, tokens, matched),
+			Conversation: conv,
+		})
+		last = m
+	}
+	return page, nil
+}
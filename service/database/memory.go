@@ -0,0 +1,563 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// errMemConstraint viene restituito dall'implementazione in memoria nei casi in cui il database rifiuterebbe la
+// modifica per un vincolo di integrità (chiave duplicata o riferimento a una riga inesistente)
+var errMemConstraint = errors.New("constraint failed")
+
+// memTimestampLayout è il formato dei timestamp dei messaggi usato nei cursori di paginazione: come il testo salvato
+// da SQLite, può essere confrontato come stringa
+const memTimestampLayout = "2006-01-02 15:04:05"
+
+type memUser struct {
+	id    string
+	name  string
+	photo string
+}
+
+type memSession struct {
+	userID    string
+	expiresAt time.Time
+}
+
+type memConversation struct {
+	id            string
+	name          string
+	typ           string
+	creatorID     string
+	photo         string
+	lastMessageID string
+	otherUser     string
+	description   string
+	createdAt     time.Time
+
+	// members sono i membri dei gruppi (i membri delle conversazioni private sono creatorID e otherUser)
+	members map[string]memMember
+
+	// invites sono gli inviti al gruppo, indicizzati per token; joinRequests le richieste di ingresso in attesa,
+	// indicizzate per id dell'utente
+	invites      map[string]memInvite
+	joinRequests map[string]memJoinRequest
+}
+
+type memMember struct {
+	role     string
+	joinedAt time.Time
+	addedBy  string
+}
+
+type memInvite struct {
+	createdBy        string
+	createdAt        time.Time
+	expiresAt        time.Time
+	maxUses          int
+	uses             int
+	requiresApproval bool
+}
+
+type memJoinRequest struct {
+	inviteToken string
+	requestedAt time.Time
+}
+
+type memReaction struct {
+	userID   string
+	reaction string
+}
+
+type memReceipt struct {
+	deliveredAt time.Time
+	readAt      time.Time
+}
+
+type memMessage struct {
+	id        string
+	convID    string
+	senderID  string
+	content   string
+	timestamp time.Time
+	status    string
+	editedAt  time.Time
+	replyTo   string
+	kind      string
+	payload   *SystemPayload
+
+	// reactions sono in ordine di inserimento, cioè in ordine di tempo
+	reactions []memReaction
+	receipts  map[string]memReceipt
+	edits     []MessageEdit
+}
+
+type memAttachment struct {
+	messageID string
+	path      string
+	att       Attachment
+}
+
+type memChange struct {
+	userID    string
+	change    Change
+	createdAt time.Time
+}
+
+type memUserEvent struct {
+	event     UserEvent
+	createdAt time.Time
+}
+
+// memState contiene tutti i dati del database in memoria. Le mappe sono indicizzate per id
+type memState struct {
+	lastID map[string]int64
+
+	name          string
+	users         map[string]memUser
+	sessions      map[string]memSession
+	conversations map[string]memConversation
+	messages      map[string]memMessage
+	attachments   map[string]memAttachment
+
+	// changes è il change log in ordine di sequenza; changeFloor è l'ultima sequenza compattata
+	changes     []memChange
+	changeFloor int64
+
+	eventSeq map[string]int64
+	events   map[string][]memUserEvent
+}
+
+// clone restituisce una copia indipendente dello stato, usata da WithTx per poter annullare le modifiche
+func (s *memState) clone() *memState {
+	c := &memState{
+		lastID:        make(map[string]int64, len(s.lastID)),
+		name:          s.name,
+		users:         make(map[string]memUser, len(s.users)),
+		sessions:      make(map[string]memSession, len(s.sessions)),
+		conversations: make(map[string]memConversation, len(s.conversations)),
+		messages:      make(map[string]memMessage, len(s.messages)),
+		attachments:   make(map[string]memAttachment, len(s.attachments)),
+		changes:       append([]memChange(nil), s.changes...),
+		changeFloor:   s.changeFloor,
+		eventSeq:      make(map[string]int64, len(s.eventSeq)),
+		events:        make(map[string][]memUserEvent, len(s.events)),
+	}
+	for k, v := range s.lastID {
+		c.lastID[k] = v
+	}
+	for k, v := range s.users {
+		c.users[k] = v
+	}
+	for k, v := range s.sessions {
+		c.sessions[k] = v
+	}
+	for k, v := range s.conversations {
+		members := make(map[string]memMember, len(v.members))
+		for id, m := range v.members {
+			members[id] = m
+		}
+		v.members = members
+		invites := make(map[string]memInvite, len(v.invites))
+		for token, inv := range v.invites {
+			invites[token] = inv
+		}
+		v.invites = invites
+		requests := make(map[string]memJoinRequest, len(v.joinRequests))
+		for id, r := range v.joinRequests {
+			requests[id] = r
+		}
+		v.joinRequests = requests
+		c.conversations[k] = v
+	}
+	for k, v := range s.messages {
+		v.reactions = append([]memReaction(nil), v.reactions...)
+		v.edits = append([]MessageEdit(nil), v.edits...)
+		receipts := make(map[string]memReceipt, len(v.receipts))
+		for id, r := range v.receipts {
+			receipts[id] = r
+		}
+		v.receipts = receipts
+		c.messages[k] = v
+	}
+	for k, v := range s.attachments {
+		c.attachments[k] = v
+	}
+	for k, v := range s.eventSeq {
+		c.eventSeq[k] = v
+	}
+	for k, v := range s.events {
+		c.events[k] = append([]memUserEvent(nil), v...)
+	}
+	return c
+}
+
+// memdb è un'implementazione di AppDatabase che tiene tutti i dati in memoria, con la stessa semantica di quella
+// basata su SQL. È pensata per i test: i dati vengono persi alla chiusura del processo
+type memdb struct {
+	mu *sync.Mutex
+
+	// s è lo stato del database; all'interno di WithTx è una copia che viene resa definitiva solo al commit
+	s  *memState
+	tx bool
+}
+
+// NewMemory returns a new, empty, thread-safe AppDatabase that keeps all data in memory. It behaves like the SQL
+// implementation returned by New and is meant for tests.
+func NewMemory() AppDatabase {
+	return &memdb{
+		mu: &sync.Mutex{},
+		s: &memState{
+			lastID:        make(map[string]int64),
+			users:         make(map[string]memUser),
+			sessions:      make(map[string]memSession),
+			conversations: make(map[string]memConversation),
+			messages:      make(map[string]memMessage),
+			attachments:   make(map[string]memAttachment),
+			eventSeq:      make(map[string]int64),
+			events:        make(map[string][]memUserEvent),
+		},
+	}
+}
+
+// lock controlla che ctx non sia stato annullato e acquisisce il lock del database, tranne all'interno di WithTx dove
+// è già acquisito. La funzione restituita rilascia il lock
+func (db *memdb) lock(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if db.tx {
+		return func() {}, nil
+	}
+	db.mu.Lock()
+	return db.mu.Unlock, nil
+}
+
+func (db *memdb) WithTx(ctx context.Context, fn func(tx AppDatabase) error) error {
+	if db.tx {
+		return fn(db)
+	}
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx := &memdb{mu: db.mu, s: db.s.clone(), tx: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	*db.s = *tx.s
+	return nil
+}
+
+func (db *memdb) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (db *memdb) GetName(ctx context.Context) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if db.s.name == "" {
+		return "", sql.ErrNoRows
+	}
+	return db.s.name, nil
+}
+
+func (db *memdb) SetName(ctx context.Context, name string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if db.s.name != "" {
+		return fmt.Errorf("%w: example_table.id", errMemConstraint)
+	}
+	db.s.name = name
+	return nil
+}
+
+// newID restituisce il prossimo id della tabella: come con AUTOINCREMENT, gli id non vengono mai riusati
+func (s *memState) newID(table string) string {
+	s.lastID[table]++
+	return strconv.FormatInt(s.lastID[table], 10)
+}
+
+// sortIDs ordina gli id numericamente, come farebbe il database con le colonne INTEGER
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.ParseInt(ids[i], 10, 64)
+		b, _ := strconv.ParseInt(ids[j], 10, 64)
+		return a < b
+	})
+}
+
+// union restituisce gli id distinti e non vuoti, in ordine numerico
+func union(ids ...[]string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, list := range ids {
+		for _, id := range list {
+			if id != "" && !seen[id] {
+				seen[id] = true
+				out = append(out, id)
+			}
+		}
+	}
+	sortIDs(out)
+	return out
+}
+
+// members restituisce gli id dei membri attuali della conversazione (vedi GetConversationMembers)
+func (s *memState) members(convID string) []string {
+	conv, ok := s.conversations[convID]
+	if !ok {
+		return nil
+	}
+	if conv.typ == "private" {
+		return union([]string{conv.creatorID, conv.otherUser})
+	}
+	var ids []string
+	for id := range conv.members {
+		ids = append(ids, id)
+	}
+	return union(ids)
+}
+
+// isMember controlla se l'utente è membro della conversazione (vedi IsUserInConversation)
+func (s *memState) isMember(userID, convID string) bool {
+	conv, ok := s.conversations[convID]
+	if !ok {
+		return false
+	}
+	if conv.typ == "private" {
+		return userID == conv.creatorID || userID == conv.otherUser
+	}
+	_, ok = conv.members[userID]
+	return ok
+}
+
+// contacts restituisce gli id degli utenti con cui l'utente ha almeno una conversazione in comune (vedi GetContactIDs)
+func (s *memState) contacts(userID string) []string {
+	var ids []string
+	for _, conv := range s.conversations {
+		switch {
+		case conv.typ == "private" && conv.creatorID == userID:
+			ids = append(ids, conv.otherUser)
+		case conv.typ == "private" && conv.otherUser == userID:
+			ids = append(ids, conv.creatorID)
+		case conv.typ == "group" && conv.members[userID].role != "":
+			for id := range conv.members {
+				if id != userID {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return union(ids)
+}
+
+// recordChange salva la modifica nel change log di ogni destinatario esistente, come recordChange di appdbimpl
+func (s *memState) recordChange(change Change, recipients []string) {
+	now := globaltime.Now().UTC()
+	for _, userID := range union(recipients) {
+		if _, ok := s.users[userID]; !ok {
+			continue
+		}
+		c := change
+		seq, _ := strconv.ParseInt(s.newID("change_log"), 10, 64)
+		c.Seq = seq
+		s.changes = append(s.changes, memChange{userID: userID, change: c, createdAt: now})
+	}
+}
+
+// recordConversationChange salva la modifica nel change log di tutti i membri attuali della conversazione
+func (s *memState) recordConversationChange(change Change) {
+	s.recordChange(change, s.members(change.ConversationID))
+}
+
+// recordUserChange salva la modifica al profilo dell'utente nel change log dell'utente e dei suoi contatti
+func (s *memState) recordUserChange(change Change) {
+	s.recordChange(change, append(s.contacts(change.UserID), change.UserID))
+}
+
+// formatTime restituisce il timestamp nel formato in cui il driver SQL lo restituisce, o una stringa vuota se t è zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func (db *memdb) CreateUser(ctx context.Context, name string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	for _, u := range db.s.users {
+		if u.name == name {
+			return "", fmt.Errorf("%w: users.name", errMemConstraint)
+		}
+	}
+	id := db.s.newID("users")
+	db.s.users[id] = memUser{id: id, name: name}
+	return id, nil
+}
+
+func (db *memdb) GetUserByID(ctx context.Context, id string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	u, ok := db.s.users[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.name, nil
+}
+
+func (db *memdb) GetUserPhotoByID(ctx context.Context, id string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	u, ok := db.s.users[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return u.photo, nil
+}
+
+func (db *memdb) GetUserByName(ctx context.Context, name string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	for _, u := range db.s.users {
+		if u.name == name {
+			return u.id, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (db *memdb) ModifyUserName(ctx context.Context, id string, name string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, u := range db.s.users {
+		if u.name == name && u.id != id {
+			return fmt.Errorf("%w: users.name", errMemConstraint)
+		}
+	}
+	if u, ok := db.s.users[id]; ok {
+		u.name = name
+		db.s.users[id] = u
+	}
+	db.s.recordUserChange(Change{Type: ChangeUserRenamed, UserID: id, Value: name})
+	return nil
+}
+
+func (db *memdb) UpdateUserPhoto(ctx context.Context, id string, photoPath string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if u, ok := db.s.users[id]; ok {
+		u.photo = photoPath
+		db.s.users[id] = u
+	}
+	db.s.recordUserChange(Change{Type: ChangeUserPhotoUpdated, UserID: id})
+	return nil
+}
+
+func (db *memdb) CreateSession(ctx context.Context, userID string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, ok := db.s.users[userID]; !ok {
+		return "", fmt.Errorf("%w: sessions.user_id", errMemConstraint)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	db.s.sessions[hashToken(token)] = memSession{userID: userID, expiresAt: globaltime.Now().UTC().Add(SessionDuration)}
+	return token, nil
+}
+
+func (db *memdb) GetUserIDBySession(ctx context.Context, token string) (string, error) {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	session, ok := db.s.sessions[hashToken(token)]
+	if !ok || !session.expiresAt.After(globaltime.Now().UTC()) {
+		return "", ErrSessionNotFound
+	}
+	return session.userID, nil
+}
+
+func (db *memdb) DeleteSession(ctx context.Context, token string) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	delete(db.s.sessions, hashToken(token))
+	return nil
+}
+
+func (db *memdb) DeleteExpiredSessions(ctx context.Context) error {
+	unlock, err := db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := globaltime.Now().UTC()
+	for hash, session := range db.s.sessions {
+		if !session.expiresAt.After(now) {
+			delete(db.s.sessions, hash)
+		}
+	}
+	return nil
+}
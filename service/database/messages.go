@@ -1,59 +1,94 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"strings"
 )
 
-//	InsertMessage inserisce un messaggio nel database
-func (db *appdbimpl) InsertMessage(convID string, userID string, text string) (string, error) {
-
-	// Inserisce il messaggio nel database
+//	InsertMessage inserisce un messaggio nel database insieme ai suoi allegati
+func (db *appdbimpl) InsertMessage(ctx context.Context, convID string, userID string, text string, replyTo string, attachments []NewAttachment) (string, error) {
     var messageID string
-    err := db.c.QueryRow(
-        "INSERT INTO messages (conversation_id, sender_id, content, status) VALUES (?, ?, ?, 'sent') RETURNING id",
-        convID, userID, text,
-    ).Scan(&messageID)
+    err := db.withTx(ctx, func(tx *appdbimpl) error {
+        // Inserisce il messaggio nel database
+        err := tx.c.QueryRowContext(ctx,
+            "INSERT INTO messages (conversation_id, sender_id, content, status, reply_to) VALUES (?, ?, ?, 'sent', ?) RETURNING id",
+            convID, userID, text, nullIfEmpty(replyTo),
+        ).Scan(&messageID)
+        if err != nil {
+            return err
+        }
+
+        // Inserisce gli allegati del messaggio
+        if err := tx.insertAttachments(ctx, messageID, attachments); err != nil {
+            return err
+        }
+
+        // Registra il nuovo messaggio nel change log dei membri della conversazione
+        return tx.recordConversationChange(ctx, Change{
+            Type:           ChangeMessageCreated,
+            ConversationID: convID,
+            MessageID:      messageID,
+            UserID:         userID,
+        })
+    })
 
 	// Restituisce un errore se la query non è andata a buon fine
     if err != nil {
         return "", err
     }
-
-	// Aggiorna l'ultimo messaggio della conversazione e restituisce l'ID del messaggio
     return messageID, nil
 }
 
 //	GetMessageFromID recupera un messaggio dal database dato il suo ID
-func (db *appdbimpl) GetMessageFromID(messageID string) (Message, error) {
+func (db *appdbimpl) GetMessageFromID(ctx context.Context, messageID string) (Message, error) {
 	var message Message
+	var editedAt, replyTo, payload sql.NullString
 	
 	// Esegue la query per recuperare il messaggio
-	err := db.c.QueryRow(
-		"SELECT id, conversation_id, sender_id, content, timestamp, status FROM messages WHERE id = ?",
+	err := db.c.QueryRowContext(ctx,
+		"SELECT id, conversation_id, sender_id, content, timestamp, status, edited_at, reply_to, kind, payload FROM messages WHERE id = ?",
 		messageID,
-	).Scan(&message.MessageID, &message.ConversationID, &message.SenderID, &message.Content, &message.Timestamp, &message.Status)
+	).Scan(&message.MessageID, &message.ConversationID, &message.SenderID, &message.Content, &message.Timestamp, &message.Status, &editedAt, &replyTo, &message.Kind, &payload)
 	
     message.Reactions = []Reaction{}
 	if err != nil {
 		return Message{}, err
 	}
-	return message, nil
+	message.EditedAt = editedAt.String
+	message.ReplyTo = replyPreview(replyTo)
+	message.Payload, err = systemPayload(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	message.Attachments = []Attachment{}
+
+	// Completa l'anteprima del messaggio citato e recupera gli allegati
+	messages := []Message{message}
+	if err := db.loadReplyPreviews(ctx, messages); err != nil {
+		return Message{}, err
+	}
+	if err := db.loadAttachments(ctx, messages); err != nil {
+		return Message{}, err
+	}
+	return messages[0], nil
 }
 
-// UpdateLastMessage aggiorna l'ultimo messaggio di una conversazione
-func (db *appdbimpl) UpdateLastMessage(convID string, messageID string) error {
-	_, err := db.c.Exec(
+// UpdateLastMessage aggiorna l'ultimo messaggio di una conversazione. Un messageID vuoto indica che la conversazione
+// non ha più messaggi
+func (db *appdbimpl) UpdateLastMessage(ctx context.Context, convID string, messageID string) error {
+	_, err := db.c.ExecContext(ctx,
 		"UPDATE conversations SET lastMessageId = ? WHERE id = ?",
-		messageID, convID,
+		nullIfEmpty(messageID), convID,
 	)
 	return err
 }
 
 // MessageExists controlla se un messaggio esiste nel database
-func (db *appdbimpl) MessageExists(messageID string) (bool, error) {
+func (db *appdbimpl) MessageExists(ctx context.Context, messageID string) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow(
+	err := db.c.QueryRowContext(ctx,
 		"SELECT EXISTS(SELECT 1 FROM messages WHERE id = ?)",
 		messageID,
 	).Scan(&exists)
@@ -66,9 +101,9 @@ func (db *appdbimpl) MessageExists(messageID string) (bool, error) {
 }
 
 // GetSenderIDFromMessageID recupera l'ID del mittente di un messaggio dato il suo ID
-func (db *appdbimpl) GetSenderIDFromMessageID(messageID string) (string, error) {
+func (db *appdbimpl) GetSenderIDFromMessageID(ctx context.Context, messageID string) (string, error) {
 	var senderID string
-	err := db.c.QueryRow(
+	err := db.c.QueryRowContext(ctx,
 		"SELECT sender_id FROM messages WHERE id = ?",
 		messageID,
 	).Scan(&senderID)
@@ -81,20 +116,38 @@ func (db *appdbimpl) GetSenderIDFromMessageID(messageID string) (string, error)
 }
 
 // DeleteMessage elimina un messaggio dal database
-func (db *appdbimpl) DeleteMessage(messageID string) error {
-    // Elimina il messaggio dal database
-    _, err := db.c.Exec(
-        "DELETE FROM messages WHERE id = ?",
-        messageID,
-    )
-    return err
+func (db *appdbimpl) DeleteMessage(ctx context.Context, messageID string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        // Recupera la conversazione del messaggio, necessaria per il change log
+        convID, err := tx.conversationOfMessage(ctx, messageID)
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil
+        } else if err != nil {
+            return err
+        }
+
+        // Elimina il messaggio dal database
+        _, err = tx.c.ExecContext(ctx,
+            "DELETE FROM messages WHERE id = ?",
+            messageID,
+        )
+        if err != nil {
+            return err
+        }
+
+        return tx.recordConversationChange(ctx, Change{
+            Type:           ChangeMessageDeleted,
+            ConversationID: convID,
+            MessageID:      messageID,
+        })
+    })
 }
 
 // GetLastMessageID recupera l'ID dell'ultimo messaggio di una conversazione
-func (db *appdbimpl) GetLastMessageID(convID string) (string, error) {
+func (db *appdbimpl) GetLastMessageID(ctx context.Context, convID string) (string, error) {
     var lastMessageID sql.NullString
-    err := db.c.QueryRow(
-        "SELECT id FROM messages WHERE conversation_id = ? ORDER BY timestamp DESC LIMIT 1",
+    err := db.c.QueryRowContext(ctx,
+        "SELECT id FROM messages WHERE conversation_id = ? ORDER BY timestamp DESC, id DESC LIMIT 1",
         convID,
     ).Scan(&lastMessageID)
 
@@ -108,139 +161,227 @@ func (db *appdbimpl) GetLastMessageID(convID string) (string, error) {
 }
 
 // InsertReaction inserisce una reazione a un messaggio nel database
-func (db *appdbimpl) InsertReaction(userID string, messageID string, reaction string) error {
-    // Controlla se l'utente ha già reagito a questo messaggio
-    var exists bool
-    err := db.c.QueryRow(
-        "SELECT EXISTS(SELECT 1 FROM reactions WHERE message_id = ? AND user_id = ?)",
-        messageID, userID,
-    ).Scan(&exists)
-    if err != nil {
-        return err
-    }
-
-    // Se esiste già una reazione, la rimuove prima di aggiungere la nuova
-    if exists {
-        _, err = db.c.Exec(
-            "DELETE FROM reactions WHERE message_id = ? AND user_id = ?",
+func (db *appdbimpl) InsertReaction(ctx context.Context, userID string, messageID string, reaction string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        // Controlla se l'utente ha già reagito a questo messaggio
+        var exists bool
+        err := tx.c.QueryRowContext(ctx,
+            "SELECT EXISTS(SELECT 1 FROM reactions WHERE message_id = ? AND user_id = ?)",
             messageID, userID,
-        )
+        ).Scan(&exists)
         if err != nil {
             return err
         }
-    }
 
-    // Inserisce la nuova reazione
-    _, err = db.c.Exec(
-        "INSERT INTO reactions (message_id, user_id, reaction) VALUES (?, ?, ?)",
-        messageID, userID, reaction,
-    )
-    if err != nil {
-        return err
-    }
+        // Se esiste già una reazione, la rimuove prima di aggiungere la nuova
+        if exists {
+            _, err = tx.c.ExecContext(ctx,
+                "DELETE FROM reactions WHERE message_id = ? AND user_id = ?",
+                messageID, userID,
+            )
+            if err != nil {
+                return err
+            }
+        }
 
-    // Aggiorna il contatore delle reazioni nel messaggio
-    _, err = db.c.Exec(
-        "UPDATE messages SET reaction_count = reaction_count + 1 WHERE id = ?",
-        messageID,
-    )
+        // Inserisce la nuova reazione
+        _, err = tx.c.ExecContext(ctx,
+            "INSERT INTO reactions (message_id, user_id, reaction) VALUES (?, ?, ?)",
+            messageID, userID, reaction,
+        )
+        if err != nil {
+            return err
+        }
+
+        // Aggiorna il contatore delle reazioni nel messaggio
+        _, err = tx.c.ExecContext(ctx,
+            "UPDATE messages SET reaction_count = reaction_count + 1 WHERE id = ?",
+            messageID,
+        )
+        if err != nil {
+            return err
+        }
 
-    return err
+        return tx.recordReactionChange(ctx, ChangeReactionAdded, messageID, userID, reaction)
+    })
 }
 
 // DeleteReaction elimina una reazione a un messaggio dal database
-func (db *appdbimpl) DeleteReaction(messageID, userID string) error {
-    // Elimina la reazione dell'utente per il messaggio specifico
-    _, err := db.c.Exec(
-        "DELETE FROM reactions WHERE message_id = ? AND user_id = ?",
-        messageID, userID,
-    )
-    if err != nil {
-        return err
-    }
+func (db *appdbimpl) DeleteReaction(ctx context.Context, messageID, userID string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        // Elimina la reazione dell'utente per il messaggio specifico
+        _, err := tx.c.ExecContext(ctx,
+            "DELETE FROM reactions WHERE message_id = ? AND user_id = ?",
+            messageID, userID,
+        )
+        if err != nil {
+            return err
+        }
 
-    // Diminuisce il contatore delle reazioni nel messaggio
-    _, err = db.c.Exec(
-        "UPDATE messages SET reaction_count = reaction_count - 1 WHERE id = ? AND reaction_count > 0",
-        messageID,
-    )
+        // Diminuisce il contatore delle reazioni nel messaggio
+        _, err = tx.c.ExecContext(ctx,
+            "UPDATE messages SET reaction_count = reaction_count - 1 WHERE id = ? AND reaction_count > 0",
+            messageID,
+        )
+        if err != nil {
+            return err
+        }
 
-    return err
+        return tx.recordReactionChange(ctx, ChangeReactionRemoved, messageID, userID, "")
+    })
 }
 
 // UserHasReaction controlla se un utente ha reagito a un messaggio
-func (db *appdbimpl) UserHasReaction(messageID, userID string) (bool, error) {
+func (db *appdbimpl) UserHasReaction(ctx context.Context, messageID, userID string) (bool, error) {
     var exists bool
-    err := db.c.QueryRow(
+    err := db.c.QueryRowContext(ctx,
         "SELECT EXISTS(SELECT 1 FROM reactions WHERE message_id = ? AND user_id = ?)",
         messageID, userID,
     ).Scan(&exists)
     return exists, err
 }
 
-// GetMessagesFromConversation recupera tutti i messaggi di una conversazione dal database
-func (db *appdbimpl) GetMessagesFromConversation(conversationID string) ([]Message, error) {
-    rows, err := db.c.Query(`
-        SELECT 
-            m.id, m.conversation_id, m.sender_id, m.content, m.timestamp, m.status,
-            COALESCE(r.user_id, '') AS reactionUser, 
-            COALESCE(r.reaction, '') AS reaction
+// GetMessagesFromConversation recupera una pagina di messaggi di una conversazione dal database.
+// I messaggi sono ordinati per (timestamp, id); senza cursori viene restituita la pagina più recente
+func (db *appdbimpl) GetMessagesFromConversation(ctx context.Context, conversationID string, q MessageQuery) (MessagePage, error) {
+    if q.Before != "" && q.After != "" {
+        return MessagePage{}, ErrInvalidCursor
+    }
+    limit := q.Limit
+    if limit <= 0 {
+        limit = DefaultMessageLimit
+    }
+    if limit > MaxMessageLimit {
+        limit = MaxMessageLimit
+    }
+
+    // Costruisce la query in base alla direzione richiesta
+    query := `
+        SELECT m.id, m.conversation_id, m.sender_id, m.content, m.timestamp, CAST(m.timestamp AS TEXT), m.status, m.edited_at, m.reply_to, m.kind, m.payload
         FROM messages m
-        LEFT JOIN reactions r ON m.id = r.message_id
-        WHERE m.conversation_id = ?
-        ORDER BY m.timestamp ASC`, conversationID)
+        WHERE m.conversation_id = ?`
+    args := []interface{}{conversationID}
+    forward := q.After != ""
+    switch {
+    case q.Before != "":
+        cur, err := decodeMessageCursor(q.Before)
+        if err != nil {
+            return MessagePage{}, err
+        }
+        query += " AND (m.timestamp < ? OR (m.timestamp = ? AND m.id < ?))"
+        args = append(args, cur.Timestamp, cur.Timestamp, cur.ID)
+    case forward:
+        cur, err := decodeMessageCursor(q.After)
+        if err != nil {
+            return MessagePage{}, err
+        }
+        query += " AND (m.timestamp > ? OR (m.timestamp = ? AND m.id > ?))"
+        args = append(args, cur.Timestamp, cur.Timestamp, cur.ID)
+    }
+    if forward {
+        query += " ORDER BY m.timestamp ASC, m.id ASC LIMIT ?"
+    } else {
+        query += " ORDER BY m.timestamp DESC, m.id DESC LIMIT ?"
+    }
+    // Recupera un messaggio in più per sapere se esiste una pagina successiva
+    args = append(args, limit+1)
 
+    rows, err := db.c.QueryContext(ctx, query, args...)
     if err != nil {
-        return nil, err
+        return MessagePage{}, err
     }
     defer rows.Close()
 
-    messages := make(map[string]Message)
-
+    var messages []Message
+    var cursors []messageCursor
     for rows.Next() {
-        var msgID, convId, senderID, content, timestamp, status, reactionUser, reaction string
-
-        if err := rows.Scan(&msgID, &convId, &senderID, &content, &timestamp, &status, &reactionUser, &reaction); err != nil {
-            return nil, err
-        }
-
-        // Se il messaggio non è già nella mappa, lo aggiungiamo
-        if _, exists := messages[msgID]; !exists {
-            messages[msgID] = Message{
-                MessageID: msgID,
-                ConversationID: convId,
-                SenderID:  senderID,
-                Content:   content,
-                Timestamp: timestamp,
-                Status:    status,
-                Reactions: []Reaction{},
-            }
+        var msg Message
+        var rawTimestamp string
+        var editedAt, replyTo, payload sql.NullString
+        if err := rows.Scan(&msg.MessageID, &msg.ConversationID, &msg.SenderID, &msg.Content, &msg.Timestamp, &rawTimestamp, &msg.Status, &editedAt, &replyTo, &msg.Kind, &payload); err != nil {
+            return MessagePage{}, err
         }
+        msg.EditedAt = editedAt.String
+        msg.ReplyTo = replyPreview(replyTo)
+        if msg.Payload, err = systemPayload(payload); err != nil {
+            return MessagePage{}, err
+        }
+        msg.Attachments = []Attachment{}
+        msg.Reactions = []Reaction{}
+        messages = append(messages, msg)
+        cursors = append(cursors, messageCursor{Timestamp: rawTimestamp, ID: msg.MessageID})
+    }
+    if err := rows.Err(); err != nil {
+        return MessagePage{}, err
+    }
 
-        // Se c'è una reazione, la aggiungiamo
-        if reactionUser != "" {
-            msg := messages[msgID]
-            msg.Reactions = append(msg.Reactions, Reaction{
-                UserID:   reactionUser,
-                Reaction: reaction,
-            })
-            messages[msgID] = msg
+    page := MessagePage{Messages: []Message{}}
+    if len(messages) > limit {
+        messages = messages[:limit]
+        page.NextCursor = cursors[limit-1].encode()
+    }
+
+    // I messaggi vengono sempre restituiti dal più vecchio al più recente
+    if !forward {
+        for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+            messages[i], messages[j] = messages[j], messages[i]
         }
     }
 
-    // Convertiamo la mappa in una slice di messaggi
-    messageList := make([]Message, 0, len(messages))
-    for _, msg := range messages {
-        messageList = append(messageList, msg)
+    if err := db.loadReactions(ctx, messages); err != nil {
+        return MessagePage{}, err
+    }
+    if err := db.loadReplyPreviews(ctx, messages); err != nil {
+        return MessagePage{}, err
+    }
+    if err := db.loadAttachments(ctx, messages); err != nil {
+        return MessagePage{}, err
+    }
+    page.Messages = append(page.Messages, messages...)
+    return page, nil
+}
+
+// loadReactions recupera con una sola query le reazioni dei messaggi specificati
+func (db *appdbimpl) loadReactions(ctx context.Context, messages []Message) error {
+    if len(messages) == 0 {
+        return nil
     }
 
-    return messageList, nil
+    index := make(map[string]int, len(messages))
+    placeholders := make([]string, len(messages))
+    args := make([]interface{}, len(messages))
+    for i, msg := range messages {
+        index[msg.MessageID] = i
+        placeholders[i] = "?"
+        args[i] = msg.MessageID
+    }
+
+    rows, err := db.c.QueryContext(ctx,
+        "SELECT message_id, user_id, reaction FROM reactions WHERE message_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY timestamp ASC",
+        args...,
+    )
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var messageID string
+        var reaction Reaction
+        if err := rows.Scan(&messageID, &reaction.UserID, &reaction.Reaction); err != nil {
+            return err
+        }
+        if i, ok := index[messageID]; ok {
+            messages[i].Reactions = append(messages[i].Reactions, reaction)
+        }
+    }
+    return rows.Err()
 }
 
 // GetContentFromMessageID recupera il contenuto di un messaggio dato il suo ID
-func (db *appdbimpl) GetContentFromMessageID(messageID string) (string, error) {
+func (db *appdbimpl) GetContentFromMessageID(ctx context.Context, messageID string) (string, error) {
     var content string
-    err := db.c.QueryRow(
+    err := db.c.QueryRowContext(ctx,
         "SELECT content FROM messages WHERE id = ?",
         messageID,
     ).Scan(&content)
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// migrationFiles contiene le migrazioni dello schema, una per file, in una cartella per ogni dialetto. Il nome del file
+// è il numero della versione dello schema che la migrazione produce seguito da una descrizione, per esempio
+// "0002_storage_keys.sql". Ogni dialetto ha le stesse versioni, scritte nella sua sintassi
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew viene restituito quando il database è stato aggiornato da una versione più recente del server, che
+// conosce migrazioni che questa versione non ha
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of the server")
+
+// Migration è una migrazione dello schema del database
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations legge le migrazioni del dialetto incluse nell'eseguibile, ordinate per versione. Le versioni devono
+// essere consecutive a partire da 1
+func loadMigrations(d Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name[i+1:], SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// tableExists controlla se nel database esiste la tabella specificata
+func tableExists(db *sql.DB, d Dialect, table string) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name=?)"
+	if d == Postgres {
+		query = "SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?)"
+	}
+	var exists bool
+	err := db.QueryRow(d.rebind(query), table).Scan(&exists)
+	return exists, err
+}
+
+// schemaVersion restituisce la versione dello schema del database, cioè l'ultima migrazione applicata. I database
+// senza la tabella schema_version hanno la versione 0
+func schemaVersion(db *sql.DB, d Dialect) (int, error) {
+	exists, err := tableExists(db, d, "schema_version")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// PendingMigrations restituisce le migrazioni non ancora applicate al database, senza applicarle. Restituisce
+// ErrSchemaTooNew se il database ha una versione dello schema più recente di quelle conosciute
+func PendingMigrations(db *sql.DB, d Dialect) ([]Migration, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(d)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(db, d)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("%w: version %d, latest known %d", ErrSchemaTooNew, version, len(migrations))
+	}
+	return migrations[version:], nil
+}
+
+// Migrate applica al database le migrazioni mancanti, in ordine. Ogni migrazione è applicata in una transazione
+// insieme alla registrazione della nuova versione nella tabella schema_version, quindi se una migrazione fallisce lo
+// schema resta alla versione precedente
+func Migrate(db *sql.DB, d Dialect) error {
+	pending, err := PendingMigrations(db, d)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return fmt.Errorf("error creating table schema_version: %w", err)
+	}
+
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(tx, d, m); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("error applying migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error applying migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration esegue la migrazione nella transazione e registra la nuova versione dello schema
+func applyMigration(tx *sql.Tx, d Dialect, m Migration) error {
+	if m.Version == 1 && d == SQLite {
+		if err := upgradeLegacySchema(tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	_, err := tx.Exec(d.rebind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"),
+		m.Version, m.Name, globaltime.Now().UTC())
+	return err
+}
+
+// upgradeLegacySchema porta allo schema della prima migrazione i database SQLite creati prima dell'introduzione delle
+// migrazioni. Le tabelle mancanti vengono create dalla migrazione stessa; qui vengono aggiunte le colonne introdotte
+// quando le tabelle esistevano già
+func upgradeLegacySchema(tx *sql.Tx) error {
+	columns := [][3]string{
+		{"messages", "edited_at", "DATETIME"},
+		{"messages", "reply_to", "INTEGER"},
+	}
+	for _, c := range columns {
+		table, column, definition := c[0], c[1], c[2]
+		var tableExists, columnExists bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name=?),
+			EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name=?)`, table, table, column).Scan(&tableExists, &columnExists)
+		if err != nil {
+			return fmt.Errorf("error checking column %s.%s: %w", table, column, err)
+		}
+		if !tableExists || columnExists {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+		}
+	}
+	return nil
+}
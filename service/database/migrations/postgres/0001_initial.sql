@@ -0,0 +1,135 @@
+-- Schema del database PostgreSQL, equivalente a quello SQLite della stessa versione. Gli id sono colonne identity e le
+-- date sono TIMESTAMP in UTC: i valori predefiniti sono troncati ai secondi come CURRENT_TIMESTAMP di SQLite.
+-- A differenza di SQLite, l'indice full-text dei messaggi fa parte dello schema (colonna search e indice GIN).
+
+CREATE TABLE users (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    photo TEXT
+);
+
+CREATE TABLE conversations (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name TEXT,
+    type TEXT CHECK(type IN ('private', 'group')) NOT NULL,
+    creator_id BIGINT NOT NULL,
+    photo TEXT,
+    lastMessageId BIGINT,
+    otherUser BIGINT,
+    FOREIGN KEY (creator_id) REFERENCES users(id),
+    FOREIGN KEY (otherUser) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE messages (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    conversation_id BIGINT NOT NULL,
+    sender_id BIGINT NOT NULL,
+    content TEXT NOT NULL,
+    reaction_count INTEGER DEFAULT 0,
+    timestamp TIMESTAMP DEFAULT date_trunc('second', CURRENT_TIMESTAMP AT TIME ZONE 'UTC'),
+    status TEXT CHECK(status IN ('sent', 'received', 'read')) NOT NULL,
+    edited_at TIMESTAMP,
+    reply_to BIGINT,
+    search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (sender_id) REFERENCES users(id)
+);
+CREATE INDEX messages_reply_to ON messages (reply_to);
+CREATE INDEX messages_search ON messages USING GIN (search);
+
+-- La tabella messages viene creata dopo conversations, quindi il riferimento all'ultimo messaggio è aggiunto ora
+ALTER TABLE conversations ADD FOREIGN KEY (lastMessageId) REFERENCES messages(id) ON DELETE SET NULL;
+
+CREATE TABLE group_members (
+    conversation_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE TABLE reactions (
+    message_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    reaction TEXT NOT NULL,
+    timestamp TIMESTAMP DEFAULT date_trunc('second', CURRENT_TIMESTAMP AT TIME ZONE 'UTC'),
+    PRIMARY KEY (message_id, user_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE sessions (
+    token_hash TEXT NOT NULL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE message_receipts (
+    message_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    delivered_at TIMESTAMP,
+    read_at TIMESTAMP,
+    PRIMARY KEY (message_id, user_id),
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE event_sequences (
+    user_id BIGINT NOT NULL PRIMARY KEY,
+    last_seq BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE user_events (
+    user_id BIGINT NOT NULL,
+    seq BIGINT NOT NULL,
+    type TEXT NOT NULL,
+    conversation_id BIGINT,
+    payload TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, seq),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE change_log (
+    seq BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    type TEXT NOT NULL,
+    conversation_id BIGINT,
+    message_id BIGINT,
+    subject_id BIGINT,
+    value TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX change_log_user_seq ON change_log (user_id, seq);
+
+CREATE TABLE change_log_floor (
+    id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+    seq BIGINT NOT NULL
+);
+
+CREATE TABLE message_edits (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    message_id BIGINT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    replaced_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX message_edits_message ON message_edits (message_id, id);
+
+CREATE TABLE attachments (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    message_id BIGINT NOT NULL,
+    path TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX attachments_message ON attachments (message_id, id);
@@ -0,0 +1,5 @@
+-- Le foto e gli allegati erano salvati con il percorso relativo alla cartella service/uploads/, che ora è la radice
+-- dello storage: il percorso diventa la chiave del file
+UPDATE users SET photo = substr(photo, 17) WHERE photo LIKE 'service/uploads/%';
+UPDATE conversations SET photo = substr(photo, 17) WHERE photo LIKE 'service/uploads/%';
+UPDATE attachments SET path = substr(path, 17) WHERE path LIKE 'service/uploads/%';
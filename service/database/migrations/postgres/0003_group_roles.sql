@@ -0,0 +1,5 @@
+-- Ogni membro di un gruppo ha un ruolo, che determina le azioni che può compiere sul gruppo. Il creatore dei gruppi
+-- esistenti ne diventa il proprietario
+ALTER TABLE group_members ADD COLUMN role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member'));
+UPDATE group_members SET role = 'owner'
+WHERE user_id = (SELECT creator_id FROM conversations WHERE conversations.id = group_members.conversation_id);
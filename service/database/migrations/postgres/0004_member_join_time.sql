@@ -0,0 +1,4 @@
+-- Momento in cui ogni membro è entrato nel gruppo, usato per scegliere il nuovo proprietario quando il proprietario
+-- esce. Per i membri esistenti non è noto: viene usato il momento della migrazione
+ALTER TABLE group_members ADD COLUMN joined_at TIMESTAMP;
+UPDATE group_members SET joined_at = date_trunc('second', CURRENT_TIMESTAMP AT TIME ZONE 'UTC');
@@ -0,0 +1,4 @@
+-- Con SQLite la migrazione riscrive nel formato del driver i valori di joined_at assegnati dalla migrazione 0004. In
+-- PostgreSQL joined_at è un TIMESTAMP, quindi i valori assegnati dalla 0004 non dipendono da un formato: non c'è niente
+-- da correggere
+SELECT 1;
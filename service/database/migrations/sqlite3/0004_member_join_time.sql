@@ -0,0 +1,5 @@
+-- Momento in cui ogni membro è entrato nel gruppo, usato per scegliere il nuovo proprietario quando il proprietario
+-- esce. Per i membri esistenti non è noto: viene usato il momento della migrazione, nel formato con cui il driver SQLite
+-- salva i time.Time (UTC), così i valori sono ordinati correttamente insieme a quelli scritti dal server
+ALTER TABLE group_members ADD COLUMN joined_at DATETIME;
+UPDATE group_members SET joined_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
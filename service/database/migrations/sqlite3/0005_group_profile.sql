@@ -0,0 +1,5 @@
+-- Profilo dei gruppi: la descrizione, il momento della creazione e, per ogni membro, l'utente che lo ha aggiunto. Per
+-- i gruppi e i membri esistenti il momento della creazione e l'autore dell'aggiunta non sono noti e restano NULL
+ALTER TABLE conversations ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE conversations ADD COLUMN created_at DATETIME;
+ALTER TABLE group_members ADD COLUMN added_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
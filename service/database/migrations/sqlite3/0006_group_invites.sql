@@ -0,0 +1,27 @@
+-- Link di invito ai gruppi e richieste di ingresso in attesa di approvazione. max_uses e expires_at sono NULL per gli
+-- inviti senza limite di utilizzi o senza scadenza
+CREATE TABLE IF NOT EXISTS group_invites (
+    token TEXT NOT NULL PRIMARY KEY,
+    conversation_id INTEGER NOT NULL,
+    created_by INTEGER,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME,
+    max_uses INTEGER CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS group_invites_conversation ON group_invites (conversation_id);
+
+CREATE TABLE IF NOT EXISTS group_join_requests (
+    conversation_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    invite_token TEXT,
+    requested_at DATETIME NOT NULL,
+    PRIMARY KEY (conversation_id, user_id),
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (invite_token) REFERENCES group_invites(token) ON DELETE SET NULL
+);
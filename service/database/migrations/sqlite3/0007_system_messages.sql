@@ -0,0 +1,5 @@
+-- Messaggi di sistema dei gruppi, che registrano nella cronologia l'ingresso e l'uscita dei membri e il cambio di nome
+-- o di foto. kind distingue i messaggi degli utenti da quelli di sistema, il cui evento è descritto in payload (JSON);
+-- content ne contiene una descrizione testuale. I messaggi esistenti sono tutti messaggi degli utenti
+ALTER TABLE messages ADD COLUMN kind TEXT NOT NULL DEFAULT 'text' CHECK (kind IN ('text', 'system'));
+ALTER TABLE messages ADD COLUMN payload TEXT;
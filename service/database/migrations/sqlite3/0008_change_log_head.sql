@@ -0,0 +1,12 @@
+-- Seq dell'ultima modifica salvata nel change log. Le modifiche ricevono il seq da questo contatore invece che
+-- dall'autoincremento: con PostgreSQL due transazioni concorrenti ricevevano i seq nell'ordine in cui salvavano le
+-- modifiche, non in quello in cui terminavano, quindi un client poteva sincronizzarsi oltre una modifica con un seq più
+-- basso non ancora visibile e non riceverla mai. La riga resta bloccata fino alla fine della transazione che salva le
+-- modifiche, quindi le scritture del change log sono serializzate
+CREATE TABLE IF NOT EXISTS change_log_head (
+    id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+    seq INTEGER NOT NULL
+);
+
+INSERT INTO change_log_head (id, seq)
+SELECT 1, COALESCE((SELECT MAX(seq) FROM change_log), (SELECT seq FROM change_log_floor WHERE id = 1), 0);
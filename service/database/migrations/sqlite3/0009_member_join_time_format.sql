@@ -0,0 +1,4 @@
+-- La migrazione 0004 assegnava ai membri esistenti il momento della migrazione nel formato di CURRENT_TIMESTAMP, senza
+-- frazioni di secondo né fuso orario, diverso da quello con cui il driver SQLite salva i time.Time scritti dal server.
+-- I valori vengono riscritti nello stesso formato, in UTC come CURRENT_TIMESTAMP
+UPDATE group_members SET joined_at = strftime('%Y-%m-%d %H:%M:%f+00:00', joined_at) WHERE length(joined_at) = 19;
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"fmt"
+
+	"WasaTEXT/service/storage"
+)
+
+// PhotoVersion restituisce la versione della foto salvata con la chiave specificata, cioè lo SHA-256 del suo
+// contenuto. Restituisce una stringa vuota per la foto predefinita e per le foto salvate prima che le chiavi fossero
+// ricavate dal contenuto
+func PhotoVersion(key string) string {
+	return storage.KeyHash(key)
+}
+
+// photoURL aggiunge all'endpoint della foto la versione della foto nel parametro v, così l'URL cambia quando cambia
+// la foto e i client possono tenerla in cache
+func photoURL(endpoint, key string) string {
+	if v := PhotoVersion(key); v != "" {
+		return endpoint + "?v=" + v
+	}
+	return endpoint
+}
+
+// UserPhotoURL restituisce l'endpoint della foto dell'utente salvata con la chiave specificata
+func UserPhotoURL(userID, key string) string {
+	return photoURL(fmt.Sprintf("/users/get-photo/%s", userID), key)
+}
+
+// GroupPhotoURL restituisce l'endpoint della foto del gruppo salvata con la chiave specificata
+func GroupPhotoURL(convID, key string) string {
+	return photoURL(fmt.Sprintf("/conversations/group/get-photo/%s", convID), key)
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// messageRecipients è una subquery che restituisce gli id dei destinatari del messaggio della riga corrente di
+// `messages`: tutti i membri della conversazione tranne il mittente
+const messageRecipients = `
+	SELECT gm.user_id FROM group_members gm
+	WHERE gm.conversation_id = messages.conversation_id AND gm.user_id != messages.sender_id
+	UNION SELECT c.creator_id FROM conversations c
+	WHERE c.id = messages.conversation_id AND c.type = 'private' AND c.creator_id != messages.sender_id
+	UNION SELECT c.otherUser FROM conversations c
+	WHERE c.id = messages.conversation_id AND c.type = 'private' AND c.otherUser != messages.sender_id`
+
+// MarkConversationDelivered registra la consegna all'utente di tutti i messaggi della conversazione ricevuti finora
+func (db *appdbimpl) MarkConversationDelivered(ctx context.Context, convID, userID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		_, err := tx.c.ExecContext(ctx, `
+			INSERT INTO message_receipts (message_id, user_id, delivered_at)
+			SELECT m.id, CAST(? AS INTEGER), `+tx.conn.dialect.timestampParam()+` FROM messages m
+			WHERE m.conversation_id = ? AND m.sender_id != ?
+			ON CONFLICT (message_id, user_id) DO NOTHING`,
+			userID, globaltime.Now().UTC(), convID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.refreshMessageStatuses(ctx, convID)
+	})
+}
+
+// MarkConversationRead registra la lettura da parte dell'utente di tutti i messaggi della conversazione ricevuti finora
+func (db *appdbimpl) MarkConversationRead(ctx context.Context, convID, userID string) error {
+	return db.withTx(ctx, func(tx *appdbimpl) error {
+		now := globaltime.Now().UTC()
+		_, err := tx.c.ExecContext(ctx, `
+			INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+			SELECT m.id, CAST(? AS INTEGER), `+tx.conn.dialect.timestampParam()+`, `+tx.conn.dialect.timestampParam()+`
+			FROM messages m
+			WHERE m.conversation_id = ? AND m.sender_id != ?
+			ON CONFLICT (message_id, user_id) DO UPDATE SET
+				delivered_at = COALESCE(message_receipts.delivered_at, excluded.delivered_at),
+				read_at = COALESCE(message_receipts.read_at, excluded.read_at)`,
+			userID, now, now, convID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.refreshMessageStatuses(ctx, convID)
+	})
+}
+
+// refreshMessageStatuses aggiorna lo stato aggregato dei messaggi della conversazione: un messaggio diventa 'received'
+// quando tutti i destinatari lo hanno ricevuto e 'read' quando tutti lo hanno letto. Lo stato non torna mai indietro
+func (db *appdbimpl) refreshMessageStatuses(ctx context.Context, convID string) error {
+	read, err := db.c.ExecContext(ctx, `
+		UPDATE messages SET status = 'read'
+		WHERE conversation_id = ? AND status != 'read'
+		AND NOT EXISTS (
+			SELECT 1 FROM users u
+			WHERE u.id IN (`+messageRecipients+`)
+			AND NOT EXISTS (
+				SELECT 1 FROM message_receipts mr
+				WHERE mr.message_id = messages.id AND mr.user_id = u.id AND mr.read_at IS NOT NULL
+			)
+		)`, convID)
+	if err != nil {
+		return err
+	}
+
+	received, err := db.c.ExecContext(ctx, `
+		UPDATE messages SET status = 'received'
+		WHERE conversation_id = ? AND status = 'sent'
+		AND NOT EXISTS (
+			SELECT 1 FROM users u
+			WHERE u.id IN (`+messageRecipients+`)
+			AND NOT EXISTS (
+				SELECT 1 FROM message_receipts mr
+				WHERE mr.message_id = messages.id AND mr.user_id = u.id AND mr.delivered_at IS NOT NULL
+			)
+		)`, convID)
+	if err != nil {
+		return err
+	}
+
+	// Se lo stato di almeno un messaggio è cambiato, lo registra nel change log dei membri della conversazione
+	readCount, err := read.RowsAffected()
+	if err != nil {
+		return err
+	}
+	receivedCount, err := received.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if readCount+receivedCount == 0 {
+		return nil
+	}
+	return db.recordConversationChange(ctx, Change{Type: ChangeMessageStatus, ConversationID: convID})
+}
+
+// GetMessageReceipts restituisce lo stato di consegna e lettura del messaggio per ogni destinatario
+func (db *appdbimpl) GetMessageReceipts(ctx context.Context, messageID string) ([]Receipt, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT u.id, u.name, mr.delivered_at, mr.read_at
+		FROM messages
+		JOIN users u ON u.id IN (`+messageRecipients+`)
+		LEFT JOIN message_receipts mr ON mr.message_id = messages.id AND mr.user_id = u.id
+		WHERE messages.id = ?
+		ORDER BY u.name ASC`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []Receipt{}
+	for rows.Next() {
+		var receipt Receipt
+		var deliveredAt, readAt sql.NullString
+		if err := rows.Scan(&receipt.UserID, &receipt.UserName, &deliveredAt, &readAt); err != nil {
+			return nil, err
+		}
+		receipt.DeliveredAt = deliveredAt.String
+		receipt.ReadAt = readAt.String
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// QuoteSnippetLength è il numero massimo di caratteri del messaggio citato mostrati nell'anteprima di una risposta
+const QuoteSnippetLength = 100
+
+// replyPreview restituisce l'anteprima (ancora da completare con loadReplyPreviews) del messaggio a cui risponde un
+// messaggio, o nil se il messaggio non è una risposta
+func replyPreview(replyTo sql.NullString) *MessagePreview {
+	if !replyTo.Valid {
+		return nil
+	}
+	return &MessagePreview{MessageID: replyTo.String}
+}
+
+// quoteSnippet accorcia il contenuto del messaggio citato a QuoteSnippetLength caratteri
+func quoteSnippet(content string) string {
+	runes := []rune(content)
+	if len(runes) <= QuoteSnippetLength {
+		return content
+	}
+	return string(runes[:QuoteSnippetLength]) + "…"
+}
+
+// loadReplyPreviews completa con una sola query le anteprime dei messaggi citati dai messaggi specificati. Se un
+// messaggio citato è stato eliminato, la sua anteprima ha Deleted impostato e nessun contenuto
+func (db *appdbimpl) loadReplyPreviews(ctx context.Context, messages []Message) error {
+	var placeholders []string
+	var args []interface{}
+	for _, msg := range messages {
+		if msg.ReplyTo != nil {
+			placeholders = append(placeholders, "?")
+			args = append(args, msg.ReplyTo.MessageID)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT m.id, m.sender_id, u.name, m.content
+		FROM messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	quoted := make(map[string]MessagePreview)
+	for rows.Next() {
+		var preview MessagePreview
+		var content string
+		if err := rows.Scan(&preview.MessageID, &preview.SenderID, &preview.SenderName, &content); err != nil {
+			return err
+		}
+		preview.Snippet = quoteSnippet(content)
+		quoted[preview.MessageID] = preview
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if messages[i].ReplyTo == nil {
+			continue
+		}
+		preview, ok := quoted[messages[i].ReplyTo.MessageID]
+		if !ok {
+			preview = MessagePreview{MessageID: messages[i].ReplyTo.MessageID, Deleted: true}
+		}
+		messages[i].ReplyTo = &preview
+	}
+	return nil
+}
+
+// GetReplies restituisce tutte le risposte della conversazione al messaggio specificato, dalla più vecchia alla più
+// recente
+func (db *appdbimpl) GetReplies(ctx context.Context, convID, messageID string) ([]Message, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT m.id, m.conversation_id, m.sender_id, m.content, m.timestamp, m.status, m.edited_at, m.reply_to, m.kind, m.payload
+		FROM messages m
+		WHERE m.conversation_id = ? AND m.reply_to = ?
+		ORDER BY m.timestamp ASC, m.id ASC`, convID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replies := []Message{}
+	for rows.Next() {
+		var msg Message
+		var editedAt, replyTo, payload sql.NullString
+		if err := rows.Scan(&msg.MessageID, &msg.ConversationID, &msg.SenderID, &msg.Content, &msg.Timestamp, &msg.Status, &editedAt, &replyTo, &msg.Kind, &payload); err != nil {
+			return nil, err
+		}
+		msg.EditedAt = editedAt.String
+		msg.ReplyTo = replyPreview(replyTo)
+		if msg.Payload, err = systemPayload(payload); err != nil {
+			return nil, err
+		}
+		msg.Attachments = []Attachment{}
+		msg.Reactions = []Reaction{}
+		replies = append(replies, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := db.loadReactions(ctx, replies); err != nil {
+		return nil, err
+	}
+	if err := db.loadReplyPreviews(ctx, replies); err != nil {
+		return nil, err
+	}
+	if err := db.loadAttachments(ctx, replies); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
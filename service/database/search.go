@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	// SnippetStart e SnippetEnd delimitano i termini evidenziati negli snippet dei risultati di ricerca. Lo snippet è
+	// HTML: il resto del contenuto del messaggio viene sempre sottoposto a escape
+	SnippetStart = "<mark>"
+	SnippetEnd   = "</mark>"
+
+	// snippetOpen e snippetClose sono i caratteri (dell'area a uso privato di Unicode) con cui snippet() e ts_headline
+	// delimitano i termini trovati, sostituiti da SnippetStart e SnippetEnd dopo l'escape del contenuto
+	snippetOpen  = "\uE000"
+	snippetClose = "\uE001"
+
+	// snippetTokens è il numero massimo di token inclusi in uno snippet
+	snippetTokens = 12
+)
+
+// snippetMarkers sostituisce i delimitatori dei termini trovati con i tag di evidenziazione
+var snippetMarkers = strings.NewReplacer(snippetOpen, SnippetStart, snippetClose, SnippetEnd)
+
+// highlightSnippet converte lo snippet prodotto con snippetOpen e snippetClose in HTML: il contenuto del messaggio
+// viene sottoposto a escape, così solo i tag di evidenziazione vengono interpretati dal client
+func highlightSnippet(raw string) string {
+	return snippetMarkers.Replace(html.EscapeString(raw))
+}
+
+// ErrInvalidSearchQuery viene restituito quando la query di ricerca non contiene termini validi
+var ErrInvalidSearchQuery = errors.New("invalid search query")
+
+// ensureSearchIndex crea (se necessario) l'indice full-text dei messaggi e i trigger che lo tengono allineato alla
+// tabella messages. Viene usato FTS5 se il driver SQLite è compilato con il supporto (tag `sqlite_fts5`), altrimenti
+// FTS4. Restituisce il nome del modulo in uso.
+func ensureSearchIndex(db *sql.DB) (string, error) {
+	// Se l'indice esiste già, riusa il modulo con cui è stato creato
+	var ddl string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='messages_fts';`).Scan(&ddl)
+	if err == nil {
+		if strings.Contains(strings.ToLower(ddl), "fts5") {
+			return "fts5", nil
+		}
+		return "fts4", nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	module := "fts5"
+	stmts := []string{
+		`CREATE VIRTUAL TABLE messages_fts USING fts5(content, content='messages', content_rowid='id');`,
+		`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+		END;`,
+		`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END;`,
+		`CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+		END;`,
+	}
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE temp.fts5_probe USING fts5(x);`); err != nil {
+		// FTS5 non disponibile: usa FTS4, che con le tabelle "external content" richiede di rimuovere le righe
+		// dall'indice prima che vengano cancellate dalla tabella dei contenuti
+		module = "fts4"
+		stmts = []string{
+			`CREATE VIRTUAL TABLE messages_fts USING fts4(content="messages", content);`,
+			`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+				INSERT INTO messages_fts(docid, content) VALUES (new.id, new.content);
+			END;`,
+			`CREATE TRIGGER messages_fts_delete BEFORE DELETE ON messages BEGIN
+				DELETE FROM messages_fts WHERE docid = old.id;
+			END;`,
+			`CREATE TRIGGER messages_fts_update_before BEFORE UPDATE OF content ON messages BEGIN
+				DELETE FROM messages_fts WHERE docid = old.id;
+			END;`,
+			`CREATE TRIGGER messages_fts_update_after AFTER UPDATE OF content ON messages BEGIN
+				INSERT INTO messages_fts(docid, content) VALUES (new.id, new.content);
+			END;`,
+		}
+	} else {
+		_, _ = db.Exec(`DROP TABLE temp.fts5_probe;`)
+	}
+
+	// Indicizza anche i messaggi già presenti nel database
+	stmts = append(stmts, `INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');`)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			_ = tx.Rollback()
+			return "", fmt.Errorf("error creating search index: %w", err)
+		}
+	}
+	return module, tx.Commit()
+}
+
+// buildMatchQuery trasforma il testo inserito dall'utente in una query MATCH sicura: ogni parola diventa una frase
+// tra virgolette, così gli operatori della sintassi FTS non vengono interpretati
+func buildMatchQuery(text string) (string, error) {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	if len(terms) == 0 {
+		return "", ErrInvalidSearchQuery
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// SearchMessages cerca tra i messaggi delle conversazioni di cui l'utente fa parte, dal più recente al più vecchio.
+// Se convID non è vuoto la ricerca è limitata a quella conversazione; cursor è il NextCursor di una pagina precedente
+func (db *appdbimpl) SearchMessages(ctx context.Context, userID, text, convID string, limit int, cursor string) (SearchPage, error) {
+	match, err := buildMatchQuery(text)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if limit <= 0 {
+		limit = DefaultMessageLimit
+	}
+	if limit > MaxMessageLimit {
+		limit = MaxMessageLimit
+	}
+
+	snippet := fmt.Sprintf("snippet(messages_fts, 0, '%s', '%s', '…', %d)", snippetOpen, snippetClose, snippetTokens)
+	from := "messages_fts JOIN messages m ON m.id = messages_fts.rowid"
+	where := "messages_fts MATCH ?"
+	args := []interface{}{match}
+	switch db.fts {
+	case "fts4":
+		snippet = fmt.Sprintf("snippet(messages_fts, '%s', '%s', '…', 0, %d)", snippetOpen, snippetClose, snippetTokens)
+	case "tsvector":
+		// Con PostgreSQL ogni parola del testo deve comparire nel messaggio, come con la query MATCH di SQLite
+		snippet = fmt.Sprintf(`ts_headline('simple', m.content, plainto_tsquery('simple', ?),
+			'StartSel="%s", StopSel="%s", MaxWords=%d, MinWords=1')`, snippetOpen, snippetClose, snippetTokens)
+		from = "messages m"
+		where = "m.search @@ plainto_tsquery('simple', ?)"
+		args = []interface{}{text, text}
+	}
+
+	// Le regole di appartenenza sono le stesse di IsUserInConversation
+	query := `
+		SELECT m.id, m.conversation_id, m.sender_id, m.content, m.timestamp, CAST(m.timestamp AS TEXT), m.status, m.edited_at, m.reply_to, ` + snippet + `
+		FROM ` + from + `
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE ` + where + ` AND m.kind = 'text'
+		AND (
+			(c.type = 'private' AND (c.creator_id = ? OR c.otherUser = ?))
+			OR (c.type = 'group' AND EXISTS (
+				SELECT 1 FROM group_members gm WHERE gm.conversation_id = c.id AND gm.user_id = ?
+			))
+		)`
+	args = append(args, userID, userID, userID)
+	if convID != "" {
+		query += " AND m.conversation_id = ?"
+		args = append(args, convID)
+	}
+	if cursor != "" {
+		cur, err := decodeMessageCursor(cursor)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		query += " AND (m.timestamp < ? OR (m.timestamp = ? AND m.id < ?))"
+		args = append(args, cur.Timestamp, cur.Timestamp, cur.ID)
+	}
+	query += " ORDER BY m.timestamp DESC, m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	defer rows.Close()
+
+	page := SearchPage{Results: []SearchResult{}}
+	var last messageCursor
+	for rows.Next() {
+		var res SearchResult
+		var rawTimestamp string
+		var editedAt, replyTo sql.NullString
+		msg := &res.Message
+		if err := rows.Scan(&msg.MessageID, &msg.ConversationID, &msg.SenderID, &msg.Content, &msg.Timestamp, &rawTimestamp, &msg.Status, &editedAt, &replyTo, &res.Snippet); err != nil {
+			return SearchPage{}, err
+		}
+		if len(page.Results) == limit {
+			page.NextCursor = last.encode()
+			break
+		}
+		msg.EditedAt = editedAt.String
+		msg.ReplyTo = replyPreview(replyTo)
+		msg.Kind = MessageKindText
+		res.Snippet = highlightSnippet(res.Snippet)
+		msg.Attachments = []Attachment{}
+		msg.Reactions = []Reaction{}
+		page.Results = append(page.Results, res)
+		last = messageCursor{Timestamp: rawTimestamp, ID: msg.MessageID}
+	}
+	if err := rows.Err(); err != nil {
+		return SearchPage{}, err
+	}
+	rows.Close()
+
+	// Completa le anteprime dei messaggi citati e gli allegati
+	messages := make([]Message, len(page.Results))
+	for i := range page.Results {
+		messages[i] = page.Results[i].Message
+	}
+	if err := db.loadReplyPreviews(ctx, messages); err != nil {
+		return SearchPage{}, err
+	}
+	if err := db.loadAttachments(ctx, messages); err != nil {
+		return SearchPage{}, err
+	}
+	for i := range page.Results {
+		page.Results[i].Message = messages[i]
+	}
+
+	// Aggiunge il contesto della conversazione (nome e foto visti dall'utente) a ogni risultato
+	conversations := make(map[string]Conversation)
+	for i := range page.Results {
+		id := page.Results[i].Message.ConversationID
+		conv, ok := conversations[id]
+		if !ok {
+			conv, err = db.GetConversationByID(ctx, id, userID)
+			if err != nil {
+				return SearchPage{}, err
+			}
+			conversations[id] = conv
+		}
+		page.Results[i].Conversation = conv
+	}
+	return page, nil
+}
@@ -0,0 +1,6 @@
+//go:build !sqlite_fts5
+
+package database
+
+// wantSearchModule è il modulo che l'indice di ricerca deve usare con il driver compilato senza il supporto a FTS5
+const wantSearchModule = "fts4"
@@ -0,0 +1,6 @@
+//go:build sqlite_fts5
+
+package database
+
+// wantSearchModule è il modulo che l'indice di ricerca deve usare con il driver compilato con il tag sqlite_fts5
+const wantSearchModule = "fts5"
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// SessionDuration è la durata di validità di un token di sessione
+const SessionDuration = 30 * 24 * time.Hour
+
+// ErrSessionNotFound viene restituito quando il token non esiste, è scaduto o è stato revocato
+var ErrSessionNotFound = errors.New("session not found")
+
+// hashToken calcola l'hash del token: nel database non vengono mai salvati i token in chiaro
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession genera un nuovo token opaco per l'utente specificato e lo salva nel database
+func (db *appdbimpl) CreateSession(ctx context.Context, userID string) (string, error) {
+	// Genera 32 byte casuali per il token
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	now := globaltime.Now().UTC()
+	_, err := db.c.ExecContext(ctx,
+		"INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, now, now.Add(SessionDuration),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetUserIDBySession restituisce l'id dell'utente associato a un token di sessione valido
+func (db *appdbimpl) GetUserIDBySession(ctx context.Context, token string) (string, error) {
+	var userID string
+	err := db.c.QueryRowContext(ctx,
+		"SELECT user_id FROM sessions WHERE token_hash = ? AND expires_at > ?",
+		hashToken(token), globaltime.Now().UTC(),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrSessionNotFound
+	}
+	return userID, err
+}
+
+// DeleteSession revoca il token di sessione specificato
+func (db *appdbimpl) DeleteSession(ctx context.Context, token string) error {
+	_, err := db.c.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+	return err
+}
+
+// DeleteExpiredSessions elimina dal database tutte le sessioni scadute
+func (db *appdbimpl) DeleteExpiredSessions(ctx context.Context) error {
+	_, err := db.c.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= ?", globaltime.Now().UTC())
+	return err
+}
@@ -1,5 +1,7 @@
 package database
 
+import "time"
+
 type User struct {
     UserID   string
     Name string
@@ -7,22 +9,150 @@ type User struct {
 }
 
 type Conversation struct {
-    ConvID        string
-    Name      string
-    Type      string
-    CreatorID string
-    Photo     string
-    LastMessage string
+    ConvID      string `json:"conversation_id"`
+    Name        string `json:"name"`
+    Type        string `json:"type"`
+    CreatorID   string `json:"creator_id"`
+    Photo       string `json:"photo"`
+    LastMessage string `json:"last_message"`
+}
+
+// GroupMember è un membro di un gruppo. Photo è l'endpoint della foto dell'utente; AddedBy è l'id dell'utente che lo
+// ha aggiunto, vuoto per il creatore del gruppo e per i membri aggiunti prima che venisse registrato
+type GroupMember struct {
+    UserID   string `json:"user_id"`
+    UserName string `json:"user_name"`
+    Photo    string `json:"photo"`
+    Role     string `json:"role"`
+    JoinedAt string `json:"joined_at,omitempty"`
+    AddedBy  string `json:"added_by,omitempty"`
+}
+
+// GroupProfile è il profilo di un gruppo. CreatorID è il proprietario attuale del gruppo; CreatedAt è vuoto per i
+// gruppi creati prima che venisse registrato
+type GroupProfile struct {
+    ConvID      string `json:"conversation_id"`
+    Name        string `json:"name"`
+    Description string `json:"description"`
+    Photo       string `json:"photo"`
+    CreatorID   string `json:"creator_id"`
+    CreatorName string `json:"creator_name"`
+    CreatedAt   string `json:"created_at,omitempty"`
+    MemberCount int    `json:"member_count"`
 }
 
 type Message struct {
-    MessageID      string
+    MessageID      string          `json:"message_id"`
+    ConversationID string          `json:"conversation_id"`
+    SenderID       string          `json:"sender_id"`
+    Content        string          `json:"content"`
+    Timestamp      string          `json:"timestamp"`
+    Status         string          `json:"status"`
+    EditedAt       string          `json:"edited_at"`
+    ReplyTo        *MessagePreview `json:"reply_to"`
+    Attachments    []Attachment    `json:"attachments"`
+    Reactions      []Reaction      `json:"reactions"`
+    Kind           string          `json:"kind"`
+    Payload        *SystemPayload  `json:"payload,omitempty"`
+}
+
+// SystemPayload descrive l'evento del gruppo registrato da un messaggio di sistema, il cui mittente è l'utente che
+// lo ha causato. UserID è il membro entrato, uscito o rimosso dal gruppo, o il nuovo proprietario; Name il nuovo nome
+// del gruppo
+type SystemPayload struct {
+    Type   string `json:"type"`
+    UserID string `json:"user_id,omitempty"`
+    Name   string `json:"name,omitempty"`
+}
+
+// MessagePreview è l'anteprima del messaggio a cui risponde un altro messaggio. Se il messaggio citato è stato
+// eliminato, Deleted è vero e gli altri campi (tranne MessageID) sono vuoti
+type MessagePreview struct {
+    MessageID  string `json:"message_id"`
+    SenderID   string `json:"sender_id"`
+    SenderName string `json:"sender_name"`
+    Snippet    string `json:"snippet"`
+    Deleted    bool   `json:"deleted"`
+}
+
+// MessageQuery descrive la pagina di messaggi richiesta: Before e After sono cursori opachi
+// (mutuamente esclusivi), Limit è il numero massimo di messaggi da restituire
+type MessageQuery struct {
+    Before string
+    After  string
+    Limit  int
+}
+
+// MessagePage è una pagina di messaggi ordinati dal più vecchio al più recente.
+// NextCursor è vuoto se non ci sono altri messaggi nella direzione richiesta
+type MessagePage struct {
+    Messages   []Message `json:"messages"`
+    NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// SearchResult è un messaggio trovato dalla ricerca full-text, con lo snippet evidenziato
+// e la conversazione a cui appartiene
+type SearchResult struct {
+    Message      Message      `json:"message"`
+    Snippet      string       `json:"snippet"`
+    Conversation Conversation `json:"conversation"`
+}
+
+// SearchPage è una pagina di risultati di ricerca, dal più recente al più vecchio
+type SearchPage struct {
+    Results    []SearchResult `json:"results"`
+    NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Receipt è lo stato di consegna e lettura di un messaggio per un destinatario.
+// DeliveredAt e ReadAt sono vuoti se il messaggio non è ancora stato consegnato o letto
+type Receipt struct {
+    UserID      string `json:"user_id"`
+    UserName    string `json:"user_name"`
+    DeliveredAt string `json:"delivered_at"`
+    ReadAt      string `json:"read_at"`
+}
+
+// UserEvent è un evento salvato nello stream di un utente. Seq cresce in modo monotono per ogni utente
+// e Payload contiene i dettagli dell'evento serializzati in JSON (vuoto se non ci sono dettagli)
+type UserEvent struct {
+    UserID         string
+    Seq            int64
+    Type           string
     ConversationID string
-    SenderID       string
-    Content        string
-    Timestamp      string
-    Status         string
-    Reactions []Reaction 
+    Payload        string
+    CreatedAt      string
+}
+
+// Change è una modifica salvata nel change log di un utente. UserID è l'utente a cui si riferisce la modifica (ad es.
+// il membro aggiunto a un gruppo o l'autore di una reazione) e Value il nuovo valore, se presente (il nuovo nome o
+// l'emoji della reazione). Message è valorizzato solo per le modifiche ChangeMessageCreated, se il messaggio esiste ancora
+type Change struct {
+    Seq            int64    `json:"seq"`
+    Type           string   `json:"type"`
+    ConversationID string   `json:"conversation_id"`
+    MessageID      string   `json:"message_id"`
+    UserID         string   `json:"user_id"`
+    Value          string   `json:"value"`
+    CreatedAt      string   `json:"created_at"`
+    Message        *Message `json:"message"`
+}
+
+// ChangePage è una pagina del change log di un utente. NextSince è il valore da usare per la richiesta successiva;
+// se FullResync è vero il client deve ricaricare tutto il proprio stato e poi ripartire da NextSince
+type ChangePage struct {
+    Changes    []Change `json:"changes"`
+    NextSince  int64    `json:"next_since"`
+    HasMore    bool     `json:"has_more"`
+    FullResync bool     `json:"full_resync"`
+}
+
+// MessageEdit è una versione precedente del contenuto di un messaggio: CreatedAt è il momento in cui il contenuto è
+// stato scritto e ReplacedAt quello in cui è stato sostituito da una modifica
+type MessageEdit struct {
+    Content    string `json:"content"`
+    CreatedAt  string `json:"created_at"`
+    ReplacedAt string `json:"replaced_at"`
 }
 
 type Comment struct {
@@ -30,7 +160,60 @@ type Comment struct {
     MessageID string
 }
 
+// Attachment è un file allegato a un messaggio. URL è l'endpoint da cui scaricarlo; Width e Height sono le dimensioni
+// in pixel per le immagini e 0 per gli altri file
+type Attachment struct {
+    AttachmentID string `json:"attachment_id"`
+    FileName     string `json:"file_name"`
+    MimeType     string `json:"mime_type"`
+    Size         int64  `json:"size"`
+    Width        int    `json:"width"`
+    Height       int    `json:"height"`
+    URL          string `json:"url"`
+}
+
+// GroupInvite è un link di invito a un gruppo. ExpiresAt è vuoto per gli inviti senza scadenza e MaxUses è 0 per gli
+// inviti senza limite di utilizzi; CreatedBy è vuoto se l'utente che ha creato l'invito non esiste più
+type GroupInvite struct {
+    Token            string `json:"token"`
+    ConversationID   string `json:"conversation_id"`
+    CreatedBy        string `json:"created_by,omitempty"`
+    CreatedAt        string `json:"created_at"`
+    ExpiresAt        string `json:"expires_at,omitempty"`
+    MaxUses          int    `json:"max_uses,omitempty"`
+    Uses             int    `json:"uses"`
+    RequiresApproval bool   `json:"requires_approval"`
+}
+
+// NewGroupInvite descrive le condizioni di un nuovo invito: un ExpiresAt zero o un MaxUses zero indicano un invito
+// senza scadenza o senza limite di utilizzi
+type NewGroupInvite struct {
+    ExpiresAt        time.Time
+    MaxUses          int
+    RequiresApproval bool
+}
+
+// JoinRequest è la richiesta di un utente di entrare in un gruppo tramite un invito che richiede l'approvazione di un
+// amministratore. InviteToken è vuoto se l'invito è stato revocato
+type JoinRequest struct {
+    UserID      string `json:"user_id"`
+    UserName    string `json:"user_name"`
+    Photo       string `json:"photo"`
+    InviteToken string `json:"invite_token,omitempty"`
+    RequestedAt string `json:"requested_at"`
+}
+
+// NewAttachment descrive un file già salvato nello storage con la chiave Path da allegare a un nuovo messaggio
+type NewAttachment struct {
+    Path     string
+    FileName string
+    MimeType string
+    Size     int64
+    Width    int
+    Height   int
+}
+
 type Reaction struct {
-    UserID   string 
-    Reaction string 
+    UserID   string `json:"user_id"`
+    Reaction string `json:"reaction"`
 }
\ No newline at end of file
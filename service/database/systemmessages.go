@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Tipi dei messaggi: quelli scritti dagli utenti e quelli di sistema, che registrano gli eventi del gruppo nella
+// cronologia e non possono essere modificati, inoltrati o ricevere reazioni
+const (
+	MessageKindText   = "text"
+	MessageKindSystem = "system"
+)
+
+// Eventi del gruppo registrati dai messaggi di sistema (SystemPayload.Type)
+const (
+	SystemMemberAdded       = "member_added"
+	SystemMemberLeft        = "member_left"
+	SystemMemberRemoved     = "member_removed"
+	SystemOwnerChanged      = "owner_changed"
+	SystemGroupRenamed      = "group_renamed"
+	SystemGroupPhotoUpdated = "group_photo_updated"
+)
+
+// systemContent restituisce la descrizione testuale dell'evento, salvata come contenuto del messaggio di sistema e
+// mostrata come ultimo messaggio del gruppo. senderName è il nome dell'utente che ha causato l'evento e userName quello
+// del membro entrato, uscito o rimosso, o del nuovo proprietario
+func systemContent(payload SystemPayload, senderID, senderName, userName string) string {
+	switch payload.Type {
+	case SystemMemberAdded:
+		if payload.UserID == senderID {
+			return fmt.Sprintf("%s joined the group", userName)
+		}
+		return fmt.Sprintf("%s added %s", senderName, userName)
+	case SystemMemberLeft:
+		return fmt.Sprintf("%s left the group", userName)
+	case SystemMemberRemoved:
+		return fmt.Sprintf("%s removed %s", senderName, userName)
+	case SystemOwnerChanged:
+		return fmt.Sprintf("%s is now the group owner", userName)
+	case SystemGroupRenamed:
+		return fmt.Sprintf("%s changed the group name to %q", senderName, payload.Name)
+	case SystemGroupPhotoUpdated:
+		return fmt.Sprintf("%s changed the group photo", senderName)
+	}
+	return ""
+}
+
+// systemPayload decodifica l'evento registrato da un messaggio di sistema, o restituisce nil per i messaggi degli
+// utenti
+func systemPayload(payload sql.NullString) (*SystemPayload, error) {
+	if !payload.Valid {
+		return nil, nil
+	}
+	var p SystemPayload
+	if err := json.Unmarshal([]byte(payload.String), &p); err != nil {
+		return nil, fmt.Errorf("decoding system message payload: %w", err)
+	}
+	return &p, nil
+}
+
+// InsertSystemMessage inserisce nel gruppo un messaggio di sistema che registra l'evento descritto da payload, con
+// senderID come mittente, e ne restituisce l'id. Come InsertMessage non aggiorna l'ultimo messaggio del gruppo
+func (db *appdbimpl) InsertSystemMessage(ctx context.Context, groupID, senderID string, payload SystemPayload) (string, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var messageID string
+	err = db.withTx(ctx, func(tx *appdbimpl) error {
+		// Il contenuto usa i nomi attuali degli utenti; il membro entrato o uscito può essere il mittente stesso
+		var senderName, userName sql.NullString
+		err := tx.c.QueryRowContext(ctx,
+			"SELECT (SELECT name FROM users WHERE id = ?), (SELECT name FROM users WHERE id = ?)",
+			senderID, nullIfEmpty(payload.UserID),
+		).Scan(&senderName, &userName)
+		if err != nil {
+			return err
+		}
+
+		err = tx.c.QueryRowContext(ctx,
+			"INSERT INTO messages (conversation_id, sender_id, content, status, kind, payload) VALUES (?, ?, ?, 'sent', ?, ?) RETURNING id",
+			groupID, senderID, systemContent(payload, senderID, senderName.String, userName.String), MessageKindSystem, string(encoded),
+		).Scan(&messageID)
+		if err != nil {
+			return err
+		}
+
+		// Registra il nuovo messaggio nel change log dei membri del gruppo
+		return tx.recordConversationChange(ctx, Change{
+			Type:           ChangeMessageCreated,
+			ConversationID: groupID,
+			MessageID:      messageID,
+			UserID:         senderID,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
@@ -1,29 +1,29 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"log"
 )
 
 // CreateUser crea un nuovo utente con il nome specificato
-func (db *appdbimpl) CreateUser(name string) (string, error) {
+func (db *appdbimpl) CreateUser(ctx context.Context, name string) (string, error) {
     var id string
-    err := db.c.QueryRow("INSERT INTO users (name, photo) VALUES (?, '') RETURNING id", name).Scan(&id)
+    err := db.c.QueryRowContext(ctx, "INSERT INTO users (name, photo) VALUES (?, '') RETURNING id", name).Scan(&id)
     return id, err
 }
 
 // GetUserByID restituisce il nome dell'utente con l'id specificato
-func (db *appdbimpl) GetUserByID(id string) (string, error) {
+func (db *appdbimpl) GetUserByID(ctx context.Context, id string) (string, error) {
     var name string
-    err := db.c.QueryRow("SELECT name FROM users WHERE id = ?", id).Scan(&name)
+    err := db.c.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", id).Scan(&name)
     return name, err
 }
 
 // GetPhotoByID restituisce la foto dell'utente con l'id specificato
-func (db *appdbimpl) GetUserPhotoByID(id string) (string, error) {
+func (db *appdbimpl) GetUserPhotoByID(ctx context.Context, id string) (string, error) {
     var photo sql.NullString
-	err := db.c.QueryRow("SELECT photo FROM users WHERE id = ? ", id).Scan(&photo)
+	err := db.c.QueryRowContext(ctx, "SELECT photo FROM users WHERE id = ? ", id).Scan(&photo)
 	if err != nil {
         return "", err
     }
@@ -34,28 +34,39 @@ func (db *appdbimpl) GetUserPhotoByID(id string) (string, error) {
     return photo.String, nil
 }
 
-// GetUserByName restituisce l'id dell'utente con il nome specificato
-func (db *appdbimpl) GetUserByName(name string) (string, error) {
+// GetUserByName restituisce l'id dell'utente con il nome specificato; se l'utente non esiste restituisce
+// sql.ErrNoRows
+func (db *appdbimpl) GetUserByName(ctx context.Context, name string) (string, error) {
     var id string
     log.Println("DEBUG: Searching for user: ", name)
-    err := db.c.QueryRow("SELECT id FROM users WHERE name = ?", name).Scan(&id)
+    err := db.c.QueryRowContext(ctx, "SELECT id FROM users WHERE name = ?", name).Scan(&id)
     if err != nil{
         log.Println("ERROR: User not found in database:", name)
-        return "", fmt.Errorf("404: User not found")
+        return "", err
     }
     log.Println("DEBUG: Found user: ", name, "with id: ", id)
     return id, nil
 }
 
 // ModifyUserName modifica il nome dell'utente con l'id specificato
-func (db *appdbimpl) ModifyUserName(id string, name string) error {
-    _, err := db.c.Exec("UPDATE users SET name = ? WHERE id = ?", name, id)
-    return err
+func (db *appdbimpl) ModifyUserName(ctx context.Context, id string, name string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        _, err := tx.c.ExecContext(ctx, "UPDATE users SET name = ? WHERE id = ?", name, id)
+        if err != nil {
+            return err
+        }
+        return tx.recordUserChange(ctx, Change{Type: ChangeUserRenamed, UserID: id, Value: name})
+    })
 }
 
 // updateUserPhoto aggiorna la foto dell'utente con l'id specificato
-func (db *appdbimpl) UpdateUserPhoto(id string, photoPath string) error {
-    _, err := db.c.Exec("UPDATE users SET photo = ? WHERE id = ?", photoPath,
-        id)
-    return err
+func (db *appdbimpl) UpdateUserPhoto(ctx context.Context, id string, photoPath string) error {
+    return db.withTx(ctx, func(tx *appdbimpl) error {
+        _, err := tx.c.ExecContext(ctx, "UPDATE users SET photo = ? WHERE id = ?", photoPath,
+            id)
+        if err != nil {
+            return err
+        }
+        return tx.recordUserChange(ctx, Change{Type: ChangeUserPhotoUpdated, UserID: id})
+    })
 }
\ No newline at end of file
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// UserEventRetention è per quanto tempo gli eventi restano disponibili per la ripresa dello stream: un client che si
+// riconnette dopo più tempo deve ricaricare il proprio stato
+const UserEventRetention = 7 * 24 * time.Hour
+
+// AppendUserEvent salva l'evento nello stream di ciascun utente, assegnandogli il numero di sequenza successivo
+// all'ultimo usato per quell'utente. Restituisce gli eventi salvati, uno per destinatario
+func (db *appdbimpl) AppendUserEvent(ctx context.Context, userIDs []string, eventType, convID, payload string) ([]UserEvent, error) {
+	now := globaltime.Now().UTC()
+	var conversationID sql.NullString
+	if convID != "" {
+		conversationID = sql.NullString{String: convID, Valid: true}
+	}
+
+	stored := make([]UserEvent, 0, len(userIDs))
+	err := db.withTx(ctx, func(tx *appdbimpl) error {
+		seen := make(map[string]struct{}, len(userIDs))
+		for _, userID := range userIDs {
+			if _, ok := seen[userID]; ok {
+				continue
+			}
+			seen[userID] = struct{}{}
+
+			// Il contatore è separato dagli eventi, così la sequenza non riparte quando gli eventi vecchi vengono
+			// eliminati
+			var seq int64
+			err := tx.c.QueryRowContext(ctx, `
+				INSERT INTO event_sequences (user_id, last_seq) VALUES (?, 1)
+				ON CONFLICT (user_id) DO UPDATE SET last_seq = event_sequences.last_seq + 1
+				RETURNING last_seq`, userID).Scan(&seq)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.c.ExecContext(ctx,
+				"INSERT INTO user_events (user_id, seq, type, conversation_id, payload, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+				userID, seq, eventType, conversationID, payload, now,
+			)
+			if err != nil {
+				return err
+			}
+
+			stored = append(stored, UserEvent{
+				UserID:         userID,
+				Seq:            seq,
+				Type:           eventType,
+				ConversationID: convID,
+				Payload:        payload,
+				CreatedAt:      now.Format(time.RFC3339),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// GetUserEventsAfter restituisce, in ordine di sequenza, al massimo limit eventi dell'utente successivi ad afterSeq
+func (db *appdbimpl) GetUserEventsAfter(ctx context.Context, userID string, afterSeq int64, limit int) ([]UserEvent, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT user_id, seq, type, conversation_id, payload, created_at
+		FROM user_events
+		WHERE user_id = ? AND seq > ?
+		ORDER BY seq ASC
+		LIMIT ?`, userID, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userEvents := []UserEvent{}
+	for rows.Next() {
+		var ev UserEvent
+		var convID sql.NullString
+		if err := rows.Scan(&ev.UserID, &ev.Seq, &ev.Type, &convID, &ev.Payload, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		ev.ConversationID = convID.String
+		userEvents = append(userEvents, ev)
+	}
+	return userEvents, rows.Err()
+}
+
+// GetUserEventBounds restituisce il numero di sequenza del più vecchio evento ancora disponibile per l'utente e quello
+// dell'ultimo evento generato. Se non ci sono eventi disponibili, il primo è l'ultimo + 1
+func (db *appdbimpl) GetUserEventBounds(ctx context.Context, userID string) (int64, int64, error) {
+	var last int64
+	err := db.c.QueryRowContext(ctx, "SELECT last_seq FROM event_sequences WHERE user_id = ?", userID).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+
+	var first sql.NullInt64
+	err = db.c.QueryRowContext(ctx, "SELECT MIN(seq) FROM user_events WHERE user_id = ?", userID).Scan(&first)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !first.Valid {
+		return last + 1, last, nil
+	}
+	return first.Int64, last, nil
+}
+
+// DeleteExpiredUserEvents elimina gli eventi più vecchi di UserEventRetention
+func (db *appdbimpl) DeleteExpiredUserEvents(ctx context.Context) error {
+	_, err := db.c.ExecContext(ctx, "DELETE FROM user_events WHERE created_at <= ?", globaltime.Now().UTC().Add(-UserEventRetention))
+	return err
+}
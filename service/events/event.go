@@ -0,0 +1,43 @@
+package events
+
+// Types of the events published by the API
+const (
+	TypeConversationCreated = "conversation.created"
+	TypeConversationDeleted = "conversation.deleted"
+	TypeMessageCreated      = "message.created"
+	TypeMessageDeleted      = "message.deleted"
+	TypeMessageEdited       = "message.edited"
+	TypeReactionAdded       = "reaction.added"
+	TypeReactionRemoved     = "reaction.removed"
+	TypeGroupRenamed        = "group.renamed"
+	TypeGroupPhotoUpdated   = "group.photo_updated"
+	TypeGroupDescription    = "group.description_updated"
+	TypeMemberAdded         = "group.member_added"
+	TypeMemberLeft          = "group.member_left"
+	TypeMemberRemoved       = "group.member_removed"
+	TypeMemberRoleChanged   = "group.member_role_changed"
+	TypeOwnerChanged        = "group.owner_changed"
+	TypeJoinRequested       = "group.join_requested"
+	TypeUserRenamed         = "user.renamed"
+	TypeUserPhotoUpdated    = "user.photo_updated"
+
+	// TypeStreamReset is sent to a client resuming the stream when the events it missed are no longer available: the
+	// client must reload its state. Its Seq is the last event generated for the user.
+	TypeStreamReset = "stream.reset"
+)
+
+// Event is a notification about a change that is relevant for a user
+type Event struct {
+	// Seq is the position of the event in the stream of the recipient. It increases monotonically for each user, and
+	// it's zero for events that have not been persisted
+	Seq int64 `json:"seq,omitempty"`
+
+	// Type is one of the Type* constants
+	Type string `json:"type"`
+
+	// ConversationID is the conversation affected by the change, if any
+	ConversationID string `json:"conversation_id,omitempty"`
+
+	// Payload contains the details of the change (e.g., the new message). It must be JSON-serializable
+	Payload interface{} `json:"payload,omitempty"`
+}
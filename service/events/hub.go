@@ -0,0 +1,137 @@
+/*
+Package events contains the in-process publish/subscribe hub used to notify connected clients about changes in their
+conversations (new messages, reactions, group updates, etc.).
+
+Each client subscribes with the ID of the authenticated user, and receives every event published for that user until
+the subscription or the hub is closed:
+
+	hub := events.NewHub()
+	sub, err := hub.Subscribe(userID)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	for ev := range sub.C {
+		// send ev to the client
+	}
+
+Publishing never blocks: a subscriber that is too slow to keep up is disconnected (its channel is closed), and it
+should reconnect.
+*/
+package events
+
+import (
+	"errors"
+	"sync"
+)
+
+// subscriptionBuffer is the number of events that can be queued for a subscriber before it is considered too slow
+const subscriptionBuffer = 64
+
+// ErrHubClosed is returned by Subscribe when the hub has been closed
+var ErrHubClosed = errors.New("event hub closed")
+
+// Hub dispatches events to the subscriptions of the recipients. It is safe for concurrent use.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[string]map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives the events published for a user. C is closed when the subscription ends.
+type Subscription struct {
+	// C is the channel where events are delivered
+	C <-chan Event
+
+	c      chan Event
+	userID string
+	hub    *Hub
+}
+
+// NewHub returns a new, empty Hub
+func NewHub() *Hub {
+	return &Hub{
+		subs: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a new subscription for the events of the user userID
+func (h *Hub) Subscribe(userID string) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+
+	c := make(chan Event, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, userID: userID, hub: h}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	return sub, nil
+}
+
+// Close ends the subscription. It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// remove deletes the subscription from the hub and closes its channel. The caller must hold h.mu.
+func (h *Hub) remove(s *Subscription) {
+	userSubs, ok := h.subs[s.userID]
+	if !ok {
+		return
+	}
+	if _, ok := userSubs[s]; !ok {
+		return
+	}
+	delete(userSubs, s)
+	if len(userSubs) == 0 {
+		delete(h.subs, s.userID)
+	}
+	close(s.c)
+}
+
+// Publish sends the event to every subscription of the given users. Subscribers whose buffer is full are
+// disconnected.
+func (h *Hub) Publish(userIDs []string, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	seen := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+
+		for sub := range h.subs[userID] {
+			select {
+			case sub.c <- ev:
+			default:
+				h.remove(sub)
+			}
+		}
+	}
+}
+
+// Close closes every subscription. After Close, Subscribe fails and Publish does nothing.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, userSubs := range h.subs {
+		for sub := range userSubs {
+			h.remove(sub)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Package imaging validates, resizes and re-encodes the images uploaded by the users.
+
+Only PNG, JPEG and GIF images are accepted. The size of the image is read from its header before decoding it, so that
+images that would take too much memory once decoded (decompression bombs) are rejected without decoding them.
+
+Images are always re-encoded, which drops any metadata (EXIF, GPS position, comments, etc.) of the uploaded file.
+JPEG images are re-encoded as JPEG; PNG and GIF images as PNG (only the first frame of animated GIFs is kept).
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxPixels is the maximum number of pixels (width × height) of an accepted image
+const MaxPixels = 16 << 20
+
+// jpegQuality is the quality used to re-encode JPEG images
+const jpegQuality = 85
+
+// ErrNotImage is returned when the data is not a PNG, JPEG or GIF image
+var ErrNotImage = errors.New("not a PNG, JPEG or GIF image")
+
+// ErrTooLarge is returned when the image has more than MaxPixels pixels
+var ErrTooLarge = errors.New("image too large")
+
+// Format is the format an image is encoded in
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+)
+
+// Ext returns the file extension of the format, including the dot
+func (f Format) Ext() string {
+	if f == JPEG {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Decode decodes a PNG, JPEG or GIF image, checking its size before decoding it. It returns the image and the format
+// it should be re-encoded in.
+func Decode(data []byte) (image.Image, Format, error) {
+	cfg, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrNotImage
+	}
+
+	var format Format
+	switch name {
+	case "jpeg":
+		format = JPEG
+	case "png", "gif":
+		format = PNG
+	default:
+		return nil, "", ErrNotImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, "", ErrNotImage
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	var img image.Image
+	switch name {
+	case "jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "gif":
+		img, err = gif.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, "", ErrNotImage
+	}
+	return img, format, nil
+}
+
+// Encode encodes the image in the given format
+func Encode(img image.Image, format Format) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == JPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,228 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a w × h image with a gradient, so that the encoders can't reduce it to a single color
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeGIF(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngChunk encodes a PNG chunk with its length and CRC
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	copy(chunk[8:], data)
+	binary.BigEndian.PutUint32(chunk[8+len(data):], crc32.ChecksumIEEE(chunk[4:8+len(data)]))
+	return chunk
+}
+
+// pngHeader returns the signature and the IHDR chunk of a w × h RGBA PNG, without any pixel data: it is all that is
+// needed to claim the size of the image
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8], ihdr[9] = 8, 6 // 8 bits per channel, RGBA
+	return append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", ihdr)...)
+}
+
+// jpegHeader returns the start of a w × h grayscale JFIF image, up to its SOF0 segment
+func jpegHeader(w, h uint16) []byte {
+	app0 := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0}
+	sof := []byte{0xff, 0xc0, 0, 11, 8, 0, 0, 0, 0, 1, 1, 0x11, 0}
+	binary.BigEndian.PutUint16(sof[5:], h)
+	binary.BigEndian.PutUint16(sof[7:], w)
+	return append(app0, sof...)
+}
+
+// withEXIF inserts after the SOI marker of the JPEG an APP1 segment with EXIF metadata, including a GPS position
+func withEXIF(data []byte) []byte {
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08GPSLatitude 45.4642 N GPSLongitude 9.19 E")
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+	segment = append(segment, exif...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+// withTextChunk inserts after the IHDR chunk of the PNG a tEXt chunk with a comment
+func withTextChunk(data []byte) []byte {
+	end := 8 + 25 // signature and IHDR chunk
+	out := append([]byte{}, data[:end]...)
+	out = append(out, pngChunk("tEXt", []byte("Comment\x00taken at home"))...)
+	return append(out, data[end:]...)
+}
+
+// jpegMarkers returns the markers of the segments of a JPEG, up to the start of the scan
+func jpegMarkers(t *testing.T, data []byte) []byte {
+	var markers []byte
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			t.Fatalf("invalid JPEG segment at %d", i)
+		}
+		markers = append(markers, data[i+1])
+		if data[i+1] == 0xda {
+			break
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+	return markers
+}
+
+// pngChunks returns the types of the chunks of a PNG
+func pngChunks(data []byte) []string {
+	var chunks []string
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		chunks = append(chunks, string(data[i+4:i+8]))
+		i += 12 + n
+	}
+	return chunks
+}
+
+func TestDecode(t *testing.T) {
+	img := testImage(40, 30)
+	valid := encodePNG(t, img)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format Format
+		err    error
+	}{
+		{"PNG", valid, PNG, nil},
+		{"JPEG", encodeJPEG(t, img), JPEG, nil},
+		{"GIF", encodeGIF(t, img), PNG, nil},
+		{"empty", nil, "", ErrNotImage},
+		{"text", []byte("just some text, not an image"), "", ErrNotImage},
+		{"HTML", []byte("<svg xmlns='http://www.w3.org/2000/svg' onload='alert(1)'/>"), "", ErrNotImage},
+		{"BMP", append([]byte("BM"), make([]byte, 64)...), "", ErrNotImage},
+		{"truncated PNG", valid[:len(valid)/2], "", ErrNotImage},
+		{"PNG header only", pngHeader(40, 30), "", ErrNotImage},
+		{"PNG with no pixels", pngHeader(0, 30), "", ErrNotImage},
+		{"PNG bomb", pngHeader(100000, 100000), "", ErrTooLarge},
+		{"PNG one pixel too many", pngHeader(MaxPixels+1, 1), "", ErrTooLarge},
+		{"JPEG bomb", jpegHeader(65000, 65000), "", ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, format, err := Decode(tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if format != tt.format {
+				t.Errorf("Decode() format = %q, want %q", format, tt.format)
+			}
+			if got.Bounds().Dx() != 40 || got.Bounds().Dy() != 30 {
+				t.Errorf("Decode() bounds = %v", got.Bounds())
+			}
+		})
+	}
+}
+
+// TestReencodeDropsMetadata checks that decoding and encoding again an image, as done with every upload, drops its
+// metadata
+func TestReencodeDropsMetadata(t *testing.T) {
+	img := testImage(40, 30)
+	tests := []struct {
+		name   string
+		data   []byte
+		format Format
+	}{
+		{"JPEG with EXIF", withEXIF(encodeJPEG(t, img)), JPEG},
+		{"PNG with text", withTextChunk(encodePNG(t, img)), PNG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Contains(tt.data, []byte("GPSLatitude")) && !bytes.Contains(tt.data, []byte("tEXt")) {
+				t.Fatal("the test image has no metadata")
+			}
+			decoded, format, err := Decode(tt.data)
+			if err != nil {
+				t.Fatalf("Decode(): %v", err)
+			}
+			if format != tt.format {
+				t.Fatalf("Decode() format = %q, want %q", format, tt.format)
+			}
+			out, err := Encode(decoded, format)
+			if err != nil {
+				t.Fatalf("Encode(): %v", err)
+			}
+
+			if format == JPEG {
+				for _, m := range jpegMarkers(t, out) {
+					if m == 0xe1 {
+						t.Errorf("re-encoded JPEG has an APP1 segment: markers %x", jpegMarkers(t, out))
+					}
+				}
+			} else {
+				for _, chunk := range pngChunks(out) {
+					if chunk != "IHDR" && chunk != "IDAT" && chunk != "IEND" {
+						t.Errorf("re-encoded PNG has a %s chunk", chunk)
+					}
+				}
+			}
+			for _, s := range []string{"Exif", "GPS", "taken at home"} {
+				if bytes.Contains(out, []byte(s)) {
+					t.Errorf("re-encoded image contains %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if PNG.Ext() != ".png" || PNG.ContentType() != "image/png" {
+		t.Errorf("PNG: %q, %q", PNG.Ext(), PNG.ContentType())
+	}
+	if JPEG.Ext() != ".jpg" || JPEG.ContentType() != "image/jpeg" {
+		t.Errorf("JPEG: %q, %q", JPEG.Ext(), JPEG.ContentType())
+	}
+}
@@ -0,0 +1,78 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Fit scales the image down, keeping its aspect ratio, so that neither side is longer than maxSide. Images that
+// already fit are returned unchanged.
+func Fit(img image.Image, maxSide int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+
+	dw, dh := maxSide, maxSide
+	if w > h {
+		dh = int(math.Max(1, math.Round(float64(h)*float64(maxSide)/float64(w))))
+	} else {
+		dw = int(math.Max(1, math.Round(float64(w)*float64(maxSide)/float64(h))))
+	}
+	return resize(img, dw, dh)
+}
+
+// resize scales the image down to dw × dh pixels. Each destination pixel is the average of the source pixels it
+// covers (weighted by the covered area), computed on premultiplied colors so transparent pixels don't darken the edges.
+func resize(img image.Image, dw, dh int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// Scale the width of every row first, then the height of every column
+	line := make([]float64, w*4)
+	tmp := make([]float64, dw*h*4)
+	for y := 0; y < h; y++ {
+		for i, v := range src.Pix[y*src.Stride : y*src.Stride+w*4] {
+			line[i] = float64(v)
+		}
+		scaleLine(line, w, tmp[y*dw*4:(y+1)*dw*4], dw)
+	}
+
+	col := make([]float64, h*4)
+	out := make([]float64, dh*4)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for x := 0; x < dw; x++ {
+		for y := 0; y < h; y++ {
+			copy(col[y*4:y*4+4], tmp[(y*dw+x)*4:])
+		}
+		scaleLine(col, h, out, dh)
+		for y := 0; y < dh; y++ {
+			for c := 0; c < 4; c++ {
+				dst.Pix[y*dst.Stride+x*4+c] = uint8(math.Min(255, math.Round(out[y*4+c])))
+			}
+		}
+	}
+	return dst
+}
+
+// scaleLine averages a line of n pixels with 4 channels each from src into m pixels of dst
+func scaleLine(src []float64, n int, dst []float64, m int) {
+	ratio := float64(n) / float64(m)
+	for i := 0; i < m; i++ {
+		start, end := float64(i)*ratio, float64(i+1)*ratio
+		var sum [4]float64
+		for j := int(start); j < n && float64(j) < end; j++ {
+			weight := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			for c := 0; c < 4; c++ {
+				sum[c] += src[j*4+c] * weight
+			}
+		}
+		for c := 0; c < 4; c++ {
+			dst[i*4+c] = sum[c] / ratio
+		}
+	}
+}
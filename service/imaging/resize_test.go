@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// TestFit checks the size of the variants of the photos, whose longest side is 64 or 256 pixels
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, maxSide int
+		wantW, wantH  int
+	}{
+		{1024, 768, 64, 64, 48},
+		{1024, 768, 256, 256, 192},
+		{768, 1024, 64, 48, 64},
+		{768, 1024, 256, 192, 256},
+		{500, 500, 64, 64, 64},
+		{500, 500, 256, 256, 256},
+		{300, 100, 256, 256, 85},
+		{1000, 3, 64, 64, 1},
+		{3, 1000, 256, 1, 256},
+		{64, 64, 64, 64, 64},
+		{200, 40, 256, 200, 40},
+		{1, 1, 64, 1, 1},
+	}
+	for _, tt := range tests {
+		img := testImage(tt.w, tt.h)
+		got := Fit(img, tt.maxSide)
+		if b := got.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("Fit(%d×%d, %d) = %d×%d, want %d×%d", tt.w, tt.h, tt.maxSide, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+		}
+		if tt.w <= tt.maxSide && tt.h <= tt.maxSide && got != image.Image(img) {
+			t.Errorf("Fit(%d×%d, %d) didn't return the image unchanged", tt.w, tt.h, tt.maxSide)
+		}
+	}
+}
+
+func TestFitColors(t *testing.T) {
+	// A uniform image keeps its color, also when its bounds don't start at the origin
+	uniform := image.NewRGBA(image.Rect(10, 20, 310, 220))
+	red := color.RGBA{R: 200, G: 10, B: 30, A: 255}
+	draw.Draw(uniform, uniform.Bounds(), &image.Uniform{C: red}, image.Point{}, draw.Src)
+	got := Fit(uniform, 64)
+	for _, p := range []image.Point{{0, 0}, {31, 20}, {63, 42}} {
+		if c := got.At(p.X, p.Y); c != red {
+			t.Errorf("Fit(uniform).At(%v) = %v, want %v", p, c, red)
+		}
+	}
+
+	// Transparent pixels don't darken the opaque pixels next to them: half transparent and half white averages to
+	// half-transparent white
+	half := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	draw.Draw(half, image.Rect(0, 0, 128, 64), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	got = Fit(half, 1)
+	want := color.NRGBA{R: 255, G: 255, B: 255, A: 128}
+	if c := color.NRGBAModel.Convert(got.At(0, 0)).(color.NRGBA); c != want {
+		t.Errorf("Fit(half transparent) = %v, want %v", c, want)
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+)
+
+// ContentKey returns the content-addressed key of data: prefix, followed by the hex SHA-256 of data and by ext. For
+// example "photos/9f86d08…0f00a08.png".
+func ContentKey(prefix string, data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return prefix + hex.EncodeToString(sum[:]) + ext
+}
+
+// KeyHash returns the hex SHA-256 a content-addressed key is named after, or an empty string if key is not
+// content-addressed. Anything following the hash in the name of the blob, after an underscore or a dot, is ignored, so
+// derived blobs (e.g. "photos/<hash>_64.png") report the hash of the blob they were derived from.
+func KeyHash(key string) string {
+	name := path.Base(key)
+	if i := strings.IndexAny(name, "_."); i >= 0 {
+		name = name[:i]
+	}
+	if len(name) != sha256.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// PutContent saves data with the given key, unless a blob with that key already exists. It is meant for
+// content-addressed keys, for which a blob with the same key has the same content: identical uploads are saved once.
+func PutContent(ctx context.Context, s BlobStore, key string, data []byte, contentType string) error {
+	_, err := s.Stat(ctx, key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return s.Put(ctx, key, bytes.NewReader(data), contentType)
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local is a BlobStore that saves each blob as a file below a root directory
+type Local struct {
+	root string
+}
+
+// NewLocal returns a Local store rooted in the given directory, creating it if needed. The root must be an absolute
+// path: a relative one would depend on the directory the server is started from.
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, errors.New("storage root is required")
+	}
+	if !filepath.IsAbs(root) {
+		return nil, fmt.Errorf("storage root %q is not an absolute path", root)
+	}
+	root = filepath.Clean(root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// path returns the path of the file containing the blob with the given key
+func (l *Local) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and then renames it, so readers never see a partially written blob
+func (l *Local) Put(_ context.Context, key string, r io.Reader, _ string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get opens the file of the blob. The returned reader is an *os.File, so it also implements io.Seeker
+func (l *Local) Get(_ context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, BlobInfo{}, ErrNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, BlobInfo{}, err
+	}
+	if st.IsDir() {
+		_ = f.Close()
+		return nil, BlobInfo{}, ErrNotFound
+	}
+	return f, BlobInfo{Key: key, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (l *Local) Delete(_ context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	// Directories are not blobs, as in Get: they are left in place even if empty
+	if st, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) || (err == nil && st.IsDir()) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Stat(_ context.Context, key string) (BlobInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	st, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && st.IsDir()) {
+		return BlobInfo{}, ErrNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+// List walks the whole root directory, skipping the temporary files of uploads in progress
+func (l *Local) List(_ context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(l.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
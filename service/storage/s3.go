@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"WasaTEXT/service/globaltime"
+)
+
+// S3Config is the configuration of an S3 store
+type S3Config struct {
+	// Endpoint is the base URL of the object storage, e.g. "https://s3.eu-south-1.amazonaws.com" or
+	// "http://127.0.0.1:9000". Buckets are addressed in path style (Endpoint/Bucket/Key).
+	Endpoint string
+
+	// Region is used to sign the requests; MinIO accepts any region, AWS requires the region of the bucket
+	Region string
+
+	// Bucket is the name of the bucket where blobs are saved. It must already exist.
+	Bucket string
+
+	// AccessKey and SecretKey are the credentials used to sign the requests
+	AccessKey string
+	SecretKey string
+
+	// Client is the HTTP client used for the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// S3 is a BlobStore that saves blobs as objects in a bucket of an S3-compatible object storage
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+}
+
+// NewS3 returns an S3 store with the given configuration
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("S3 endpoint is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.New("S3 endpoint must be an http or https URL")
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	return &S3{cfg: cfg, endpoint: endpoint}, nil
+}
+
+// objectURL returns the URL of the object with the given key, or of the bucket if key is empty
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path += "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do signs and sends the request. body may be nil.
+func (s *S3) do(ctx context.Context, method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	payloadHash := emptyPayloadHash
+	var reader io.Reader
+	if body != nil {
+		payloadHash = sha256Hex(body)
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", payloadHash, globaltime.Now())
+	return s.cfg.Client.Do(req)
+}
+
+// s3Error is the error returned by the object storage in the body of failed requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// responseError converts a failed response into an error, consuming and closing its body
+func responseError(resp *http.Response, method, key string) error {
+	defer resp.Body.Close()
+	var e s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	parsed := xml.Unmarshal(body, &e) == nil && e.Code != ""
+
+	// A 404 on the object list, or with the NoSuchBucket code, means that the bucket is missing, not a blob. HEAD
+	// responses have no body, so any other 404 is a missing blob
+	if resp.StatusCode == http.StatusNotFound && key != "" && e.Code != "NoSuchBucket" {
+		return ErrNotFound
+	}
+	if parsed {
+		return fmt.Errorf("s3 %s %q: %s: %s (%s)", method, key, resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3 %s %q: %s", method, key, resp.Status)
+}
+
+// blobInfo reads the information of the object from the headers of the response
+func blobInfo(key string, resp *http.Response) BlobInfo {
+	info := BlobInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info
+}
+
+// Put reads the whole content in memory, since the payload must be hashed to sign the request
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(key, nil), body, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp, http.MethodPut, key)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	if err := validateKey(key); err != nil {
+		return nil, BlobInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key, nil), nil, nil)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, BlobInfo{}, responseError(resp, http.MethodGet, key)
+	}
+	return resp.Body, blobInfo(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		if err := responseError(resp, http.MethodDelete, key); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	if err := validateKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(key, nil), nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return BlobInfo{}, responseError(resp, http.MethodHead, key)
+	}
+	_ = resp.Body.Close()
+	return blobInfo(key, resp), nil
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List uses ListObjectsV2, following the continuation tokens until all the objects have been listed
+func (s *S3) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, s.objectURL("", query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp, http.MethodGet, "")
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding S3 object list: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			info := BlobInfo{Key: obj.Key, Size: obj.Size}
+			if t, err := time.Parse(time.RFC3339, obj.LastModified); err == nil {
+				info.ModTime = t
+			}
+			blobs = append(blobs, info)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
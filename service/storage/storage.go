@@ -0,0 +1,64 @@
+/*
+Package storage contains the BlobStore interface used to save uploaded files (user and group photos, message
+attachments), and its backends:
+
+  - Local saves blobs as files below a root directory;
+  - S3 saves blobs in a bucket of an S3-compatible object storage (AWS S3, MinIO, etc.).
+
+Blobs are identified by keys: slash-separated relative paths such as "photos/<sha256>.png" (see ContentKey). Keys can't
+be empty, start or end with a slash, or contain empty, "." or ".." elements.
+*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the requested blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned when the key of a blob is not valid
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// BlobInfo describes a stored blob. ContentType is empty if the backend does not keep it
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore saves and retrieves blobs. Implementations are safe for concurrent use.
+type BlobStore interface {
+	// Put saves the content of r as the blob with the given key, replacing it if it already exists
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+
+	// Get returns the content of the blob with the given key, or ErrNotFound. The caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+
+	// Delete removes the blob with the given key. Deleting a blob that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Stat returns the information of the blob with the given key, or ErrNotFound
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+
+	// List returns the information of all blobs whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// validateKey checks that key is a valid blob key
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}